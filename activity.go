@@ -0,0 +1,185 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	forkActivityFile   = "forks.activity"
+	forkActivityHeader = "timeq-fork-activity 1"
+)
+
+// The time of the last read of each fork is kept in memory and written to
+// forkActivityFile by Maintain() and Close(). After a crash, reads since
+// then are forgotten, so a fork might look idle for up to one janitor
+// interval longer than it was. Forks without a time (e.g. created by an
+// older version) count as read when the queue was opened.
+
+// loadForkActivity reads the last read times of all forks.
+func (bs *buckets) loadForkActivity() error {
+	saved, err := readForkActivity(bs.opts.FS, bs.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	bs.lastRead = make(map[ForkName]*atomic.Int64, len(bs.forks))
+	for _, fork := range bs.forks {
+		stamp := &atomic.Int64{}
+		stamp.Store(now)
+		if at, ok := saved[fork]; ok {
+			stamp.Store(at)
+		}
+
+		bs.lastRead[fork] = stamp
+	}
+
+	bs.lastReadSaved = saved
+	return nil
+}
+
+// noteRead remembers that `fork` was read just now. The queue itself is not
+// tracked. It only needs the shared lock, as it does not change the map.
+func (bs *buckets) noteRead(fork ForkName) {
+	if stamp, ok := bs.lastRead[fork]; ok {
+		stamp.Store(time.Now().UnixNano())
+	}
+}
+
+// addForkActivity starts tracking a new fork.
+func (bs *buckets) addForkActivity(fork ForkName) {
+	if _, ok := bs.lastRead[fork]; ok {
+		return
+	}
+
+	stamp := &atomic.Int64{}
+	stamp.Store(time.Now().UnixNano())
+	bs.lastRead[fork] = stamp
+}
+
+// LastRead returns the time of the last read of `fork`.
+// See Fork.LastRead().
+func (bs *buckets) LastRead(fork ForkName) (time.Time, error) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	stamp, ok := bs.lastRead[fork]
+	if !ok {
+		return time.Time{}, ErrNoSuchFork
+	}
+
+	return time.Unix(0, stamp.Load()), nil
+}
+
+// expireForks removes the forks that were not read for Options.ForkExpiry.
+func (bs *buckets) expireForks() error {
+	if bs.opts.ForkExpiry <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-bs.opts.ForkExpiry)
+
+	var err error
+	for _, fork := range slices.Clone(bs.forks) {
+		lastRead := time.Unix(0, bs.lastRead[fork].Load())
+		if lastRead.After(cutoff) {
+			continue
+		}
+
+		if rmErr := bs.removeFork(fork); rmErr != nil {
+			err = errors.Join(err, fmt.Errorf("expire fork: %s: %w", fork, rmErr))
+			continue
+		}
+
+		bs.opts.Logger.Printf("removed fork %s, it was not read since %v", fork, lastRead.Format(time.RFC3339))
+		if bs.opts.OnForkExpire != nil {
+			bs.opts.OnForkExpire(fork, lastRead)
+		}
+	}
+
+	return err
+}
+
+// saveForkActivity writes the last read times, if they changed since the last time.
+func (bs *buckets) saveForkActivity() error {
+	current := make(map[ForkName]int64, len(bs.lastRead))
+	for fork, stamp := range bs.lastRead {
+		current[fork] = stamp.Load()
+	}
+
+	if maps.Equal(current, bs.lastReadSaved) {
+		return nil
+	}
+
+	if err := writeForkActivity(bs.opts.FS, bs.dir, current); err != nil {
+		return fmt.Errorf("fork activity: %w", err)
+	}
+
+	bs.lastReadSaved = current
+	return nil
+}
+
+func readForkActivity(fsys FS, dir string) (map[ForkName]int64, error) {
+	activity := make(map[ForkName]int64)
+	data, err := fsys.ReadFile(filepath.Join(dir, forkActivityFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return activity, nil
+		}
+
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if lines[0] != forkActivityHeader {
+		return nil, fmt.Errorf("fork activity: bad header: %q", lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("fork activity: bad line: %q", line)
+		}
+
+		at, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("fork activity: %w", err)
+		}
+
+		activity[ForkName(fields[0])] = at
+	}
+
+	return activity, nil
+}
+
+func writeForkActivity(fsys FS, dir string, activity map[ForkName]int64) error {
+	path := filepath.Join(dir, forkActivityFile)
+	if len(activity) == 0 {
+		return filterIsNotExist(fsys.Remove(path))
+	}
+
+	forks := make([]ForkName, 0, len(activity))
+	for fork := range activity {
+		forks = append(forks, fork)
+	}
+
+	// keep the output stable:
+	slices.Sort(forks)
+
+	var buf strings.Builder
+	buf.WriteString(forkActivityHeader + "\n")
+	for _, fork := range forks {
+		fmt.Fprintf(&buf, "%s %d\n", fork, activity[fork])
+	}
+
+	return fsys.WriteFile(path, []byte(buf.String()), 0600)
+}
@@ -2,8 +2,16 @@
 package timeq
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 
 	"github.com/sahib/timeq/item"
@@ -21,7 +29,12 @@ type Key = item.Key
 
 // Queue is the high level API to the priority queue.
 type Queue struct {
-	buckets *buckets
+	buckets    *buckets
+	lenCounter *atomic.Int64
+	janitor    *janitor
+
+	groupsMu sync.Mutex
+	groups   map[ForkName]*Group
 }
 
 // ForkName is the name of a specific fork.
@@ -48,6 +61,29 @@ func (name ForkName) Validate() error {
 // See TransactionFn for more details.
 type Transaction interface {
 	Push(items Items) error
+
+	// Stats returns what the read did so far, including
+	// the items that were passed to the current call.
+	Stats() ReadStats
+}
+
+// ReadStats describes the work of a single Read() call.
+// It helps to understand why some reads take longer than others.
+type ReadStats struct {
+	// Buckets is the number of buckets that were read from.
+	Buckets int
+
+	// Batches is the number of pushed batches that had to be
+	// iterated to get the items in key order.
+	Batches int
+
+	// Bytes is the size of the read items, like they are stored on disk.
+	Bytes int64
+
+	// Loaded is the number of buckets that had to be loaded from
+	// disk, because they were not open (anymore). See also
+	// Options.MaxParallelOpenBuckets.
+	Loaded int
 }
 
 // TransactionFn is the function passed to the Read() call.
@@ -68,72 +104,558 @@ func Open(dir string, opts Options) (*Queue, error) {
 		return nil, err
 	}
 
+	opts.applyMemoryLimit()
+
 	bs, err := loadAllBuckets(dir, opts)
 	if err != nil {
 		return nil, fmt.Errorf("buckets: %w", err)
 	}
 
 	if err := bs.ValidateBucketKeys(opts.BucketSplitConf); err != nil {
-		return nil, err
+		// release the lock, so the queue can be opened with a fixed split conf:
+		return nil, errors.Join(err, bs.lock.Unlock())
 	}
 
-	return &Queue{buckets: bs}, nil
+	if err := bs.verify(); err != nil {
+		return nil, errors.Join(err, bs.Close())
+	}
+
+	queue := &Queue{buckets: bs, lenCounter: bs.LenCounter("")}
+	if opts.JanitorInterval > 0 && !opts.OpenMode.readOnly() {
+		queue.janitor = startJanitor(bs, opts.JanitorInterval)
+	}
+
+	return queue, nil
 }
 
 // Push pushes a batch of `items` to the queue.
 // It is allowed to call this function during the read callback.
+//
+// If some items are invalid (e.g. their blob is bigger than MaxBlobSize),
+// a *PushError is returned that lists them by their index in `items`.
+// With ErrorModeAbort nothing is pushed then, with ErrorModeContinue
+// the valid items are pushed and PushError.Written is set.
 func (q *Queue) Push(items Items) error {
 	return q.buckets.Push(items, true)
 }
 
+// PushWait is like Push(), but blocks while the queue is full (see
+// Options.MaxLen and Options.MaxBytes) until consumers made room or `ctx`
+// is done. This is useful to apply backpressure to the producer instead
+// of rejecting items. Do not call it inside a read transaction.
+func (q *Queue) PushWait(ctx context.Context, items Items) error {
+	return q.buckets.PushWait(ctx, items)
+}
+
 // Read fetches up to `n` items from the queue. It will call the supplied `fn`
 // one or several times until either `n` is reached or the queue is empty. If
 // the queue is empty before calling Read(), then `fn` is not called. If `n` is
 // negative, then as many items as possible are returned until the queue is
 // empty.
 //
-// The `dst` argument can be used to pass a preallocated slice that
-// the queue appends to. This can be done to avoid allocations.
-// If you don't care you can also simply pass nil.
-//
 // You should NEVER use the supplied items outside of `fn`, as they
 // are directly sliced from a mmap(2). Accessing them outside will
 // almost certainly lead to a crash. If you need them outside (e.g. for
-// appending to a slice) then you can use the Copy() function of Items.
+// appending to a slice) then you can use the Copy() function of Items,
+// use ReadBuffered() with a re-usable buffer or PeekRef().
 //
 // You can return either ReadOpPop or ReadOpPeek from `fn`.
 //
 // You may only call Push() inside the read transaction.
 // All other operations will DEADLOCK if called!
+//
+// A single Read() sees the queue as it was when it started: pushes of other
+// goroutines wait until it is done and items pushed by the transaction are
+// only returned by the next Read(). The items passed to `fn` stay valid
+// during `fn`, even if the transaction pushes to the same bucket.
 func (q *Queue) Read(n int, fn TransactionFn) error {
 	return q.buckets.Read(n, "", fn)
 }
 
+// ReadBuffered works like Read(), but the items passed to `fn` are copied to
+// the memory owned by `buf`. The items stay valid after `fn` returned, until
+// `buf` is passed to the next call of ReadBuffered(). Once `buf` has grown
+// to the size needed by your reads, no further allocations are made for the
+// item data. `buf` may not be used by several goroutines at the same time.
+func (q *Queue) ReadBuffered(n int, buf *ReadBuffer, fn TransactionFn) error {
+	return q.buckets.Read(n, "", buf.wrap(fn))
+}
+
+// PeekRef returns up to `n` items without popping and without copying them.
+// Unlike the items passed to Read(), they point to memory that stays valid
+// until ItemsRef.Release() is called, even if the items get popped, the
+// queue grows or is closed in the meantime. This is meant for consumers
+// that cannot afford a copy. The blobs must not be modified and Release()
+// has to be called in any case, as the memory is leaked otherwise. A
+// negative `n` peeks at all items, which is rarely a good idea.
+//
+// Unlike Read(), PeekRef() calls of several goroutines do not wait for each
+// other if the buckets they need are loaded already, as peeking changes
+// nothing. The same goes for PeekCopy(). Read() always has exclusive access,
+// even if `fn` only returns ReadOpPeek, since that is not known in advance.
+func (q *Queue) PeekRef(n int) (ItemsRef, error) {
+	return q.buckets.PeekRef(n, "")
+}
+
+// ReadWait is like Read(), but waits until the queue has at least `n` items
+// before reading. If that does not happen within `maxWait`, whatever is
+// there is read, which might be nothing. This is useful to collect batches
+// of a decent size without adding too much latency ("micro-batching").
+// It returns ctx.Err() without reading if `ctx` is done before. A negative
+// `n` reads right away.
+func (q *Queue) ReadWait(ctx context.Context, n int, maxWait time.Duration, fn TransactionFn) error {
+	return q.buckets.ReadWait(ctx, n, maxWait, "", fn)
+}
+
 // Delete deletes all items in the range `from` to `to`.
 // Both `from` and `to` are including, i.e. keys with this value are deleted.
-// The number of deleted items is returned.
-func (q *Queue) Delete(from, to Key) (int, error) {
+// Buckets that lie completely in the range are removed without reading them,
+// unless a fork still has items in them. What was deleted is returned.
+func (q *Queue) Delete(from, to Key) (DeleteResult, error) {
 	return q.buckets.Delete("", from, to)
 }
 
+// DeleteFunc deletes the items in the range `from` to `to` (both including)
+// for which `keep` returns false. Batches containing deleted items are
+// rewritten, so this is more expensive than Delete(). `keep` is called
+// with the queue locked and the item is only valid during the call.
+// The number of deleted items is returned.
+func (q *Queue) DeleteFunc(from, to Key, keep func(Item) bool) (int, error) {
+	return q.buckets.DeleteFunc("", from, to, keep)
+}
+
+// PopDelete is like Delete(), but passes the items to `fn` before they are
+// deleted, e.g. to archive them. `fn` is called once per bucket with the
+// items of that bucket, sorted by key. The items are copies and may be kept.
+// If `fn` returns an error, the deletion stops and the error is returned;
+// items passed in earlier calls are deleted already at this point.
+func (q *Queue) PopDelete(from, to Key, fn func(Items) error) (int, error) {
+	return q.buckets.PopDelete("", from, to, fn)
+}
+
+// Reprioritize changes the key of all items in the range `from` to `to`
+// (both including) to the key that `shift` returns for it, e.g. to boost old
+// items that were not consumed for too long. Items are moved to other buckets
+// as needed; forks are not affected. The number of moved items is returned.
+//
+// The new items are pushed before the old ones are deleted, so a crash
+// in between might result in duplicates, but does not lose items.
+func (q *Queue) Reprioritize(from, to Key, shift func(Key) Key) (int, error) {
+	return q.buckets.Reprioritize("", from, to, shift)
+}
+
+// ClearRange is like Delete(), but deletes the items in the range for the
+// queue and all of its forks at once. Buckets that lie completely in the
+// range are removed without reading them, so this is cheap for large ranges.
+// The number of deleted items of all consumers is returned.
+func (q *Queue) ClearRange(from, to Key) (int, error) {
+	res, err := q.buckets.ClearRange(from, to)
+	return res.Items, err
+}
+
+// Truncate deletes all items with a key lower than `before` from the queue
+// and all of its forks, e.g. to enforce a retention period. Buckets that end
+// before `before` are removed as whole directories without reading them;
+// only the bucket containing `before` is loaded to delete the rest.
+// What was deleted for all consumers is returned.
+func (q *Queue) Truncate(before Key) (DeleteResult, error) {
+	return q.buckets.Truncate(before)
+}
+
+// SubscribeChan delivers the items of `fork` (empty for the queue itself) on
+// the returned channel in batches of up to `batchSize` items, as soon as they
+// are pushed. The items are copies and are only popped after they were
+// received from the channel, so nothing is lost when stopping. Call the
+// returned function to stop the subscription; the channel is closed then.
+// It is also closed when the queue is closed or the fork is removed.
+//
+// This is an alternative to Read() for code that is built around select loops.
+// The subscription should be the only consumer of `fork`, otherwise items can
+// be delivered twice. Errors are passed to Options.Logger and retried.
+func (q *Queue) SubscribeChan(fork ForkName, batchSize int) (<-chan Items, func()) {
+	return q.buckets.SubscribeChan(fork, batchSize)
+}
+
+// RunConsumer reads the items of the queue (or of opts.Fork) in batches and
+// passes them to `handler` until `ctx` is done, which makes it return ctx.Err().
+// This is the loop around Read() that most services need:
+//
+//   - Items are popped once `handler` returned without error. Otherwise they
+//     stay in the queue and are retried after an exponential backoff.
+//   - When the queue is empty, it waits for the next push (or opts.PollInterval).
+//   - Nothing is read while reads are paused or the queue is frozen.
+//   - Failed batches are counted in Metrics().HandlerErrors.
+//
+// It returns early with ErrClosed or ErrNoSuchFork, if the queue was closed
+// or the fork does not exist. Several consumers may run at the same time.
+func (q *Queue) RunConsumer(ctx context.Context, opts ConsumerOptions, handler ConsumerHandler) error {
+	return q.buckets.RunConsumer(ctx, opts, handler)
+}
+
+// NewCoalescer returns a Coalescer that collects small pushes and pushes
+// them as one batch. Use it when many callers push single items: each
+// push to a bucket has a fixed cost (mapping, writing and syncing the
+// logs), which dominates for tiny batches. The Coalescer has to be closed
+// before the queue. Items staged in it are lost on a crash.
+func (q *Queue) NewCoalescer(opts CoalesceOptions) *Coalescer {
+	return q.buckets.newCoalescer(q, opts)
+}
+
 // Len returns the number of items in the queue.
-// NOTE: This gets more expensive when you have a higher number of buckets,
-// so you probably should not call that in a hot loop.
+// The count is kept up to date on every operation, so this is cheap.
 func (q *Queue) Len() int {
 	return q.buckets.Len("")
 }
 
+// LenApprox works like Len(), but does not wait for other operations on
+// the queue to finish. While other goroutines push or read, the result
+// might be slightly off. Use this in hot loops or for metrics.
+func (q *Queue) LenApprox() int {
+	return int(q.lenCounter.Load())
+}
+
+// OnLag calls `fn` when the consumer `fork` starts lagging behind as defined
+// by `cond` and again when it caught up. Use an empty fork name for the queue
+// itself. The condition is checked after each push and read, which is cheap
+// as no bucket needs to be loaded. The returned function removes the watch.
+//
+// NOTE: `fn` is called while the queue is locked, so it must not call any
+// method of the queue. Send the alert to a channel or goroutine if needed.
+func (q *Queue) OnLag(fork ForkName, cond LagCondition, fn func(LagAlert)) func() {
+	return q.buckets.OnLag(fork, cond, fn)
+}
+
+// Maintain does the same maintenance work as the background janitor (see
+// Options.JanitorInterval) once: It enforces Options.JanitorRetention,
+// removes empty buckets and compacts index logs of loaded buckets.
+func (q *Queue) Maintain() error {
+	return q.buckets.Maintain()
+}
+
+// Trim removes the directories of buckets that are empty for all consumers
+// and files of forks that do not exist anymore. Buckets are usually removed
+// once they were fully consumed, but some ways of consuming them (e.g.
+// removing a fork while the bucket was not loaded) leave empty buckets behind.
+// See also Options.TrimOnClose.
+func (q *Queue) Trim() error {
+	return q.buckets.Trim()
+}
+
+// Metrics returns statistics about the throughput and latency of the queue
+// and its forks, as well as about the buckets that were opened and closed.
+// See the Metrics type for details. They are not tied to any monitoring
+// system, so you can export them however you like.
+func (q *Queue) Metrics() Metrics {
+	return q.buckets.Metrics()
+}
+
+// DeleteResult describes what Delete() or Truncate() deleted.
+type DeleteResult struct {
+	// Items is the number of deleted items.
+	Items int
+
+	// DroppedBuckets is the number of buckets that were removed entirely.
+	DroppedBuckets int
+
+	// ReclaimedBytes is the size of the data of the dropped buckets.
+	// Deleting only some items of a bucket does not free any space on disk.
+	ReclaimedBytes int64
+
+	// Buckets lists what was deleted in each bucket, sorted by key.
+	Buckets []BucketDeletion
+}
+
+// BucketDeletion is the part of a DeleteResult for a single bucket.
+type BucketDeletion struct {
+	// Key is the lowest key that may be stored in the bucket.
+	Key Key
+
+	// Items is the number of items deleted from the bucket.
+	Items int
+
+	// Dropped is true if the bucket was removed entirely.
+	Dropped bool
+}
+
+// at returns the entry for the bucket with `key`, adding it if needed.
+func (res *DeleteResult) at(key Key) *BucketDeletion {
+	idx, found := slices.BinarySearchFunc(res.Buckets, key, func(bd BucketDeletion, key Key) int {
+		return cmp.Compare(bd.Key, key)
+	})
+
+	if !found {
+		res.Buckets = slices.Insert(res.Buckets, idx, BucketDeletion{Key: key})
+	}
+
+	return &res.Buckets[idx]
+}
+
+func (res *DeleteResult) add(key Key, n int) {
+	if n == 0 {
+		return
+	}
+
+	res.Items += n
+	res.at(key).Items += n
+}
+
+func (res *DeleteResult) drop(key Key, size int64) {
+	res.DroppedBuckets++
+	res.ReclaimedBytes += size
+	res.at(key).Dropped = true
+}
+
+// BucketCount is the number of items in a single bucket.
+type BucketCount struct {
+	// Key is the lowest key that may be stored in the bucket.
+	// All keys in the bucket are lower than the Key of the next bucket.
+	Key Key
+
+	// Len is the number of items in the bucket.
+	Len int
+
+	// LastPop is the time of the last pop from the bucket.
+	// It is zero if nothing was popped yet.
+	LastPop time.Time
+
+	// PoppedItems and PoppedBytes count what was popped from the bucket.
+	// Bytes are counted like they are stored on disk.
+	PoppedItems uint64
+	PoppedBytes uint64
+
+	// Tags are the tags that were set with SetTag().
+	Tags map[string]string
+}
+
+// CountByBucket returns the number of items in each bucket, sorted by key.
+// Empty buckets are not included. This shows where in the key space the
+// items are, e.g. how many items are older than an hour when using timestamps.
+// Like Len(), this is cheap and does not load any bucket.
+//
+// The pop statistics and tags are stored next to the index of each bucket.
+// Apart from tags, they are only written on Sync() and Close(), so they
+// might lag behind after a crash.
+func (q *Queue) CountByBucket() []BucketCount {
+	return q.buckets.CountByBucket("")
+}
+
+// SetTag attaches a tag with `name` and `value` to the bucket that holds
+// `key`, e.g. to note where its items came from. An empty value removes
+// the tag. Tags are returned by CountByBucket() and are gone once the bucket
+// is removed. Each fork has its own tags.
+func (q *Queue) SetTag(key Key, name, value string) error {
+	return q.buckets.SetTag("", key, name, value)
+}
+
+// PauseReads makes Read() and ReadBuffered() of the queue return immediately
+// without any items until ResumeReads() is called, e.g. to halt consumers
+// during an incident without stopping them. Pushing is still possible.
+// Forks are not affected; they can be paused on their own. A read that is
+// running while calling this is finished before PauseReads() returns.
+func (q *Queue) PauseReads() {
+	q.buckets.SetReadsPaused("", true)
+}
+
+// ResumeReads undoes PauseReads().
+func (q *Queue) ResumeReads() {
+	q.buckets.SetReadsPaused("", false)
+}
+
+// ReadsPaused returns true if PauseReads() was called without ResumeReads().
+func (q *Queue) ReadsPaused() bool {
+	return q.buckets.ReadsPaused("")
+}
+
+// SetOptions changes some options of the open queue, without having to
+// close and reopen it. See OptionsPatch for the options that can be changed.
+// The changes only live as long as the queue is open; pass them to Open()
+// again on the next start.
+func (q *Queue) SetOptions(patch OptionsPatch) error {
+	return q.buckets.SetOptions(patch)
+}
+
+// Freeze makes the queue read-only until Thaw() is called, e.g. during a
+// backup or while downstream storage is down. Push(), Delete(), Clear(),
+// Shovel() and friends return ErrFrozen then, also for the forks and for
+// pushes inside a transaction. Read() can still pop items; use PauseReads()
+// in addition if nothing should change at all. A write that is running
+// while calling this is finished before Freeze() returns.
+func (q *Queue) Freeze() {
+	q.buckets.SetFrozen(true)
+}
+
+// Thaw undoes Freeze().
+func (q *Queue) Thaw() {
+	q.buckets.SetFrozen(false)
+}
+
+// Frozen returns true if Freeze() was called without Thaw().
+func (q *Queue) Frozen() bool {
+	return q.buckets.Frozen()
+}
+
+// Demote makes the queue a follower of another queue, which has this one in
+// its Options.Replicas. Push() returns ErrFollower then; items only arrive
+// via PushReplicated(). Reads still work and pushes inside a transaction
+// are allowed, as they only re-queue items that were read. The role is
+// stored in the queue directory, so it survives a restart.
+func (q *Queue) Demote() error {
+	return q.buckets.Demote()
+}
+
+// Promote makes the queue the primary, e.g. after the old primary failed,
+// and returns its new epoch. The epoch is the fencing token that is sent
+// with every replicated batch: a queue that received a batch of epoch N
+// rejects batches of lower epochs with ErrFenced and becomes a follower
+// if it was a primary of a lower epoch itself. So once the new primary
+// pushed to the replicas, the old one cannot write to them anymore and
+// gets a *ReplicationError (if Options.MinReplicaAcks is set) instead.
+// Promote only one follower at a time; two primaries of the same epoch
+// reject each other's batches, but not the batches of older primaries.
+func (q *Queue) Promote() (epoch uint64, err error) {
+	return q.buckets.Promote()
+}
+
+// Follower returns true if the queue was demoted. See Demote().
+func (q *Queue) Follower() bool {
+	follower, _ := q.buckets.Role()
+	return follower
+}
+
+// Epoch returns the newest epoch that the queue knows. It is zero
+// until a queue was promoted. See Promote().
+func (q *Queue) Epoch() uint64 {
+	_, epoch := q.buckets.Role()
+	return epoch
+}
+
+// PushReplicated is Push() for batches replicated by a primary of
+// `epoch`. The batch is rejected with ErrFenced if it came from a primary
+// that was replaced. See Promote(). It is called for queues that are
+// used as Options.Replicas of another queue and should not be called
+// otherwise. The batch is not replicated any further.
+func (q *Queue) PushReplicated(epoch uint64, items Items) error {
+	return q.buckets.PushReplicated(epoch, items)
+}
+
+// LenExact works like Len(), but counts the items of every bucket instead of
+// using the count that is updated by each operation. This is more expensive
+// and only needed if you want to be sure that the count is correct.
+func (q *Queue) LenExact() int {
+	return q.buckets.LenExact("")
+}
+
+// CheckInvariants verifies the state of the queue and its forks against the
+// data on disk: the index of each bucket must be sorted, point to items
+// inside the value log and count the same number of items as the cached
+// counts that Len() is based on. Every inconsistency is returned as a
+// Violation; a healthy queue returns none. An error is only returned if
+// the check itself failed. This loads every bucket and reads all items,
+// so it is meant for debugging or canary setups, not for regular use.
+func (q *Queue) CheckInvariants() ([]Violation, error) {
+	return q.buckets.CheckInvariants()
+}
+
+// ReindexBucket rebuilds the indexes of the queue and all forks for the
+// bucket that `key` belongs to from its value log. This is what Open() does
+// when it finds a damaged index, e.g. after CheckInvariants() reported
+// problems. Since the value log does not know what was consumed, every item
+// in the bucket becomes visible again to every consumer, including popped
+// and deleted ones. Items that DeleteFunc() or Reprioritize() rewrote might
+// show up twice.
+func (q *Queue) ReindexBucket(key Key) error {
+	return q.buckets.ReindexBucket(key)
+}
+
+// ReindexAll is like ReindexBucket(), but for all buckets.
+func (q *Queue) ReindexAll() error {
+	return q.buckets.ReindexAll()
+}
+
+// DumpBucket writes a human-readable listing of the bucket that `key` belongs
+// to: the index entries of each consumer, the trailers and cached counts that
+// Len() is based on and the header of every item in the value log. This is
+// meant for debugging, e.g. when Len() does not match what you see. The
+// format is not stable. Use CheckInvariants() for automated checks.
+func (q *Queue) DumpBucket(key Key, w io.Writer) error {
+	return q.buckets.DumpBucket(key, w)
+}
+
+// ExportBucket writes the bucket that `key` belongs to as a single archive
+// to `w`. It contains the items and the position of each fork in the bucket
+// and can be added to another queue with ImportBucket(), e.g. to analyze a
+// certain time window on another machine. The queue is locked during the
+// export, so `w` should be fast, like a local file.
+func (q *Queue) ExportBucket(key Key, w io.Writer) error {
+	return q.buckets.ExportBucket(key, w)
+}
+
+// ImportBucket adds a bucket that was exported by ExportBucket() and returns
+// its key. The queue must use the same BucketSplitConf as the exporting queue
+// and may not have a bucket with the same key yet. Forks that only exist in
+// the archive are ignored, forks that only exist in the queue see all items
+// of the imported bucket.
+func (q *Queue) ImportBucket(r io.Reader) (Key, error) {
+	return q.buckets.ImportBucket(r)
+}
+
+// RestoreRange pushes the items of a bucket archive written by ExportBucket()
+// whose key is between `from` and `to` (both inclusive) and returns how many
+// there were. This can be used to re-inject a time window after it was
+// deleted by accident, without importing the whole bucket. All items in the
+// archive are considered, including the ones that were already popped when
+// it was exported. Unlike ImportBucket(), the BucketSplitConf does not have
+// to match. Items that are still in the queue will exist twice afterwards.
+func (q *Queue) RestoreRange(r io.Reader, from, to Key) (int, error) {
+	return q.buckets.RestoreRange(r, from, to)
+}
+
+// ReadOnlyFS returns a read-only view of the items of `fork` (or the queue
+// itself if `fork` is empty) for ad-hoc inspection. There is one directory
+// per non-empty bucket, named like on disk (K<key>), with one file per item.
+// The files are named by their zero-padded key (with a ".1", ".2", ...
+// suffix for duplicate keys) and contain the blob of the item.
+//
+// The items of a bucket are read when it is opened, so a view does not
+// block the queue. It can be served with http.FS() or mounted with any
+// FUSE library that can serve an fs.FS. Nothing can be changed through it.
+func (q *Queue) ReadOnlyFS(fork ForkName) fs.FS {
+	return &readOnlyFS{bs: q.buckets, fork: fork}
+}
+
 // Sync can be called to explicitly sync the queue contents
 // to persistent storage, even if you configured SyncNone.
 func (q *Queue) Sync() error {
 	return q.buckets.Sync()
 }
 
-// Clear fully deletes the queue contents.
+// SyncRange is like Sync(), but only syncs the buckets that may contain keys
+// between `from` and `to` (inclusive). Use it to make a batch you just pushed
+// durable without paying for syncing the whole queue.
+func (q *Queue) SyncRange(from, to Key) error {
+	return q.buckets.SyncRange(from, to)
+}
+
+// Prewarm loads the `n` buckets with the lowest keys and tells the kernel to
+// read their contents into memory, so the next Read() calls do not have to
+// wait for the disk. At most MaxParallelOpenBuckets are loaded.
+func (q *Queue) Prewarm(n int) error {
+	return q.buckets.Prewarm(n)
+}
+
+// Clear fully deletes the queue contents, including all forks.
+// Existing Fork handles will not see any new items afterwards.
 func (q *Queue) Clear() error {
 	return q.buckets.Clear()
 }
 
+// ClearData deletes all items of the queue and its forks, but keeps the
+// forks themselves. They are empty afterwards and will receive all items
+// that are pushed from now on, just like a freshly created fork.
+func (q *Queue) ClearData() error {
+	return q.buckets.ClearData()
+}
+
 // Shovel moves items from `src` to `dst`. The `src` queue will be completely drained
 // afterwards. For speed reasons this assume that the dst queue uses the same bucket func
 // as the source queue. If you cannot guarantee this, you should implement a naive Shovel()
@@ -147,6 +669,36 @@ func (q *Queue) Shovel(dst *Queue) (int, error) {
 	return q.buckets.Shovel(dst.buckets, "")
 }
 
+// ExportFormat writes a copy of the queue to `dstDir` that can be opened by
+// older versions of timeq, which only support up to format `version`. Those
+// return ErrFormatTooNew on Open() otherwise. Like Clone(), `dstDir` must not
+// exist or be empty. `version` may not be older than the oldest format this
+// version knows how to write.
+func (q *Queue) ExportFormat(dstDir string, version int) error {
+	return q.buckets.ExportFormat(dstDir, version)
+}
+
+// MergeFrom moves all items of `other` to `q` and returns how many there
+// were. Unlike Shovel(), the items are pushed like any other items, so they
+// end up in the buckets given by the BucketSplitConf of `q` and are sorted
+// in between the existing items by their key, even if both queues use a
+// different BucketSplitConf. This is slower than Shovel(), as every item is
+// copied. If a push fails, the items that were not pushed yet stay in
+// `other`. A crash in between might cause a batch to end up in both queues.
+func (q *Queue) MergeFrom(other *Queue) (int, error) {
+	return q.buckets.MergeFrom(other.buckets, "")
+}
+
+// Clone creates an independent copy of the queue at `dstDir`, which can be
+// opened with Open() afterwards. `dstDir` must not exist or be empty. The files
+// of the queue are hardlinked, so this is fast and needs little extra space,
+// no matter how big the queue is. The first write to a bucket copies its
+// files, in the original as well as in the clone. If `dstDir` is on another
+// filesystem, the files are copied right away.
+func (q *Queue) Clone(dstDir string) error {
+	return q.buckets.Clone(dstDir)
+}
+
 // Fork splits the reading end of the queue in two parts. If Pop() is
 // called on the returned Fork (which implements the Consumer interface),
 // then other forks and the original queue is not affected.
@@ -159,7 +711,69 @@ func (q *Queue) Fork(name ForkName) (*Fork, error) {
 		return nil, err
 	}
 
-	return &Fork{name: name, q: q}, nil
+	return &Fork{name: name, q: q, lenCounter: q.buckets.LenCounter(name)}, nil
+}
+
+// ExportPosition returns the read position of `fork` (or of the queue itself,
+// if empty) as opaque token, e.g. to back it up together with the state of
+// the application that consumes the fork. It has the locations of all items
+// that the fork did not consume yet; the items themselves are not included.
+func (q *Queue) ExportPosition(fork ForkName) ([]byte, error) {
+	return q.buckets.ExportPosition(fork)
+}
+
+// RestorePosition sets the read position of `fork` (or of the queue itself,
+// if empty) to a token returned by ExportPosition(). The fork is created if
+// it does not exist. Afterwards, the fork has the items it had when exporting,
+// as far as they still exist, plus all items that were pushed since.
+//
+// The token is only valid for the queue it was exported from (or a copy of
+// its directory, e.g. on a replacement host). ErrPositionMismatch is returned
+// if it references data that the queue does not have. Items that other
+// consumers rewrote with DeleteFunc() since the export might show up twice.
+// If it fails, the position might be restored partially; calling it again
+// with the same token is safe.
+func (q *Queue) RestorePosition(fork ForkName, token []byte) error {
+	return q.buckets.RestorePosition(fork, token)
+}
+
+// MoveFork hands the items between `from` and `to` (both including) that
+// `src` did not consume yet over to `dst`, e.g. to rebalance work between
+// consumers that each read their own fork. Afterwards `src` does not have
+// these items anymore, while `dst` has them in addition to its own ones.
+// Items that both forks have are not duplicated. No data is copied, only
+// the indexes of the forks change. An empty name means the queue itself.
+// The number of items that `src` gave away is returned.
+//
+// If MoveFork() fails or the process crashes in the middle, items might
+// end up in both forks, but never in none of them.
+func (q *Queue) MoveFork(src, dst ForkName, from, to Key) (int, error) {
+	return q.buckets.MoveFork(src, dst, from, to)
+}
+
+// SetMeta stores `val` under `key` in the queue directory, e.g. to keep the
+// configuration of consumers or a schema version next to the data. A nil
+// value removes `key`. The change is durable when SetMeta() returns. Metadata
+// is meant to be small, as all of it is rewritten on every call and kept in
+// memory. It is not touched by Clear() or ClearData().
+func (q *Queue) SetMeta(key, val []byte) error {
+	return q.buckets.SetMeta(key, val)
+}
+
+// GetMeta returns the value of `key` that was set with SetMeta()
+// and false if there is none. The value may be modified by the caller.
+func (q *Queue) GetMeta(key []byte) ([]byte, bool) {
+	return q.buckets.GetMeta(key)
+}
+
+// NextSeq reserves `n` consecutive sequence numbers and returns the first
+// one, e.g. for producers that need unique ids for their batches. The numbers
+// come from the same counter as the ones of Options.RecordSequence, so they
+// are never handed out twice by this queue. The counter is written to disk
+// before NextSeq() returns, so this also holds after a crash. Numbers that
+// were reserved but not used are not returned; there might be gaps.
+func (q *Queue) NextSeq(n int) (first uint64, err error) {
+	return q.buckets.NextSeq(n)
 }
 
 // Forks returns a list of fork names. The list will be empty if there are no forks yet.
@@ -170,9 +784,29 @@ func (q *Queue) Forks() []ForkName {
 
 // Close should always be called and error checked when you're done
 // with using the queue. Close might still flush out some data, depending
-// on what sync mode you configured.
+// on what sync mode you configured. It waits for running transactions.
 func (q *Queue) Close() error {
-	return q.buckets.Close()
+	return q.CloseWithContext(context.Background())
+}
+
+// CloseWithContext is like Close(), but gives up waiting for running
+// transactions when `ctx` is done. New operations return ErrClosed as
+// soon as this was called. If the transactions did not finish in time,
+// ctx.Err() is returned and nothing was closed yet; the memory of the
+// queue stays mapped, so a late callback does not crash. You may call
+// Close() afterwards to wait for them without a deadline.
+func (q *Queue) CloseWithContext(ctx context.Context) error {
+	err := q.buckets.CloseWithContext(ctx)
+	if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+		return err
+	}
+
+	if q.janitor != nil {
+		q.janitor.Stop()
+		q.janitor = nil
+	}
+
+	return err
 }
 
 // PopCopy works like a simplified Read() but copies the items and pops them.
@@ -187,13 +821,98 @@ func PopCopy(c Consumer, n int) (Items, error) {
 
 // PeekCopy works like a simplified Read() but copies the items and does not
 // remove them. It is less efficient and should not be used if you care for
-// performance.
+// performance. It goes through PeekRef(), so concurrent calls only wait for
+// each other while the items are released, not while they are read.
 func PeekCopy(c Consumer, n int) (Items, error) {
+	ref, err := c.PeekRef(n)
+	if err != nil {
+		return nil, err
+	}
+
 	var items Items
-	return items, c.Read(n, func(_ Transaction, popped Items) (ReadOp, error) {
-		items = append(items, popped.Copy()...)
-		return ReadOpPeek, nil
-	})
+	if len(ref.Items) > 0 {
+		items = ref.Items.Copy()
+	}
+
+	return items, ref.Release()
+}
+
+// ReadBuffer holds the memory that ReadBuffered() copies items to.
+// It is meant to be created once and re-used over many calls.
+// The zero value is ready to use.
+type ReadBuffer struct {
+	items Items
+	arena []byte
+
+	fn      TransactionFn
+	wrapped TransactionFn
+}
+
+// NewReadBuffer returns a ReadBuffer that has room for `nItems` items
+// and `nBytes` bytes of blob data before it needs to grow.
+func NewReadBuffer(nItems, nBytes int) *ReadBuffer {
+	return &ReadBuffer{
+		items: make(Items, 0, nItems),
+		arena: make([]byte, 0, nBytes),
+	}
+}
+
+// Items returns all items that were copied during the last ReadBuffered() call.
+func (rb *ReadBuffer) Items() Items {
+	return rb.items
+}
+
+func (rb *ReadBuffer) wrap(fn TransactionFn) TransactionFn {
+	rb.items = rb.items[:0]
+	rb.arena = rb.arena[:0]
+	rb.fn = fn
+	if rb.wrapped == nil {
+		// only create the closure once, so re-using the buffer does not allocate.
+		rb.wrapped = func(tx Transaction, items Items) (ReadOp, error) {
+			return rb.fn(tx, rb.copy(items))
+		}
+	}
+
+	return rb.wrapped
+}
+
+// copy appends `items` to the buffer and returns the part that was appended.
+// If the buffer needs to grow, previously returned items keep pointing to the
+// old memory, so they stay valid until the next reset.
+func (rb *ReadBuffer) copy(items Items) Items {
+	start := len(rb.items)
+	for idx := 0; idx < len(items); idx++ {
+		blobStart := len(rb.arena)
+		rb.arena = append(rb.arena, items[idx].Blob...)
+		blobEnd := len(rb.arena)
+		rb.items = append(rb.items, Item{
+			Key: items[idx].Key,
+			// limit capacity, so users cannot append into other blobs:
+			Blob: rb.arena[blobStart:blobEnd:blobEnd],
+		})
+	}
+
+	end := len(rb.items)
+	return rb.items[start:end:end]
+}
+
+// ItemsRef are items that point directly to the memory of the queue.
+// See Queue.PeekRef().
+type ItemsRef struct {
+	// Items are valid until Release() was called.
+	Items Items
+
+	release func() error
+}
+
+// Release gives the memory of Items back to the queue.
+// Calling it more than once is fine.
+func (r ItemsRef) Release() error {
+	if r.release == nil {
+		return nil
+	}
+
+	return r.release()
 }
 
 /////////////
@@ -201,8 +920,9 @@ func PeekCopy(c Consumer, n int) (Items, error) {
 // Fork is an implementation of the Consumer interface for a named fork.
 // See the Fork() method for more explanation.
 type Fork struct {
-	name ForkName
-	q    *Queue
+	name       ForkName
+	q          *Queue
+	lenCounter *atomic.Int64
 }
 
 // Consumer is an interface that both Fork and Queue implement.
@@ -210,9 +930,20 @@ type Fork struct {
 // Queue methods for details.
 type Consumer interface {
 	Read(n int, fn TransactionFn) error
-	Delete(from, to Key) (int, error)
+	ReadBuffered(n int, buf *ReadBuffer, fn TransactionFn) error
+	PeekRef(n int) (ItemsRef, error)
+	Delete(from, to Key) (DeleteResult, error)
+	DeleteFunc(from, to Key, keep func(Item) bool) (int, error)
+	PopDelete(from, to Key, fn func(Items) error) (int, error)
+	Reprioritize(from, to Key, shift func(Key) Key) (int, error)
 	Shovel(dst *Queue) (int, error)
 	Len() int
+	LenApprox() int
+	LenExact() int
+	CountByBucket() []BucketCount
+	PauseReads()
+	ResumeReads()
+	ReadsPaused() bool
 	Fork(name ForkName) (*Fork, error)
 }
 
@@ -228,6 +959,33 @@ func (f *Fork) Read(n int, fn TransactionFn) error {
 	return f.q.buckets.Read(n, f.name, fn)
 }
 
+// PeekRef is like Queue.PeekRef().
+func (f *Fork) PeekRef(n int) (ItemsRef, error) {
+	if f.q == nil {
+		return ItemsRef{}, ErrNoSuchFork
+	}
+
+	return f.q.buckets.PeekRef(n, f.name)
+}
+
+// ReadWait is like Queue.ReadWait().
+func (f *Fork) ReadWait(ctx context.Context, n int, maxWait time.Duration, fn TransactionFn) error {
+	if f.q == nil {
+		return ErrNoSuchFork
+	}
+
+	return f.q.buckets.ReadWait(ctx, n, maxWait, f.name, fn)
+}
+
+// ReadBuffered is like Queue.ReadBuffered().
+func (f *Fork) ReadBuffered(n int, buf *ReadBuffer, fn TransactionFn) error {
+	if f.q == nil {
+		return ErrNoSuchFork
+	}
+
+	return f.q.buckets.Read(n, f.name, buf.wrap(fn))
+}
+
 // Len is like Queue.Len().
 func (f *Fork) Len() int {
 	if f.q == nil {
@@ -238,15 +996,116 @@ func (f *Fork) Len() int {
 	return f.q.buckets.Len(f.name)
 }
 
+// LenApprox is like Queue.LenApprox().
+func (f *Fork) LenApprox() int {
+	if f.q == nil {
+		return 0
+	}
+
+	return int(f.lenCounter.Load())
+}
+
+// CountByBucket is like Queue.CountByBucket().
+func (f *Fork) CountByBucket() []BucketCount {
+	if f.q == nil {
+		return []BucketCount{}
+	}
+
+	return f.q.buckets.CountByBucket(f.name)
+}
+
+// SetTag is like Queue.SetTag().
+func (f *Fork) SetTag(key Key, name, value string) error {
+	if f.q == nil {
+		return ErrNoSuchFork
+	}
+
+	return f.q.buckets.SetTag(f.name, key, name, value)
+}
+
+// PauseReads is like Queue.PauseReads().
+func (f *Fork) PauseReads() {
+	if f.q == nil {
+		return
+	}
+
+	f.q.buckets.SetReadsPaused(f.name, true)
+}
+
+// ResumeReads is like Queue.ResumeReads().
+func (f *Fork) ResumeReads() {
+	if f.q == nil {
+		return
+	}
+
+	f.q.buckets.SetReadsPaused(f.name, false)
+}
+
+// ReadsPaused is like Queue.ReadsPaused().
+func (f *Fork) ReadsPaused() bool {
+	if f.q == nil {
+		return false
+	}
+
+	return f.q.buckets.ReadsPaused(f.name)
+}
+
+// LenExact is like Queue.LenExact().
+func (f *Fork) LenExact() int {
+	if f.q == nil {
+		return 0
+	}
+
+	return f.q.buckets.LenExact(f.name)
+}
+
 // Delete is like Queue.Delete().
-func (f *Fork) Delete(from, to Key) (int, error) {
+func (f *Fork) Delete(from, to Key) (DeleteResult, error) {
 	if f.q == nil {
-		return 0, ErrNoSuchFork
+		return DeleteResult{}, ErrNoSuchFork
 	}
 
 	return f.q.buckets.Delete(f.name, from, to)
 }
 
+// DeleteFunc is like Queue.DeleteFunc().
+func (f *Fork) DeleteFunc(from, to Key, keep func(Item) bool) (int, error) {
+	if f.q == nil {
+		return 0, ErrNoSuchFork
+	}
+
+	return f.q.buckets.DeleteFunc(f.name, from, to, keep)
+}
+
+// PopDelete is like Queue.PopDelete().
+func (f *Fork) PopDelete(from, to Key, fn func(Items) error) (int, error) {
+	if f.q == nil {
+		return 0, ErrNoSuchFork
+	}
+
+	return f.q.buckets.PopDelete(f.name, from, to, fn)
+}
+
+// Reprioritize is like Queue.Reprioritize(). Only the items of this fork are moved.
+func (f *Fork) Reprioritize(from, to Key, shift func(Key) Key) (int, error) {
+	if f.q == nil {
+		return 0, ErrNoSuchFork
+	}
+
+	return f.q.buckets.Reprioritize(f.name, from, to, shift)
+}
+
+// LastRead returns the time of the last Read() or PeekRef() on this fork,
+// even if it returned nothing. For a new fork, it is the time it was created.
+// See Options.ForkExpiry.
+func (f *Fork) LastRead() (time.Time, error) {
+	if f.q == nil {
+		return time.Time{}, ErrNoSuchFork
+	}
+
+	return f.q.buckets.LastRead(f.name)
+}
+
 // Remove removes this fork. If the fork is used after this, the API
 // will return ErrNoSuchFork in all cases.
 func (f *Fork) Remove() error {
@@ -275,5 +1134,5 @@ func (f *Fork) Fork(name ForkName) (*Fork, error) {
 		return nil, err
 	}
 
-	return &Fork{name: name, q: f.q}, nil
+	return &Fork{name: name, q: f.q, lenCounter: f.q.buckets.LenCounter(name)}, nil
 }
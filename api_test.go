@@ -2,17 +2,30 @@ package timeq
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
+	"unsafe"
 
+	"github.com/sahib/timeq/index"
 	"github.com/sahib/timeq/item"
 	"github.com/sahib/timeq/item/testutils"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -223,29 +236,29 @@ func TestAPIDelete(t *testing.T) {
 	require.NoError(t, queue.Push(exp))
 	ndeleted, err := queue.Delete(0, 500)
 	require.NoError(t, err)
-	require.Equal(t, 501, ndeleted)
+	require.Equal(t, 501, ndeleted.Items)
 
 	// Deleting the same should yield 0 now.
 	ndeleted, err = queue.Delete(0, 500)
 	require.NoError(t, err)
-	require.Equal(t, 0, ndeleted)
+	require.Equal(t, 0, ndeleted.Items)
 
 	// Do a partial delete of a bucket:
 	ndeleted, err = queue.Delete(0, 501)
 	require.NoError(t, err)
-	require.Equal(t, 1, ndeleted)
+	require.Equal(t, 1, ndeleted.Items)
 
 	// Delete more than what is left:
 	ndeleted, err = queue.Delete(0, 2000)
 	require.NoError(t, err)
-	require.Equal(t, 498, ndeleted)
+	require.Equal(t, 498, ndeleted.Items)
 
 	// Try with a fork:
 	f, err := queue.Fork("fork")
 	require.NoError(t, err)
 	ndeleted, err = f.Delete(0, 2000)
 	require.NoError(t, err)
-	require.Equal(t, 0, ndeleted)
+	require.Equal(t, 0, ndeleted.Items)
 
 	require.NoError(t, queue.Close())
 }
@@ -302,792 +315,5037 @@ func TestAPClear(t *testing.T) {
 	require.NoError(t, queue.Close())
 }
 
-func TestAPIMove(t *testing.T) {
+func TestAPIClearInterrupted(t *testing.T) {
 	t.Parallel()
 
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	srcDir := filepath.Join(dir, "src")
-	dstDir := filepath.Join(dir, "dst")
-
 	opts := DefaultOptions()
-	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
 
-	srcQueue, err := Open(srcDir, opts)
+	_, err = queue.Fork("fork")
 	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
+	require.NoError(t, queue.Close())
 
-	dstQueue, err := Open(dstDir, opts)
+	// simulate a crash during Clear(): the tombstone was written
+	// and the first bucket was removed only partly.
+	keys := []Key{}
+	for key := Key(0); key < 320; key += 32 {
+		keys = append(keys, key)
+	}
+
+	require.NoError(t, writeClearTombstone(OSFS(), dir, keys, true))
+	require.NoError(t, os.Remove(filepath.Join(dir, Key(0).String(), "dat.log")))
+
+	queue, err = Open(dir, opts)
 	require.NoError(t, err)
+	require.Equal(t, 0, queue.Len())
+	require.Empty(t, queue.Forks())
+	require.NoFileExists(t, filepath.Join(dir, clearTombstoneFile))
+	for _, key := range keys {
+		require.NoDirExists(t, filepath.Join(dir, key.String()))
+	}
 
-	exp := testutils.GenItems(0, 200, 1)
-	require.NoError(t, srcQueue.Push(exp))
-	require.Equal(t, len(exp), srcQueue.Len())
-	require.Equal(t, 0, dstQueue.Len())
+	// a normal clear leaves no tombstone behind:
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
+	require.NoError(t, queue.Clear())
+	require.NoFileExists(t, filepath.Join(dir, clearTombstoneFile))
+	require.NoError(t, queue.Close())
+}
 
-	var got Items
-	require.NoError(t, srcQueue.Read(len(exp), func(_ Transaction, items Items) (ReadOp, error) {
-		got = append(got, items.Copy()...)
-		return ReadOpPop, dstQueue.Push(items)
-	}))
+func TestAPIClearData(t *testing.T) {
+	t.Parallel()
 
+	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
-	require.Equal(t, len(exp), len(got))
-	require.Equal(t, exp, got)
+	defer os.RemoveAll(dir)
 
-	require.Equal(t, 0, srcQueue.Len())
-	require.Equal(t, len(exp), dstQueue.Len())
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
 
-	gotMoved := Items{}
-	require.NoError(t, dstQueue.Read(len(exp), func(_ Transaction, items Items) (ReadOp, error) {
-		gotMoved = append(gotMoved, items.Copy()...)
-		return ReadOpPop, nil
-	}))
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+	require.Equal(t, 100, fork.Len())
 
-	require.Equal(t, exp, gotMoved)
+	// forks should stay and receive new items:
+	require.NoError(t, queue.ClearData())
+	require.Equal(t, 0, queue.Len())
+	require.Equal(t, 0, fork.Len())
+	require.Equal(t, []ForkName{"fork"}, queue.Forks())
 
-	require.Equal(t, 0, srcQueue.Len())
-	require.Equal(t, 0, dstQueue.Len())
+	exp := testutils.GenItems(100, 200, 1)
+	require.NoError(t, queue.Push(exp))
+	require.Equal(t, 100, fork.Len())
+	require.NoError(t, queue.ClearData())
+	require.NoError(t, queue.Close())
 
-	require.NoError(t, srcQueue.Close())
-	require.NoError(t, dstQueue.Close())
-}
+	// forks should also survive a reopen without any buckets:
+	queue, err = Open(dir, DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, []ForkName{"fork"}, queue.Forks())
 
-type LogBuffer struct {
-	buf bytes.Buffer
-}
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(exp))
 
-func (lb *LogBuffer) Printf(fmtSpec string, args ...any) {
-	lb.buf.WriteString(fmt.Sprintf(fmtSpec, args...))
-	lb.buf.WriteByte('\n')
-}
+	var got Items
+	require.NoError(t, fork.Read(len(exp), func(_ Transaction, items Items) (ReadOp, error) {
+		got = append(got, items.Copy()...)
+		return ReadOpPop, nil
+	}))
+	require.Equal(t, exp, got)
 
-func (lb *LogBuffer) String() string {
-	return lb.buf.String()
-}
+	// Clear() should get rid of the forks:
+	require.NoError(t, queue.Clear())
+	require.Empty(t, queue.Forks())
+	require.NoError(t, queue.Close())
 
-func TestAPIErrorModePush(t *testing.T) {
-	t.Run("abort", func(t *testing.T) {
-		testAPIErrorModePush(t, ErrorModeAbort)
-	})
-	t.Run("continue", func(t *testing.T) {
-		testAPIErrorModePush(t, ErrorModeContinue)
-	})
+	queue, err = Open(dir, DefaultOptions())
+	require.NoError(t, err)
+	require.Empty(t, queue.Forks())
+	require.NoError(t, queue.Close())
 }
 
-func testAPIErrorModePush(t *testing.T, mode ErrorMode) {
+func TestAPIClearRange(t *testing.T) {
 	t.Parallel()
 
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	logger := &LogBuffer{}
-	opts := Options{
-		ErrorMode:       mode,
-		Logger:          logger,
-		BucketSplitConf: FixedSizeBucketSplitConf(10),
-	}
-
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5) // 32 keys per bucket.
 	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	// make sure the whole directory cannot be accessed,
-	// forcing an error during Push.
-	require.NoError(t, os.Chmod(dir, 0100))
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
+	require.NoError(t, queue.Close())
 
-	pushErr := queue.Push(testutils.GenItems(0, 100, 1))
-	if mode == ErrorModeContinue {
-		require.NotEmpty(t, logger.String())
-		require.NoError(t, pushErr)
-	} else {
-		require.Error(t, pushErr)
+	// reopen, so that the buckets in the middle are not loaded:
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+
+	_, err = queue.ClearRange(10, 0)
+	require.Error(t, err)
+
+	numDeleted, err := queue.ClearRange(40, 199)
+	require.NoError(t, err)
+	require.Equal(t, 2*160, numDeleted)
+	require.Equal(t, 160, queue.Len())
+	require.Equal(t, 160, fork.Len())
+
+	// only the buckets at the edges of the range had to be loaded:
+	require.Equal(t, uint64(2), queue.Metrics().BucketsOpened)
+
+	exp := append(testutils.GenItems(0, 40, 1), testutils.GenItems(200, 320, 1)...)
+	for _, consumer := range []Consumer{queue, fork} {
+		got, err := PopCopy(consumer, 320)
+		require.NoError(t, err)
+		require.Equal(t, exp, got)
 	}
 
 	require.NoError(t, queue.Close())
 }
 
-func TestAPIErrorModePop(t *testing.T) {
-	t.Run("abort", func(t *testing.T) {
-		testAPIErrorModePop(t, ErrorModeAbort)
-	})
-	t.Run("continue", func(t *testing.T) {
-		testAPIErrorModePop(t, ErrorModeContinue)
-	})
-}
-
-func testAPIErrorModePop(t *testing.T, mode ErrorMode) {
+func TestAPIDeleteKeysBelowBucketKey(t *testing.T) {
 	t.Parallel()
 
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	logger := &LogBuffer{}
-	opts := Options{
-		ErrorMode:       mode,
-		Logger:          logger,
-		BucketSplitConf: FixedSizeBucketSplitConf(10),
-	}
-
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
 	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
-
-	// truncate the data log of a single
-	require.NoError(
-		t,
-		os.Truncate(filepath.Join(dir, Key(0).String(), dataLogName), 0),
-	)
+	// both go to the bucket with key 0:
+	items := Items{{Key: -5, Blob: []byte("-5")}, {Key: 3, Blob: []byte("3")}}
+	require.NoError(t, queue.Push(items))
 
-	popErr := queue.Read(100, func(_ Transaction, items Items) (ReadOp, error) {
-		if mode == ErrorModeContinue {
-			require.NotEmpty(t, logger.String())
-			require.NotEmpty(t, items)
-		} else {
-			require.Empty(t, items)
-		}
+	res, err := queue.Delete(0, 9)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Items)
+	require.Zero(t, res.DroppedBuckets)
+	require.Equal(t, 1, queue.Len())
 
-		return ReadOpPop, nil
-	})
+	require.NoError(t, queue.Push(items[1:]))
+	n, err := queue.ClearRange(0, 9)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
 
-	if mode == ErrorModeContinue {
-		require.NoError(t, popErr)
-	} else {
-		require.Error(t, popErr)
-	}
+	got, err := PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Equal(t, items[:1], got)
 
+	// the whole bucket is covered now:
+	require.NoError(t, queue.Push(items))
+	res, err = queue.Delete(-9, 9)
+	require.NoError(t, err)
+	require.Equal(t, 2, res.Items)
+	require.Equal(t, 1, res.DroppedBuckets)
 	require.NoError(t, queue.Close())
 }
 
-func TestAPIErrorModeDelete(t *testing.T) {
-	t.Parallel()
-	t.Run("abort", func(t *testing.T) {
-		testAPIErrorModeDelete(t, ErrorModeAbort)
-	})
-	t.Run("continue", func(t *testing.T) {
-		testAPIErrorModeDelete(t, ErrorModeContinue)
-	})
-}
-
-func testAPIErrorModeDelete(t *testing.T, mode ErrorMode) {
+func TestAPIDeleteWholeBuckets(t *testing.T) {
 	t.Parallel()
 
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	logger := &LogBuffer{}
-	opts := Options{
-		ErrorMode:       mode,
-		Logger:          logger,
-		BucketSplitConf: FixedSizeBucketSplitConf(10),
-	}
-
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5) // 32 keys per bucket.
 	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
 
-	// truncate the data log of a single
-	// this will trigger a panic when working with the mmap.
-	require.NoError(
-		t,
-		os.Truncate(filepath.Join(dir, Key(0).String(), dataLogName), 0),
-	)
+	// the fork only keeps items in the last buckets:
+	_, err = fork.Delete(0, 255)
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
 
-	ndeleted, err := queue.Delete(0, 100)
-	if mode == ErrorModeContinue {
-		require.NotEmpty(t, logger.String())
-		require.NoError(t, err)
-		require.Equal(t, 90, ndeleted)
-	} else {
-		require.Error(t, err)
-		require.Equal(t, 0, ndeleted)
-	}
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+
+	res, err := queue.Delete(40, 299)
+	require.NoError(t, err)
+	require.Equal(t, 260, res.Items)
+	require.Equal(t, 6, res.DroppedBuckets)
+	require.Positive(t, res.ReclaimedBytes)
+	require.Equal(t, 60, queue.Len())
+
+	// partly deleted at the start, dropped, kept for the fork, partly deleted at the end:
+	require.Len(t, res.Buckets, 9)
+	require.Equal(t, BucketDeletion{Key: 32, Items: 24}, res.Buckets[0])
+	require.Equal(t, BucketDeletion{Key: 64, Items: 32, Dropped: true}, res.Buckets[1])
+	require.Equal(t, BucketDeletion{Key: 256, Items: 32}, res.Buckets[7])
+	require.Equal(t, BucketDeletion{Key: 288, Items: 12}, res.Buckets[8])
+
+	// buckets of the fork and the ones at the edges had to be loaded:
+	require.Equal(t, uint64(3), queue.Metrics().BucketsOpened)
+
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+
+	got, err := PopCopy(fork, 320)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(256, 320, 1), got)
 
+	got, err = PopCopy(queue, 320)
+	require.NoError(t, err)
+	require.Equal(t, append(testutils.GenItems(0, 40, 1), testutils.GenItems(300, 320, 1)...), got)
 	require.NoError(t, queue.Close())
 }
 
-func TestAPIBadOptions(t *testing.T) {
+func TestAPITruncate(t *testing.T) {
 	t.Parallel()
 
-	// Still create test dir to make sure it does not error out because of that:
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
 	opts := DefaultOptions()
-	opts.BucketSplitConf.Func = nil
-	_, err = Open(dir, opts)
-	require.Error(t, err)
+	opts.BucketSplitConf = ShiftBucketSplitConf(5) // 32 keys per bucket.
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
+	require.NoError(t, queue.Close())
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	res, err := queue.Truncate(math.MinInt64)
+	require.NoError(t, err)
+	require.Equal(t, 0, res.Items)
+
+	res, err = queue.Truncate(100)
+	require.NoError(t, err)
+	require.Equal(t, 2*100, res.Items)
+	require.Equal(t, 3, res.DroppedBuckets)
+	require.Equal(t, BucketDeletion{Key: 96, Items: 2 * 4}, res.Buckets[3])
+	require.Equal(t, 220, queue.Len())
+	require.Equal(t, 220, fork.Len())
+
+	// only the bucket containing the boundary had to be loaded:
+	require.Equal(t, uint64(1), queue.Metrics().BucketsOpened)
+
+	exp := testutils.GenItems(100, 320, 1)
+	for _, consumer := range []Consumer{queue, fork} {
+		got, err := PopCopy(consumer, 320)
+		require.NoError(t, err)
+		require.Equal(t, exp, got)
+	}
+
+	require.NoError(t, queue.Close())
 }
 
-func TestAPIPushError(t *testing.T) {
+func TestAPIDeleteFunc(t *testing.T) {
 	t.Parallel()
 
-	// Still create test dir to make sure it does not error out because of that:
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	buf := &bytes.Buffer{}
 	opts := DefaultOptions()
-	opts.Logger = WriterLogger(buf)
+	opts.BucketSplitConf = ShiftBucketSplitConf(6)
 	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	// First push creates the
-	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
 
-	// Truncating the log should trigger an error on the second push (actually a panic)
-	dataPath := filepath.Join(dir, item.Key(0).String(), dataLogName)
-	require.NoError(t, os.Truncate(dataPath, 0))
-	require.Error(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	// two batches with the same keys, so there are several locations per key:
+	items := testutils.GenItems(0, 200, 1)
+	require.NoError(t, queue.Push(items))
+	require.NoError(t, queue.Push(items))
 
-	require.NoError(t, queue.Close())
-}
+	_, err = queue.DeleteFunc(10, 0, nil)
+	require.Error(t, err)
 
-// helper to get the number of open file descriptors for current process:
-func openfds(t *testing.T) int {
-	ents, err := os.ReadDir("/proc/self/fd")
+	keep := func(it Item) bool {
+		return it.Key%2 != 0
+	}
+
+	numDeleted, err := queue.DeleteFunc(50, 149, keep)
 	require.NoError(t, err)
-	return len(ents)
-}
+	require.Equal(t, 2*50, numDeleted)
+	require.Equal(t, 400-100, queue.Len())
+	require.Equal(t, 400, fork.Len())
+	require.NoError(t, queue.Close())
 
-// helper to get the residual memory of the current process:
-func rssBytes(t *testing.T) int64 {
-	data, err := os.ReadFile("/proc/self/status")
+	// check that the change survives a reopen:
+	queue, err = Open(dir, opts)
 	require.NoError(t, err)
+	require.Equal(t, 400-100, queue.Len())
 
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if len(line) == 0 {
-			continue
-		}
-
-		split := strings.SplitN(line, ":", 2)
-		if strings.TrimSpace(split[0]) != "VmRSS" {
-			continue
+	var exp Items
+	for _, it := range items {
+		if it.Key < 50 || it.Key > 149 || keep(it) {
+			exp = append(exp, it, it)
 		}
-
-		kbs := strings.TrimSpace(strings.TrimSuffix(split[1], "kB"))
-		kb, err := strconv.ParseInt(kbs, 10, 64)
-		require.NoError(t, err)
-		return kb * 1024
 	}
 
-	require.Fail(t, "failed to find rss")
-	return 0
+	got, err := PopCopy(queue, 400)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.Equal(t, 400, fork.Len())
+	require.NoError(t, queue.Close())
 }
 
-// Check if old buckets get closed when pushing a lot of data.
-// Old buckets would still claim the memory maps, causing more residual memory
-// usage and also increasing number of file descriptors.
-func TestAPIMaxParallelBuckets(t *testing.T) {
+func TestAPIPopDelete(t *testing.T) {
 	t.Parallel()
 
-	// Still create test dir to make sure it does not error out because of that:
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	const N = 1000 // bucket size
 	opts := DefaultOptions()
-	opts.BucketSplitConf = FixedSizeBucketSplitConf(N)
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
 
-	// This test should fail if this is set to 0!
-	opts.MaxParallelOpenBuckets = 1
+	items := testutils.GenItems(0, 200, 1)
+	require.NoError(t, queue.Push(items))
 
-	queue, err := Open(dir, opts)
+	var archived Items
+	numDeleted, err := queue.PopDelete(50, 149, func(items Items) error {
+		archived = append(archived, items...)
+		return nil
+	})
 	require.NoError(t, err)
+	require.Equal(t, 100, numDeleted)
+	require.Equal(t, items[50:150], archived)
+	require.Equal(t, 100, queue.Len())
+
+	// errors of the callback stop the deletion:
+	errArchive := errors.New("archive is full")
+	numDeleted, err = queue.PopDelete(0, 199, func(items Items) error {
+		return errArchive
+	})
+	require.ErrorIs(t, err, errArchive)
+	require.Equal(t, 0, numDeleted)
+	require.Equal(t, 100, queue.Len())
 
-	var refFds int
-	var refRss int64
+	got, err := PopCopy(queue, 200)
+	require.NoError(t, err)
+	require.Equal(t, append(items[:50:50], items[150:]...), got)
+	require.NoError(t, queue.Close())
+}
 
-	// this accounts for parallel running tests.
-	// the main point is to check for linear increase.
-	const limit = 3.5
+func TestAPICloseWithContext(t *testing.T) {
+	t.Parallel()
 
-	for idx := 0; idx < 100; idx++ {
-		if idx == 10 {
-			refFds = openfds(t)
-			refRss = rssBytes(t)
-		}
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
 
-		// regression bug: CloseUnused() did not re-add trailers for nil-buckets.
-		// Also, we need to check that Len() does not re-open buckets.
-		require.Equal(t, idx*N, queue.Len())
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
 
-		if idx > 10 {
-			// it takes a bit of time for the values to stabilize.
-			fds := openfds(t)
-			rss := rssBytes(t)
+	// block a transaction until we tell it to continue:
+	inRead, release := make(chan struct{}), make(chan struct{})
+	readErrCh := make(chan error, 1)
+	go func() {
+		readErrCh <- queue.Read(10, func(_ Transaction, items Items) (ReadOp, error) {
+			close(inRead)
+			<-release
 
-			if fac := float64(fds) / float64(refFds); fac > limit {
-				require.Failf(
-					t,
-					"fd increase",
-					"number of fds increases: %v at bucket #%d",
-					fac,
-					idx,
-				)
-			}
+			// the items must still be accessible:
+			require.Equal(t, testutils.GenItems(0, 10, 1), items.Copy())
+			return ReadOpPop, nil
+		})
+	}()
 
-			if fac := float64(rss) / float64(refRss); fac > limit {
-				require.Failf(
-					t,
-					"rss increase",
-					"number of rss increases: %v times at bucket #%d",
-					fac,
-					idx,
-				)
-			}
-		}
+	<-inRead
 
-		require.NoError(t, queue.Push(testutils.GenItems(idx*N, idx*N+N, 1)))
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, queue.CloseWithContext(ctx), context.DeadlineExceeded)
+
+	// new operations get rejected after the running one finished:
+	pushErrCh := make(chan error, 1)
+	go func() {
+		pushErrCh <- queue.Push(testutils.GenItems(100, 200, 1))
+	}()
+
+	close(release)
+	require.NoError(t, <-readErrCh)
+	require.ErrorIs(t, <-pushErrCh, ErrClosed)
 
 	require.NoError(t, queue.Close())
-}
+	require.NoError(t, queue.Close())
+	require.ErrorIs(t, queue.Push(testutils.GenItems(100, 200, 1)), ErrClosed)
+	_, err = PopCopy(queue, 10)
+	require.ErrorIs(t, err, ErrClosed)
 
-func TestAPIFixedSizeBucketSplitFunc(t *testing.T) {
-	// just to make sure that the func does not break,
-	// even though the test is really stupid.
-	fn := FixedSizeBucketSplitConf(100).Func
-	for idx := 0; idx < 1000; idx++ {
-		require.Equal(t, item.Key(idx/100)*100, fn(item.Key(idx)))
-	}
+	// the popped items should be gone after a reopen:
+	queue, err = Open(dir, DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, 90, queue.Len())
+	require.NoError(t, queue.Close())
 }
 
-func TestAPIDoNotCrashOnMultiBucketPop(t *testing.T) {
-	mpobs := []int{0, 1, 2, 3, 5, 7, 10, 25, 50, 100, 101}
-	for _, mpob := range mpobs {
-		t.Run(fmt.Sprintf("%d", mpob), func(t *testing.T) {
-			testAPIDoNotCrashOnMultiBucketPop(t, mpob)
-		})
-	}
-}
+func TestAPIPauseReads(t *testing.T) {
+	t.Parallel()
 
-func testAPIDoNotCrashOnMultiBucketPop(t *testing.T, maxParallelOpenBuckets int) {
-	// Still create test dir to make sure it does not error out because of that:
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	const N = 100
-	opts := DefaultOptions()
-	opts.BucketSplitConf = FixedSizeBucketSplitConf(N)
-
-	opts.MaxParallelOpenBuckets = maxParallelOpenBuckets
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
 
-	srcDir := filepath.Join(dir, "src")
-	queue, err := Open(srcDir, opts)
+	fork, err := queue.Fork("fork")
 	require.NoError(t, err)
 
-	dstDir := filepath.Join(dir, "dst")
-	dstQueue, err := Open(dstDir, opts)
+	exp := testutils.GenItems(0, 100, 1)
+	require.NoError(t, queue.Push(exp))
+
+	queue.PauseReads()
+	require.True(t, queue.ReadsPaused())
+	require.False(t, fork.ReadsPaused())
+
+	got, err := PopCopy(queue, 100)
 	require.NoError(t, err)
+	require.Empty(t, got)
+	require.Equal(t, 100, queue.Len())
 
-	// Add several buckets to the queue:
-	// Access all data from all buckets, so that all memory has to be touched.
-	// If some memory is not mapped anymore (because the bucket was closed due
-	// to the MaxParallelOpenBuckets feature) then we would find out here.
-	for idx := 0; idx < N; idx++ {
-		off := idx * N
-		require.NoError(t, queue.Push(testutils.GenItems(off, off+N, 1)))
-	}
+	// forks are paused separately:
+	got, err = PopCopy(fork, 50)
+	require.NoError(t, err)
+	require.Equal(t, exp[:50], got)
 
-	refFds := openfds(t)
-	refRss := rssBytes(t)
+	fork.PauseReads()
+	got, err = PopCopy(fork, 50)
+	require.NoError(t, err)
+	require.Empty(t, got)
 
-	count := 0
-	require.NoError(t, queue.Read(N*N, func(_ Transaction, items Items) (ReadOp, error) {
-		for _, item := range items {
-			num, err := strconv.Atoi(string(item.Blob))
-			require.NoError(t, err)
-			require.Equal(t, num, count)
-			count++
-		}
+	queue.ResumeReads()
+	require.False(t, queue.ReadsPaused())
+	got, err = PopCopy(queue, 100)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
 
-		return ReadOpPop, nil
-	}))
+	fork.ResumeReads()
+	got, err = PopCopy(fork, 50)
+	require.NoError(t, err)
+	require.Equal(t, exp[50:], got)
 
-	gotFds := openfds(t)
-	gotRss := rssBytes(t)
-	require.LessOrEqual(t, gotFds, refFds)
-	require.True(t, float64(refRss)*1.5 > float64(gotRss))
 	require.NoError(t, queue.Close())
-	require.NoError(t, dstQueue.Close())
 }
 
-func TestAPIShovelMemoryUsage(t *testing.T) {
-	// Still create test dir to make sure it does not error out because of that:
+func TestAPIFreeze(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	const N = 10 // bucket size
-	opts := DefaultOptions()
-	opts.BucketSplitConf = FixedSizeBucketSplitConf(N)
-
-	// This test should fail if this is set to 0!
-	opts.MaxParallelOpenBuckets = 1
-
-	srcDir := filepath.Join(dir, "src")
-	srcQueue, err := Open(srcDir, opts)
+	queue, err := Open(dir, DefaultOptions())
 	require.NoError(t, err)
 
-	dstDir := filepath.Join(dir, "dst")
-	dstQueue, err := Open(dstDir, opts)
+	fork, err := queue.Fork("fork")
 	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
 
-	// Add a lot of mem to the srcQueue:
-	for idx := 0; idx < N; idx++ {
-		off := idx * N
-		require.NoError(t, srcQueue.Push(testutils.GenItems(off, off+N, 1)))
-
-		// also create the same buckets for dest queue, so that we do not take
-		// the fast path that do not involve any buckets access.
-		require.NoError(t, dstQueue.Push(testutils.GenItems(off, off+1, 1)))
-	}
+	queue.Freeze()
+	require.True(t, queue.Frozen())
+	require.ErrorIs(t, queue.Push(testutils.GenItems(100, 200, 1)), ErrFrozen)
+	require.ErrorIs(t, queue.Clear(), ErrFrozen)
 
-	refFds := openfds(t)
-	refRss := rssBytes(t)
+	_, err = queue.Delete(0, 10)
+	require.ErrorIs(t, err, ErrFrozen)
+	_, err = fork.Delete(0, 10)
+	require.ErrorIs(t, err, ErrFrozen)
 
-	count, err := srcQueue.Shovel(dstQueue)
+	// reading is still possible, pushing inside a transaction is not:
+	err = queue.Read(10, func(tx Transaction, items Items) (ReadOp, error) {
+		require.ErrorIs(t, tx.Push(items), ErrFrozen)
+		return ReadOpPop, nil
+	})
 	require.NoError(t, err)
-	require.Equal(t, N*N, count)
+	require.Equal(t, 90, queue.Len())
+	require.Equal(t, 100, fork.Len())
+
+	queue.Thaw()
+	require.False(t, queue.Frozen())
+	require.NoError(t, queue.Push(testutils.GenItems(100, 200, 1)))
+	require.Equal(t, 190, queue.Len())
+	require.Equal(t, 200, fork.Len())
+	require.NoError(t, queue.Close())
+}
 
-	nowFds := openfds(t)
-	nowRss := rssBytes(t)
+func TestAPISetOptions(t *testing.T) {
+	t.Parallel()
 
-	// Allow some fds to be extra:
-	require.LessOrEqual(t, nowFds, refFds+1)
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
 
-	// RSS memory usage should have not increased a lot:
-	require.True(t, float64(nowRss) < float64(refRss)*1.5)
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.MaxParallelOpenBuckets = 0
+	opts.SyncMode = SyncNone
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
 
-	// Just add some extra stuff to the queue since we had an
-	// crash related to a broken queue after shovel:
-	for idx := 0; idx < N; idx++ {
-		off := idx * N
-		require.NoError(t, srcQueue.Push(testutils.GenItems(off, off+N, 1)))
+	exp := testutils.GenItems(0, 320, 1)
+	require.NoError(t, queue.Push(exp))
+	require.Equal(t, 10, queue.Metrics().BucketsLoaded)
+
+	// lowering the limit closes buckets right away:
+	maxBucks := 2
+	syncMode := SyncFull
+	require.NoError(t, queue.SetOptions(OptionsPatch{
+		MaxParallelOpenBuckets: &maxBucks,
+		SyncMode:               &syncMode,
+	}))
+	require.Equal(t, 2, queue.Metrics().BucketsLoaded)
 
-		// also create the same buckets for dest queue, so that we do not take
-		// the fast path that do not involve any buckets access.
-		require.NoError(t, dstQueue.Push(testutils.GenItems(off, off+1, 1)))
-	}
+	badSyncMode := SyncMode(42)
+	require.Error(t, queue.SetOptions(OptionsPatch{SyncMode: &badSyncMode}))
 
-	require.NoError(t, srcQueue.Close())
-	require.NoError(t, dstQueue.Close())
+	var buf bytes.Buffer
+	require.NoError(t, queue.SetOptions(OptionsPatch{Logger: WriterLogger(&buf)}))
+
+	got, err := PopCopy(queue, 320)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+	require.LessOrEqual(t, queue.Metrics().BucketsLoaded, 2)
+	require.NoError(t, queue.Close())
 }
 
-func TestAPIZeroLengthPush(t *testing.T) {
-	// Still create test dir to make sure it does not error out because of that:
+func TestAPIBucketSyncMode(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	queue, err := Open(dir, DefaultOptions())
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.MaxParallelOpenBuckets = 0
+	opts.BucketSyncMode = func(key Key) SyncMode {
+		switch {
+		case key < 64:
+			return SyncNone
+		case key < 128:
+			return SyncMode(42)
+		default:
+			return SyncFull
+		}
+	}
+
+	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	require.NoError(t, queue.Push(Items{}))
-	require.NoError(t, queue.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
-		require.Fail(t, "should not have been executed")
-		return ReadOpPop, nil
-	}))
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
 
-	// Check that items after it are still reachable if there's a zero item:
-	emptyItems := Items{{Key: 1, Blob: []byte{}}}
-	nonEmptyItems := Items{{Key: 2, Blob: []byte("hello world")}}
+	modes := func() map[Key]SyncMode {
+		modes := make(map[Key]SyncMode)
+		queue.buckets.tree.Scan(func(key Key, buck *bucket) bool {
+			modes[key] = buck.opts.SyncMode
+			return true
+		})
+		return modes
+	}
 
-	require.NoError(t, queue.Push(append(emptyItems, nonEmptyItems...)))
+	got := modes()
+	require.Len(t, got, 10)
+	require.Equal(t, SyncNone, got[32])
+	require.Equal(t, SyncFull, got[96]) // invalid -> opts.SyncMode
+	require.Equal(t, SyncFull, got[288])
 
-	var executed bool
-	require.NoError(t, queue.Read(2, func(_ Transaction, items Items) (ReadOp, error) {
-		require.Equal(t, emptyItems[0], items[0])
-		require.Equal(t, nonEmptyItems[0], items[1])
-		executed = true
-		return ReadOpPop, nil
-	}))
+	// the override wins over changed options:
+	syncMode := SyncData
+	require.NoError(t, queue.SetOptions(OptionsPatch{SyncMode: &syncMode}))
+	got = modes()
+	require.Equal(t, SyncNone, got[32])
+	require.Equal(t, SyncData, got[96])
+	require.Equal(t, SyncFull, got[288])
 
-	require.True(t, executed)
 	require.NoError(t, queue.Close())
 }
 
-func TestAPIZeroKeyPush(t *testing.T) {
+func TestAPISyncRange(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	queue, err := Open(dir, DefaultOptions())
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.SyncMode = SyncNone
+	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	zeroKey := Items{{Key: 0, Blob: []byte{}}}
-	require.NoError(t, queue.Push(zeroKey))
-	require.Equal(t, 1, queue.Len())
+	exp := testutils.GenItems(0, 320, 1)
+	require.NoError(t, queue.Push(exp))
+
+	require.NoError(t, queue.SyncRange(40, 70))
+	require.NoError(t, queue.SyncRange(1000, 2000)) // no buckets there
+	require.NoError(t, queue.SyncRange(70, 40))     // empty range
+	require.Equal(t, uint64(3), queue.Metrics().Sync.Calls)
+
+	got, err := PopCopy(queue, 320)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+
+	require.NoError(t, queue.Close())
+	require.ErrorIs(t, queue.SyncRange(0, 320), ErrClosed)
+}
+
+func TestAPIBucketMeta(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 64, 1)))
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	start := time.Now()
+	got, err := PopCopy(queue, 10)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.SetTag(40, "source", "backfill"))
+	require.NoError(t, fork.SetTag(0, "team", "a"))
+	require.Error(t, queue.SetTag(1000, "source", "backfill"))
+
+	check := func(queue *Queue, fork *Fork) {
+		counts := queue.CountByBucket()
+		require.Len(t, counts, 2)
+		require.Equal(t, 22, counts[0].Len)
+		require.Equal(t, uint64(10), counts[0].PoppedItems)
+		require.Equal(t, uint64(got.StorageSize()), counts[0].PoppedBytes)
+		require.False(t, counts[0].LastPop.Before(start.Round(0)))
+		require.Empty(t, counts[0].Tags)
+		require.True(t, counts[1].LastPop.IsZero())
+		require.Equal(t, map[string]string{"source": "backfill"}, counts[1].Tags)
+
+		forkCounts := fork.CountByBucket()
+		require.Len(t, forkCounts, 2)
+		require.Equal(t, uint64(0), forkCounts[0].PoppedItems)
+		require.Equal(t, map[string]string{"team": "a"}, forkCounts[0].Tags)
+		require.Empty(t, forkCounts[1].Tags)
+	}
+
+	check(queue, fork)
+
+	// with the len manifest:
+	require.NoError(t, queue.Close())
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	check(queue, fork)
+
+	// the same via the trailers of the buckets:
+	require.NoError(t, queue.Close())
+	require.NoError(t, os.Remove(filepath.Join(dir, lenManifestFile)))
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	check(queue, fork)
+
+	// removing a tag:
+	require.NoError(t, queue.SetTag(32, "source", ""))
+	require.Empty(t, queue.CountByBucket()[1].Tags)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIMeta(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	_, ok := queue.GetMeta([]byte("schema"))
+	require.False(t, ok)
+
+	val := []byte("v1")
+	require.NoError(t, queue.SetMeta([]byte("schema"), val))
+	require.NoError(t, queue.SetMeta([]byte("empty"), []byte{}))
+	require.NoError(t, queue.SetMeta([]byte("gone"), []byte("x")))
+	require.NoError(t, queue.SetMeta([]byte("gone"), nil))
+
+	// the queue keeps its own copy:
+	val[1] = '2'
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	require.NoError(t, queue.Clear())
+
+	queue.Freeze()
+	require.ErrorIs(t, queue.SetMeta([]byte("schema"), []byte("v3")), ErrFrozen)
+	queue.Thaw()
+	require.NoError(t, queue.Close())
+	require.ErrorIs(t, queue.SetMeta([]byte("schema"), []byte("v3")), ErrClosed)
+
+	queue, err = Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	got, ok := queue.GetMeta([]byte("schema"))
+	require.True(t, ok)
+	require.Equal(t, []byte("v1"), got)
+
+	got, ok = queue.GetMeta([]byte("empty"))
+	require.True(t, ok)
+	require.Empty(t, got)
+
+	_, ok = queue.GetMeta([]byte("gone"))
+	require.False(t, ok)
+
+	// removing everything removes the file:
+	require.NoError(t, queue.SetMeta([]byte("schema"), nil))
+	require.NoError(t, queue.SetMeta([]byte("empty"), nil))
+	_, err = os.Stat(filepath.Join(dir, userMetaFile))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIRecordSequence(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.RecordSequence = true
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(10, 20, 1)))
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+
+	// goes to two buckets, but is still one push:
+	require.NoError(t, queue.Push(testutils.GenItems(30, 40, 1)))
+
+	// rewrites batches, but keeps the sequence:
+	_, err = queue.DeleteFunc(0, 40, func(it Item) bool {
+		return it.Key%2 == 0
+	})
+	require.NoError(t, err)
+
+	got, err := PopCopy(queue, 100)
+	require.NoError(t, err)
+	require.Len(t, got, 15)
+	for _, it := range got {
+		switch {
+		case it.Key >= 30:
+			require.Equal(t, uint64(3), it.Seq, it.Key)
+		case it.Key >= 10:
+			require.Equal(t, uint64(1), it.Seq, it.Key)
+		default:
+			require.Equal(t, uint64(2), it.Seq, it.Key)
+		}
+	}
+
+	// the buckets are gone, but the sequence continues:
+	require.Equal(t, 0, queue.Len())
+	require.NoError(t, queue.Close())
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	require.NoError(t, queue.Close())
+
+	// after a crash, the sequence file might be outdated:
+	require.NoError(t, os.Remove(filepath.Join(dir, seqStateFile)))
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(100, 110, 1)))
+
+	got, err = PopCopy(queue, 100)
+	require.NoError(t, err)
+	require.Len(t, got, 20)
+	for _, it := range got {
+		require.Equal(t, uint64(4+it.Key/100), it.Seq, it.Key)
+	}
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPINextSeq(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.RecordSequence = true
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	first, err := queue.NextSeq(10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+
+	_, err = queue.NextSeq(0)
+	require.Error(t, err)
+
+	// pushes share the counter:
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	got, err := PeekCopy(queue, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), got[0].Seq)
+
+	first, err = queue.NextSeq(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), first)
+
+	// the counter is written right away, not only on Close():
+	seq, err := readSeqState(OSFS(), dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), seq)
+	require.NoError(t, queue.Close())
+
+	// works without Options.RecordSequence too:
+	opts.RecordSequence = false
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+
+	first, err = queue.NextSeq(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), first)
+	require.NoError(t, queue.Close())
+
+	_, err = queue.NextSeq(1)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestAPIRecordPushTime(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.RecordPushTime = true
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	// the keys are no timestamps; the second batch has lower keys:
+	before1 := time.Now()
+	require.NoError(t, queue.Push(testutils.GenItems(10, 20, 1)))
+	after1 := time.Now()
+	time.Sleep(time.Millisecond)
+	before2 := time.Now()
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	after2 := time.Now()
+
+	// rewrites batches, but keeps the push time:
+	_, err = queue.DeleteFunc(0, 20, func(it Item) bool {
+		return it.Key%2 == 0
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Close())
+	opts.RecordPushTime = false
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+
+	// new buckets do not record push times anymore:
+	require.NoError(t, queue.Push(testutils.GenItems(100, 102, 1)))
+
+	got, err := PopCopy(queue, 100)
+	require.NoError(t, err)
+	require.Len(t, got, 12)
+	for _, it := range got {
+		var before, after time.Time
+		switch {
+		case it.Key >= 100:
+			require.True(t, it.PushedAt.IsZero())
+			continue
+		case it.Key >= 10:
+			before, after = before1, after1
+		default:
+			before, after = before2, after2
+		}
+
+		require.False(t, it.PushedAt.Before(before.Round(0)), it.Key)
+		require.False(t, it.PushedAt.After(after.Round(0)), it.Key)
+	}
+
+	metrics := queue.Metrics()
+	require.GreaterOrEqual(t, metrics.MaxQueueTime, metrics.AvgQueueTime)
+	require.Greater(t, metrics.AvgQueueTime, time.Duration(0))
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIPeekRef(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.MaxParallelOpenBuckets = 1
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 100, 1)
+	require.NoError(t, queue.Push(exp))
+
+	ref, err := queue.PeekRef(50)
+	require.NoError(t, err)
+	require.Equal(t, exp[:50], ref.Items)
+	require.Equal(t, 100, queue.Len())
+
+	// grow the first bucket, so its mapping would need to move:
+	for idx := 0; idx < 10; idx++ {
+		big := Items{{Key: 0, Blob: make([]byte, 1024*1024)}}
+		require.NoError(t, queue.Push(big))
+	}
+
+	// pop and delete all buckets and close the queue,
+	// the peeked items must still be readable:
+	_, err = PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
+	require.Equal(t, exp[:50], ref.Items)
+
+	require.NoError(t, ref.Release())
+	require.NoError(t, ref.Release())
+
+	// nothing to peek:
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	ref, err = queue.PeekRef(10)
+	require.NoError(t, err)
+	require.Empty(t, ref.Items)
+	require.NoError(t, ref.Release())
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIPeekRefConcurrent(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 100, 1)
+	require.NoError(t, queue.Push(exp))
+	require.NoError(t, queue.Close())
+
+	// the buckets are not loaded after open, so this needs the write lock:
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	ref, err := queue.PeekRef(50)
+	require.NoError(t, err)
+	require.Equal(t, exp[:50], ref.Items)
+	require.NoError(t, ref.Release())
+
+	// now they are loaded; peeking works while someone else holds the read lock:
+	queue.buckets.mu.RLock()
+	ref, err = queue.PeekRef(50)
+	queue.buckets.mu.RUnlock()
+	require.NoError(t, err)
+	require.Equal(t, exp[:50], ref.Items)
+	require.NoError(t, ref.Release())
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 8; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run := 0; run < 100; run++ {
+				ref, err := queue.PeekRef(10)
+				assert.NoError(t, err)
+				assert.Len(t, ref.Items, 10)
+				assert.NoError(t, ref.Release())
+
+				got, err := PeekCopy(queue, 10)
+				assert.NoError(t, err)
+				assert.Len(t, got, 10)
+			}
+		}()
+	}
+
+	// pushes and pops in between:
+	for run := 0; run < 100; run++ {
+		require.NoError(t, queue.Push(testutils.GenItems(100, 200, 1)))
+		got, err := PopCopy(queue, 100)
+		require.NoError(t, err)
+		require.Len(t, got, 100)
+	}
+
+	wg.Wait()
+	require.Equal(t, 100, queue.Len())
+}
+
+func TestAPIReadWait(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	readWait := func(n int, maxWait time.Duration) (Items, time.Duration, error) {
+		var got Items
+		start := time.Now()
+		err := queue.ReadWait(ctx, n, maxWait, func(_ Transaction, items Items) (ReadOp, error) {
+			got = append(got, items.Copy()...)
+			return ReadOpPop, nil
+		})
+
+		return got, time.Since(start), err
+	}
+
+	// not enough items, returns what is there after maxWait:
+	require.NoError(t, queue.Push(testutils.GenItems(0, 3, 1)))
+	got, took, err := readWait(10, 20*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 3, 1), got)
+	require.GreaterOrEqual(t, took, 20*time.Millisecond)
+
+	// enough items, does not wait:
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	got, took, err = readWait(5, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 5, 1), got)
+	require.Less(t, took, time.Minute)
+
+	// pushes while waiting are noticed:
+	pushErr := make(chan error, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pushErr <- queue.Push(testutils.GenItems(10, 20, 1))
+	}()
+
+	got, took, err = readWait(15, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, <-pushErr)
+	require.Equal(t, append(testutils.GenItems(5, 10, 1), testutils.GenItems(10, 20, 1)...), got)
+	require.Less(t, took, time.Minute)
+
+	// nothing there at all:
+	got, _, err = readWait(1, time.Millisecond)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, queue.ReadWait(cancelCtx, 1, time.Minute, func(_ Transaction, _ Items) (ReadOp, error) {
+		return ReadOpPop, nil
+	}), context.Canceled)
+
+	require.NoError(t, queue.Close())
+	_, _, err = readWait(1, time.Minute)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestAPIIndexBuffer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.IndexBufferSize = 1 << 20
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	for idx := 0; idx < 10; idx++ {
+		require.NoError(t, queue.Push(testutils.GenItems(idx*10, idx*10+10, 1)))
+	}
+
+	// nothing was written to the index logs yet:
+	info, err := os.Stat(filepath.Join(dir, Key(0).String(), "idx.log"))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+
+	got, err := PopCopy(queue, 50)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 50, 1), got)
+
+	require.NoError(t, queue.Maintain())
+	info, err = os.Stat(filepath.Join(dir, Key(96).String(), "idx.log"))
+	require.NoError(t, err)
+	require.NotZero(t, info.Size())
+
+	require.NoError(t, queue.Close())
+
+	// the len manifest would hide a missing flush:
+	require.NoError(t, os.Remove(filepath.Join(dir, lenManifestFile)))
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, 50, queue.Len())
+
+	got, err = PopCopy(queue, 10)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(50, 60, 1), got)
+
+	// buckets are moved with their index files:
+	dst, err := Open(filepath.Join(dir, "dst"), opts)
+	require.NoError(t, err)
+	n, err := queue.Shovel(dst)
+	require.NoError(t, err)
+	require.Equal(t, 40, n)
+	require.NoError(t, queue.Close())
+
+	got, err = PopCopy(dst, 100)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(60, 100, 1), got)
+	require.NoError(t, dst.Close())
+}
+
+func TestAPIIndexFlushPolicy(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.IndexFlush = IndexFlushEveryN
+	_, err = Open(dir, opts)
+	require.Error(t, err)
+
+	// buffering is a part of the policy:
+	opts.IndexFlush = IndexFlushOnSync
+	opts.IndexBufferSize = 1024
+	_, err = Open(dir, opts)
+	require.Error(t, err)
+
+	opts.IndexBufferSize = 0
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	idxSize := func() int64 {
+		info, err := os.Stat(filepath.Join(dir, Key(0).String(), "idx.log"))
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	require.NoError(t, queue.Push(testutils.GenItems(10, 20, 1)))
+	require.Zero(t, idxSize())
+
+	got, err := PopCopy(queue, 5)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 5, 1), got)
+	require.Zero(t, idxSize())
+
+	require.NoError(t, queue.Sync())
+	require.Equal(t, int64(4*index.LocationSize), idxSize())
+	require.NoError(t, queue.Close())
+
+	require.NoError(t, os.Remove(filepath.Join(dir, lenManifestFile)))
+	opts.IndexFlush = IndexFlushEveryN
+	opts.IndexFlushBatches = 2
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, 15, queue.Len())
+
+	// entries are still written with every batch:
+	require.NoError(t, queue.Push(testutils.GenItems(20, 30, 1)))
+	require.Equal(t, int64(5*index.LocationSize), idxSize())
+
+	got, err = PopCopy(queue, 25)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(5, 30, 1), got)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIOperationIDs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	opts.ErrorMode = ErrorModeContinue
+	opts.Logger = WriterLogger(&buf)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+
+	// errors in a bucket are logged with ErrorModeContinue:
+	errBoom := errors.New("boom")
+	require.NoError(t, queue.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
+		return ReadOpPeek, errBoom
+	}))
+	require.Equal(t, "[timeq] read#2: failed to pop: boom\n", buf.String())
+
+	// a logger set later is wrapped too:
+	buf.Reset()
+	var otherBuf bytes.Buffer
+	require.NoError(t, queue.SetOptions(OptionsPatch{Logger: WriterLogger(&otherBuf)}))
+	require.NoError(t, queue.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
+		return ReadOpPeek, errBoom
+	}))
+	require.Empty(t, buf.String())
+	require.Equal(t, "[timeq] read#3: failed to pop: boom\n", otherBuf.String())
+
+	queue.Freeze()
+	err = queue.Push(testutils.GenItems(10, 20, 1))
+	require.ErrorIs(t, err, ErrFrozen)
+	require.True(t, strings.HasPrefix(err.Error(), "push#4: "))
+	queue.Thaw()
+
+	require.NoError(t, queue.Close())
+	err = queue.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
+		return ReadOpPop, nil
+	})
+	require.ErrorIs(t, err, ErrClosed)
+	require.True(t, strings.HasPrefix(err.Error(), "read#5: "))
+}
+
+func TestAPIClone(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	dstDir := filepath.Join(dir, "dst")
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	queue, err := Open(srcDir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.SetMeta([]byte("schema"), []byte("v1")))
+
+	got, err := PopCopy(queue, 10)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 10, 1), got)
+
+	require.NoError(t, queue.Clone(dstDir))
+	require.Error(t, queue.Clone(dstDir))
+
+	// the files are shared until they are written to:
+	dataPath := filepath.Join(Key(32).String(), dataLogName)
+	nlinks, err := linkCount(OSFS(), filepath.Join(srcDir, dataPath))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), nlinks)
+
+	// write to the original, this must not change the clone:
+	require.NoError(t, queue.Push(testutils.GenItems(100, 110, 1)))
+	got, err = PopCopy(queue, 10)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(10, 20, 1), got)
+
+	clone, err := Open(dstDir, opts)
+	require.NoError(t, err)
+	require.Equal(t, 90, clone.Len())
+	require.Equal(t, []ForkName{"fork"}, clone.Forks())
+	val, ok := clone.GetMeta([]byte("schema"))
+	require.True(t, ok)
+	require.Equal(t, []byte("v1"), val)
+
+	// ...and the other way round. The read items have to stay
+	// valid, even if the pushed bucket copies its files:
+	requeued := Item{Key: 10, Blob: []byte("requeued")}
+	var ncalls int
+	require.NoError(t, clone.Read(5, func(tx Transaction, items Items) (ReadOp, error) {
+		if ncalls++; ncalls > 1 {
+			// the push left room for more:
+			return ReadOpPeek, nil
+		}
+
+		require.NoError(t, tx.Push(Items{requeued}))
+		require.Equal(t, testutils.GenItems(10, 15, 1), items)
+		return ReadOpPop, nil
+	}))
+
+	require.NoError(t, clone.Push(testutils.GenItems(200, 210, 1)))
+	got, err = PopCopy(clone, -1)
+	require.NoError(t, err)
+	exp := append(Items{requeued}, testutils.GenItems(15, 100, 1)...)
+	require.Equal(t, append(exp, testutils.GenItems(200, 210, 1)...), got)
+
+	cloneFork, err := clone.Fork("fork")
+	require.NoError(t, err)
+	require.Equal(t, 111, cloneFork.Len())
+	require.NoError(t, clone.Close())
+
+	got, err = PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(20, 110, 1), got)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	got, err = PopCopy(fork, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 110, 1), got)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIMergeFrom(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	queue, err := Open(filepath.Join(dir, "a"), opts)
+	require.NoError(t, err)
+
+	otherOpts := DefaultOptions()
+	otherOpts.BucketSplitConf = ShiftBucketSplitConf(3)
+	other, err := Open(filepath.Join(dir, "b"), otherOpts)
+	require.NoError(t, err)
+
+	// the buckets of both queues overlap, but are not the same:
+	require.NoError(t, queue.Push(testutils.GenItems(0, 200, 2)))
+	require.NoError(t, other.Push(testutils.GenItems(1, 200, 2)))
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	n, err := queue.MergeFrom(other)
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, 0, other.Len())
+	require.Equal(t, 200, queue.Len())
+
+	_, err = queue.MergeFrom(queue)
+	require.Error(t, err)
+
+	got, err := PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 200, 1), got)
+
+	// forks get the merged items too:
+	got, err = PopCopy(fork, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 200, 1), got)
+
+	require.NoError(t, queue.Close())
+	require.NoError(t, other.Close())
+}
+
+func TestAPIExportImportBucket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	src, err := Open(filepath.Join(dir, "src"), opts)
+	require.NoError(t, err)
+
+	srcFork, err := src.Fork("a")
+	require.NoError(t, err)
+	_, err = src.Fork("b")
+	require.NoError(t, err)
+
+	require.NoError(t, src.Push(testutils.GenItems(0, 100, 1)))
+	_, err = PopCopy(srcFork, 40)
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+	require.NoError(t, src.ExportBucket(40, &archive))
+	require.Error(t, src.ExportBucket(1000, &archive))
+	require.NoError(t, src.Close())
+
+	dst, err := Open(filepath.Join(dir, "dst"), opts)
+	require.NoError(t, err)
+	dstFork, err := dst.Fork("a")
+	require.NoError(t, err)
+	otherFork, err := dst.Fork("c")
+	require.NoError(t, err)
+	require.NoError(t, dst.Push(testutils.GenItems(0, 10, 1)))
+
+	key, err := dst.ImportBucket(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, Key(32), key)
+	require.Equal(t, []ForkName{"a", "c"}, dst.Forks())
+
+	_, err = dst.ImportBucket(bytes.NewReader(archive.Bytes()))
+	require.Error(t, err)
+
+	// the fork keeps its position in the bucket:
+	require.Equal(t, 10+24, dstFork.Len())
+	got, err := PopCopy(dstFork, -1)
+	require.NoError(t, err)
+	require.Equal(t, append(testutils.GenItems(0, 10, 1), testutils.GenItems(40, 64, 1)...), got)
+
+	// ...while unknown forks start like the queue:
+	require.Equal(t, 10+32, otherFork.Len())
+	got, err = PopCopy(dst, -1)
+	require.NoError(t, err)
+	require.Equal(t, append(testutils.GenItems(0, 10, 1), testutils.GenItems(32, 64, 1)...), got)
+	require.NoError(t, dst.Close())
+
+	otherOpts := DefaultOptions()
+	otherOpts.BucketSplitConf = ShiftBucketSplitConf(6)
+	other, err := Open(filepath.Join(dir, "other"), otherOpts)
+	require.NoError(t, err)
+	_, err = other.ImportBucket(bytes.NewReader(archive.Bytes()))
+	require.ErrorIs(t, err, ErrChangedSplitFunc)
+	_, err = other.ImportBucket(strings.NewReader("garbage"))
+	require.Error(t, err)
+	require.NoError(t, other.Close())
+}
+
+func TestAPIRestoreRange(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 64, 1)))
+
+	var archive bytes.Buffer
+	require.NoError(t, queue.ExportBucket(32, &archive))
+
+	// accidentally delete a time window and pop some more:
+	_, err = queue.Delete(35, 50)
+	require.NoError(t, err)
+	_, err = PopCopy(queue, 33)
+	require.NoError(t, err)
+	require.Equal(t, 64-16-33, queue.Len())
+
+	n, err := queue.RestoreRange(bytes.NewReader(archive.Bytes()), 35, 50)
+	require.NoError(t, err)
+	require.Equal(t, 16, n)
+
+	got, err := PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(33, 64, 1), got)
+
+	_, err = queue.RestoreRange(strings.NewReader("garbage"), 0, 100)
+	require.Error(t, err)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIFormatTooNew(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queueDir := filepath.Join(dir, "queue")
+	queue, err := Open(queueDir, DefaultOptions())
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+
+	// a downgraded copy is readable by this version:
+	downDir := filepath.Join(dir, "down")
+	require.Error(t, queue.ExportFormat(downDir, FormatVersion+1))
+	require.Error(t, queue.ExportFormat(downDir, 0))
+	require.NoError(t, queue.ExportFormat(downDir, FormatVersion))
+	require.NoError(t, queue.Close())
+
+	// pretend a newer version wrote the queue:
+	require.NoError(t, writeFormat(DefaultOptions().FS, queueDir, FormatVersion+1))
+	_, err = Open(queueDir, DefaultOptions())
+	require.ErrorIs(t, err, ErrFormatTooNew)
+
+	var formatErr *FormatError
+	require.ErrorAs(t, err, &formatErr)
+	require.Equal(t, FormatVersion+1, formatErr.Version)
+	require.Equal(t, FormatVersion, formatErr.Supported)
+
+	down, err := Open(downDir, DefaultOptions())
+	require.NoError(t, err)
+	got, err := PopCopy(down, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 100, 1), got)
+	require.NoError(t, down.Close())
+}
+
+func TestAPIOpenModes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	withMode := func(mode OpenMode) Options {
+		opts := DefaultOptions()
+		opts.OpenMode = mode
+		return opts
+	}
+
+	queue, err := Open(dir, withMode(OpenExclusive))
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+
+	for _, mode := range []OpenMode{OpenExclusive, OpenSharedRead, OpenWriter, OpenReader} {
+		_, err = Open(dir, withMode(mode))
+		require.ErrorIs(t, err, ErrLocked)
+	}
+
+	require.NoError(t, queue.Close())
+
+	// any number of shared readers, but nobody else:
+	r1, err := Open(dir, withMode(OpenSharedRead))
+	require.NoError(t, err)
+	r2, err := Open(dir, withMode(OpenSharedRead))
+	require.NoError(t, err)
+	_, err = Open(dir, withMode(OpenExclusive))
+	require.ErrorIs(t, err, ErrLocked)
+	_, err = Open(dir, withMode(OpenWriter))
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.ErrorIs(t, r1.Push(testutils.GenItems(100, 200, 1)), ErrReadOnly)
+	_, err = r1.Delete(0, 100)
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = r1.Fork("fork")
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = PopCopy(r1, 10)
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	got, err := PeekCopy(r2, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 100, 1), got)
+	require.NoError(t, r1.Close())
+	require.NoError(t, r2.Close())
+
+	// a single writer with readers:
+	writer, err := Open(dir, withMode(OpenWriter))
+	require.NoError(t, err)
+	_, err = Open(dir, withMode(OpenWriter))
+	require.ErrorIs(t, err, ErrLocked)
+	_, err = Open(dir, withMode(OpenSharedRead))
+	require.ErrorIs(t, err, ErrLocked)
+
+	reader, err := Open(dir, withMode(OpenReader))
+	require.NoError(t, err)
+	got, err = PeekCopy(reader, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 100, 1), got)
+
+	// items pushed to buckets the reader loaded already are not visible:
+	require.NoError(t, writer.Push(testutils.GenItems(100, 200, 1)))
+	got, err = PeekCopy(reader, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 100, 1), got)
+	require.NoError(t, reader.Close())
+
+	reader, err = Open(dir, withMode(OpenReader))
+	require.NoError(t, err)
+	got, err = PeekCopy(reader, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 200, 1), got)
+	require.NoError(t, reader.Close())
+	require.NoError(t, writer.Close())
+
+	_, err = Open(dir, withMode(openModeMax))
+	require.Error(t, err)
+}
+
+func TestAPIOpenModesReadOnlyDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// read-only queues do not create the queue:
+	opts := DefaultOptions()
+	opts.OpenMode = OpenSharedRead
+	_, err = Open(filepath.Join(dir, "missing"), opts)
+	require.Error(t, err)
+	require.NoDirExists(t, filepath.Join(dir, "missing"))
+
+	// options that write on open or on close for a writer:
+	opts = DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(50)
+	opts.MmapIndex = true
+	opts.IndexCheckpointInterval = 1
+	opts.RecordPushTime = true
+	opts.RecordSequence = true
+
+	queueDir := filepath.Join(dir, "queue")
+	queue, err := Open(queueDir, opts)
+	require.NoError(t, err)
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+	require.NoError(t, queue.Close())
+
+	// As root, permissions do not stop any writes, so also
+	// check that nothing was changed after reading:
+	snapshot := func() map[string]string {
+		files := make(map[string]string)
+		require.NoError(t, filepath.WalkDir(queueDir, func(path string, ent fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			info, err := ent.Info()
+			require.NoError(t, err)
+
+			files[path] = fmt.Sprintf("%v %d %v", info.Mode(), info.Size(), info.ModTime())
+			if ent.IsDir() {
+				return os.Chmod(path, 0500)
+			}
+
+			return os.Chmod(path, 0400)
+		}))
+
+		return files
+	}
+
+	before := snapshot()
+	defer filepath.WalkDir(queueDir, func(path string, _ fs.DirEntry, _ error) error {
+		return os.Chmod(path, 0700)
+	})
+
+	for _, mode := range []OpenMode{OpenSharedRead, OpenReader} {
+		opts.OpenMode = mode
+		reader, err := Open(queueDir, opts)
+		require.NoError(t, err)
+
+		got, err := PeekCopy(reader, -1)
+		require.NoError(t, err)
+		require.Len(t, got, 100)
+		for idx, it := range got {
+			require.Equal(t, Key(idx), it.Key)
+			require.Equal(t, uint64(1), it.Seq)
+		}
+
+		fork, err := reader.Fork("fork")
+		require.NoError(t, err)
+		require.Equal(t, 100, fork.Len())
+		require.NoError(t, reader.Close())
+	}
+
+	after := snapshot()
+	for path, info := range before {
+		// modes were made read-only by the first snapshot:
+		before[path] = info[strings.Index(info, " "):]
+		after[path] = after[path][strings.Index(after[path], " "):]
+	}
+
+	require.Equal(t, before, after)
+}
+
+func TestAPIPushLimits(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.MaxLen = 100
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	// the push below the limit may exceed it:
+	require.NoError(t, queue.Push(testutils.GenItems(0, 150, 1)))
+	require.ErrorIs(t, queue.Push(testutils.GenItems(150, 200, 1)), ErrQueueFull)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, queue.PushWait(ctx, testutils.GenItems(150, 200, 1)), context.DeadlineExceeded)
+
+	// the slowest consumer decides if the queue is full:
+	pushErrCh := make(chan error, 1)
+	go func() {
+		pushErrCh <- queue.PushWait(context.Background(), testutils.GenItems(150, 200, 1))
+	}()
+
+	_, err = PopCopy(queue, 150)
+	require.NoError(t, err)
+	select {
+	case err := <-pushErrCh:
+		require.Fail(t, "push should still block", "err: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	_, err = PopCopy(fork, 100)
+	require.NoError(t, err)
+	require.NoError(t, <-pushErrCh)
+	require.Equal(t, 50, queue.Len())
+	require.Equal(t, 100, fork.Len())
+	require.NoError(t, queue.Close())
+
+	// limit the bytes instead:
+	opts.MaxLen = 0
+	opts.MaxBytes = 1
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.ErrorIs(t, queue.Push(testutils.GenItems(200, 300, 1)), ErrQueueFull)
+	require.NoError(t, queue.Clear())
+	require.NoError(t, queue.Push(testutils.GenItems(200, 300, 1)))
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIPushInvalidItems(t *testing.T) {
+	t.Parallel()
+
+	for _, errMode := range []ErrorMode{ErrorModeAbort, ErrorModeContinue} {
+		dir, err := os.MkdirTemp("", "timeq-apitest")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		opts := DefaultOptions()
+		opts.ErrorMode = errMode
+
+		queue, err := Open(dir, opts)
+		require.NoError(t, err)
+
+		items := testutils.GenItems(10, 0, -1)
+		items[2].Blob = make([]byte, MaxBlobSize+1)
+		items[5].Blob = make([]byte, MaxBlobSize+1)
+
+		err = queue.Push(items)
+		var pushErr *PushError
+		require.ErrorAs(t, err, &pushErr)
+		require.ErrorIs(t, err, ErrBlobTooBig)
+		require.Equal(t, []int{2, 5}, []int{
+			pushErr.Failed[0].Index,
+			pushErr.Failed[1].Index,
+		})
+
+		if errMode == ErrorModeAbort {
+			require.False(t, pushErr.Written)
+			require.Equal(t, 0, queue.Len())
+		} else {
+			require.True(t, pushErr.Written)
+			require.Equal(t, 8, queue.Len())
+		}
+
+		require.NoError(t, queue.Close())
+	}
+}
+
+func TestAPIPushNegativeKeys(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the split func truncates towards zero, so -5 lands in bucket 0:
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(Items{{Key: 3}, {Key: -15}, {Key: -5}}))
+	require.NoError(t, queue.Close())
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+
+	got, err := PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Equal(t, []Key{-15, -5, 3}, []Key{got[0].Key, got[1].Key, got[2].Key})
+	require.NoError(t, queue.Close())
+}
+
+// faultFS makes the removal of value logs fail, once enabled.
+type faultFS struct {
+	FS
+	fail bool
+}
+
+func (f *faultFS) Remove(path string) error {
+	if f.fail && filepath.Base(path) == dataLogName {
+		return errors.New("injected fault")
+	}
+
+	return f.FS.Remove(path)
+}
+
+func TestAPIFaultFS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fsys := &faultFS{FS: OSFS()}
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(32)
+	opts.FS = fsys
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
+
+	fsys.fail = true
+	require.Error(t, queue.Clear())
+	require.FileExists(t, filepath.Join(dir, clearTombstoneFile))
+	require.NoError(t, queue.Close())
+
+	// the clear is finished on the next open:
+	fsys.fail = false
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, 0, queue.Len())
+	require.NoFileExists(t, filepath.Join(dir, clearTombstoneFile))
+	require.NoError(t, queue.Close())
+}
+
+// openFS records the files opened via OpenFile.
+type openFS struct {
+	FS
+	mu     sync.Mutex
+	opened map[string]bool
+}
+
+func (f *openFS) OpenFile(path string, flag int, perm fs.FileMode) (*os.File, error) {
+	f.mu.Lock()
+	f.opened[filepath.Base(path)] = true
+	f.mu.Unlock()
+	return f.FS.OpenFile(path, flag, perm)
+}
+
+func TestAPIFSOpenFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fsys := &openFS{FS: OSFS(), opened: make(map[string]bool)}
+	opts := DefaultOptions()
+	opts.FS = fsys
+	opts.OpenMode = OpenWriter
+	opts.RecordPushTime = true
+	opts.RecordSequence = true
+	opts.DiskReserveSize = 4096
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	require.NoError(t, queue.Close())
+
+	for _, name := range []string{queueLockFile, writerLockFile, reserveFile, pushStampsName, seqLogName} {
+		require.True(t, fsys.opened[name], name)
+	}
+}
+
+func TestAPICheckInvariants(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(32)
+	opts.MaxParallelOpenBuckets = 2
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 320, 1)))
+	require.NoError(t, queue.Read(50, func(_ Transaction, items Items) (ReadOp, error) {
+		return ReadOpPop, nil
+	}))
+
+	_, err = fork.Delete(100, 150)
+	require.NoError(t, err)
+
+	violations, err := queue.CheckInvariants()
+	require.NoError(t, err)
+	require.Empty(t, violations)
+
+	// corrupt the cached counts:
+	queue.buckets.lenOf("fork").Add(5)
+	queue.buckets.trailers[trailerKey{Key: 288, fork: ""}] = index.Trailer{TotalEntries: 3}
+
+	violations, err = queue.CheckInvariants()
+	require.NoError(t, err)
+	require.Len(t, violations, 3)
+	require.Equal(t, ForkName(""), violations[0].Fork)
+	require.Equal(t, ForkName("fork"), violations[1].Fork)
+	require.Equal(t, Key(288), violations[2].Bucket)
+	require.Equal(t, ForkName(""), violations[2].Fork)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIDumpBucket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+	require.NoError(t, queue.Push(testutils.GenItems(10, 20, 1)))
+	_, err = queue.Delete(0, 4)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, queue.DumpBucket(42, &buf))
+
+	dump := buf.String()
+	require.Contains(t, dump, "bucket K00000000000000000000")
+	require.Contains(t, dump, "consumer »«:\n  items:         15\n")
+	require.Contains(t, dump, "consumer »fork«:\n  items:         20\n")
+	require.Contains(t, dump, "[key=K00000000000000000005, off=75, len=5]")
+	require.Contains(t, dump, "  off=0 key=0 size=1\n")
+	require.Contains(t, dump, "  off=294 key=19 size=2\n")
+
+	require.Error(t, queue.DumpBucket(100, &buf))
+	require.NoError(t, queue.Close())
+}
+
+func TestAPISubscribeChan(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	ch, stop := queue.SubscribeChan("", 10)
+	forkCh, forkStop := queue.SubscribeChan("fork", 1000)
+
+	go func() {
+		for idx := 0; idx < 50; idx += 5 {
+			assert.NoError(t, queue.Push(testutils.GenItems(idx, idx+5, 1)))
+		}
+	}()
+
+	var got Items
+	for len(got) < 50 {
+		batch := <-ch
+		require.LessOrEqual(t, len(batch), 10)
+		got = append(got, batch...)
+	}
+
+	require.Equal(t, testutils.GenItems(0, 50, 1), got)
+
+	// items are only popped after they were received:
+	require.NoError(t, queue.Push(testutils.GenItems(50, 60, 1)))
+	require.Eventually(t, func() bool { return queue.Len() == 10 }, 5*time.Second, time.Millisecond)
+	stop()
+	stop()
+
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Equal(t, 10, queue.Len())
+
+	got = nil
+	for len(got) < 60 {
+		got = append(got, <-forkCh...)
+	}
+
+	require.Equal(t, testutils.GenItems(0, 60, 1), got)
+	require.Eventually(t, func() bool { return fork.Len() == 0 }, 5*time.Second, time.Millisecond)
+
+	// removing the fork ends the subscription:
+	require.NoError(t, fork.Remove())
+	_, ok = <-forkCh
+	require.False(t, ok)
+	forkStop()
+
+	// lower keys pushed between peeking and popping are not lost:
+	batch, err := queue.buckets.peekCopy("", 5)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(50, 55, 1), batch)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 3, 1)))
+	require.NoError(t, queue.buckets.popDelivered("", batch))
+	rest, err := queue.buckets.peekCopy("", -1)
+	require.NoError(t, err)
+	require.Equal(t, append(testutils.GenItems(0, 3, 1), testutils.GenItems(55, 60, 1)...), rest)
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPISubscribeChanBuckets(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	exp := append(testutils.GenItems(1, 3, 1), testutils.GenItems(11, 13, 1)...)
+	require.NoError(t, queue.Push(exp))
+
+	// a single batch spans both buckets:
+	ch, stop := queue.SubscribeChan("", 100)
+	require.Equal(t, exp, <-ch)
+	require.Eventually(t, func() bool { return queue.Len() == 0 }, 5*time.Second, time.Millisecond)
+	stop()
+
+	// lower keys pushed between peeking and popping are not lost,
+	// even if the first bucket was popped already:
+	require.NoError(t, queue.Push(exp))
+	batch, err := queue.buckets.peekCopy("", 3)
+	require.NoError(t, err)
+	require.Equal(t, exp[:3], batch)
+
+	require.NoError(t, queue.Push(testutils.GenItems(10, 11, 1)))
+	require.NoError(t, queue.buckets.popDelivered("", batch))
+	rest, err := queue.buckets.peekCopy("", -1)
+	require.NoError(t, err)
+	require.Equal(t, append(testutils.GenItems(10, 11, 1), exp[3]), rest)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIReadOnlyFS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 30, 1)))
+	require.NoError(t, queue.Push(Items{{Key: 25, Blob: []byte("dup")}}))
+	_, err = queue.Delete(0, 9)
+	require.NoError(t, err)
+
+	qfs := queue.ReadOnlyFS("")
+	require.NoError(t, fstest.TestFS(
+		qfs,
+		"K00000000000000000010/00000000000000000010",
+		"K00000000000000000020/00000000000000000025.1",
+	))
+
+	ents, err := fs.ReadDir(qfs, ".")
+	require.NoError(t, err)
+	require.Len(t, ents, 2)
+
+	blob, err := fs.ReadFile(qfs, "K00000000000000000020/00000000000000000025")
+	require.NoError(t, err)
+	require.Equal(t, "25", string(blob))
+
+	blob, err = fs.ReadFile(qfs, "K00000000000000000020/00000000000000000025.1")
+	require.NoError(t, err)
+	require.Equal(t, "dup", string(blob))
+
+	// the fork still has the first bucket:
+	ents, err = fs.ReadDir(queue.ReadOnlyFS("fork"), ".")
+	require.NoError(t, err)
+	require.Len(t, ents, 3)
+
+	_, err = fs.ReadDir(qfs, "K00000000000000000000")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = fs.ReadDir(queue.ReadOnlyFS("nope"), ".")
+	require.ErrorIs(t, err, ErrNoSuchFork)
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIReprioritize(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+
+	// new keys overlap with the range and with existing items:
+	n, err := queue.Reprioritize(90, 99, func(key Key) Key { return key + 1 })
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+
+	n, err = queue.Reprioritize(50, 79, func(key Key) Key { return key - 50 })
+	require.NoError(t, err)
+	require.Equal(t, 30, n)
+
+	var exp Items
+	for idx := 0; idx < 30; idx++ {
+		exp = append(exp, testutils.ItemFromIndex(idx), Item{Key: Key(idx), Blob: testutils.ItemFromIndex(idx + 50).Blob})
+	}
+
+	exp = append(exp, testutils.GenItems(30, 50, 1)...)
+	exp = append(exp, testutils.GenItems(80, 90, 1)...)
+	for idx := 90; idx < 100; idx++ {
+		exp = append(exp, Item{Key: Key(idx + 1), Blob: testutils.ItemFromIndex(idx).Blob})
+	}
+
+	var got Items
+	require.NoError(t, queue.Read(1000, func(_ Transaction, items Items) (ReadOp, error) {
+		got = append(got, items.Copy()...)
+		return ReadOpPeek, nil
+	}))
+
+	// the order of items with the same key is not defined:
+	byKeyAndBlob := func(a, b Item) int {
+		if c := cmp.Compare(a.Key, b.Key); c != 0 {
+			return c
+		}
+
+		return bytes.Compare(a.Blob, b.Blob)
+	}
+
+	slices.SortFunc(got, byKeyAndBlob)
+	slices.SortFunc(exp, byKeyAndBlob)
+	require.Equal(t, exp, got)
+	require.Equal(t, 100, queue.Len())
+
+	// the fork was not touched:
+	got = nil
+	require.Equal(t, 100, fork.Len())
+	require.NoError(t, fork.Read(1000, func(_ Transaction, items Items) (ReadOp, error) {
+		got = append(got, items.Copy()...)
+		return ReadOpPeek, nil
+	}))
+	require.Equal(t, testutils.GenItems(0, 100, 1), got)
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIRunConsumer(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var got Items
+	var nfails int
+	var errs []error
+
+	consumerOpts := ConsumerOptions{
+		BatchSize:  15,
+		MinBackoff: time.Millisecond,
+		OnError: func(err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- queue.RunConsumer(ctx, consumerOpts, func(_ context.Context, items Items) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if nfails < 2 {
+				nfails++
+				return errors.New("not yet")
+			}
+
+			got = append(got, items.Copy()...)
+			return nil
+		})
+	}()
+
+	queue.PauseReads()
+	require.NoError(t, queue.Push(testutils.GenItems(0, 50, 1)))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 50, queue.Len())
+
+	queue.ResumeReads()
+	require.Eventually(t, func() bool { return queue.Len() == 0 }, 5*time.Second, time.Millisecond)
+
+	// wakes up on push, although PollInterval is one second:
+	require.NoError(t, queue.Push(testutils.GenItems(50, 60, 1)))
+	require.Eventually(t, func() bool { return queue.Len() == 0 }, 500*time.Millisecond, time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	mu.Lock()
+	require.Equal(t, testutils.GenItems(0, 60, 1), got)
+	require.Len(t, errs, 2)
+	mu.Unlock()
+
+	require.Equal(t, uint64(2), queue.Metrics().HandlerErrors)
+
+	err = queue.RunConsumer(context.Background(), ConsumerOptions{Fork: "nope"}, nil)
+	require.ErrorIs(t, err, ErrNoSuchFork)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIExportRestorePosition(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 30, 1)))
+
+	drain := func(c Consumer, n int) Items {
+		var got Items
+		require.NoError(t, c.Read(n, func(_ Transaction, items Items) (ReadOp, error) {
+			got = append(got, items.Copy()...)
+			return ReadOpPop, nil
+		}))
+		return got
+	}
+
+	require.Equal(t, testutils.GenItems(0, 15, 1), drain(fork, 15))
+	token, err := queue.ExportPosition("fork")
+	require.NoError(t, err)
+
+	require.Equal(t, testutils.GenItems(15, 25, 1), drain(fork, 10))
+	require.NoError(t, queue.Push(testutils.GenItems(30, 40, 1)))
+	require.NoError(t, queue.Push(Items{{Key: 5, Blob: []byte("late")}}))
+
+	require.NoError(t, queue.RestorePosition("fork", token))
+	require.NoError(t, queue.RestorePosition("other", token))
+	require.Equal(t, 26, fork.Len())
+
+	exp := append(Items{{Key: 5, Blob: []byte("late")}}, testutils.GenItems(15, 40, 1)...)
+	require.Equal(t, exp, drain(fork, -1))
+
+	// survives a reopen:
+	require.NoError(t, queue.Close())
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+
+	other, err := queue.Fork("other")
+	require.NoError(t, err)
+	require.Equal(t, 26, other.Len())
+	require.Equal(t, exp, drain(other, -1))
+
+	// does not fit to another queue:
+	otherDir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(otherDir)
+
+	otherQueue, err := Open(otherDir, opts)
+	require.NoError(t, err)
+	require.NoError(t, otherQueue.Push(testutils.GenItems(0, 2, 1)))
+	require.ErrorIs(t, otherQueue.RestorePosition("", token), ErrPositionMismatch)
+	require.Error(t, otherQueue.RestorePosition("", []byte("garbage")))
+	require.NoError(t, otherQueue.Close())
+
+	_, err = queue.ExportPosition("nope")
+	require.ErrorIs(t, err, ErrNoSuchFork)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIRouter(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+
+	queues := map[string]*Queue{}
+	for _, name := range []string{"src", "even", "odd", "fallback"} {
+		queue, err := Open(filepath.Join(dir, name), opts)
+		require.NoError(t, err)
+		queues[name] = queue
+	}
+
+	src := queues["src"]
+	require.NoError(t, src.Push(testutils.GenItems(0, 50, 1)))
+
+	router := &Router{
+		Route: func(it Item) string {
+			if it.Key >= 40 {
+				return "unknown"
+			}
+
+			if it.Key%2 == 0 {
+				return "even"
+			}
+
+			return "odd"
+		},
+		Destinations: map[string]*Queue{
+			"even": queues["even"],
+			"odd":  queues["odd"],
+		},
+	}
+
+	n, err := router.RouteBatch(src, 40)
+	require.NoError(t, err)
+	require.Equal(t, 40, n)
+	require.Equal(t, 10, src.Len())
+	require.Equal(t, 20, queues["even"].Len())
+
+	var even Items
+	require.NoError(t, queues["even"].Read(100, func(_ Transaction, items Items) (ReadOp, error) {
+		even = append(even, items.Copy()...)
+		return ReadOpPeek, nil
+	}))
+	require.Equal(t, testutils.GenItems(0, 40, 2), even)
+	require.Equal(t, 20, queues["odd"].Len())
+
+	// items without destination stay in the source:
+	_, err = router.RouteBatch(src, 10)
+	require.ErrorIs(t, err, ErrNoRoute)
+	require.Equal(t, 10, src.Len())
+
+	router.Destinations["unknown"] = src
+	_, err = router.RouteBatch(src, 10)
+	require.Error(t, err)
+	require.Equal(t, 10, src.Len())
+	delete(router.Destinations, "unknown")
+
+	router.Fallback = queues["fallback"]
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- router.Run(ctx, src, ConsumerOptions{})
+	}()
+
+	require.NoError(t, src.Push(testutils.GenItems(50, 60, 1)))
+	require.Eventually(t, func() bool { return src.Len() == 0 }, 5*time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+
+	require.Equal(t, 20, queues["fallback"].Len())
+	for _, queue := range queues {
+		require.NoError(t, queue.Close())
+	}
+}
+
+func TestAPIMove(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srcDir := filepath.Join(dir, "src")
+	dstDir := filepath.Join(dir, "dst")
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+
+	srcQueue, err := Open(srcDir, opts)
+	require.NoError(t, err)
+
+	dstQueue, err := Open(dstDir, opts)
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 200, 1)
+	require.NoError(t, srcQueue.Push(exp))
+	require.Equal(t, len(exp), srcQueue.Len())
+	require.Equal(t, 0, dstQueue.Len())
+
+	var got Items
+	require.NoError(t, srcQueue.Read(len(exp), func(_ Transaction, items Items) (ReadOp, error) {
+		got = append(got, items.Copy()...)
+		return ReadOpPop, dstQueue.Push(items)
+	}))
+
+	require.NoError(t, err)
+	require.Equal(t, len(exp), len(got))
+	require.Equal(t, exp, got)
+
+	require.Equal(t, 0, srcQueue.Len())
+	require.Equal(t, len(exp), dstQueue.Len())
+
+	gotMoved := Items{}
+	require.NoError(t, dstQueue.Read(len(exp), func(_ Transaction, items Items) (ReadOp, error) {
+		gotMoved = append(gotMoved, items.Copy()...)
+		return ReadOpPop, nil
+	}))
+
+	require.Equal(t, exp, gotMoved)
+
+	require.Equal(t, 0, srcQueue.Len())
+	require.Equal(t, 0, dstQueue.Len())
+
+	require.NoError(t, srcQueue.Close())
+	require.NoError(t, dstQueue.Close())
+}
+
+type LogBuffer struct {
+	buf bytes.Buffer
+}
+
+func (lb *LogBuffer) Printf(fmtSpec string, args ...any) {
+	lb.buf.WriteString(fmt.Sprintf(fmtSpec, args...))
+	lb.buf.WriteByte('\n')
+}
+
+func (lb *LogBuffer) String() string {
+	return lb.buf.String()
+}
+
+func TestAPIErrorModePush(t *testing.T) {
+	t.Run("abort", func(t *testing.T) {
+		testAPIErrorModePush(t, ErrorModeAbort)
+	})
+	t.Run("continue", func(t *testing.T) {
+		testAPIErrorModePush(t, ErrorModeContinue)
+	})
+}
+
+func testAPIErrorModePush(t *testing.T, mode ErrorMode) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &LogBuffer{}
+	opts := Options{
+		ErrorMode:       mode,
+		Logger:          logger,
+		BucketSplitConf: FixedSizeBucketSplitConf(10),
+	}
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	// make sure the whole directory cannot be accessed,
+	// forcing an error during Push.
+	require.NoError(t, os.Chmod(dir, 0100))
+
+	pushErr := queue.Push(testutils.GenItems(0, 100, 1))
+	if mode == ErrorModeContinue {
+		require.NotEmpty(t, logger.String())
+		require.NoError(t, pushErr)
+	} else {
+		require.Error(t, pushErr)
+	}
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIErrorModePop(t *testing.T) {
+	t.Run("abort", func(t *testing.T) {
+		testAPIErrorModePop(t, ErrorModeAbort)
+	})
+	t.Run("continue", func(t *testing.T) {
+		testAPIErrorModePop(t, ErrorModeContinue)
+	})
+}
+
+func testAPIErrorModePop(t *testing.T, mode ErrorMode) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &LogBuffer{}
+	opts := Options{
+		ErrorMode:       mode,
+		Logger:          logger,
+		BucketSplitConf: FixedSizeBucketSplitConf(10),
+	}
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+
+	// truncate the data log of a single
+	require.NoError(
+		t,
+		os.Truncate(filepath.Join(dir, Key(0).String(), dataLogName), 0),
+	)
+
+	popErr := queue.Read(100, func(_ Transaction, items Items) (ReadOp, error) {
+		if mode == ErrorModeContinue {
+			require.NotEmpty(t, logger.String())
+			require.NotEmpty(t, items)
+		} else {
+			require.Empty(t, items)
+		}
+
+		return ReadOpPop, nil
+	})
+
+	if mode == ErrorModeContinue {
+		require.NoError(t, popErr)
+	} else {
+		require.Error(t, popErr)
+	}
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIErrorModeDelete(t *testing.T) {
+	t.Parallel()
+	t.Run("abort", func(t *testing.T) {
+		testAPIErrorModeDelete(t, ErrorModeAbort)
+	})
+	t.Run("continue", func(t *testing.T) {
+		testAPIErrorModeDelete(t, ErrorModeContinue)
+	})
+}
+
+func testAPIErrorModeDelete(t *testing.T, mode ErrorMode) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &LogBuffer{}
+	opts := Options{
+		ErrorMode:       mode,
+		Logger:          logger,
+		BucketSplitConf: FixedSizeBucketSplitConf(10),
+	}
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+
+	// truncate the data log of a single
+	// this will trigger a panic when working with the mmap.
+	require.NoError(
+		t,
+		os.Truncate(filepath.Join(dir, Key(0).String(), dataLogName), 0),
+	)
+
+	// buckets that are deleted as a whole are not loaded,
+	// so the range must only partly cover the broken one.
+	ndeleted, err := queue.Delete(5, 100)
+	if mode == ErrorModeContinue {
+		require.NotEmpty(t, logger.String())
+		require.NoError(t, err)
+		require.Equal(t, 90, ndeleted.Items)
+	} else {
+		require.Error(t, err)
+		require.Equal(t, 0, ndeleted.Items)
+	}
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIBadOptions(t *testing.T) {
+	t.Parallel()
+
+	// Still create test dir to make sure it does not error out because of that:
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf.Func = nil
+	_, err = Open(dir, opts)
+	require.Error(t, err)
+}
+
+func TestAPIPushError(t *testing.T) {
+	t.Parallel()
+
+	// Still create test dir to make sure it does not error out because of that:
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	buf := &bytes.Buffer{}
+	opts := DefaultOptions()
+	opts.Logger = WriterLogger(buf)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	// First push creates the
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+
+	// Truncating the log should trigger an error on the second push (actually a panic)
+	dataPath := filepath.Join(dir, item.Key(0).String(), dataLogName)
+	require.NoError(t, os.Truncate(dataPath, 0))
+	require.Error(t, queue.Push(testutils.GenItems(0, 10, 1)))
+
+	require.NoError(t, queue.Close())
+}
+
+// helper to get the number of open file descriptors for current process:
+func openfds(t *testing.T) int {
+	ents, err := os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	return len(ents)
+}
+
+// helper to get the residual memory of the current process:
+func rssBytes(t *testing.T) int64 {
+	data, err := os.ReadFile("/proc/self/status")
+	require.NoError(t, err)
+
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		split := strings.SplitN(line, ":", 2)
+		if strings.TrimSpace(split[0]) != "VmRSS" {
+			continue
+		}
+
+		kbs := strings.TrimSpace(strings.TrimSuffix(split[1], "kB"))
+		kb, err := strconv.ParseInt(kbs, 10, 64)
+		require.NoError(t, err)
+		return kb * 1024
+	}
+
+	require.Fail(t, "failed to find rss")
+	return 0
+}
+
+// Check if old buckets get closed when pushing a lot of data.
+// Old buckets would still claim the memory maps, causing more residual memory
+// usage and also increasing number of file descriptors.
+func TestAPIMaxParallelBuckets(t *testing.T) {
+	t.Parallel()
+
+	// Still create test dir to make sure it does not error out because of that:
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const N = 1000 // bucket size
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(N)
+
+	// This test should fail if this is set to 0!
+	opts.MaxParallelOpenBuckets = 1
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	var refFds int
+	var refRss int64
+
+	// this accounts for parallel running tests.
+	// the main point is to check for linear increase.
+	const limit = 3.5
+
+	for idx := 0; idx < 100; idx++ {
+		if idx == 10 {
+			refFds = openfds(t)
+			refRss = rssBytes(t)
+		}
+
+		// regression bug: CloseUnused() did not re-add trailers for nil-buckets.
+		// Also, we need to check that Len() does not re-open buckets.
+		require.Equal(t, idx*N, queue.Len())
+
+		if idx > 10 {
+			// it takes a bit of time for the values to stabilize.
+			fds := openfds(t)
+			rss := rssBytes(t)
+
+			if fac := float64(fds) / float64(refFds); fac > limit {
+				require.Failf(
+					t,
+					"fd increase",
+					"number of fds increases: %v at bucket #%d",
+					fac,
+					idx,
+				)
+			}
+
+			if fac := float64(rss) / float64(refRss); fac > limit {
+				require.Failf(
+					t,
+					"rss increase",
+					"number of rss increases: %v times at bucket #%d",
+					fac,
+					idx,
+				)
+			}
+		}
+
+		require.NoError(t, queue.Push(testutils.GenItems(idx*N, idx*N+N, 1)))
+	}
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIFixedSizeBucketSplitFunc(t *testing.T) {
+	// just to make sure that the func does not break,
+	// even though the test is really stupid.
+	fn := FixedSizeBucketSplitConf(100).Func
+	for idx := 0; idx < 1000; idx++ {
+		require.Equal(t, item.Key(idx/100)*100, fn(item.Key(idx)))
+	}
+}
+
+func TestAPIDoNotCrashOnMultiBucketPop(t *testing.T) {
+	mpobs := []int{0, 1, 2, 3, 5, 7, 10, 25, 50, 100, 101}
+	for _, mpob := range mpobs {
+		t.Run(fmt.Sprintf("%d", mpob), func(t *testing.T) {
+			testAPIDoNotCrashOnMultiBucketPop(t, mpob)
+		})
+	}
+}
+
+func testAPIDoNotCrashOnMultiBucketPop(t *testing.T, maxParallelOpenBuckets int) {
+	// Still create test dir to make sure it does not error out because of that:
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const N = 100
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(N)
+
+	opts.MaxParallelOpenBuckets = maxParallelOpenBuckets
+
+	srcDir := filepath.Join(dir, "src")
+	queue, err := Open(srcDir, opts)
+	require.NoError(t, err)
+
+	dstDir := filepath.Join(dir, "dst")
+	dstQueue, err := Open(dstDir, opts)
+	require.NoError(t, err)
+
+	// Add several buckets to the queue:
+	// Access all data from all buckets, so that all memory has to be touched.
+	// If some memory is not mapped anymore (because the bucket was closed due
+	// to the MaxParallelOpenBuckets feature) then we would find out here.
+	for idx := 0; idx < N; idx++ {
+		off := idx * N
+		require.NoError(t, queue.Push(testutils.GenItems(off, off+N, 1)))
+	}
+
+	refFds := openfds(t)
+	refRss := rssBytes(t)
+
+	count := 0
+	require.NoError(t, queue.Read(N*N, func(_ Transaction, items Items) (ReadOp, error) {
+		for _, item := range items {
+			num, err := strconv.Atoi(string(item.Blob))
+			require.NoError(t, err)
+			require.Equal(t, num, count)
+			count++
+		}
+
+		return ReadOpPop, nil
+	}))
+
+	gotFds := openfds(t)
+	gotRss := rssBytes(t)
+	require.LessOrEqual(t, gotFds, refFds)
+	require.True(t, float64(refRss)*1.5 > float64(gotRss))
+	require.NoError(t, queue.Close())
+	require.NoError(t, dstQueue.Close())
+}
+
+func TestAPIShovelMemoryUsage(t *testing.T) {
+	// Still create test dir to make sure it does not error out because of that:
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const N = 10 // bucket size
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(N)
+
+	// This test should fail if this is set to 0!
+	opts.MaxParallelOpenBuckets = 1
+
+	srcDir := filepath.Join(dir, "src")
+	srcQueue, err := Open(srcDir, opts)
+	require.NoError(t, err)
+
+	dstDir := filepath.Join(dir, "dst")
+	dstQueue, err := Open(dstDir, opts)
+	require.NoError(t, err)
+
+	// Add a lot of mem to the srcQueue:
+	for idx := 0; idx < N; idx++ {
+		off := idx * N
+		require.NoError(t, srcQueue.Push(testutils.GenItems(off, off+N, 1)))
+
+		// also create the same buckets for dest queue, so that we do not take
+		// the fast path that do not involve any buckets access.
+		require.NoError(t, dstQueue.Push(testutils.GenItems(off, off+1, 1)))
+	}
+
+	refFds := openfds(t)
+	refRss := rssBytes(t)
+
+	count, err := srcQueue.Shovel(dstQueue)
+	require.NoError(t, err)
+	require.Equal(t, N*N, count)
+
+	nowFds := openfds(t)
+	nowRss := rssBytes(t)
+
+	// Allow some fds to be extra:
+	require.LessOrEqual(t, nowFds, refFds+1)
+
+	// RSS memory usage should have not increased a lot:
+	require.True(t, float64(nowRss) < float64(refRss)*1.5)
+
+	// Just add some extra stuff to the queue since we had an
+	// crash related to a broken queue after shovel:
+	for idx := 0; idx < N; idx++ {
+		off := idx * N
+		require.NoError(t, srcQueue.Push(testutils.GenItems(off, off+N, 1)))
+
+		// also create the same buckets for dest queue, so that we do not take
+		// the fast path that do not involve any buckets access.
+		require.NoError(t, dstQueue.Push(testutils.GenItems(off, off+1, 1)))
+	}
+
+	require.NoError(t, srcQueue.Close())
+	require.NoError(t, dstQueue.Close())
+}
+
+func TestAPIZeroLengthPush(t *testing.T) {
+	// Still create test dir to make sure it does not error out because of that:
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(Items{}))
+	require.NoError(t, queue.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
+		require.Fail(t, "should not have been executed")
+		return ReadOpPop, nil
+	}))
+
+	// Check that items after it are still reachable if there's a zero item:
+	emptyItems := Items{{Key: 1, Blob: []byte{}}}
+	nonEmptyItems := Items{{Key: 2, Blob: []byte("hello world")}}
+
+	require.NoError(t, queue.Push(append(emptyItems, nonEmptyItems...)))
+
+	var executed bool
+	require.NoError(t, queue.Read(2, func(_ Transaction, items Items) (ReadOp, error) {
+		require.Equal(t, emptyItems[0], items[0])
+		require.Equal(t, nonEmptyItems[0], items[1])
+		executed = true
+		return ReadOpPop, nil
+	}))
+
+	require.True(t, executed)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIZeroKeyPush(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	zeroKey := Items{{Key: 0, Blob: []byte{}}}
+	require.NoError(t, queue.Push(zeroKey))
+	require.Equal(t, 1, queue.Len())
+
+	var executed bool
+	require.NoError(t, queue.Read(1, func(_ Transaction, items Items) (ReadOp, error) {
+		require.Equal(t, zeroKey, items)
+		executed = true
+		return ReadOpPop, nil
+	}))
+
+	require.True(t, executed)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIForkBasicBeforePush(t *testing.T) {
+	t.Run("push-before-full-Read", func(t *testing.T) {
+		// if we push before fork, the buckets exist & are forked online.
+		testAPIForkBasicBeforePush(t, true, 100, 100)
+	})
+	t.Run("push-after-full-Read", func(t *testing.T) {
+		// if we push after fork, the buckets do not exist & are forked offline.
+		testAPIForkBasicBeforePush(t, false, 100, 100)
+	})
+	t.Run("push-before-partial-Read", func(t *testing.T) {
+		// If the bucket is fully empty, then we do the RemoveFork() offline.
+		testAPIForkBasicBeforePush(t, true, 100, 99)
+	})
+	t.Run("push-after-partial-Read", func(t *testing.T) {
+		// If the bucket is not fully empty, then we do the RemoveFork() online.
+		testAPIForkBasicBeforePush(t, false, 100, 99)
+	})
+}
+
+func testAPIForkBasicBeforePush(t *testing.T, pushBefore bool, pushn, popn int) {
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exp := testutils.GenItems(0, pushn, 1)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	// At the beginning, no forks should exist.
+	require.Equal(t, []ForkName{}, queue.Forks())
+
+	if pushBefore {
+		require.NoError(t, queue.Push(exp))
+	}
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.Equal(t, []ForkName{"fork"}, queue.Forks())
+
+	// fork twice should not yield an error (since it's a no-op)
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+
+	// consumers should also exist, even if we start later.
+	if !pushBefore {
+		require.NoError(t, queue.Push(exp))
+	}
+
+	got1, err := PopCopy(fork, popn)
+	require.NoError(t, err)
+
+	got2, err := PopCopy(queue, popn)
+	require.NoError(t, err)
+
+	require.Equal(t, exp[:popn], got1)
+	require.Equal(t, exp[:popn], got2)
+
+	require.NoError(t, fork.Remove())
+	require.Equal(t, []ForkName{}, queue.Forks())
+
+	items, err := PopCopy(fork, popn)
+	require.Equal(t, ErrNoSuchFork, err)
+	require.Empty(t, items)
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIChainFork(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 100, 1)
+	require.NoError(t, queue.Push(exp))
+
+	var forks []*Fork
+	var forkNames []ForkName
+	var consumers []Consumer
+
+	for idx := 0; idx < 10; idx++ {
+		forkName := ForkName(fmt.Sprintf("%d", idx))
+
+		var c Consumer = queue
+		if len(forks) > 0 {
+			c = forks[len(forks)-1]
+		}
+
+		popped, err := PopCopy(c, 10)
+		require.NoError(t, err)
+		require.Len(t, popped, 10)
+		require.Equal(t, exp[idx*10:idx*10+10], popped)
+
+		fork, err := c.Fork(forkName)
+		require.NoError(t, err)
+
+		forkNames = append(forkNames, forkName)
+		forks = append(forks, fork)
+		consumers = append(consumers, c)
+	}
+
+	require.Equal(t, forkNames, queue.Forks())
+	for idx, consumer := range consumers {
+		require.Equal(t, 90-10*idx, consumer.Len())
+	}
+
+	for _, fork := range forks {
+		require.NoError(t, fork.Remove())
+	}
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPINegativKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, queue.Push(testutils.GenItems(-100, +100, 1)))
+	require.NoError(t, queue.Push(testutils.GenItems(-100, +100, 1)))
+
+	for idx := 0; idx < 40; idx++ {
+		require.NoError(t, queue.Read(10, func(_ Transaction, items Items) (ReadOp, error) {
+			for itemIdx, item := range items {
+				a := (idx*10 + itemIdx - 200)
+				if a <= 0 {
+					// trick to balance out the shift in negative numbers:
+					a -= 1
+				}
+				exp := a / 2
+				require.Equal(t, Key(exp), item.Key)
+			}
+			return ReadOpPop, nil
+		}))
+	}
+
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIZeroLengthPayload(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	exp := Items{
+		Item{
+			Key:  123,
+			Blob: []byte{},
+		},
+	}
+	require.NoError(t, queue.Push(exp))
+
+	got, err := PopCopy(queue, 1)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+}
+
+func assertBucketExistence(t *testing.T, queue *Queue, expectExist bool) {
+	buckDir := queue.buckets.buckPath(0)
+	if _, err := os.Stat(buckDir); err != nil {
+		if expectExist {
+			require.Fail(t, "bucket should exist, but does not")
+		}
+	} else {
+		if !expectExist {
+			require.Fail(t, "bucket should not exist, but does")
+		}
+	}
+}
+
+func TestAPIForkBucketDeleteWhenEmpty(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const N = 10
+	exp := testutils.GenItems(0, N, 1)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	f1, err := queue.Fork("hänsel")
+	require.NoError(t, err)
+
+	f2, err := queue.Fork("gretel")
+	require.NoError(t, err)
+	assertBucketExistence(t, queue, false)
+
+	require.NoError(t, queue.Push(exp))
+	assertBucketExistence(t, queue, true)
+
+	_, err = PopCopy(f1, N)
+	require.NoError(t, err)
+	assertBucketExistence(t, queue, true)
+
+	_, err = PopCopy(f2, N)
+	require.NoError(t, err)
+	assertBucketExistence(t, queue, true)
+
+	_, err = PopCopy(queue, N)
+	require.NoError(t, err)
+
+	assertBucketExistence(t, queue, false)
+}
+
+func TestAPIForkBucketDeleteOnRemoveFork(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const N = 10
+	exp := testutils.GenItems(0, N, 1)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	f1, err := queue.Fork("hänsel")
+	require.NoError(t, err)
+
+	f2, err := queue.Fork("gretel")
+	require.NoError(t, err)
+	assertBucketExistence(t, queue, false)
+
+	require.NoError(t, queue.Push(exp))
+	assertBucketExistence(t, queue, true)
+
+	_, err = PopCopy(queue, N)
+	require.NoError(t, err)
+	assertBucketExistence(t, queue, true)
+
+	require.NoError(t, f1.Remove())
+	assertBucketExistence(t, queue, true)
+
+	require.NoError(t, f2.Remove())
+	assertBucketExistence(t, queue, false)
+}
+
+func TestAPIPushInRead(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	const N = 10
+	exp := testutils.GenItems(0, N, 1)
+	require.NoError(t, queue.Push(exp))
+	require.NoError(t, queue.Read(N, func(tx Transaction, items Items) (ReadOp, error) {
+		// just push it right back.
+		return ReadOpPop, tx.Push(items)
+	}))
+
+	require.Equal(t, N, queue.Len())
+
+	got, err := PopCopy(queue, N)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIReadBuffered(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	// spread over several buckets, so fn gets called several times:
+	const N = 100
+	exp := testutils.GenItems(0, N, 1)
+	require.NoError(t, queue.Push(exp))
+
+	var got Items
+	buf := NewReadBuffer(0, 0)
+	require.NoError(t, queue.ReadBuffered(N, buf, func(_ Transaction, items Items) (ReadOp, error) {
+		// it's fine to keep the items without copying:
+		got = append(got, items...)
+		return ReadOpPeek, nil
+	}))
+
+	require.Equal(t, exp, got)
+	require.Equal(t, exp, buf.Items())
+
+	// the second read should not need to grow the buffer anymore:
+	arenaPtr := unsafe.SliceData(buf.arena)
+	itemsPtr := unsafe.SliceData(buf.items)
+	require.NoError(t, queue.ReadBuffered(N, buf, func(_ Transaction, items Items) (ReadOp, error) {
+		return ReadOpPop, nil
+	}))
+
+	require.Equal(t, exp, buf.Items())
+	require.True(t, arenaPtr == unsafe.SliceData(buf.arena))
+	require.True(t, itemsPtr == unsafe.SliceData(buf.items))
+	require.Equal(t, 0, queue.Len())
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIAdvise(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(1000)
+	opts.AdviseSequential = true
+	opts.AdviseFreeConsumed = true
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	const N = 5000
+	exp := testutils.GenItems(0, N, 1)
+	for idx := 0; idx < N; idx += 100 {
+		require.NoError(t, queue.Push(exp[idx:idx+100]))
+	}
+
+	require.NoError(t, queue.Prewarm(2))
+
+	var got Items
+	for idx := 0; idx < N; idx += 50 {
+		items, err := PopCopy(queue, 50)
+		require.NoError(t, err)
+		got = append(got, items...)
+
+		if idx%1000 == 0 {
+			require.NoError(t, queue.Maintain())
+		}
+	}
+
+	require.Equal(t, exp, got)
+	require.Equal(t, 0, queue.Len())
+	require.NoError(t, queue.Close())
+}
+
+func TestAPILockActiveBucket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+	opts.MaxParallelOpenBuckets = 2
+	opts.LockActiveBucket = true
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 100, 1)
+	require.NoError(t, queue.Push(exp))
+
+	var got Items
+	for idx := 0; idx < 10; idx++ {
+		items, err := PopCopy(queue, 10)
+		require.NoError(t, err)
+		got = append(got, items...)
+
+		if queue.buckets.locked != nil {
+			// should always be the bucket we popped from last:
+			require.Equal(t, Key(idx*10), queue.buckets.lockedKey)
+		}
+	}
+
+	require.Equal(t, exp, got)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPILockActiveBucketFreeConsumed(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(1000)
+	opts.LockActiveBucket = true
+	opts.AdviseFreeConsumed = true
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 2000, 1)
+	require.NoError(t, queue.Push(exp))
+
+	// popping from a locked bucket must not fail on freeing memory:
+	var got Items
+	for idx := 0; idx < 20; idx++ {
+		items, err := PopCopy(queue, 100)
+		require.NoError(t, err)
+		got = append(got, items...)
+	}
+
+	require.Equal(t, exp, got)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIMmapIndex(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(1000)
+	opts.MmapIndex = true
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	const N = 2500
+	exp := testutils.GenItems(0, N, 1)
+	for idx := 0; idx < N; idx += 10 {
+		require.NoError(t, queue.Push(exp[idx:idx+10]))
+	}
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	got, err := PopCopy(queue, 500)
+	require.NoError(t, err)
+	require.Equal(t, exp[:500], got)
+	require.NoError(t, queue.Close())
+
+	// re-open: indexes are loaded from the snapshots now.
+	for run := 0; run < 2; run++ {
+		queue, err = Open(dir, opts)
+		require.NoError(t, err)
+		require.Equal(t, N-500-run*500, queue.Len())
+
+		fork, err = queue.Fork("fork")
+		require.NoError(t, err)
+		require.Equal(t, N-run*1000, fork.Len())
+
+		got, err = PopCopy(queue, 500)
+		require.NoError(t, err)
+		require.Equal(t, exp[500+run*500:1000+run*500], got)
+
+		got, err = PopCopy(fork, 1000)
+		require.NoError(t, err)
+		require.Equal(t, exp[run*1000:(run+1)*1000], got)
+		require.NoError(t, queue.Close())
+	}
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, fork.Remove())
+
+	got, err = PopCopy(queue, N)
+	require.NoError(t, err)
+	require.Equal(t, exp[1500:], got)
+	require.Equal(t, 0, queue.Len())
+	require.NoError(t, queue.Close())
+
+	// all buckets should have been removed, including snapshots:
+	ents, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, ents, 6) // split.conf, names.conf, format.version, queue.lock, writer.lock and totals.state
+}
+
+func TestAPIIndexStructureSorted(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.IndexStructure = IndexStructureSorted
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	// push out of order, so not everything is appended:
+	exp := item.Items{}
+	exp = append(exp, testutils.GenItems(0, 1000, 2)...)
+	exp = append(exp, testutils.GenItems(1, 1000, 2)...)
+	require.NoError(t, queue.Push(exp[:500]))
+	require.NoError(t, queue.Push(exp[500:]))
+	slices.SortStableFunc(exp, func(a, b item.Item) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	got, err := PopCopy(queue, 500)
+	require.NoError(t, err)
+	require.Equal(t, exp[:500], got)
+	require.NoError(t, queue.Close())
+
+	// switching the structure between runs is fine:
+	opts.IndexStructure = IndexStructureRadix
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	got, err = PopCopy(queue, 250)
+	require.NoError(t, err)
+	require.Equal(t, exp[500:750], got)
+	require.NoError(t, queue.Close())
+
+	opts.IndexStructure = IndexStructureBTree
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	got, err = PopCopy(queue, 1000)
+	require.NoError(t, err)
+	require.Equal(t, exp[750:], got)
+	require.NoError(t, queue.Close())
+
+	opts.IndexStructure = IndexStructure(42)
+	_, err = Open(dir, opts)
+	require.Error(t, err)
+}
+
+func TestAPIIndexCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.IndexCheckpointInterval = 10
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(1000)
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	const N = 500
+	exp := testutils.GenItems(0, N, 1)
+	for idx := 0; idx < N; idx += 10 {
+		require.NoError(t, queue.Push(exp[idx:idx+10]))
+	}
+
+	snapPath := filepath.Join(dir, fmt.Sprintf("K%020d", 0), "idx.snap")
+	require.FileExists(t, snapPath)
+
+	for idx := 0; idx < 100; idx += 5 {
+		got, err := PopCopy(queue, 5)
+		require.NoError(t, err)
+		require.Equal(t, exp[idx:idx+5], got)
+	}
+
+	require.NoError(t, queue.Close())
+
+	// the opened index has to be the same as with a full replay:
+	for _, interval := range []int{10, 0} {
+		opts.IndexCheckpointInterval = interval
+		queue, err = Open(dir, opts)
+		require.NoError(t, err)
+		require.Equal(t, N-100, queue.Len())
+
+		got, err := PeekCopy(queue, N)
+		require.NoError(t, err)
+		require.Equal(t, exp[100:], got)
+		require.NoError(t, queue.Close())
+	}
+}
+
+func TestAPILenManifest(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.MaxParallelOpenBuckets = 1
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 1000, 1)))
+
+	// buckets are not loaded, but the fork needs to know its size:
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.Equal(t, 1000, fork.Len())
+
+	_, err = PopCopy(queue, 150)
+	require.NoError(t, err)
+	_, err = queue.Delete(500, 549)
+	require.NoError(t, err)
+	require.Equal(t, 800, queue.Len())
+	require.Equal(t, 1000, fork.Len())
+	require.NoError(t, queue.Close())
+
+	manifestPath := filepath.Join(dir, lenManifestFile)
+	require.FileExists(t, manifestPath)
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.NoFileExists(t, manifestPath)
+
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.Equal(t, 800, queue.Len())
+	require.Equal(t, 1000, fork.Len())
+
+	// simulate a crash: no manifest is written,
+	// so the counts need to come from the buckets.
+	_, err = PopCopy(fork, 100)
+	require.NoError(t, err)
+	require.NoError(t, queue.Sync())
+	require.NoError(t, queue.buckets.lock.Unlock())
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.Equal(t, 800, queue.Len())
+	require.Equal(t, 900, fork.Len())
+	require.NoError(t, queue.Close())
+
+	// broken manifests are ignored:
+	require.NoError(t, os.WriteFile(manifestPath, []byte("garbage"), 0600))
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, 800, queue.Len())
+	require.NoError(t, queue.Close())
+}
+
+func TestAPILenApproxExact(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.MaxParallelOpenBuckets = 2
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	// read the approximate length while another goroutine pushes:
+	var pushErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for idx := 0; idx < 1000 && pushErr == nil; idx += 10 {
+			pushErr = queue.Push(testutils.GenItems(idx, idx+10, 1))
+		}
+	}()
+
+	for last := 0; last < 1000; {
+		curr := queue.LenApprox()
+		require.GreaterOrEqual(t, curr, last)
+		last = curr
+		select {
+		case <-done:
+			last = 1000
+		default:
+		}
+	}
+
+	<-done
+	require.NoError(t, pushErr)
+	require.Equal(t, 1000, queue.LenApprox())
+	require.Equal(t, 1000, queue.LenExact())
+	require.Equal(t, 1000, fork.LenApprox())
+
+	_, err = PopCopy(fork, 250)
+	require.NoError(t, err)
+	require.Equal(t, 750, fork.LenApprox())
+	require.Equal(t, 750, fork.LenExact())
+	require.Equal(t, 1000, queue.LenApprox())
+
+	require.NoError(t, fork.Remove())
+	require.Equal(t, 0, fork.LenApprox())
+	require.Equal(t, 0, fork.LenExact())
+	require.NoError(t, queue.Close())
+}
+
+func TestAPICountByBucket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.MaxParallelOpenBuckets = 1
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.Empty(t, queue.CountByBucket())
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 300, 1)))
+	require.NoError(t, queue.Push(testutils.GenItems(1000, 1050, 1)))
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	_, err = PopCopy(queue, 150)
+	require.NoError(t, err)
+
+	// the pop statistics are tested in TestAPIBucketMeta:
+	counts := queue.CountByBucket()
+	require.NotEmpty(t, counts)
+	require.Equal(t, uint64(50), counts[0].PoppedItems)
+	counts[0].LastPop = time.Time{}
+	counts[0].PoppedItems = 0
+	counts[0].PoppedBytes = 0
+
+	require.Equal(t, []BucketCount{
+		{Key: 100, Len: 50},
+		{Key: 200, Len: 100},
+		{Key: 1000, Len: 50},
+	}, counts)
+
+	require.Equal(t, []BucketCount{
+		{Key: 0, Len: 100},
+		{Key: 100, Len: 100},
+		{Key: 200, Len: 100},
+		{Key: 1000, Len: 50},
+	}, fork.CountByBucket())
+
+	require.NoError(t, queue.Close())
+}
+
+func popMember(t *testing.T, m *GroupMember, n int) Items {
+	var got Items
+	require.NoError(t, m.Read(n, func(_ Transaction, items Items) (ReadOp, error) {
+		got = append(got, items.Copy()...)
+		return ReadOpPop, nil
+	}))
+
+	return got
+}
+
+func TestAPIGroup(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+	opts.MaxParallelOpenBuckets = 20
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 200, 1)))
+
+	group := queue.Group("")
+	require.Same(t, group, queue.Group(""))
+
+	m1, m2 := group.Join("a"), group.Join("b")
+	require.Equal(t, []string{"a", "b"}, group.Members())
+
+	buckets1, err := m1.Buckets()
+	require.NoError(t, err)
+	buckets2, err := m2.Buckets()
+	require.NoError(t, err)
+	require.Len(t, append(buckets1, buckets2...), 20)
+	require.NotEmpty(t, buckets1)
+	require.NotEmpty(t, buckets2)
+
+	// each member only gets the items of its buckets:
+	got1 := popMember(t, m1, 10)
+	require.Len(t, got1, 10)
+	require.Equal(t, buckets1[0], got1[0].Key)
+	got2 := popMember(t, m2, 10)
+	require.Equal(t, buckets2[0], got2[0].Key)
+
+	// after leaving, the other member takes over all buckets:
+	m2.Leave()
+	require.Equal(t, []string{"a"}, group.Members())
+	_, err = m2.Buckets()
+	require.ErrorIs(t, err, ErrNotMember)
+	require.ErrorIs(t, m2.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
+		return ReadOpPop, nil
+	}), ErrNotMember)
+
+	require.Len(t, popMember(t, m1, -1), 180)
+	require.Equal(t, 0, queue.Len())
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIGroupSessionTimeout(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.GroupSessionTimeout = 10 * time.Millisecond
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	group := queue.Group("")
+	m1 := group.Join("a")
+	group.Join("b")
+	time.Sleep(20 * time.Millisecond)
+
+	// b did not show up in time:
+	_, err = m1.Buckets()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, group.Members())
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIPartitioned(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the first byte of the blob is the tenant:
+	partition := HashPartition(func(it Item) []byte { return it.Blob[:1] })
+
+	pq, err := OpenPartitioned(dir, 4, partition, DefaultOptions())
+	require.NoError(t, err)
+	require.Equal(t, 4, pq.NumPartitions())
+
+	var items Items
+	for idx := 0; idx < 100; idx++ {
+		tenant := byte('a' + idx%8)
+		items = append(items, Item{Key: Key(idx), Blob: []byte{tenant, byte(idx)}})
+	}
+
+	require.NoError(t, pq.Push(items))
+	require.Equal(t, 100, pq.Len())
+
+	var total int
+	for idx := 0; idx < pq.NumPartitions(); idx++ {
+		got, err := PopCopy(pq.Partition(idx), -1)
+		require.NoError(t, err)
+
+		// all items of a tenant are in one partition, in order:
+		for _, it := range got {
+			require.Equal(t, idx, partition(it, 4))
+		}
+
+		require.True(t, slices.IsSortedFunc(got, func(a, b Item) int {
+			return cmp.Compare(a.Key, b.Key)
+		}))
+		total += len(got)
+	}
+
+	require.Equal(t, 100, total)
+
+	badPartition := func(Item, int) int { return 4 }
+	require.NoError(t, pq.Close())
+
+	pq, err = OpenPartitioned(dir, 4, badPartition, DefaultOptions())
+	require.NoError(t, err)
+	require.Error(t, pq.Push(items))
+	require.Equal(t, 0, pq.Len())
+	require.NoError(t, pq.Close())
+
+	_, err = OpenPartitioned(dir, 3, partition, DefaultOptions())
+	require.ErrorIs(t, err, ErrChangedPartitions)
+}
+
+func TestAPIPartitionedOrdered(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	partition := HashPartition(func(it Item) []byte { return it.Blob[:1] })
+	pq, err := OpenPartitioned(dir, 4, partition, DefaultOptions())
+	require.NoError(t, err)
+	defer pq.Close()
+
+	// spread the keys over several buckets of every partition:
+	var items Items
+	for idx := 0; idx < 100; idx++ {
+		tenant := byte('a' + idx%8)
+		key := Key(idx) * Key(6*time.Hour)
+		items = append(items, Item{Key: key, Blob: []byte{tenant, byte(idx)}})
+	}
+
+	require.NoError(t, pq.Push(items))
+
+	var got Items
+	for len(got) < len(items) {
+		err := pq.ReadOrdered(30, func(tx Transaction, batch Items) (ReadOp, error) {
+			require.LessOrEqual(t, len(batch), 30)
+			require.Equal(t, int64(batch.StorageSize()), tx.Stats().Bytes)
+			got = append(got, batch...)
+			return ReadOpPop, nil
+		})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, items, got)
+	require.Equal(t, 0, pq.Len())
+
+	// peeking leaves the items alone:
+	require.NoError(t, pq.Push(items[:10]))
+	require.NoError(t, pq.ReadOrdered(-1, func(_ Transaction, batch Items) (ReadOp, error) {
+		require.Equal(t, items[:10], batch)
+		return ReadOpPeek, nil
+	}))
+	require.Equal(t, 10, pq.Len())
+}
+
+func TestAPIReadStableView(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.MaxParallelOpenBuckets = 1
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	// three buckets: 0, 32 and 64.
+	exp := append(testutils.GenItems(0, 10, 1), testutils.GenItems(64, 74, 1)...)
+	require.NoError(t, queue.Push(exp))
+	require.NoError(t, queue.Push(testutils.GenItems(32, 33, 1)))
+	_, err = queue.Delete(32, 32)
+	require.NoError(t, err)
+
+	bigBlob := make([]byte, 1024*1024)
+	var got Items
+	var pushed bool
+	require.NoError(t, queue.Read(-1, func(tx Transaction, items Items) (ReadOp, error) {
+		before := items.Copy()
+		if !pushed {
+			pushed = true
+
+			// grows the current bucket, loads bucket 32 (which would close
+			// the current one) and pushes to bucket 64, which is read later:
+			var requeue Items
+			for idx := 0; idx < 16; idx++ {
+				requeue = append(requeue, Item{Key: Key(20 + idx%5), Blob: bigBlob})
+			}
+
+			requeue = append(requeue, Item{Key: 40}, Item{Key: 65}, Item{Key: 80})
+			require.NoError(t, tx.Push(requeue))
+		}
+
+		// the items are still valid:
+		require.Equal(t, before, items)
+		got = append(got, before...)
+		return ReadOpPop, nil
+	}))
+
+	require.Equal(t, exp, got)
+	require.Equal(t, 19, queue.Len())
+
+	got, err = PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Len(t, got, 19)
+	require.Equal(t, Key(20), got[0].Key)
+	require.Equal(t, Key(80), got[len(got)-1].Key)
+}
+
+func TestAPIReadStats(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	// two overlapping batches in the first bucket, one in the second:
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 2)))
+	require.NoError(t, queue.Push(testutils.GenItems(1, 100, 2)))
+	require.NoError(t, queue.Push(testutils.GenItems(100, 150, 1)))
+	require.NoError(t, queue.Close())
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+
+	var stats []ReadStats
+	err = queue.Read(-1, func(tx Transaction, items Items) (ReadOp, error) {
+		stats = append(stats, tx.Stats())
+		return ReadOpPeek, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []ReadStats{{
+		Buckets: 1,
+		Batches: 2,
+		Bytes:   int64(testutils.GenItems(0, 100, 1).StorageSize()),
+		Loaded:  1,
+	}, {
+		Buckets: 2,
+		Batches: 3,
+		Bytes:   int64(testutils.GenItems(0, 150, 1).StorageSize()),
+		Loaded:  2,
+	}}, stats)
+
+	// both buckets are loaded now:
+	err = queue.Read(10, func(tx Transaction, items Items) (ReadOp, error) {
+		require.Equal(t, 0, tx.Stats().Loaded)
+		require.Equal(t, 1, tx.Stats().Buckets)
+		return ReadOpPop, nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIMetrics(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.MaxParallelOpenBuckets = 1
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, Metrics{OpenBucketLimit: 1}, queue.Metrics())
+
+	require.NoError(t, queue.Push(testutils.GenItems(0, 200, 1)))
+	require.NoError(t, queue.Push(testutils.GenItems(200, 300, 1)))
+	require.NoError(t, queue.Sync())
+
+	// peeks do not count as processed items:
+	_, err = PeekCopy(queue, 50)
+	require.NoError(t, err)
+	_, err = PopCopy(queue, 150)
+	require.NoError(t, err)
+
+	m := queue.Metrics()
+	require.Equal(t, uint64(2), m.Push.Calls)
+	require.Equal(t, uint64(300), m.Push.Items)
+	require.Equal(t, 150.0, m.Push.AvgBatchSize)
+	require.Greater(t, m.Push.ItemsPerSecond, 0.0)
+	require.Greater(t, m.Push.MaxLatency, time.Duration(0))
+	require.GreaterOrEqual(t, m.Push.MaxLatency, m.Push.AvgLatency)
+
+	// PeekCopy() does not go through Read():
+	require.Equal(t, uint64(1), m.Read.Calls)
+	require.Equal(t, uint64(150), m.Read.Items)
+	require.Equal(t, uint64(1), m.Sync.Calls)
+
+	// every opened bucket is either still loaded, evicted or removed:
+	require.GreaterOrEqual(t, m.BucketsOpened, uint64(4))
+	require.Equal(t, m.BucketsOpened, m.BucketsEvicted+m.BucketsRemoved+uint64(m.BucketsLoaded))
+	require.Equal(t, uint64(1), m.BucketsRemoved)
+	require.Equal(t, 1, m.BucketsLoaded)
+	require.Equal(t, 2, m.Buckets)
+
+	// with a single open bucket, reading evicts what pushing loaded:
+	require.Equal(t, m.BucketsOpened, m.BucketsClosed+uint64(m.BucketsLoaded))
+	require.Greater(t, m.BucketsReopened, uint64(0))
+	require.LessOrEqual(t, m.BucketsReopened, m.BucketsEvicted)
+
+	// pushing to the loaded bucket does not need to open it:
+	require.NoError(t, queue.Push(testutils.GenItems(150, 151, 1)))
+	require.Equal(t, m.BucketHits+1, queue.Metrics().BucketHits)
+	require.Equal(t, m.BucketsOpened, queue.Metrics().BucketsOpened)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIPublishExpvar(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := Open(dir, DefaultOptions())
+	require.NoError(t, err)
+
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 100, 1)))
+	_, err = PopCopy(queue, 10)
+	require.NoError(t, err)
+
+	require.NoError(t, queue.PublishExpvar("timeq-apitest"))
+	require.Error(t, queue.PublishExpvar("timeq-apitest"))
+
+	// only one of several concurrent calls may publish:
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for idx := range errs {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			errs[idx] = queue.PublishExpvar("timeq-apitest-concurrent")
+		}(idx)
+	}
+
+	wg.Wait()
+	nPublished := 0
+	for _, err := range errs {
+		if err == nil {
+			nPublished++
+		}
+	}
+
+	require.Equal(t, 1, nPublished)
+
+	var stats struct {
+		Len      int            `json:"len"`
+		ForkLens map[string]int `json:"fork_lens"`
+		Metrics  struct {
+			Push struct {
+				Items int
+			}
+		} `json:"metrics"`
+	}
+
+	v := expvar.Get("timeq-apitest")
+	require.NotNil(t, v)
+	require.NoError(t, json.Unmarshal([]byte(v.String()), &stats))
+	require.Equal(t, 90, stats.Len)
+	require.Equal(t, map[string]int{"fork": 100}, stats.ForkLens)
+	require.Equal(t, 100, stats.Metrics.Push.Items)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIOnLag(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.MaxParallelOpenBuckets = 1
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	var lenAlerts, ageAlerts []LagAlert
+	remove := queue.OnLag("fork", LagCondition{MaxLen: 150}, func(alert LagAlert) {
+		lenAlerts = append(lenAlerts, alert)
+	})
+
+	now := Key(1000)
+	queue.OnLag("", LagCondition{
+		MaxAge: 500,
+		Now:    func() Key { return now },
+	}, func(alert LagAlert) {
+		ageAlerts = append(ageAlerts, alert)
+	})
+
+	require.NoError(t, queue.Push(testutils.GenItems(450, 600, 1)))
+	require.Empty(t, lenAlerts)
+
+	// bucket 400 is not loaded anymore, so only its lowest possible key is known:
+	require.Equal(t, []LagAlert{{Lagging: true, Len: 150, OldestKey: 400}}, ageAlerts)
+
+	require.NoError(t, queue.Push(testutils.GenItems(600, 700, 1)))
+	require.Equal(t, []LagAlert{{Fork: "fork", Lagging: true, Len: 250, OldestKey: 400}}, lenAlerts)
+
+	// no repeated alerts while still lagging:
+	require.NoError(t, queue.Push(testutils.GenItems(700, 710, 1)))
+	require.Len(t, lenAlerts, 1)
+
+	// catching up sends another alert:
+	_, err = PopCopy(fork, 200)
+	require.NoError(t, err)
+	require.Len(t, lenAlerts, 2)
+	require.Equal(t, LagAlert{Fork: "fork", Lagging: false, Len: 60, OldestKey: 650}, lenAlerts[1])
+
+	_, err = PopCopy(queue, 60)
+	require.NoError(t, err)
+	require.Len(t, ageAlerts, 2)
+	require.Equal(t, LagAlert{Lagging: false, Len: 200, OldestKey: 510}, ageAlerts[1])
+
+	// removed watches are not called anymore:
+	remove()
+	require.NoError(t, queue.Push(testutils.GenItems(710, 1000, 1)))
+	require.Len(t, lenAlerts, 2)
+	require.NoError(t, queue.Close())
+}
 
-	var executed bool
-	require.NoError(t, queue.Read(1, func(_ Transaction, items Items) (ReadOp, error) {
-		require.Equal(t, zeroKey, items)
-		executed = true
-		return ReadOpPop, nil
+func TestAPIMaintain(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.MaxParallelOpenBuckets = 2
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	// many small batches in one bucket and another bucket:
+	for idx := 0; idx < 100; idx++ {
+		require.NoError(t, queue.Push(testutils.GenItems(idx, idx+1, 1)))
+	}
+	require.NoError(t, queue.Push(testutils.GenItems(100, 200, 1)))
+
+	// pop one by one, so the index log of the first bucket grows:
+	for idx := 0; idx < 90; idx++ {
+		_, err := PopCopy(queue, 1)
+		require.NoError(t, err)
+	}
+
+	idxPath := filepath.Join(dir, Key(0).String(), "idx.log")
+	infoBefore, err := os.Stat(idxPath)
+	require.NoError(t, err)
+	require.NoError(t, queue.Maintain())
+	infoAfter, err := os.Stat(idxPath)
+	require.NoError(t, err)
+	require.Less(t, infoAfter.Size(), infoBefore.Size()/4)
+
+	// empty bucket 100 for the queue and then remove the fork while
+	// the bucket is not loaded. This leaves an empty bucket behind.
+	_, err = queue.Delete(100, 199)
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, fork.Remove())
+	require.DirExists(t, filepath.Join(dir, Key(100).String()))
+	require.NoError(t, queue.Maintain())
+	require.NoDirExists(t, filepath.Join(dir, Key(100).String()))
+
+	got, err := PopCopy(queue, 100)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(90, 100, 1), got)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPIJanitorRetention(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.JanitorInterval = 5 * time.Millisecond
+	opts.JanitorRetention = time.Hour
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	now := time.Now()
+	old := Key(now.Add(-2 * time.Hour).UnixNano())
+	recent := Key(now.UnixNano())
+	require.NoError(t, queue.Push(Items{
+		{Key: old, Blob: []byte("old")},
+		{Key: recent, Blob: []byte("recent")},
 	}))
 
-	require.True(t, executed)
+	require.Eventually(t, func() bool {
+		return queue.Len() == 1 && fork.Len() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	got, err := PopCopy(fork, 10)
+	require.NoError(t, err)
+	require.Equal(t, Items{{Key: recent, Blob: []byte("recent")}}, got)
 	require.NoError(t, queue.Close())
 }
 
-func TestAPIForkBasicBeforePush(t *testing.T) {
-	t.Run("push-before-full-Read", func(t *testing.T) {
-		// if we push before fork, the buckets exist & are forked online.
-		testAPIForkBasicBeforePush(t, true, 100, 100)
-	})
-	t.Run("push-after-full-Read", func(t *testing.T) {
-		// if we push after fork, the buckets do not exist & are forked offline.
-		testAPIForkBasicBeforePush(t, false, 100, 100)
-	})
-	t.Run("push-before-partial-Read", func(t *testing.T) {
-		// If the bucket is fully empty, then we do the RemoveFork() offline.
-		testAPIForkBasicBeforePush(t, true, 100, 99)
-	})
-	t.Run("push-after-partial-Read", func(t *testing.T) {
-		// If the bucket is not fully empty, then we do the RemoveFork() online.
-		testAPIForkBasicBeforePush(t, false, 100, 99)
+func TestAPIOnExpire(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fail := true
+	expired := make(map[ForkName]Items)
+
+	opts := DefaultOptions()
+	opts.JanitorRetention = time.Hour
+	opts.OnExpire = func(fork ForkName, items Items) error {
+		if fail && fork == "" {
+			return errors.New("archive is down")
+		}
+
+		expired[fork] = append(expired[fork], items.Copy()...)
+		return nil
+	}
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	now := time.Now()
+	old := Key(now.Add(-2 * time.Hour).UnixNano())
+	recent := Key(now.UnixNano())
+	require.NoError(t, queue.Push(Items{
+		{Key: old, Blob: []byte("old")},
+		{Key: recent, Blob: []byte("recent")},
+	}))
+
+	// the queue keeps its items if they could not be archived:
+	require.Error(t, queue.Maintain())
+	require.Equal(t, 2, queue.Len())
+	require.Equal(t, 1, fork.Len())
+
+	fail = false
+	require.NoError(t, queue.Maintain())
+	require.Equal(t, 1, queue.Len())
+
+	exp := Items{{Key: old, Blob: []byte("old")}}
+	require.Equal(t, map[ForkName]Items{"": exp, "fork": exp}, expired)
+	require.NoError(t, queue.Close())
+}
+
+func TestAPITrimOnClose(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.TrimOnClose = true
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	_, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 200, 1)))
+	_, err = queue.Delete(0, 99)
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
+
+	// bucket 0 is now only used by the fork; remove it offline:
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, fork.Remove())
+
+	// some left-over files of unknown forks:
+	bucket100 := filepath.Join(dir, Key(100).String())
+	ghostPath := filepath.Join(bucket100, "ghost.idx.log")
+	require.NoError(t, os.WriteFile(ghostPath, nil, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(bucket100, "ghost.idx.snap"), nil, 0600))
+
+	require.DirExists(t, filepath.Join(dir, Key(0).String()))
+	require.NoError(t, queue.Close())
+	require.NoDirExists(t, filepath.Join(dir, Key(0).String()))
+	require.NoFileExists(t, ghostPath)
+	require.NoFileExists(t, filepath.Join(bucket100, "ghost.idx.snap"))
+	require.FileExists(t, filepath.Join(bucket100, "idx.log"))
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.Empty(t, queue.Forks())
+	got, err := PopCopy(queue, 200)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(100, 200, 1), got)
+
+	// closing an empty queue leaves no bucket dirs behind:
+	require.NoError(t, queue.Close())
+	ents, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, ents, 6) // split.conf, names.conf, format.version, queue.lock, writer.lock and totals.state
+}
+
+// strayFaultFS fails to remove files named "stray".
+type strayFaultFS struct {
+	FS
+}
+
+func (f strayFaultFS) Remove(path string) error {
+	if filepath.Base(path) == "stray" {
+		return errors.New("injected fault")
+	}
+
+	return f.FS.Remove(path)
+}
+
+func TestAPITrimOnCloseFailure(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.TrimOnClose = true
+	opts.FS = strayFaultFS{FS: OSFS()}
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 200, 1)))
+
+	strayPath := filepath.Join(dir, Key(100).String(), "stray")
+	require.NoError(t, os.WriteFile(strayPath, nil, 0600))
+
+	// the rest of closing still happens:
+	require.Error(t, queue.Close())
+	require.FileExists(t, filepath.Join(dir, lenManifestFile))
+	require.NoError(t, queue.Close())
+
+	require.NoError(t, os.Remove(strayPath))
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	got, err := PopCopy(queue, 200)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 200, 1), got)
+	require.NoError(t, queue.Close())
+}
+
+type failingReplica struct{}
+
+func (failingReplica) Push(_ Items) error {
+	return errors.New("replica is down")
+}
+
+func TestAPIReplicas(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	r1, err := Open(filepath.Join(dir, "r1"), DefaultOptions())
+	require.NoError(t, err)
+	r2, err := Open(filepath.Join(dir, "r2"), DefaultOptions())
+	require.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.Replicas = []Replica{r1, failingReplica{}, r2}
+	opts.MinReplicaAcks = 4
+	_, err = Open(filepath.Join(dir, "queue"), opts)
+	require.Error(t, err)
+
+	opts.MinReplicaAcks = 2
+	queue, err := Open(filepath.Join(dir, "queue"), opts)
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 100, 1)
+	require.NoError(t, queue.Push(exp))
+	for _, replica := range []*Queue{r1, r2} {
+		got, err := PeekCopy(replica, -1)
+		require.NoError(t, err)
+		require.Equal(t, exp, got)
+	}
+
+	// re-queues in a transaction are not replicated:
+	err = queue.Read(10, func(tx Transaction, items Items) (ReadOp, error) {
+		return ReadOpPop, tx.Push(items)
 	})
+	require.NoError(t, err)
+	require.Equal(t, 100, r1.Len())
+	require.NoError(t, queue.Close())
+
+	opts.MinReplicaAcks = 3
+	queue, err = Open(filepath.Join(dir, "queue"), opts)
+	require.NoError(t, err)
+
+	// the items are still pushed locally:
+	err = queue.Push(testutils.GenItems(100, 200, 1))
+	require.ErrorIs(t, err, ErrReplication)
+
+	var replErr *ReplicationError
+	require.ErrorAs(t, err, &replErr)
+	require.Equal(t, 2, replErr.Acks)
+	require.Equal(t, 3, replErr.Needed)
+	require.Equal(t, 200, queue.Len())
+	require.NoError(t, queue.Close())
+	require.NoError(t, r1.Close())
+	require.NoError(t, r2.Close())
+}
+
+func TestAPIReplicasSetOptions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	replica, err := Open(filepath.Join(dir, "replica"), DefaultOptions())
+	require.NoError(t, err)
+
+	opts := DefaultOptions()
+	opts.Replicas = []Replica{replica, failingReplica{}}
+	opts.MinReplicaAcks = 1
+	queue, err := Open(filepath.Join(dir, "queue"), opts)
+	require.NoError(t, err)
+
+	// replicating happens without the lock; should be fine with -race:
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for idx := 0; idx < 100; idx++ {
+			require.NoError(t, queue.SetOptions(OptionsPatch{Logger: NullLogger()}))
+		}
+	}()
+
+	for idx := 0; idx < 100; idx++ {
+		require.NoError(t, queue.Push(testutils.GenItems(idx, idx+1, 1)))
+	}
+
+	<-done
+	require.NoError(t, queue.Close())
+	require.Equal(t, 100, replica.Len())
+	require.NoError(t, replica.Close())
+}
+
+func TestAPIPromoteDemote(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	follower, err := Open(filepath.Join(dir, "follower"), DefaultOptions())
+	require.NoError(t, err)
+	require.False(t, follower.Follower())
+	require.NoError(t, follower.Demote())
+	require.True(t, follower.Follower())
+	require.ErrorIs(t, follower.Push(testutils.GenItems(0, 10, 1)), ErrFollower)
+
+	opts := DefaultOptions()
+	opts.Replicas = []Replica{follower}
+	opts.MinReplicaAcks = 1
+	primary, err := Open(filepath.Join(dir, "primary"), opts)
+	require.NoError(t, err)
+	require.NoError(t, primary.Push(testutils.GenItems(0, 10, 1)))
+	require.Equal(t, 10, follower.Len())
+
+	// the primary fails; the follower takes over:
+	epoch, err := follower.Promote()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), epoch)
+	require.False(t, follower.Follower())
+	require.NoError(t, follower.Push(testutils.GenItems(10, 20, 1)))
+
+	// the old primary comes back, but cannot write to the replica anymore:
+	err = primary.Push(testutils.GenItems(20, 30, 1))
+	require.ErrorIs(t, err, ErrReplication)
+	require.ErrorIs(t, err, ErrFenced)
+	require.Equal(t, 20, follower.Len())
+
+	// the role survives a restart; the old primary is a replica now:
+	require.NoError(t, follower.Close())
+	opts.Replicas = []Replica{primary}
+	follower, err = Open(filepath.Join(dir, "follower"), opts)
+	require.NoError(t, err)
+	require.False(t, follower.Follower())
+	require.Equal(t, uint64(1), follower.Epoch())
+
+	// the old primary becomes a follower of the new one once it gets a batch:
+	require.NoError(t, follower.Push(testutils.GenItems(30, 40, 1)))
+	require.True(t, primary.Follower())
+	require.Equal(t, uint64(1), primary.Epoch())
+	require.ErrorIs(t, primary.Push(testutils.GenItems(40, 50, 1)), ErrFollower)
+	require.Equal(t, 30, primary.Len())
+
+	// batches of older epochs are rejected, even by followers:
+	require.ErrorIs(t, primary.PushReplicated(0, testutils.GenItems(50, 60, 1)), ErrFenced)
+
+	// two primaries of the same epoch reject each other:
+	other, err := Open(filepath.Join(dir, "other"), DefaultOptions())
+	require.NoError(t, err)
+	_, err = other.Promote()
+	require.NoError(t, err)
+	require.ErrorIs(t, other.PushReplicated(1, testutils.GenItems(50, 60, 1)), ErrFenced)
+	require.Equal(t, 0, other.Len())
+
+	require.NoError(t, follower.Close())
+	require.NoError(t, primary.Close())
+	require.NoError(t, other.Close())
+}
+
+func TestAPIBucketNameConf(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketNameConf = TimeBucketNameConf()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	items := Items{
+		{Key: Key(base.UnixNano()), Blob: []byte("a")},
+		{Key: Key(base.Add(time.Hour).UnixNano()), Blob: []byte("b")},
+	}
+
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(items))
+	require.NoError(t, queue.Close())
+
+	// names are derived from the bucket key, which is a bit before the item's key:
+	for _, it := range items {
+		bucketKey := opts.BucketSplitConf.Func(it.Key)
+		name := opts.BucketNameConf.Format(bucketKey)
+		require.DirExists(t, filepath.Join(dir, name))
+		require.True(t, strings.HasPrefix(name, bucketKey.Format("2006-01-02T15-")), name)
+
+		parsed, err := opts.BucketNameConf.Parse(name)
+		require.NoError(t, err)
+		require.Equal(t, bucketKey, parsed)
+
+		parsed, err = ParseBucketName(name)
+		require.NoError(t, err)
+		require.Equal(t, bucketKey, parsed)
+
+		parsed, err = ParseBucketName(bucketKey.String())
+		require.NoError(t, err)
+		require.Equal(t, bucketKey, parsed)
+	}
+
+	_, err = ParseBucketName("split.conf")
+	require.Error(t, err)
+
+	// the names cannot be changed after the fact:
+	_, err = Open(dir, DefaultOptions())
+	require.ErrorIs(t, err, ErrChangedBucketNames)
+
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	got, err := PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Equal(t, items, got)
+	require.NoError(t, queue.Close())
 }
 
-func testAPIForkBasicBeforePush(t *testing.T, pushBefore bool, pushn, popn int) {
+func TestAPIReadAhead(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	exp := testutils.GenItems(0, pushn, 1)
+	opts := DefaultOptions()
+	opts.BucketSplitConf = ShiftBucketSplitConf(5)
+	opts.MaxParallelOpenBuckets = 2
+	opts.ReadAhead = 64 * 1024
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
 
-	queue, err := Open(dir, DefaultOptions())
+	exp := testutils.GenItems(0, 256, 1)
+	require.NoError(t, queue.Push(exp))
+	require.NoError(t, queue.Close())
+
+	// reopen, so that most buckets are not loaded yet:
+	queue, err = Open(dir, opts)
 	require.NoError(t, err)
+	defer queue.Close()
 
-	// At the beginning, no forks should exist.
-	require.Equal(t, []ForkName{}, queue.Forks())
+	var got Items
+	for queue.Len() > 0 {
+		require.NoError(t, queue.Read(50, func(tx Transaction, items Items) (ReadOp, error) {
+			got = append(got, items.Copy()...)
+			if len(got) == 100 {
+				// pushes to the bucket that is being read ahead:
+				require.NoError(t, tx.Push(Items{Item{Key: 130, Blob: []byte("x")}}))
+			}
 
-	if pushBefore {
-		require.NoError(t, queue.Push(exp))
+			return ReadOpPop, nil
+		}))
 	}
 
-	fork, err := queue.Fork("fork")
+	require.Len(t, got, len(exp)+1)
+	pushed := slices.IndexFunc(got, func(it Item) bool { return string(it.Blob) == "x" })
+	require.Equal(t, Key(130), got[pushed].Key)
+	require.Equal(t, exp, slices.Delete(got, pushed, pushed+1))
+}
+
+func TestAPIMoveFork(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
-	require.Equal(t, []ForkName{"fork"}, queue.Forks())
+	defer os.RemoveAll(dir)
 
-	// fork twice should not yield an error (since it's a no-op)
-	_, err = queue.Fork("fork")
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+
+	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	// consumers should also exist, even if we start later.
-	if !pushBefore {
-		require.NoError(t, queue.Push(exp))
+	forkA, err := queue.Fork("a")
+	require.NoError(t, err)
+	forkB, err := queue.Fork("b")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 30, 1)))
+
+	drain := func(c Consumer, n int) Items {
+		var got Items
+		require.NoError(t, c.Read(n, func(_ Transaction, items Items) (ReadOp, error) {
+			got = append(got, items.Copy()...)
+			return ReadOpPop, nil
+		}))
+		return got
 	}
 
-	got1, err := PopCopy(fork, popn)
+	// a is responsible for 0-19 and consumed some, b for 20-29:
+	_, err = forkA.Delete(20, 29)
+	require.NoError(t, err)
+	require.Len(t, drain(forkA, 5), 5)
+	_, err = forkB.Delete(0, 19)
 	require.NoError(t, err)
 
-	got2, err := PopCopy(queue, popn)
+	nmoved, err := queue.MoveFork("a", "b", 10, 14)
 	require.NoError(t, err)
+	require.Equal(t, 5, nmoved)
+	require.Equal(t, 10, forkA.Len())
+	require.Equal(t, 15, forkB.Len())
 
-	require.Equal(t, exp[:popn], got1)
-	require.Equal(t, exp[:popn], got2)
+	// nothing left to move:
+	nmoved, err = queue.MoveFork("a", "b", 10, 14)
+	require.NoError(t, err)
+	require.Equal(t, 0, nmoved)
 
-	require.NoError(t, fork.Remove())
-	require.Equal(t, []ForkName{}, queue.Forks())
+	// items that a has already are not added twice:
+	nmoved, err = queue.MoveFork("", "a", 0, 29)
+	require.NoError(t, err)
+	require.Equal(t, 30, nmoved)
+	require.Equal(t, 0, queue.Len())
+	require.Equal(t, 30, forkA.Len())
 
-	items, err := PopCopy(fork, popn)
-	require.Equal(t, ErrNoSuchFork, err)
-	require.Empty(t, items)
+	_, err = queue.MoveFork("a", "nope", 0, 29)
+	require.ErrorIs(t, err, ErrNoSuchFork)
+	_, err = queue.MoveFork("a", "a", 0, 29)
+	require.Error(t, err)
 
+	// survives a reopen:
 	require.NoError(t, queue.Close())
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	forkA, err = queue.Fork("a")
+	require.NoError(t, err)
+	forkB, err = queue.Fork("b")
+	require.NoError(t, err)
+
+	exp := append(testutils.GenItems(10, 15, 1), testutils.GenItems(20, 30, 1)...)
+	require.Equal(t, exp, drain(forkB, -1))
+	require.Equal(t, testutils.GenItems(0, 30, 1), drain(forkA, -1))
+	require.Equal(t, 0, queue.Len())
 }
 
-func TestAPIChainFork(t *testing.T) {
+func TestAPIForkExpiry(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	queue, err := Open(dir, DefaultOptions())
-	require.NoError(t, err)
-
-	exp := testutils.GenItems(0, 100, 1)
-	require.NoError(t, queue.Push(exp))
+	expired := make(map[ForkName]time.Time)
 
-	var forks []*Fork
-	var forkNames []ForkName
-	var consumers []Consumer
+	opts := DefaultOptions()
+	opts.ForkExpiry = 100 * time.Millisecond
+	opts.OnForkExpire = func(fork ForkName, lastRead time.Time) {
+		expired[fork] = lastRead
+	}
 
-	for idx := 0; idx < 10; idx++ {
-		forkName := ForkName(fmt.Sprintf("%d", idx))
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
 
-		var c Consumer = queue
-		if len(forks) > 0 {
-			c = forks[len(forks)-1]
-		}
+	idle, err := queue.Fork("idle")
+	require.NoError(t, err)
+	busy, err := queue.Fork("busy")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
 
-		popped, err := PopCopy(c, 10)
-		require.NoError(t, err)
-		require.Len(t, popped, 10)
-		require.Equal(t, exp[idx*10:idx*10+10], popped)
+	created, err := idle.LastRead()
+	require.NoError(t, err)
 
-		fork, err := c.Fork(forkName)
-		require.NoError(t, err)
+	time.Sleep(opts.ForkExpiry)
+	_, err = PopCopy(busy, 5)
+	require.NoError(t, err)
 
-		forkNames = append(forkNames, forkName)
-		forks = append(forks, fork)
-		consumers = append(consumers, c)
-	}
+	// the queue itself is never expired:
+	require.NoError(t, queue.Maintain())
+	require.Equal(t, map[ForkName]time.Time{"idle": created}, expired)
+	require.Equal(t, []ForkName{"busy"}, queue.Forks())
+	_, err = idle.LastRead()
+	require.ErrorIs(t, err, ErrNoSuchFork)
+	require.Equal(t, 10, queue.Len())
 
-	require.Equal(t, forkNames, queue.Forks())
-	for idx, consumer := range consumers {
-		require.Equal(t, 90-10*idx, consumer.Len())
-	}
+	lastRead, err := busy.LastRead()
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
 
-	for _, fork := range forks {
-		require.NoError(t, fork.Remove())
-	}
+	// the read times survive a reopen:
+	opts.ForkExpiry = time.Hour
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	defer queue.Close()
 
-	require.NoError(t, queue.Close())
+	busy, err = queue.Fork("busy")
+	require.NoError(t, err)
+	reopened, err := busy.LastRead()
+	require.NoError(t, err)
+	require.True(t, lastRead.Equal(reopened))
+	require.Equal(t, 5, busy.Len())
 }
 
-func TestAPINegativKeys(t *testing.T) {
+func TestAPITotals(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	queue, err := Open(dir, DefaultOptions())
+	opts := DefaultOptions()
+	queue, err := Open(dir, opts)
 	require.NoError(t, err)
 
-	require.NoError(t, queue.Push(testutils.GenItems(-100, +100, 1)))
-	require.NoError(t, queue.Push(testutils.GenItems(-100, +100, 1)))
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
 
-	for idx := 0; idx < 40; idx++ {
-		require.NoError(t, queue.Read(10, func(_ Transaction, items Items) (ReadOp, error) {
-			for itemIdx, item := range items {
-				a := (idx*10 + itemIdx - 200)
-				if a <= 0 {
-					// trick to balance out the shift in negative numbers:
-					a -= 1
-				}
-				exp := a / 2
-				require.Equal(t, Key(exp), item.Key)
-			}
-			return ReadOpPop, nil
-		}))
+	items := testutils.GenItems(0, 100, 1)
+	require.NoError(t, queue.Push(items))
+	_, err = PopCopy(queue, 60)
+	require.NoError(t, err)
+	_, err = PopCopy(fork, 10)
+	require.NoError(t, err)
+	_, err = PeekCopy(fork, 10)
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
+
+	// counting goes on after a reopen:
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	require.NoError(t, queue.Push(items))
+	_, err = PopCopy(queue, 20)
+	require.NoError(t, err)
+
+	volume := func(items Items) Volume {
+		return Volume{Items: uint64(len(items)), Bytes: uint64(items.StorageSize())}
 	}
 
-	require.NoError(t, queue.Close())
+	// the lowest keys are from the second push now:
+	popped := volume(append(items[:60:60], items[:20]...))
+	require.Equal(t, Totals{
+		Pushed: volume(append(items, items...)),
+		Popped: map[ForkName]Volume{
+			"":     popped,
+			"fork": volume(items[:10]),
+		},
+	}, queue.Metrics().Totals)
+
+	// the counters of removed forks are gone:
+	fork, err = queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, fork.Remove())
+	require.Equal(t, map[ForkName]Volume{"": popped}, queue.Metrics().Totals.Popped)
 }
 
-func TestAPIZeroLengthPayload(t *testing.T) {
+func TestAPIVerifyOnOpen(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	queue, err := Open(dir, DefaultOptions())
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(100)
+	opts.Logger = NullLogger()
+
+	queue, err := Open(dir, opts)
 	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 200, 1)))
+	require.NoError(t, queue.Close())
 
-	exp := Items{
-		Item{
-			Key:  123,
-			Blob: []byte{},
-		},
-	}
-	require.NoError(t, queue.Push(exp))
+	// wrong counts in the manifest are corrected:
+	manifestPath := filepath.Join(dir, lenManifestFile)
+	manifest, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	manifest = bytes.ReplaceAll(manifest, []byte("\t100\t"), []byte("\t90\t"))
+	require.NoError(t, os.WriteFile(manifestPath, manifest, 0600))
 
-	got, err := PopCopy(queue, 1)
+	opts.VerifyOnOpen = VerifyQuick
+	queue, err = Open(dir, opts)
 	require.NoError(t, err)
-	require.Equal(t, exp, got)
-}
+	require.Equal(t, 200, queue.Len())
+	require.NoError(t, queue.Close())
 
-func assertBucketExistence(t *testing.T, queue *Queue, expectExist bool) {
-	buckDir := queue.buckets.buckPath(0)
-	if _, err := os.Stat(buckDir); err != nil {
-		if expectExist {
-			require.Fail(t, "bucket should exist, but does not")
-		}
-	} else {
-		if !expectExist {
-			require.Fail(t, "bucket should not exist, but does")
-		}
-	}
+	// an index that points beyond the value log is not:
+	require.NoError(t, os.Truncate(filepath.Join(dir, Key(100).String(), dataLogName), 100))
+	_, err = Open(dir, opts)
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	opts.VerifyOnOpen = VerifyOff
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
+
+	opts.ErrorMode = ErrorModeContinue
+	opts.VerifyOnOpen = VerifyFull
+	queue, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Close())
 }
 
-func TestAPIForkBucketDeleteWhenEmpty(t *testing.T) {
+func TestAPIReindex(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	const N = 10
-	exp := testutils.GenItems(0, N, 1)
-
-	queue, err := Open(dir, DefaultOptions())
-	require.NoError(t, err)
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(50)
 
-	f1, err := queue.Fork("hänsel")
+	queue, err := Open(dir, opts)
 	require.NoError(t, err)
+	defer queue.Close()
 
-	f2, err := queue.Fork("gretel")
+	fork, err := queue.Fork("fork")
 	require.NoError(t, err)
-	assertBucketExistence(t, queue, false)
 
+	exp := testutils.GenItems(0, 100, 1)
 	require.NoError(t, queue.Push(exp))
-	assertBucketExistence(t, queue, true)
 
-	_, err = PopCopy(f1, N)
+	_, err = PopCopy(queue, 30)
+	require.NoError(t, err)
+	_, err = fork.Delete(60, 69)
 	require.NoError(t, err)
-	assertBucketExistence(t, queue, true)
 
-	_, err = PopCopy(f2, N)
+	// only the bucket of key 60 gets its items back:
+	require.NoError(t, queue.ReindexBucket(60))
+	require.Equal(t, 70, queue.Len())
+	require.Equal(t, 100, fork.Len())
+
+	require.NoError(t, queue.ReindexAll())
+	require.Equal(t, 100, queue.Len())
+
+	got, err := PopCopy(queue, -1)
 	require.NoError(t, err)
-	assertBucketExistence(t, queue, true)
+	require.Equal(t, exp, got)
 
-	_, err = PopCopy(queue, N)
+	got, err = PopCopy(fork, -1)
 	require.NoError(t, err)
+	require.Equal(t, exp, got)
 
-	assertBucketExistence(t, queue, false)
+	require.Error(t, queue.ReindexBucket(1000))
+	violations, err := queue.CheckInvariants()
+	require.NoError(t, err)
+	require.Empty(t, violations)
 }
 
-func TestAPIForkBucketDeleteOnRemoveFork(t *testing.T) {
+func TestAPICoalescer(t *testing.T) {
+	t.Parallel()
+
 	dir, err := os.MkdirTemp("", "timeq-apitest")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	const N = 10
-	exp := testutils.GenItems(0, N, 1)
-
 	queue, err := Open(dir, DefaultOptions())
 	require.NoError(t, err)
 
-	f1, err := queue.Fork("hänsel")
-	require.NoError(t, err)
+	coalescer := queue.NewCoalescer(CoalesceOptions{MaxDelay: time.Hour})
 
-	f2, err := queue.Fork("gretel")
-	require.NoError(t, err)
-	assertBucketExistence(t, queue, false)
+	var wg sync.WaitGroup
+	for idx := 0; idx < 100; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			require.NoError(t, coalescer.Push(testutils.GenItems(idx, idx+1, 1)))
+		}(idx)
+	}
 
-	require.NoError(t, queue.Push(exp))
-	assertBucketExistence(t, queue, true)
+	wg.Wait()
+	require.Zero(t, queue.Len())
+
+	// all items end up in a single batch:
+	require.NoError(t, coalescer.Flush())
+	require.Equal(t, 100, queue.Len())
+	require.Equal(t, uint64(1), queue.Metrics().Push.Calls)
+
+	// invalid items do not make it into the staging buffer:
+	items := testutils.GenItems(100, 102, 1)
+	items[1].Blob = make([]byte, MaxBlobSize+1)
+	require.ErrorIs(t, coalescer.Push(items), ErrBlobTooBig)
+	require.NoError(t, coalescer.Close())
+	require.Equal(t, 100, queue.Len())
+	require.ErrorIs(t, coalescer.Push(items[:1]), ErrClosed)
+
+	// flush by size and by deadline:
+	coalescer = queue.NewCoalescer(CoalesceOptions{
+		MaxBytes: int(testutils.GenItems(0, 10, 1).StorageSize()),
+		MaxDelay: 10 * time.Millisecond,
+	})
 
-	_, err = PopCopy(queue, N)
-	require.NoError(t, err)
-	assertBucketExistence(t, queue, true)
+	require.NoError(t, coalescer.Push(testutils.GenItems(100, 110, 1)))
+	require.Equal(t, 110, queue.Len())
 
-	require.NoError(t, f1.Remove())
-	assertBucketExistence(t, queue, true)
+	require.NoError(t, coalescer.Push(testutils.GenItems(110, 111, 1)))
+	require.Eventually(t, func() bool {
+		return queue.Len() == 111
+	}, time.Second, time.Millisecond)
 
-	require.NoError(t, f2.Remove())
-	assertBucketExistence(t, queue, false)
+	require.NoError(t, coalescer.Close())
+	got, err := PopCopy(queue, -1)
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(0, 111, 1), got)
+	require.NoError(t, queue.Close())
 }
 
-func TestAPIPushInRead(t *testing.T) {
+func TestAPICoalescerCloseWaitsForTimer(t *testing.T) {
 	t.Parallel()
 
 	dir, err := os.MkdirTemp("", "timeq-apitest")
@@ -1097,18 +5355,37 @@ func TestAPIPushInRead(t *testing.T) {
 	queue, err := Open(dir, DefaultOptions())
 	require.NoError(t, err)
 
-	const N = 10
-	exp := testutils.GenItems(0, N, 1)
-	require.NoError(t, queue.Push(exp))
-	require.NoError(t, queue.Read(N, func(tx Transaction, items Items) (ReadOp, error) {
-		// just push it right back.
-		return ReadOpPop, tx.Push(items)
-	}))
+	var failed atomic.Bool
+	coalescer := queue.NewCoalescer(CoalesceOptions{
+		MaxDelay: time.Millisecond,
+		OnError: func(err error) {
+			failed.Store(true)
+		},
+	})
 
-	require.Equal(t, N, queue.Len())
+	// let the push of the timer hang while it holds the taken items:
+	queue.buckets.mu.Lock()
+	require.NoError(t, coalescer.Push(testutils.GenItems(0, 10, 1)))
+	require.Eventually(t, func() bool {
+		coalescer.mu.Lock()
+		defer coalescer.mu.Unlock()
+		return coalescer.timer == nil
+	}, time.Second, time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- coalescer.Close()
+	}()
+
+	select {
+	case <-closed:
+		require.Fail(t, "close did not wait for the timer push")
+	case <-time.After(50 * time.Millisecond):
+	}
 
-	got, err := PopCopy(queue, N)
-	require.NoError(t, err)
-	require.Equal(t, exp, got)
+	queue.buckets.mu.Unlock()
+	require.NoError(t, <-closed)
+	require.False(t, failed.Load())
+	require.Equal(t, 10, queue.Len())
 	require.NoError(t, queue.Close())
 }
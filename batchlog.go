@@ -0,0 +1,168 @@
+package timeq
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/sahib/timeq/item"
+)
+
+const (
+	pushStampsName = "push.log"
+	seqLogName     = "seq.log"
+
+	// offset (8) and value (8) of a batch.
+	batchEntrySize = 8 + 8
+)
+
+type batchEntry struct {
+	Off item.Off
+	Val uint64
+}
+
+// batchLog is an append-only log of a value for each batch in a bucket,
+// ordered by the offset of the batch in the value log. It stores the push
+// times (see Options.RecordPushTime) and the sequence numbers (see
+// Options.RecordSequence) of the batches. An entry is written before its
+// batch, so after a crash there might be an entry without a batch, but never
+// the other way round. Such entries are shadowed by the entry of the next push.
+type batchLog struct {
+	fd      *os.File
+	sync    bool
+	entries []batchEntry
+}
+
+func openBatchLog(fsys FS, path string, sync bool) (*batchLog, error) {
+	fd, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadBatchLog(fd, sync, true)
+}
+
+// openBatchLogReadOnly opens the batch log at `path` for read-only queues.
+// Add() fails and a partial entry at the end is skipped instead of cut off.
+func openBatchLogReadOnly(fsys FS, path string) (*batchLog, error) {
+	fd, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadBatchLog(fd, false, false)
+}
+
+func loadBatchLog(fd *os.File, sync, repair bool) (*batchLog, error) {
+	data, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, errors.Join(err, fd.Close())
+	}
+
+	// A partial entry at the end is from a crash during the write. Read-only
+	// queues skip it, the writer might still be writing it.
+	if rest := len(data) % batchEntrySize; rest > 0 {
+		data = data[:len(data)-rest]
+		if repair {
+			if err := fd.Truncate(int64(len(data))); err != nil {
+				return nil, errors.Join(err, fd.Close())
+			}
+		}
+	}
+
+	bl := &batchLog{
+		fd:      fd,
+		sync:    sync,
+		entries: make([]batchEntry, 0, len(data)/batchEntrySize),
+	}
+
+	for ; len(data) > 0; data = data[batchEntrySize:] {
+		bl.remember(decodeBatchEntry(data))
+	}
+
+	return bl, nil
+}
+
+func decodeBatchEntry(data []byte) batchEntry {
+	return batchEntry{
+		Off: item.Off(binary.BigEndian.Uint64(data)),
+		Val: binary.BigEndian.Uint64(data[8:]),
+	}
+}
+
+// Add notes that the batch at `off` has the value `val`.
+func (bl *batchLog) Add(off item.Off, val uint64) error {
+	var buf [batchEntrySize]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(off))
+	binary.BigEndian.PutUint64(buf[8:], val)
+	if _, err := bl.fd.Write(buf[:]); err != nil {
+		return err
+	}
+
+	bl.remember(batchEntry{Off: off, Val: val})
+	return bl.Sync(false)
+}
+
+func (bl *batchLog) remember(entry batchEntry) {
+	// Entries without batch (see above) have an offset that is >= the one
+	// of the next push. Drop them, so that the entries stay sorted.
+	for len(bl.entries) > 0 && bl.entries[len(bl.entries)-1].Off >= entry.Off {
+		bl.entries = bl.entries[:len(bl.entries)-1]
+	}
+
+	bl.entries = append(bl.entries, entry)
+}
+
+// Get returns the value of the batch that contains the item
+// at `off` or zero if it is not known. Zero is also stored
+// for batches with unknown value.
+func (bl *batchLog) Get(off item.Off) uint64 {
+	idx := sort.Search(len(bl.entries), func(idx int) bool {
+		return bl.entries[idx].Off > off
+	})
+
+	if idx == 0 {
+		return 0
+	}
+
+	return bl.entries[idx-1].Val
+}
+
+func (bl *batchLog) Sync(force bool) error {
+	if !bl.sync && !force {
+		return nil
+	}
+
+	return bl.fd.Sync()
+}
+
+func (bl *batchLog) SetSync(sync bool) {
+	bl.sync = sync
+}
+
+func (bl *batchLog) Close() error {
+	return errors.Join(bl.fd.Sync(), bl.fd.Close())
+}
+
+// readBatchLogMax returns the highest value in the batch log at `path`
+// without opening it for writing. A missing log has the maximum zero.
+func readBatchLogMax(fsys FS, path string) (uint64, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	// shadowed entries count too; their value was handed out as well.
+	var highest uint64
+	for ; len(data) >= batchEntrySize; data = data[batchEntrySize:] {
+		highest = max(highest, decodeBatchEntry(data).Val)
+	}
+
+	return highest, nil
+}
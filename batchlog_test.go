@@ -0,0 +1,54 @@
+package timeq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchLogCrash(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), pushStampsName)
+	bl, err := openBatchLog(OSFS(), path, true)
+	require.NoError(t, err)
+	require.Zero(t, bl.Get(0))
+
+	require.NoError(t, bl.Add(0, 100))
+	require.NoError(t, bl.Add(50, 200))
+
+	// batch at 100 was never written, the next push reuses the offset:
+	require.NoError(t, bl.Add(100, 300))
+	require.NoError(t, bl.Add(100, 400))
+	require.NoError(t, bl.Close())
+
+	// crash in the middle of an entry:
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	highest, err := readBatchLogMax(OSFS(), path)
+	require.NoError(t, err)
+	require.Equal(t, uint64(400), highest)
+
+	bl, err = openBatchLog(OSFS(), path, true)
+	require.NoError(t, err)
+	defer bl.Close()
+
+	require.Equal(t, uint64(100), bl.Get(0))
+	require.Equal(t, uint64(100), bl.Get(49))
+	require.Equal(t, uint64(200), bl.Get(50))
+	require.Equal(t, uint64(400), bl.Get(1000))
+
+	// unknown values are stored as zero:
+	require.NoError(t, bl.Add(2000, 0))
+	require.Zero(t, bl.Get(2000))
+
+	highest, err = readBatchLogMax(OSFS(), filepath.Join(t.TempDir(), seqLogName))
+	require.NoError(t, err)
+	require.Zero(t, highest)
+}
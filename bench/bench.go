@@ -0,0 +1,255 @@
+// Package bench measures how fast a queue pushes and pops on this machine.
+//
+// It is meant to compare hardware and options without writing a benchmark
+// first. The workload is simple: Items items are pushed in batches of
+// BatchSize and popped again in reads of BatchSize items. The latency of
+// every Push() and Read() call is recorded.
+package bench
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/sahib/timeq"
+)
+
+// Options configure Run().
+type Options struct {
+	// Items is the number of items to push and pop. Defaults to 100000.
+	Items int
+
+	// ItemSize is the size of the blob of each item. Defaults to 40.
+	ItemSize int
+
+	// BatchSize is the number of items per Push() and per Read().
+	// Defaults to 2000.
+	BatchSize int
+
+	// KeyStep is the distance between the keys of consecutive items.
+	// Keys start at the current time in nanoseconds, so together with
+	// Queue.BucketSplitConf this decides how many buckets are used.
+	// Defaults to a millisecond.
+	KeyStep time.Duration
+
+	// Queue is used to open the queue, e.g. to compare sync modes.
+	// Defaults to timeq.DefaultOptions().
+	Queue *timeq.Options
+}
+
+func (opts *Options) setDefaults() {
+	if opts.Items <= 0 {
+		opts.Items = 100000
+	}
+
+	if opts.ItemSize <= 0 {
+		opts.ItemSize = 40
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 2000
+	}
+
+	if opts.KeyStep <= 0 {
+		opts.KeyStep = time.Millisecond
+	}
+
+	if opts.Queue == nil {
+		queueOpts := timeq.DefaultOptions()
+		opts.Queue = &queueOpts
+	}
+}
+
+// Phase is the result of pushing or popping all items.
+type Phase struct {
+	// Items is the number of items that were processed.
+	Items int
+
+	// Bytes is the size of the blobs of all items.
+	Bytes int64
+
+	// Took is how long the whole phase took.
+	Took time.Duration
+
+	// Calls is the number of Push() or Read() calls.
+	Calls int
+
+	// P50, P90 and P99 are percentiles of the latency of a single call.
+	// Max is the slowest call.
+	P50, P90, P99, Max time.Duration
+}
+
+// ItemsPerSecond returns the throughput of the phase.
+func (p Phase) ItemsPerSecond() float64 {
+	if p.Took <= 0 {
+		return 0
+	}
+
+	return float64(p.Items) / p.Took.Seconds()
+}
+
+// BytesPerSecond returns the throughput of the phase in bytes.
+func (p Phase) BytesPerSecond() float64 {
+	if p.Took <= 0 {
+		return 0
+	}
+
+	return float64(p.Bytes) / p.Took.Seconds()
+}
+
+// Result is returned by Run().
+type Result struct {
+	Push Phase
+	Pop  Phase
+}
+
+// Print writes `res` as a small table to `w`.
+func (res Result) Print(w io.Writer) error {
+	if _, err := fmt.Fprintf(
+		w,
+		"%-5s %10s %12s %10s %10s %10s %10s %10s\n",
+		"", "items", "items/s", "MB/s", "p50", "p90", "p99", "max",
+	); err != nil {
+		return err
+	}
+
+	for _, phase := range []struct {
+		name string
+		Phase
+	}{{"push", res.Push}, {"pop", res.Pop}} {
+		if _, err := fmt.Fprintf(
+			w,
+			"%-5s %10d %12.0f %10.2f %10v %10v %10v %10v\n",
+			phase.name,
+			phase.Items,
+			phase.ItemsPerSecond(),
+			phase.BytesPerSecond()/(1024*1024),
+			phase.P50,
+			phase.P90,
+			phase.P99,
+			phase.Max,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run pushes and pops items as configured by `opts` in a new queue
+// in a temporary directory below `dir`, so `dir` decides which disk
+// is measured. The temporary directory is removed afterwards.
+func Run(dir string, opts Options) (res Result, err error) {
+	opts.setDefaults()
+
+	queueDir, err := os.MkdirTemp(dir, "timeq-bench-")
+	if err != nil {
+		return res, err
+	}
+
+	defer func() { err = errors.Join(err, os.RemoveAll(queueDir)) }()
+
+	queue, err := timeq.Open(queueDir, *opts.Queue)
+	if err != nil {
+		return res, fmt.Errorf("open: %w", err)
+	}
+
+	defer func() { err = errors.Join(err, queue.Close()) }()
+
+	res.Push, err = runPush(queue, opts)
+	if err != nil {
+		return res, fmt.Errorf("push: %w", err)
+	}
+
+	res.Pop, err = runPop(queue, opts)
+	if err != nil {
+		return res, fmt.Errorf("pop: %w", err)
+	}
+
+	return res, nil
+}
+
+func runPush(queue *timeq.Queue, opts Options) (Phase, error) {
+	// all items share one buffer; the queue copies them on push.
+	blobs := make([]byte, opts.BatchSize*opts.ItemSize)
+	items := make(timeq.Items, opts.BatchSize)
+	for idx := range items {
+		items[idx].Blob = blobs[idx*opts.ItemSize : (idx+1)*opts.ItemSize]
+	}
+
+	start := time.Now()
+	baseKey := start.UnixNano()
+
+	var latencies []time.Duration
+	for pushed := 0; pushed < opts.Items; pushed += len(items) {
+		items = items[:min(opts.BatchSize, opts.Items-pushed)]
+		for idx := range items {
+			key := baseKey + int64(pushed+idx)*int64(opts.KeyStep)
+			items[idx].Key = timeq.Key(key)
+			if opts.ItemSize >= 8 {
+				binary.BigEndian.PutUint64(items[idx].Blob, uint64(key))
+			}
+		}
+
+		callStart := time.Now()
+		if err := queue.Push(items); err != nil {
+			return Phase{}, err
+		}
+
+		latencies = append(latencies, time.Since(callStart))
+	}
+
+	return newPhase(opts.Items, opts.ItemSize, time.Since(start), latencies), nil
+}
+
+func runPop(queue *timeq.Queue, opts Options) (Phase, error) {
+	start := time.Now()
+
+	var popped int
+	var latencies []time.Duration
+	for popped < opts.Items {
+		poppedBefore := popped
+		callStart := time.Now()
+		err := queue.Read(opts.BatchSize, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+			popped += len(items)
+			return timeq.ReadOpPop, nil
+		})
+
+		if err != nil {
+			return Phase{}, err
+		}
+
+		latencies = append(latencies, time.Since(callStart))
+		if popped == poppedBefore {
+			return Phase{}, fmt.Errorf("only %d of %d items could be popped", popped, opts.Items)
+		}
+	}
+
+	return newPhase(popped, opts.ItemSize, time.Since(start), latencies), nil
+}
+
+func newPhase(items, itemSize int, took time.Duration, latencies []time.Duration) Phase {
+	slices.Sort(latencies)
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	return Phase{
+		Items: items,
+		Bytes: int64(items) * int64(itemSize),
+		Took:  took,
+		Calls: len(latencies),
+		P50:   percentile(0.5),
+		P90:   percentile(0.9),
+		P99:   percentile(0.99),
+		Max:   percentile(1),
+	}
+}
@@ -0,0 +1,46 @@
+package bench
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/sahib/timeq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+
+	queueOpts := timeq.DefaultOptions()
+	queueOpts.SyncMode = timeq.SyncNone
+	res, err := Run(dir, Options{
+		Items:     1000,
+		ItemSize:  16,
+		BatchSize: 300,
+		Queue:     &queueOpts,
+	})
+	require.NoError(t, err)
+
+	for _, phase := range []Phase{res.Push, res.Pop} {
+		require.Equal(t, 1000, phase.Items)
+		require.Equal(t, int64(16000), phase.Bytes)
+		require.Positive(t, phase.Took)
+		require.Positive(t, phase.ItemsPerSecond())
+		require.LessOrEqual(t, phase.P50, phase.P99)
+		require.LessOrEqual(t, phase.P99, phase.Max)
+	}
+
+	require.Equal(t, 4, res.Push.Calls)
+	require.Equal(t, 4, res.Pop.Calls)
+
+	// the queue is removed again:
+	ents, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, ents)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, res.Print(buf))
+	require.Contains(t, buf.String(), "push")
+	require.Contains(t, buf.String(), "pop")
+}
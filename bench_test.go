@@ -126,6 +126,23 @@ func BenchmarkCopyItems(b *testing.B) {
 			globItems = c
 		}
 	})
+
+	b.Run("copy-into", func(b *testing.B) {
+		var dst Items
+		b.ResetTimer()
+		for run := 0; run < b.N; run++ {
+			dst = items.CopyInto(dst)
+			globItems = dst
+		}
+	})
+
+	b.Run("copy-pooled", func(b *testing.B) {
+		b.ResetTimer()
+		for run := 0; run < b.N; run++ {
+			globItems = items.CopyPooled()
+			globItems.Release()
+		}
+	})
 }
 
 var globalKey Key
@@ -0,0 +1,103 @@
+// Package bridge connects timeq to other messaging systems, so that timeq can
+// be used as durable buffer in front of them. It does not depend on any client
+// library; the connection is made with small adapter functions.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sahib/timeq"
+)
+
+// ErrNotConfirmed is returned when the broker rejected (nacked) a message.
+var ErrNotConfirmed = errors.New("message was not confirmed by the broker")
+
+// Confirmation is the pending acknowledgement of a published message.
+// *amqp091.DeferredConfirmation of github.com/rabbitmq/amqp091-go
+// implements it for channels in confirm mode.
+type Confirmation interface {
+	// WaitContext blocks until the broker acked (true) or nacked (false)
+	// the message, or `ctx` is done.
+	WaitContext(ctx context.Context) (bool, error)
+}
+
+// PublishFunc publishes a single item and returns its pending confirmation.
+// The blob of the item is only valid during the call; copy it if your client
+// keeps a reference to it. For RabbitMQ it typically looks like this:
+//
+//	func(ctx context.Context, it timeq.Item) (bridge.Confirmation, error) {
+//		return ch.PublishWithDeferredConfirmWithContext(ctx, "exchange", "key", false, false, amqp.Publishing{
+//			Body:      it.Blob,
+//			Timestamp: time.Unix(0, int64(it.Key)),
+//		})
+//	}
+type PublishFunc func(ctx context.Context, it timeq.Item) (Confirmation, error)
+
+// AMQPForwarder pops items from a queue or fork and publishes them to an AMQP
+// broker. Items are only popped once the broker confirmed all items of their
+// batch. If publishing fails, the batch stays in the queue and is published
+// again on the next try, i.e. items are delivered at least once.
+type AMQPForwarder struct {
+	// Consumer is the queue or fork to forward.
+	Consumer timeq.Consumer
+
+	// Publish sends a single item to the broker.
+	Publish PublishFunc
+
+	// BatchSize is the maximum number of items that are published
+	// before waiting for their confirmations. Defaults to 100.
+	BatchSize int
+
+	// PollInterval is how long Run() waits when the queue is empty
+	// or forwarding failed. Defaults to one second.
+	PollInterval time.Duration
+}
+
+// ForwardBatch publishes the next batch of items and pops them, once they are
+// confirmed. It returns the number of forwarded items, which is zero if the
+// queue is empty.
+func (f *AMQPForwarder) ForwardBatch(ctx context.Context) (int, error) {
+	batchSize := f.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	var nforwarded int
+	err := f.Consumer.Read(batchSize, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+		confirms := make([]Confirmation, 0, len(items))
+		for _, it := range items {
+			confirm, err := f.Publish(ctx, it)
+			if err != nil {
+				return timeq.ReadOpPeek, fmt.Errorf("publish %v: %w", it.Key, err)
+			}
+
+			confirms = append(confirms, confirm)
+		}
+
+		for idx, confirm := range confirms {
+			acked, err := confirm.WaitContext(ctx)
+			if err != nil {
+				return timeq.ReadOpPeek, fmt.Errorf("confirm %v: %w", items[idx].Key, err)
+			}
+
+			if !acked {
+				return timeq.ReadOpPeek, fmt.Errorf("confirm %v: %w", items[idx].Key, ErrNotConfirmed)
+			}
+		}
+
+		nforwarded += len(items)
+		return timeq.ReadOpPop, nil
+	})
+
+	return nforwarded, err
+}
+
+// Run forwards items until `ctx` is done. Errors are passed to `onErr`
+// (if not nil) and forwarding is tried again after PollInterval.
+// It returns ctx.Err() when it stops.
+func (f *AMQPForwarder) Run(ctx context.Context, onErr func(err error)) error {
+	return runLoop(ctx, f.PollInterval, f.ForwardBatch, onErr)
+}
@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sahib/timeq"
+	"github.com/sahib/timeq/timeqtest"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeConfirm struct {
+	acked bool
+}
+
+func (fc fakeConfirm) WaitContext(context.Context) (bool, error) {
+	return fc.acked, nil
+}
+
+type fakeBroker struct {
+	published timeq.Items
+	nack      func(key timeq.Key) bool
+}
+
+func (fb *fakeBroker) Publish(_ context.Context, it timeq.Item) (Confirmation, error) {
+	if fb.nack != nil && fb.nack(it.Key) {
+		return fakeConfirm{acked: false}, nil
+	}
+
+	fb.published = append(fb.published, it.Copy())
+	return fakeConfirm{acked: true}, nil
+}
+
+func TestAMQPForwarderBatch(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	require.NoError(t, timeqtest.FillSequential(queue, 250))
+
+	broker := &fakeBroker{
+		nack: func(key timeq.Key) bool { return key == 120 },
+	}
+
+	fwd := &AMQPForwarder{Consumer: queue, Publish: broker.Publish}
+	n, err := fwd.ForwardBatch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, 150, queue.Len())
+
+	// a nack keeps the whole batch in the queue:
+	n, err = fwd.ForwardBatch(context.Background())
+	require.ErrorIs(t, err, ErrNotConfirmed)
+	require.Equal(t, 0, n)
+	require.Equal(t, 150, queue.Len())
+
+	broker.nack = nil
+	broker.published = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- fwd.Run(ctx, nil)
+	}()
+
+	require.Eventually(t, func() bool { return queue.LenApprox() == 0 }, 5*time.Second, time.Millisecond)
+	cancel()
+	require.True(t, errors.Is(<-done, context.Canceled))
+	require.Equal(t, timeqtest.Sequential(100, 150), broker.published)
+}
+
+func TestAMQPForwarderBatchBuckets(t *testing.T) {
+	opts := timeq.DefaultOptions()
+	opts.BucketSplitConf = timeq.FixedSizeBucketSplitConf(100)
+	queue := timeqtest.TempQueueWithOptions(t, opts)
+
+	// 50 items in each of two buckets:
+	require.NoError(t, queue.Push(timeqtest.Sequential(50, 100)))
+
+	broker := &fakeBroker{}
+	fwd := &AMQPForwarder{Consumer: queue, Publish: broker.Publish}
+	n, err := fwd.ForwardBatch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, 0, queue.Len())
+	require.Equal(t, timeqtest.Sequential(50, 100), broker.published)
+}
@@ -0,0 +1,38 @@
+package bridge
+
+import (
+	"context"
+	"time"
+)
+
+// runLoop calls `batchFn` until `ctx` is done. If a batch had items, the next
+// one is processed right away, otherwise it waits for `pollInterval` first.
+func runLoop(ctx context.Context, pollInterval time.Duration, batchFn func(ctx context.Context) (int, error), onErr func(err error)) error {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		n, err := batchFn(ctx)
+		if err != nil && onErr != nil && ctx.Err() == nil {
+			onErr(err)
+		}
+
+		if n > 0 && err == nil {
+			// there might be more, don't wait.
+			timer.Reset(0)
+			continue
+		}
+
+		timer.Reset(pollInterval)
+	}
+}
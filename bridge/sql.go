@@ -0,0 +1,158 @@
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sahib/timeq"
+)
+
+// OutboxQueries are the SQL statements that OutboxImporter uses.
+// Use PostgresOutboxQueries() or MySQLOutboxQueries() for the usual
+// table layout or write your own for different schemas.
+type OutboxQueries struct {
+	// Select takes the maximum number of rows as only argument and must
+	// return the columns id (integer), created (timestamp) and payload
+	// (bytes) of rows that were not dispatched yet, ordered by id. The
+	// rows should be locked until the transaction ends (FOR UPDATE), so
+	// that several importers do not push the same rows.
+	Select string
+
+	// MarkDispatched takes the id of a row as only argument and must mark
+	// the row as dispatched, so that Select does not return it again.
+	MarkDispatched string
+}
+
+// PostgresOutboxQueries returns queries for a Postgres table with the columns
+// id, created_at, payload and dispatched_at (NULL if not dispatched).
+func PostgresOutboxQueries(table string) OutboxQueries {
+	return OutboxQueries{
+		Select: fmt.Sprintf(
+			"SELECT id, created_at, payload FROM %s WHERE dispatched_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED",
+			table,
+		),
+		MarkDispatched: fmt.Sprintf("UPDATE %s SET dispatched_at = now() WHERE id = $1", table),
+	}
+}
+
+// MySQLOutboxQueries is like PostgresOutboxQueries, but for MySQL 8.
+func MySQLOutboxQueries(table string) OutboxQueries {
+	return OutboxQueries{
+		Select: fmt.Sprintf(
+			"SELECT id, created_at, payload FROM %s WHERE dispatched_at IS NULL ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED",
+			table,
+		),
+		MarkDispatched: fmt.Sprintf("UPDATE %s SET dispatched_at = NOW() WHERE id = ?", table),
+	}
+}
+
+// OutboxImporter moves rows of an outbox table into a queue. The rows are
+// pushed with their creation time as key (in nanoseconds) and the payload as
+// blob. Selecting, pushing and marking the rows as dispatched happens in one
+// database transaction. If the commit fails after the push, the rows are
+// pushed again on the next try, i.e. they are delivered at least once.
+// Make sure to use a SyncMode that syncs the data, otherwise rows can get
+// lost in a crash after the commit.
+type OutboxImporter struct {
+	// DB is the database with the outbox table.
+	DB *sql.DB
+
+	// Queue is where the rows are pushed to.
+	Queue *timeq.Queue
+
+	// Queries are the statements that select and mark the rows.
+	Queries OutboxQueries
+
+	// BatchSize is the maximum number of rows per transaction.
+	// Defaults to 100.
+	BatchSize int
+
+	// PollInterval is how long Run() waits when there were no
+	// rows or importing failed. Defaults to one second.
+	PollInterval time.Duration
+}
+
+// ImportBatch imports the next batch of rows and returns the number of
+// imported rows, which is zero if there were none.
+func (oi *OutboxImporter) ImportBatch(ctx context.Context) (n int, outErr error) {
+	batchSize := oi.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	tx, err := oi.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+
+	defer func() {
+		// this is a no-op after a successful commit:
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			outErr = errors.Join(outErr, err)
+		}
+	}()
+
+	ids, items, err := oi.selectRows(ctx, tx, batchSize)
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, oi.Queries.MarkDispatched, id); err != nil {
+			return 0, fmt.Errorf("mark %d: %w", id, err)
+		}
+	}
+
+	// push as late as possible, so that most errors do not lead to duplicates:
+	if err := oi.Queue.Push(items); err != nil {
+		return 0, fmt.Errorf("push: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+
+	return len(items), nil
+}
+
+func (oi *OutboxImporter) selectRows(ctx context.Context, tx *sql.Tx, batchSize int) ([]int64, timeq.Items, error) {
+	rows, err := tx.QueryContext(ctx, oi.Queries.Select, batchSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("select: %w", err)
+	}
+
+	defer rows.Close()
+
+	var ids []int64
+	var items timeq.Items
+	for rows.Next() {
+		var id int64
+		var created time.Time
+		var payload []byte
+		if err := rows.Scan(&id, &created, &payload); err != nil {
+			return nil, nil, fmt.Errorf("scan: %w", err)
+		}
+
+		ids = append(ids, id)
+		items = append(items, timeq.Item{
+			Key:  timeq.Key(created.UnixNano()),
+			Blob: payload,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("select: %w", err)
+	}
+
+	return ids, items, nil
+}
+
+// Run imports rows until `ctx` is done. Errors are passed to `onErr`
+// (if not nil) and importing is tried again after PollInterval.
+// It returns ctx.Err() when it stops.
+func (oi *OutboxImporter) Run(ctx context.Context, onErr func(err error)) error {
+	return runLoop(ctx, oi.PollInterval, oi.ImportBatch, onErr)
+}
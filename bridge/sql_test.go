@@ -0,0 +1,180 @@
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sahib/timeq"
+	"github.com/sahib/timeq/timeqtest"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOutbox is a tiny database/sql driver that only
+// understands the queries of fakeOutboxQueries.
+type fakeOutbox struct {
+	mu         sync.Mutex
+	payloads   []string
+	dispatched map[int64]bool
+	failCommit bool
+}
+
+var fakeOutboxQueries = OutboxQueries{
+	Select:         "select",
+	MarkDispatched: "mark",
+}
+
+type fakeConn struct {
+	db     *fakeOutbox
+	marked []int64
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	marked := c.marked
+	c.marked = nil
+	if c.db.failCommit {
+		return errors.New("commit failed")
+	}
+
+	for _, id := range marked {
+		c.db.dispatched[id] = true
+	}
+
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.marked = nil
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return 1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.query != fakeOutboxQueries.MarkDispatched {
+		return nil, errors.New("unknown query")
+	}
+
+	s.conn.marked = append(s.conn.marked, args[0].(int64))
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.query != fakeOutboxQueries.Select {
+		return nil, errors.New("unknown query")
+	}
+
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows := &fakeRows{}
+	for idx, payload := range db.payloads {
+		id := int64(idx + 1)
+		if db.dispatched[id] || int64(len(rows.rows)) >= args[0].(int64) {
+			continue
+		}
+
+		created := time.Unix(0, id*1000)
+		rows.rows = append(rows.rows, []driver.Value{id, created, []byte(payload)})
+	}
+
+	return rows, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return []string{"id", "created_at", "payload"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+type fakeConnector struct {
+	db *fakeOutbox
+}
+
+func (fc fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: fc.db}, nil
+}
+
+func (fc fakeConnector) Driver() driver.Driver { return nil }
+
+func TestOutboxImporter(t *testing.T) {
+	outbox := &fakeOutbox{
+		payloads:   []string{"a", "b", "c", "d", "e"},
+		dispatched: map[int64]bool{},
+	}
+
+	db := sql.OpenDB(fakeConnector{db: outbox})
+	defer db.Close()
+
+	queue := timeqtest.TempQueue(t)
+	oi := &OutboxImporter{
+		DB:        db,
+		Queue:     queue,
+		Queries:   fakeOutboxQueries,
+		BatchSize: 3,
+	}
+
+	n, err := oi.ImportBatch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Len(t, outbox.dispatched, 3)
+
+	// a failed commit leads to a duplicate push, but nothing is lost:
+	outbox.failCommit = true
+	_, err = oi.ImportBatch(context.Background())
+	require.Error(t, err)
+	require.Len(t, outbox.dispatched, 3)
+
+	outbox.failCommit = false
+	n, err = oi.ImportBatch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = oi.ImportBatch(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	items, err := timeqtest.Drain(queue)
+	require.NoError(t, err)
+
+	var blobs []string
+	for _, it := range items {
+		blobs = append(blobs, string(it.Blob))
+	}
+
+	require.Equal(t, []string{"a", "b", "c", "d", "d", "e", "e"}, blobs)
+	require.Equal(t, timeq.Key(1000), items[0].Key)
+}
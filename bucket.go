@@ -1,12 +1,15 @@
 package timeq
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime/debug"
 	"slices"
+	"time"
 
 	"github.com/otiai10/copy"
 	"github.com/sahib/timeq/index"
@@ -16,6 +19,9 @@ import (
 
 const (
 	dataLogName = "dat.log"
+
+	// allOffs makes ReadBelow() read all batches.
+	allOffs = ^item.Off(0)
 )
 
 // ReadOp defines what timeq should do with the data that was read.
@@ -34,6 +40,18 @@ type bucketReadOpFn func(items Items) (ReadOp, error)
 type bucketIndex struct {
 	Log *index.Writer
 	Mem *index.Index
+
+	// Meta is shared by all copies of the bucketIndex. It is only
+	// written to disk on a forced sync, on close and when tagging.
+	Meta *indexMeta
+
+	// checkpointed is the size of Log when the last snapshot was written.
+	checkpointed int64
+}
+
+type indexMeta struct {
+	index.Meta
+	dirty bool
 }
 
 type bucket struct {
@@ -42,10 +60,33 @@ type bucket struct {
 	log     *vlog.Log
 	opts    Options
 	indexes map[ForkName]bucketIndex
+
+	// stamps are the push times of the batches.
+	// Nil if they are not recorded for this bucket.
+	stamps *batchLog
+
+	// seqs are the sequence numbers of the batches.
+	// Nil if they are not recorded for this bucket.
+	seqs *batchLog
+
+	// itersBuf is re-used by peek() to avoid allocating
+	// a new heap of batch iterators on every read.
+	itersBuf vlog.Iters
+
+	// sharedData and sharedIndex are true if the value log or the index
+	// logs might be hardlinked to a clone of the queue. See unshare().
+	sharedData, sharedIndex bool
+
+	// unsharedLogs are value logs that were replaced by unshare().
+	// They stay mapped until the bucket is closed.
+	unsharedLogs []*vlog.Log
 }
 
 var (
 	ErrNoSuchFork = errors.New("no fork with this name")
+	ErrClosed     = errors.New("queue is closed")
+	ErrFrozen     = errors.New("queue is frozen")
+	ErrQueueFull  = errors.New("queue is full")
 )
 
 func (b *bucket) idxForFork(fork ForkName) (bucketIndex, error) {
@@ -67,7 +108,7 @@ func recoverIndexFromLog(opts *Options, log *vlog.Log, idxPath string) (*index.I
 	// It's better to replay old values twice then to loose values.
 
 	var memErr error
-	mem, memErr := index.FromVlog(log)
+	mem, memErr := index.FromVlog(log, indexKind(opts.IndexStructure))
 	if memErr != nil {
 		// not much we can do for that case:
 		return nil, fmt.Errorf("index load failed & could not regenerate: %w", memErr)
@@ -77,7 +118,12 @@ func recoverIndexFromLog(opts *Options, log *vlog.Log, idxPath string) (*index.I
 		opts.Logger.Printf("index is empty, but log is not (%s)", idxPath)
 	}
 
-	if err := os.Remove(idxPath); err != nil {
+	if opts.OpenMode.readOnly() {
+		// the writer (if any) fixes it on disk.
+		return mem, nil
+	}
+
+	if err := removeIndex(opts.FS, idxPath); err != nil {
 		return nil, fmt.Errorf("index failover: could not remove broken index: %w", err)
 	}
 
@@ -107,8 +153,58 @@ func idxPath(dir string, fork ForkName) string {
 	return filepath.Join(dir, idxName)
 }
 
+func indexKind(is IndexStructure) index.Kind {
+	switch is {
+	case IndexStructureSorted:
+		return index.KindSorted
+	case IndexStructureRadix:
+		return index.KindRadix
+	default:
+		return index.KindBTree
+	}
+}
+
+// openIndexWriter opens the index log at `path` for appending.
+// Read-only queues get a writer that does not touch the file.
+func openIndexWriter(path string, opts Options) (*index.Writer, error) {
+	if opts.OpenMode.readOnly() {
+		return index.NewReadOnlyWriter(path)
+	}
+
+	w, err := index.NewWriter(path, opts.SyncMode&SyncIndex > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	bufSize, interval := opts.IndexBufferSize, opts.IndexFlushInterval
+	switch opts.IndexFlush {
+	case IndexFlushEveryN:
+		w.SetSyncEvery(opts.IndexFlushBatches)
+	case IndexFlushOnSync:
+		// only a forced sync writes the buffer.
+		// Validate() made sure that no buffer size was set.
+		bufSize, interval = math.MaxInt, 0
+	}
+
+	if err := w.SetBuffer(bufSize, interval); err != nil {
+		return nil, errors.Join(err, w.Close())
+	}
+
+	return w, nil
+}
+
 func loadIndex(idxPath string, log *vlog.Log, opts Options) (bucketIndex, error) {
-	mem, err := index.Load(idxPath)
+	load := index.Load
+	switch {
+	case opts.OpenMode.readOnly():
+		load = index.LoadReadOnly
+	case opts.MmapIndex:
+		load = index.LoadMapped
+	case opts.IndexCheckpointInterval > 0:
+		load = index.LoadCheckpointed
+	}
+
+	mem, err := load(idxPath, indexKind(opts.IndexStructure))
 	if err != nil || (mem.NEntries() == 0 && !log.IsEmpty()) {
 		mem, err = recoverIndexFromLog(&opts, log, idxPath)
 		if err != nil {
@@ -116,22 +212,40 @@ func loadIndex(idxPath string, log *vlog.Log, opts Options) (bucketIndex, error)
 		}
 	}
 
-	idxLog, err := index.NewWriter(idxPath, opts.SyncMode&SyncIndex > 0)
+	idxLog, err := openIndexWriter(idxPath, opts)
 	if err != nil {
 		return bucketIndex{}, fmt.Errorf("index writer: %w", err)
 	}
 
+	// the metadata is nice to have, but not worth failing for:
+	meta, err := index.ReadMeta(index.MetaPath(idxPath))
+	if err != nil {
+		opts.Logger.Printf("%s: ignoring metadata: %v", idxPath, err)
+	}
+
 	return bucketIndex{
-		Log: idxLog,
-		Mem: mem,
+		Log:          idxLog,
+		Mem:          mem,
+		Meta:         &indexMeta{Meta: meta},
+		checkpointed: idxLog.Size(),
 	}, nil
 }
 
 func openBucket(dir string, forks []ForkName, opts Options) (buck *bucket, outErr error) {
-	if err := os.MkdirAll(dir, 0700); err != nil {
+	key, err := opts.BucketNameConf.Parse(filepath.Base(dir))
+	if err != nil {
 		return nil, err
 	}
 
+	opts.SyncMode = opts.bucketSyncMode(item.Key(key))
+
+	// read-only queues only open buckets that exist.
+	if !opts.OpenMode.readOnly() {
+		if err := opts.FS.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+
 	// Setting this allows us to handle mmap() errors gracefully.
 	// The typical scenario where those errors happen, are full filesystems.
 	// This can happen like this:
@@ -154,7 +268,9 @@ func openBucket(dir string, forks []ForkName, opts Options) (buck *bucket, outEr
 	defer recoverMmapError(&outErr)
 
 	logPath := filepath.Join(dir, dataLogName)
-	log, err := vlog.Open(logPath, opts.SyncMode&SyncData > 0)
+	logOpts := logOptions(opts)
+	logOpts.SizeHint = logSizeHint(dir)
+	log, err := vlog.OpenWithOptions(logPath, logOpts)
 	if err != nil {
 		return nil, fmt.Errorf("open: %w", err)
 	}
@@ -174,7 +290,44 @@ func openBucket(dir string, forks []ForkName, opts Options) (buck *bucket, outEr
 		entries += idx.Mem.NEntries()
 	}
 
-	key, err := item.KeyFromString(filepath.Base(dir))
+	// After a crash the log might end with a partially written batch.
+	// Only data after the last indexed batch can be affected by this.
+	// With OpenReader, this could also be a batch the writer is still
+	// writing, so read-only queues leave the tail alone. They only read
+	// what is indexed anyways.
+	if !opts.OpenMode.readOnly() {
+		discarded, err := log.RepairTail(lastIndexedOff(indexes))
+		if err != nil {
+			return nil, fmt.Errorf("repair log tail: %w", err)
+		}
+
+		if discarded > 0 {
+			opts.Logger.Printf("%s: discarded %d bytes of torn data at the end", logPath, discarded)
+		}
+	}
+
+	// Push times are recorded for all batches of a bucket or for none,
+	// so a bucket that was created without them stays like that.
+	var stamps *batchLog
+	stampsPath := filepath.Join(dir, pushStampsName)
+	if _, err := opts.FS.Stat(stampsPath); err == nil || (opts.RecordPushTime && log.IsEmpty() && !opts.OpenMode.readOnly()) {
+		stamps, err = openBucketBatchLog(stampsPath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("push times: %w", err)
+		}
+	}
+
+	// Same for sequence numbers:
+	var seqs *batchLog
+	seqsPath := filepath.Join(dir, seqLogName)
+	if _, err := opts.FS.Stat(seqsPath); err == nil || (opts.RecordSequence && log.IsEmpty() && !opts.OpenMode.readOnly()) {
+		seqs, err = openBucketBatchLog(seqsPath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("sequences: %w", err)
+		}
+	}
+
+	sharedData, sharedIndex, err := sharedFiles(opts.FS, dir)
 	if err != nil {
 		return nil, err
 	}
@@ -185,9 +338,14 @@ func openBucket(dir string, forks []ForkName, opts Options) (buck *bucket, outEr
 		log:     log,
 		indexes: indexes,
 		opts:    opts,
+		stamps:  stamps,
+		seqs:    seqs,
+
+		sharedData:  sharedData,
+		sharedIndex: sharedIndex,
 	}
 
-	if buck.AllEmpty() && entries > 0 {
+	if buck.AllEmpty() && entries > 0 && !opts.OpenMode.readOnly() {
 		// This means that the buck is empty, but is still occupying space
 		// (i.e. it contains values that were popped already). Situations where
 		// this might occur are: a Pop() that was interrupted (e.g. a crash), a
@@ -202,7 +360,7 @@ func openBucket(dir string, forks []ForkName, opts Options) (buck *bucket, outEr
 			return nil, fmt.Errorf("close for reinit: %w", err)
 		}
 
-		if err := removeBucketDir(dir, forks); err != nil {
+		if err := removeBucketDir(opts.FS, dir, forks); err != nil {
 			return nil, fmt.Errorf("remove for reinit: %w", err)
 		}
 
@@ -212,49 +370,217 @@ func openBucket(dir string, forks []ForkName, opts Options) (buck *bucket, outEr
 	return buck, nil
 }
 
+// openBucketBatchLog opens the push times or sequences of a bucket.
+func openBucketBatchLog(path string, opts Options) (*batchLog, error) {
+	if opts.OpenMode.readOnly() {
+		return openBatchLogReadOnly(opts.FS, path)
+	}
+
+	return openBatchLog(opts.FS, path, opts.SyncMode&SyncData > 0)
+}
+
+func logOptions(opts Options) vlog.Options {
+	return vlog.Options{
+		SyncOnWrite:  opts.SyncMode&SyncData > 0,
+		PreallocSize: opts.LogPreallocSize,
+		Sequential:   opts.AdviseSequential,
+		HugePages:    opts.AdviseHugePages,
+		DirectIO:     opts.LogDirectIO,
+		ReadOnly:     opts.OpenMode.readOnly(),
+	}
+}
+
+// logSizeHint returns the size of the value log in `dir` as noted
+// by noteLogSize(). It is only a hint, so errors are ignored.
+func logSizeHint(dir string) int64 {
+	meta, _ := index.ReadMeta(index.MetaPath(idxPath(dir, "")))
+	return meta.LogSize
+}
+
+// noteLogSize stores the size of the value log in the metadata of the
+// queue's index, so the next open does not have to scan for the end.
+// See vlog.Options.SizeHint.
+func (b *bucket) noteLogSize() {
+	idx, ok := b.indexes[""]
+	if !ok || b.opts.OpenMode.readOnly() || idx.Meta.LogSize == b.log.Size() {
+		return
+	}
+
+	idx.Meta.LogSize = b.log.Size()
+	idx.Meta.dirty = true
+}
+
+// lastIndexedOff returns the offset of the last batch in
+// the value log that is referenced by any of the indexes.
+func lastIndexedOff(indexes map[ForkName]bucketIndex) item.Off {
+	var off item.Off
+	for _, idx := range indexes {
+		for iter := idx.Mem.Iter(); iter.Next(); {
+			off = max(off, iter.Value().Off)
+		}
+	}
+
+	return off
+}
+
 func (b *bucket) Sync(force bool) error {
+	if force {
+		b.noteLogSize()
+	}
+
 	err := b.log.Sync(force)
-	for _, idx := range b.indexes {
+	if b.stamps != nil {
+		err = errors.Join(err, b.stamps.Sync(force))
+	}
+
+	if b.seqs != nil {
+		err = errors.Join(err, b.seqs.Sync(force))
+	}
+
+	for fork, idx := range b.indexes {
 		err = errors.Join(err, idx.Log.Sync(force))
+		if force {
+			err = errors.Join(err, b.syncMeta(fork, idx))
+		}
 	}
 
 	return err
 }
 
+// syncMeta writes the metadata of `fork`, if it changed.
+func (b *bucket) syncMeta(fork ForkName, idx bucketIndex) error {
+	if !idx.Meta.dirty {
+		return nil
+	}
+
+	if err := index.WriteMeta(index.MetaPath(idxPath(b.dir, fork)), idx.Meta.Meta); err != nil {
+		return fmt.Errorf("meta: %s: %w", fork, err)
+	}
+
+	idx.Meta.dirty = false
+	return nil
+}
+
+// SetTag sets the user-defined tag `name` of `fork` to `value` and writes
+// the metadata right away. An empty `value` removes the tag.
+func (b *bucket) SetTag(fork ForkName, name, value string) error {
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return err
+	}
+
+	// copy it, as the old map might be shared via Trailers():
+	tags := make(map[string]string, len(idx.Meta.Tags)+1)
+	for key, val := range idx.Meta.Tags {
+		tags[key] = val
+	}
+
+	if value == "" {
+		delete(tags, name)
+	} else {
+		tags[name] = value
+	}
+
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	idx.Meta.Tags = tags
+	idx.Meta.dirty = true
+	return b.syncMeta(fork, idx)
+}
+
+// setOptions changes the options of an open bucket.
+// Only options that do not need a reopen may differ.
+func (b *bucket) setOptions(opts Options) {
+	opts.SyncMode = opts.bucketSyncMode(b.key)
+	b.opts = opts
+	b.log.SetSyncOnWrite(opts.SyncMode&SyncData > 0)
+	if b.stamps != nil {
+		b.stamps.SetSync(opts.SyncMode&SyncData > 0)
+	}
+
+	if b.seqs != nil {
+		b.seqs.SetSync(opts.SyncMode&SyncData > 0)
+	}
+
+	for _, idx := range b.indexes {
+		idx.Log.SetSync(opts.SyncMode&SyncIndex > 0)
+	}
+}
+
 func (b *bucket) Trailers(fn func(fork ForkName, trailer index.Trailer)) {
 	for fork, idx := range b.indexes {
-		fn(fork, idx.Mem.Trailer())
+		trailer := idx.Mem.Trailer()
+		trailer.Meta = idx.Meta.Meta
+		fn(fork, trailer)
 	}
 }
 
 func (b *bucket) Close() error {
+	b.noteLogSize()
 	err := b.log.Close()
-	for _, idx := range b.indexes {
-		err = errors.Join(err, idx.Log.Close())
+	if b.stamps != nil {
+		err = errors.Join(err, b.stamps.Close())
+	}
+
+	if b.seqs != nil {
+		err = errors.Join(err, b.seqs.Close())
+	}
+
+	for fork, idx := range b.indexes {
+		err = errors.Join(err, b.syncMeta(fork, idx), idx.Log.Close(), idx.Mem.Close())
+	}
+
+	for _, log := range b.unsharedLogs {
+		err = errors.Join(err, log.Unpin())
 	}
 
 	return err
 }
 
+// errMmapFault marks errors that recoverMmapError() made from a fault
+// while accessing a memory map.
+var errMmapFault = errors.New("panic")
+
 func recoverMmapError(dstErr *error) {
 	// See comment in Open().
 	// NOTE: calling recover() is surprisingly quite expensive.
 	// Do not call in this loops.
 	if recErr := recover(); recErr != nil {
-		*dstErr = fmt.Errorf("panic (check: enough space left / file issues): %v - trace:\n%s", recErr, string(debug.Stack()))
+		*dstErr = fmt.Errorf("%w (check: enough space left / file issues): %v - trace:\n%s", errMmapFault, recErr, string(debug.Stack()))
 	}
 }
 
 // Push expects pre-sorted items!
 // If `all` is set, all forks receive the new items.
 // If `all` is false, then only the fork with `name` gets the new items.
-func (b *bucket) Push(items item.Items, all bool, name ForkName) (outErr error) {
+func (b *bucket) Push(items item.Items, all bool, name ForkName) error {
+	return b.PushSeq(items, all, name, 0)
+}
+
+// PushSeq is like Push, but records `seq` as sequence number of the batch,
+// if the bucket records them. Zero means that the sequence is not known.
+func (b *bucket) PushSeq(items item.Items, all bool, name ForkName, seq uint64) (outErr error) {
 	if len(items) == 0 {
 		return nil
 	}
 
+	defer checkFaultDiskFull(b.dir, &outErr)
 	defer recoverMmapError(&outErr)
 
+	if err := b.unshare(true); err != nil {
+		return err
+	}
+
+	if err := b.stampNextPush(time.Now()); err != nil {
+		return err
+	}
+
+	if err := b.seqNextPush(seq); err != nil {
+		return err
+	}
+
 	loc, err := b.log.Push(items)
 	if err != nil {
 		return fmt.Errorf("push: log: %w", err)
@@ -266,6 +592,10 @@ func (b *bucket) Push(items item.Items, all bool, name ForkName) (outErr error)
 			if err := idx.Log.Push(loc, idx.Mem.Trailer()); err != nil {
 				return fmt.Errorf("push: index-log: %s: %w", name, err)
 			}
+
+			if err := b.syncIndexAfterPush(idx); err != nil {
+				return fmt.Errorf("push: index-log: %s: %w", name, err)
+			}
 		}
 	} else {
 		// only push to a certain index if requested.
@@ -278,19 +608,85 @@ func (b *bucket) Push(items item.Items, all bool, name ForkName) (outErr error)
 		if err := idx.Log.Push(loc, idx.Mem.Trailer()); err != nil {
 			return fmt.Errorf("push: index-log: %s: %w", name, err)
 		}
+
+		if err := b.syncIndexAfterPush(idx); err != nil {
+			return fmt.Errorf("push: index-log: %s: %w", name, err)
+		}
+	}
+
+	b.checkpoint()
+	return nil
+}
+
+// syncIndexAfterPush syncs the index log after a push,
+// if Options.IndexFlush asks for it.
+func (b *bucket) syncIndexAfterPush(idx bucketIndex) error {
+	switch b.opts.IndexFlush {
+	case IndexFlushEveryBatch, IndexFlushEveryN:
+		return idx.Log.Sync(false)
+	default:
+		return nil
+	}
+}
+
+// stampNextPush records that the next batch was pushed at `at`.
+func (b *bucket) stampNextPush(at time.Time) error {
+	if b.stamps == nil {
+		return nil
+	}
+
+	var nanos int64
+	if !at.IsZero() {
+		nanos = at.UnixNano()
+	}
+
+	if err := b.stamps.Add(item.Off(b.log.Size()), uint64(nanos)); err != nil {
+		return fmt.Errorf("push: push times: %w", err)
 	}
 
 	return nil
 }
 
+// seqNextPush records that the next batch has the sequence number `seq`.
+func (b *bucket) seqNextPush(seq uint64) error {
+	if b.seqs == nil {
+		return nil
+	}
+
+	if err := b.seqs.Add(item.Off(b.log.Size()), seq); err != nil {
+		return fmt.Errorf("push: sequences: %w", err)
+	}
+
+	return nil
+}
+
+// pushedAt returns the push time of the batch with the item at `off`.
+func (b *bucket) pushedAt(off item.Off) time.Time {
+	nanos := b.stamps.Get(off)
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(nanos))
+}
+
 func (b *bucket) logAt(loc item.Location) vlog.Iter {
 	continueOnErr := b.opts.ErrorMode != ErrorModeAbort
 	return b.log.At(loc, continueOnErr)
 }
 
-// addIter adds a new batchIter to `batchIters` and advances the idxIter.
-func (b *bucket) addIter(batchIters *vlog.Iters, idxIter *index.Iter) (bool, error) {
+// addIter adds an iterator for the batch at `idxIter` to `batchIters` and
+// advances `idxIter`. Batches at or after `below` in the value log are skipped.
+func (b *bucket) addIter(batchIters *vlog.Iters, idxIter *index.Iter, below item.Off) (bool, error) {
 	loc := idxIter.Value()
+	for loc.Off >= below {
+		if !idxIter.Next() {
+			return true, nil
+		}
+
+		loc = idxIter.Value()
+	}
+
 	batchIter := b.logAt(loc)
 	if !batchIter.Next() {
 		// might be empty or I/O error:
@@ -302,6 +698,12 @@ func (b *bucket) addIter(batchIters *vlog.Iters, idxIter *index.Iter) (bool, err
 }
 
 func (b *bucket) Read(n int, dst *item.Items, fork ForkName, fn bucketReadOpFn) error {
+	return b.ReadBelow(n, dst, fork, allOffs, fn)
+}
+
+// ReadBelow is like Read, but only reads the batches that start before `below`
+// in the value log, i.e. that were pushed before the log had this size.
+func (b *bucket) ReadBelow(n int, dst *item.Items, fork ForkName, below item.Off, fn bucketReadOpFn) error {
 	if n <= 0 {
 		// return nothing.
 		return nil
@@ -318,7 +720,7 @@ func (b *bucket) Read(n int, dst *item.Items, fork ForkName, fn bucketReadOpFn)
 		dst = &v
 	}
 
-	iters, items, _, err := b.peek(n, (*dst)[:0], idx.Mem)
+	iters, items, _, err := b.peek(n, (*dst)[:0], idx.Mem, below, &b.itersBuf)
 	if err != nil {
 		return err
 	}
@@ -329,7 +731,15 @@ func (b *bucket) Read(n int, dst *item.Items, fork ForkName, fn bucketReadOpFn)
 		*dst = items
 	}
 
+	// `fn` might push to this bucket, which may not move `items`.
+	// unshare() might replace b.log in the meantime, so keep it.
+	log := b.log
+	log.Pin()
 	op, err := fn(items)
+	if unpinErr := log.Unpin(); err == nil {
+		err = unpinErr
+	}
+
 	if err != nil {
 		return err
 	}
@@ -337,10 +747,23 @@ func (b *bucket) Read(n int, dst *item.Items, fork ForkName, fn bucketReadOpFn)
 	switch op {
 	case ReadOpPop:
 		if iters != nil {
+			// the iterators stay valid, only the indexes are replaced:
+			if err := b.unshare(false); err != nil {
+				return err
+			}
+
+			idx = b.indexes[fork]
 			if err := b.popSync(idx, iters); err != nil {
 				return err
 			}
+
+			idx.Meta.LastPop = time.Now().UnixNano()
+			idx.Meta.PoppedItems += uint64(len(items))
+			idx.Meta.PoppedBytes += uint64(items.StorageSize())
+			idx.Meta.dirty = true
+			b.checkpoint()
 		}
+
 	case ReadOpPeek:
 		// nothing to do.
 	}
@@ -348,8 +771,38 @@ func (b *bucket) Read(n int, dst *item.Items, fork ForkName, fn bucketReadOpFn)
 	return nil
 }
 
+// lastBatches returns the number of batches
+// that the last Read() had to iterate.
+func (b *bucket) lastBatches() int {
+	return len(b.itersBuf)
+}
+
+// PeekPinned peeks at up to `n` items of `fork`. Unlike with Read(), the
+// items stay valid after the call, until the returned log is unpinned.
+// If there was nothing to peek, no log is returned. It does not change the
+// bucket, so several PeekPinned() calls may run at the same time.
+func (b *bucket) PeekPinned(n int, fork ForkName) (item.Items, *vlog.Log, error) {
+	if n <= 0 {
+		return nil, nil, nil
+	}
+
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, items, _, err := b.peek(n, nil, idx.Mem, allOffs, &vlog.Iters{})
+	if err != nil || len(items) == 0 {
+		return nil, nil, err
+	}
+
+	b.log.Pin()
+	return items, b.log, nil
+}
+
 // peek reads from the bucket, but does not mark the elements as deleted yet.
-func (b *bucket) peek(n int, dst item.Items, idx *index.Index) (batchIters *vlog.Iters, outItems item.Items, npopped int, outErr error) {
+// The heap of batch iterators is built in `iters` and returned for popSync().
+func (b *bucket) peek(n int, dst item.Items, idx *index.Index, below item.Off, iters *vlog.Iters) (batchIters *vlog.Iters, outItems item.Items, npopped int, outErr error) {
 	defer recoverMmapError(&outErr)
 
 	// Fetch the lowest entry of the index:
@@ -360,9 +813,9 @@ func (b *bucket) peek(n int, dst item.Items, idx *index.Index) (batchIters *vlog
 	}
 
 	// initialize with first batch iter:
-	batchItersSlice := make(vlog.Iters, 0, 1)
-	batchIters = &batchItersSlice
-	indexExhausted, err := b.addIter(batchIters, &idxIter)
+	*iters = (*iters)[:0]
+	batchIters = iters
+	indexExhausted, err := b.addIter(batchIters, &idxIter, below)
 	if err != nil {
 		return nil, dst, 0, err
 	}
@@ -379,6 +832,14 @@ func (b *bucket) peek(n int, dst item.Items, idx *index.Index) (batchIters *vlog
 	for numAppends < n && !(*batchIters)[0].Exhausted() {
 		var currIter = &(*batchIters)[0]
 		dst = append(dst, currIter.Item())
+		if b.stamps != nil {
+			dst[len(dst)-1].PushedAt = b.pushedAt(currIter.CurrentLocation().Off)
+		}
+
+		if b.seqs != nil {
+			dst[len(dst)-1].Seq = b.seqs.Get(currIter.CurrentLocation().Off)
+		}
+
 		numAppends++
 
 		// advance current batch iter. We will make sure at the
@@ -405,7 +866,7 @@ func (b *bucket) peek(n int, dst item.Items, idx *index.Index) (batchIters *vlog
 		if !indexExhausted {
 			nextLoc := idxIter.Value()
 			if currIsExhausted || nextLoc.Key <= currKey {
-				indexExhausted, err = b.addIter(batchIters, &idxIter)
+				indexExhausted, err = b.addIter(batchIters, &idxIter, below)
 				if err != nil {
 					return nil, dst, 0, err
 				}
@@ -455,6 +916,92 @@ func (b *bucket) popSync(idx bucketIndex, batchIters *vlog.Iters) error {
 	return idx.Log.Sync(false)
 }
 
+// checkpoint writes a new snapshot of each index whose log grew by at least
+// Options.IndexCheckpointInterval entries since the last snapshot. This keeps
+// the part of the index log that needs to be replayed on open small.
+func (b *bucket) checkpoint() {
+	if b.opts.IndexCheckpointInterval <= 0 {
+		return
+	}
+
+	limit := int64(b.opts.IndexCheckpointInterval) * index.LocationSize
+	for name, idx := range b.indexes {
+		size := idx.Log.Size()
+		if size-idx.checkpointed < limit {
+			continue
+		}
+
+		// The snapshot may not cover more than what is on disk,
+		// otherwise it would not match the index log after a crash.
+		// Snapshots are only a cache, so failing here is not critical.
+		if err := idx.Log.Sync(true); err != nil {
+			b.opts.Logger.Printf("checkpoint: %s: sync: %v", name, err)
+			continue
+		}
+
+		snapPath := index.SnapshotPath(idxPath(b.dir, name))
+		if err := index.WriteSnapshot(idx.Mem, snapPath, size); err != nil {
+			b.opts.Logger.Printf("checkpoint: %s: %v", name, err)
+			continue
+		}
+
+		idx.checkpointed = size
+		b.indexes[name] = idx
+	}
+}
+
+// FreeConsumed releases the memory of the data before the lowest offset
+// that is still referenced by any fork. It has to look at every location
+// of every fork, which is why Maintain() does it and not every pop.
+func (b *bucket) FreeConsumed() error {
+	minOff := ^item.Off(0)
+	for _, idx := range b.indexes {
+		for iter := idx.Mem.Iter(); iter.Next(); {
+			minOff = min(minOff, iter.Value().Off)
+		}
+	}
+
+	// NOTE: if all forks are empty, the bucket gets deleted anyways.
+	return b.log.FreeBefore(minOff)
+}
+
+// readAheadRegion returns (at most `size` bytes of) the part of the value
+// log where reading `n` items of `fork` starts. See Options.ReadAhead.
+func (b *bucket) readAheadRegion(fork ForkName, n int, size int64) []byte {
+	idx, ok := b.indexes[fork]
+	if !ok {
+		return nil
+	}
+
+	minOff, count := ^item.Off(0), 0
+	for iter := idx.Mem.Iter(); iter.Next() && count < n; {
+		loc := iter.Value()
+		minOff = min(minOff, loc.Off)
+		count += int(loc.Len)
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	return b.log.Region(minOff, size)
+}
+
+// Lock locks the data of this bucket in memory.
+func (b *bucket) Lock() error {
+	return b.log.Lock()
+}
+
+// Unlock reverts Lock().
+func (b *bucket) Unlock() error {
+	return b.log.Unlock()
+}
+
+// WillNeed advises the kernel that the data of this bucket will be needed soon.
+func (b *bucket) WillNeed() error {
+	return b.log.WillNeed()
+}
+
 func (b *bucket) Delete(fork ForkName, from, to item.Key) (ndeleted int, outErr error) {
 	defer recoverMmapError(&outErr)
 
@@ -469,6 +1016,10 @@ func (b *bucket) Delete(fork ForkName, from, to item.Key) (ndeleted int, outErr
 		return 0, fmt.Errorf("to < from in bucket delete (%d < %d)", to, from)
 	}
 
+	if err := b.unshare(false); err != nil {
+		return 0, err
+	}
+
 	idx, err := b.idxForFork(fork)
 	if err != nil {
 		return 0, err
@@ -557,9 +1108,172 @@ func (b *bucket) Delete(fork ForkName, from, to item.Key) (ndeleted int, outErr
 		idx.Mem.Set(loc)
 	}
 
+	b.checkpoint()
+	return ndeleted, errors.Join(pushErr, idx.Log.Sync(false))
+}
+
+// DeleteFunc deletes all items of `fork` between `from` and `to` (both
+// including) for which `keep` returns false. Batches with such items are
+// rewritten to the end of the value log without them; other forks still
+// see the original batches.
+func (b *bucket) DeleteFunc(fork ForkName, from, to item.Key, keep func(item.Item) bool) (ndeleted int, outErr error) {
+	defer recoverMmapError(&outErr)
+
+	if b.key > to {
+		return 0, nil
+	}
+
+	if to < from {
+		return 0, fmt.Errorf("to < from in bucket delete (%d < %d)", to, from)
+	}
+
+	if err := b.unshare(true); err != nil {
+		return 0, err
+	}
+
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return 0, err
+	}
+
+	// The index can only delete the oldest location of a key.
+	// If one location of a key changes, we have to replace all of them.
+	type locGroup struct {
+		key     item.Key
+		nold    int
+		locs    []item.Location
+		changed bool
+	}
+
+	var groups []locGroup
+	for iter := idx.Mem.Iter(); iter.Next(); {
+		loc := iter.Value()
+		if loc.Key > to {
+			break
+		}
+
+		if len(groups) == 0 || groups[len(groups)-1].key != loc.Key {
+			groups = append(groups, locGroup{key: loc.Key})
+		}
+
+		group := &groups[len(groups)-1]
+		group.nold++
+
+		var kept item.Items
+		logIter := b.logAt(loc)
+		for logIter.Next() {
+			it := logIter.Item()
+			if it.Key < from || it.Key > to || keep(it) {
+				kept = append(kept, it)
+			}
+		}
+
+		if err := logIter.Err(); err != nil {
+			return ndeleted, err
+		}
+
+		if len(kept) == int(loc.Len) {
+			group.locs = append(group.locs, loc)
+			continue
+		}
+
+		group.changed = true
+		ndeleted += int(loc.Len) - len(kept)
+		if len(kept) == 0 {
+			continue
+		}
+
+		// keep the push time and sequence of the original batch:
+		if b.stamps != nil {
+			if err := b.stampNextPush(b.pushedAt(loc.Off)); err != nil {
+				return ndeleted, err
+			}
+		}
+
+		if b.seqs != nil {
+			if err := b.seqNextPush(b.seqs.Get(loc.Off)); err != nil {
+				return ndeleted, err
+			}
+		}
+
+		// the items point into the mmap, which might change on push:
+		newLoc, err := b.log.Push(kept.Copy())
+		if err != nil {
+			return ndeleted, fmt.Errorf("delete: log: %w", err)
+		}
+
+		group.locs = append(group.locs, newLoc)
+	}
+
+	var pushErr error
+	for _, group := range groups {
+		if !group.changed {
+			continue
+		}
+
+		for n := 0; n < group.nold; n++ {
+			idx.Mem.Delete(group.key)
+			pushErr = errors.Join(
+				pushErr,
+				idx.Log.Push(item.Location{Key: group.key}, idx.Mem.Trailer()),
+			)
+		}
+
+		for _, loc := range group.locs {
+			idx.Mem.Set(loc)
+			pushErr = errors.Join(pushErr, idx.Log.Push(loc, idx.Mem.Trailer()))
+		}
+	}
+
+	b.checkpoint()
 	return ndeleted, errors.Join(pushErr, idx.Log.Sync(false))
 }
 
+// collectRange returns copies of the items of `fork` that a DeleteFunc() with
+// the same arguments would delete. If `keep` is nil, all items in the range
+// are returned. The items are sorted by key.
+func (b *bucket) collectRange(fork ForkName, from, to item.Key, keep func(item.Item) bool) (items item.Items, outErr error) {
+	defer recoverMmapError(&outErr)
+
+	if b.key > to {
+		return nil, nil
+	}
+
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return nil, err
+	}
+
+	for iter := idx.Mem.Iter(); iter.Next(); {
+		loc := iter.Value()
+		if loc.Key > to {
+			break
+		}
+
+		logIter := b.logAt(loc)
+		for logIter.Next() {
+			it := logIter.Item()
+			if it.Key > to {
+				break
+			}
+
+			if it.Key >= from && (keep == nil || !keep(it)) {
+				items = append(items, it)
+			}
+		}
+
+		if err := logIter.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortStableFunc(items, func(a, b item.Item) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+
+	return items.Copy(), nil
+}
+
 func (b *bucket) AllEmpty() bool {
 	for _, idx := range b.indexes {
 		if idx.Mem.Len() > 0 {
@@ -579,10 +1293,30 @@ func (b *bucket) Empty(fork ForkName) bool {
 	return idx.Mem.Len() == 0
 }
 
+// DataSize returns the number of bytes in the value log.
+func (b *bucket) DataSize() int64 {
+	return b.log.Size()
+}
+
 func (b *bucket) Key() item.Key {
 	return b.key
 }
 
+// FirstKey returns the lowest key in `fork` or false if it's empty.
+func (b *bucket) FirstKey(fork ForkName) (item.Key, bool) {
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return 0, false
+	}
+
+	iter := idx.Mem.Iter()
+	if !iter.Next() {
+		return 0, false
+	}
+
+	return iter.Value().Key, true
+}
+
 func (b *bucket) Len(fork ForkName) int {
 	idx, err := b.idxForFork(fork)
 	if err != nil {
@@ -608,14 +1342,15 @@ func (b *bucket) Fork(src, dst ForkName) error {
 		return err
 	}
 
-	dstIdxLog, err := index.NewWriter(dstPath, b.opts.SyncMode&SyncIndex > 0)
+	dstIdxLog, err := openIndexWriter(dstPath, b.opts)
 	if err != nil {
 		return err
 	}
 
 	b.indexes[dst] = bucketIndex{
-		Log: dstIdxLog,
-		Mem: srcIdx.Mem.Copy(),
+		Log:  dstIdxLog,
+		Mem:  srcIdx.Mem.Copy(),
+		Meta: &indexMeta{},
 	}
 	return nil
 }
@@ -642,15 +1377,95 @@ func (b *bucket) RemoveFork(fork ForkName) error {
 	delete(b.indexes, fork)
 	return errors.Join(
 		idx.Log.Close(),
-		os.Remove(dstPath),
+		idx.Mem.Close(),
+		removeIndex(b.opts.FS, dstPath),
 	)
 }
 
+// FlushIndexes writes the buffered entries of all
+// index logs. See Options.IndexBufferSize.
+func (b *bucket) FlushIndexes() error {
+	var err error
+	for _, idx := range b.indexes {
+		err = errors.Join(err, idx.Log.Flush(), idx.Log.Sync(false))
+	}
+
+	return err
+}
+
+// CompactIndexes rewrites all index logs that have at least `factor` times
+// more entries than their index has locations. Index logs are append-only,
+// so they keep growing with every read until the bucket is removed.
+func (b *bucket) CompactIndexes(factor int) error {
+	for name, idx := range b.indexes {
+		var nlocs int64
+		for iter := idx.Mem.Iter(); iter.Next(); {
+			nlocs++
+		}
+
+		nentries := idx.Log.Size() / index.LocationSize
+		if nentries < int64(factor)*max(nlocs, 1) {
+			continue
+		}
+
+		if err := b.rewriteIndex(name, idx, idx.Mem); err != nil {
+			return fmt.Errorf("compact: %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// rewriteIndex replaces the index log of `name` with one that only has the
+// locations of `mem`, which becomes the new in-memory index. If it fails,
+// the old index log stays in use.
+func (b *bucket) rewriteIndex(name ForkName, idx bucketIndex, mem *index.Index) error {
+	path := idxPath(b.dir, name)
+	tmpPath := path + ".rewrite"
+	if err := index.WriteIndex(mem, tmpPath); err != nil {
+		return errors.Join(err, filterIsNotExist(b.opts.FS.Remove(tmpPath)))
+	}
+
+	// The snapshot belongs to the old index log, remove it before
+	// replacing the log. A crash in between leaves the old log intact.
+	if err := filterIsNotExist(b.opts.FS.Remove(index.SnapshotPath(path))); err != nil {
+		return errors.Join(err, b.opts.FS.Remove(tmpPath))
+	}
+
+	// The writer keeps its file descriptor over the rename,
+	// so the old log only has to be closed once it was replaced.
+	idxLog, err := openIndexWriter(tmpPath, b.opts)
+	if err != nil {
+		return errors.Join(err, b.opts.FS.Remove(tmpPath))
+	}
+
+	if err := b.opts.FS.Rename(tmpPath, path); err != nil {
+		return errors.Join(err, idxLog.Close(), b.opts.FS.Remove(tmpPath))
+	}
+
+	oldLog := idx.Log
+	idx.Log = idxLog
+	idx.Mem = mem
+	idx.checkpointed = 0
+	b.indexes[name] = idx
+
+	return errors.Join(oldLog.Close(), b.opts.FS.SyncDir(b.dir))
+}
+
 // like RemoveFork() but used when the bucket is not loaded.
-func removeForkOffline(buckDir string, fork ForkName) error {
+func removeForkOffline(fsys FS, buckDir string, fork ForkName) error {
 	// Quick path: bucket was not loaded, so we can just throw out
 	// the to-be-removed index file:
-	return os.Remove(idxPath(buckDir, fork))
+	return removeIndex(fsys, idxPath(buckDir, fork))
+}
+
+// removeIndex removes the index log at `path` and its snapshot and metadata, if any.
+func removeIndex(fsys FS, path string) error {
+	return errors.Join(
+		fsys.Remove(path),
+		filterIsNotExist(fsys.Remove(index.SnapshotPath(path))),
+		filterIsNotExist(fsys.Remove(index.MetaPath(path))),
+	)
 }
 
 func (b *bucket) Forks() []ForkName {
@@ -672,14 +1487,42 @@ func (b *bucket) Forks() []ForkName {
 }
 
 func filterIsNotExist(err error) error {
-	if os.IsNotExist(err) {
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
 
 	return err
 }
 
-func removeBucketDir(dir string, forks []ForkName) error {
+// trimBucketDir removes all files in `dir` that do not belong to the bucket:
+// index logs, snapshots and metadata of forks that are not in `forks` anymore and
+// left-over temporary files. Otherwise removeBucketDir() can't remove `dir`.
+func trimBucketDir(fsys FS, dir string, forks []ForkName) error {
+	ents, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{"dat.log": true, pushStampsName: true, seqLogName: true}
+	for _, fork := range append([]ForkName{""}, forks...) {
+		path := idxPath(dir, fork)
+		known[filepath.Base(path)] = true
+		known[filepath.Base(index.SnapshotPath(path))] = true
+		known[filepath.Base(index.MetaPath(path))] = true
+	}
+
+	for _, ent := range ents {
+		if ent.IsDir() || known[ent.Name()] {
+			continue
+		}
+
+		err = errors.Join(err, filterIsNotExist(fsys.Remove(filepath.Join(dir, ent.Name()))))
+	}
+
+	return err
+}
+
+func removeBucketDir(fsys FS, dir string, forks []ForkName) error {
 	// We do this here because os.RemoveAll() is a bit more expensive,
 	// as it does some extra syscalls and some portability checks that
 	// we do not really need. Just delete them explicitly.
@@ -691,14 +1534,16 @@ func removeBucketDir(dir string, forks []ForkName) error {
 	for _, fork := range forks {
 		err = errors.Join(
 			err,
-			filterIsNotExist(os.Remove(idxPath(dir, fork))),
+			filterIsNotExist(removeIndex(fsys, idxPath(dir, fork))),
 		)
 	}
 
 	return errors.Join(
 		err,
-		filterIsNotExist(os.Remove(filepath.Join(dir, "dat.log"))),
-		filterIsNotExist(os.Remove(filepath.Join(dir, "idx.log"))),
-		filterIsNotExist(os.Remove(dir)),
+		filterIsNotExist(fsys.Remove(filepath.Join(dir, "dat.log"))),
+		filterIsNotExist(fsys.Remove(filepath.Join(dir, pushStampsName))),
+		filterIsNotExist(fsys.Remove(filepath.Join(dir, seqLogName))),
+		filterIsNotExist(removeIndex(fsys, filepath.Join(dir, "idx.log"))),
+		filterIsNotExist(fsys.Remove(dir)),
 	)
 }
@@ -2,6 +2,7 @@ package timeq
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
 	"slices"
@@ -625,3 +626,79 @@ func TestBucketForkInvalid(t *testing.T) {
 		require.NoError(t, buck.Fork("", "fork"))
 	})
 }
+
+// renameFaultFS fails all renames.
+type renameFaultFS struct {
+	FS
+}
+
+func (renameFaultFS) Rename(src, dst string) error {
+	return errors.New("injected fault")
+}
+
+func TestBucketRewriteIndexFailure(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-buckettest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.FS = renameFaultFS{FS: OSFS()}
+
+	bucketDir := filepath.Join(dir, item.Key(23).String())
+	buck, err := openBucket(bucketDir, nil, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, buck.Push(testutils.GenItems(0, 10, 1), true, ""))
+	_, _, err = buckPop(buck, 5, nil, "")
+	require.NoError(t, err)
+
+	// the old index log stays in use:
+	require.Error(t, buck.Reindex())
+	require.NoFileExists(t, idxPath(bucketDir, "")+".rewrite")
+	require.NoError(t, buck.Push(testutils.GenItems(10, 15, 1), true, ""))
+	_, _, err = buckPop(buck, 2, nil, "")
+	require.NoError(t, err)
+	require.NoError(t, buck.Close())
+
+	buck, err = openBucket(bucketDir, nil, opts)
+	require.NoError(t, err)
+	gotItems, _, err := buckPop(buck, 100, nil, "")
+	require.NoError(t, err)
+	require.Equal(t, testutils.GenItems(7, 15, 1), gotItems)
+	require.NoError(t, buck.Close())
+}
+
+func TestBucketLogSizeHint(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-buckettest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.LogPreallocSize = 1024 * 1024
+
+	bucketDir := filepath.Join(dir, item.Key(23).String())
+	buck, err := openBucket(bucketDir, nil, opts)
+	require.NoError(t, err)
+
+	items := testutils.GenItems(0, 10, 1)
+	require.NoError(t, buck.Push(items, true, ""))
+	require.NoError(t, buck.Close())
+
+	// the size of the log is noted on close and used on the next open:
+	meta, err := index.ReadMeta(index.MetaPath(idxPath(bucketDir, "")))
+	require.NoError(t, err)
+	require.Equal(t, int64(items.StorageSize()), meta.LogSize)
+
+	buck, err = openBucket(bucketDir, nil, opts)
+	require.NoError(t, err)
+	require.Equal(t, int64(items.StorageSize()), buck.log.Size())
+
+	gotItems, _, err := buckPop(buck, 100, nil, "")
+	require.NoError(t, err)
+	require.Equal(t, items, gotItems)
+	require.NoError(t, buck.Close())
+}
@@ -0,0 +1,123 @@
+package timeq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+const (
+	nameConfFile = "names.conf"
+
+	// timeBucketNameLayout keeps the nanoseconds, so that every key
+	// can be told apart. The dashes keep the name usable on all filesystems.
+	timeBucketNameLayout = "2006-01-02T15-04-05.000000000"
+)
+
+// ErrChangedBucketNames is returned by Open() if the bucket directories were
+// named with a different BucketNameConf than the configured one.
+var ErrChangedBucketNames = errors.New("bucket name conf changed")
+
+// BucketNameConf defines how bucket directories are named.
+// See Options.BucketNameConf for more info.
+type BucketNameConf struct {
+	// Format returns the directory name of the bucket with `key`. The
+	// names should sort like the keys, e.g. for looking at them with ls.
+	Format func(item.Key) string
+
+	// Parse is the reverse of Format. It fails for other names.
+	Parse func(string) (item.Key, error)
+
+	// Name is used as identifier to figure out
+	// when the name conf changed.
+	Name string
+}
+
+// DefaultBucketNameConf names buckets after their key, like "K00000000001714564800".
+var DefaultBucketNameConf = BucketNameConf{
+	Format: item.Key.String,
+	Parse:  item.KeyFromString,
+	Name:   "numeric",
+}
+
+// TimeBucketNameConf names buckets after their key as UTC time, like
+// "2024-05-01T12-00-00.000000000". Like DefaultBucketSplitConf,
+// it assumes that keys are nanosecond unix timestamps.
+func TimeBucketNameConf() BucketNameConf {
+	return BucketNameConf{
+		Format: func(key item.Key) string {
+			return key.Format(timeBucketNameLayout)
+		},
+		Parse: func(name string) (item.Key, error) {
+			return item.ParseKey(timeBucketNameLayout, name)
+		},
+		Name: "time",
+	}
+}
+
+// ParseBucketName returns the key of a bucket directory that was named
+// with DefaultBucketNameConf or TimeBucketNameConf(), e.g. for tools that
+// look at the queue directory.
+func ParseBucketName(name string) (Key, error) {
+	key, err := DefaultBucketNameConf.Parse(name)
+	if err == nil {
+		return key, nil
+	}
+
+	if key, timeErr := TimeBucketNameConf().Parse(name); timeErr == nil {
+		return key, nil
+	}
+
+	return 0, fmt.Errorf("not a bucket name: %s", name)
+}
+
+// KeyFromTime converts `t` to a key. See Key.Time() for the reverse.
+func KeyFromTime(t time.Time) Key {
+	return item.KeyFromTime(t)
+}
+
+// checkNameConf makes sure that the buckets in `dir` were named with
+// `conf`. Queues from before names.conf existed always used numeric names.
+// The conf is written if it is missing and `write` is true.
+func checkNameConf(fsys FS, dir string, conf BucketNameConf, write bool) error {
+	path := filepath.Join(dir, nameConfFile)
+	data, err := fsys.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	current := string(bytes.TrimSpace(data))
+	if err != nil {
+		ents, err := fsys.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, ent := range ents {
+			if ent.IsDir() {
+				current = DefaultBucketNameConf.Name
+				break
+			}
+		}
+	}
+
+	if current != "" && current != conf.Name {
+		return fmt.Errorf(
+			"%w: bucket names are currently »%s« but »%s« is configured",
+			ErrChangedBucketNames,
+			current,
+			conf.Name,
+		)
+	}
+
+	if err != nil && write {
+		return fsys.WriteFile(path, []byte(conf.Name), 0600)
+	}
+
+	return nil
+}
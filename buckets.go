@@ -2,17 +2,21 @@ package timeq
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"math"
-	"os"
 	"path/filepath"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/google/renameio"
 	"github.com/sahib/timeq/index"
 	"github.com/sahib/timeq/item"
+	"github.com/sahib/timeq/vlog"
 	"github.com/tidwall/btree"
 )
 
@@ -31,29 +35,149 @@ type trailerKey struct {
 
 // small wrapper around buckets that calls Push() without locking.
 type tx struct {
-	bs *buckets
+	bs    *buckets
+	stats ReadStats
 }
 
 func (tx *tx) Push(items item.Items) error {
 	return tx.bs.Push(items, false)
 }
 
+func (tx *tx) Stats() ReadStats {
+	return tx.stats
+}
+
 type buckets struct {
-	mu       sync.Mutex
-	dir      string
-	tree     btree.Map[item.Key, *bucket]
+	mu      sync.RWMutex
+	dir     string
+	tree    btree.Map[item.Key, *bucket]
+	opts    Options
+	forks   []ForkName
+	readBuf Items
+
+	// trailers holds the number of items of each bucket and fork.
+	// They are kept up to date for loaded buckets by recount().
 	trailers map[trailerKey]index.Trailer
-	opts     Options
-	forks    []ForkName
-	readBuf  Items
+
+	// lens is the sum of all trailers per fork, so Len() is cheap.
+	// The map is guarded by `mu`, the counters can be read without it.
+	lens map[ForkName]*atomic.Int64
+
+	metrics    metrics
+	lagWatches []*lagWatch
+
+	// locked is the bucket that is currently locked in memory.
+	// See Options.LockActiveBucket.
+	locked    *bucket
+	lockedKey item.Key
+
+	// closing is set once Close() was called. Operations that
+	// get the lock afterwards return ErrClosed.
+	closing atomic.Bool
+	closed  bool
+
+	// paused holds the consumers whose reads are paused.
+	paused map[ForkName]bool
+
+	// frozen is true if the queue was made read-only with Freeze().
+	frozen bool
+
+	// follower is true if the queue was demoted and epoch is the
+	// fencing token of the newest primary it knows. See failover.go.
+	follower bool
+	epoch    uint64
+
+	// sizes caches the data size of buckets that are not loaded.
+	// See dataSize().
+	sizes map[item.Key]int64
+
+	// freed is closed when items were removed. See PushWait().
+	freed chan struct{}
+
+	// pushed is closed when items were pushed. See SubscribeChan().
+	pushed chan struct{}
+
+	// reserved is true if the disk reserve file exists.
+	// See Options.DiskReserveSize.
+	reserved bool
+
+	// userMeta is the metadata set by SetMeta().
+	userMeta map[string][]byte
+
+	// seq is the last sequence number that was handed out and seqSaved
+	// the one in seqStateFile. See Options.RecordSequence and seq.go.
+	seq, seqSaved uint64
+	seqLoaded     bool
+
+	// lastRead is the time of the last read of each fork (in unix nanoseconds)
+	// and lastReadSaved the one in forkActivityFile. See activity.go.
+	// The map is guarded by `mu`, the stamps can be set with the shared lock.
+	lastRead      map[ForkName]*atomic.Int64
+	lastReadSaved map[ForkName]int64
+
+	// totals and totalsSaved (the ones in totalsFile) are
+	// kept across restarts. See Metrics.Totals and totals.go.
+	totals, totalsSaved Totals
+
+	// opLog is also set as opts.Logger. See opLogger.
+	opLog *opLogger
+
+	// view is set during Read(). See readView.
+	view *readView
+
+	// labels are the pprof labels of the current operation.
+	// Nil outside of operations. See setLabels().
+	labels context.Context
+
+	// lock enforces opts.OpenMode. It is released by Close().
+	lock *queueLock
+
+	// adaptiveLimit is the open bucket limit with opts.MemorySoftLimit.
+	// memUsage is processRSS(), except in tests. See openLimit().
+	adaptiveLimit int
+	memChecked    time.Time
+	memUsage      func() int64
 }
 
-func loadAllBuckets(dir string, opts Options) (*buckets, error) {
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return nil, fmt.Errorf("mkdir: %w", err)
+func loadAllBuckets(dir string, opts Options) (_ *buckets, outErr error) {
+	// read-only queues do not create anything, not even an empty queue.
+	if !opts.OpenMode.readOnly() {
+		if err := opts.FS.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("mkdir: %w", err)
+		}
+	}
+
+	lock, err := lockQueue(opts.FS, dir, opts.OpenMode)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if outErr != nil {
+			outErr = errors.Join(outErr, lock.Unlock())
+		}
+	}()
+
+	// check this first, a newer version might have changed everything below:
+	_, hasFormat, err := readFormat(opts.FS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("format: %w", err)
+	}
+
+	// Read-only queues leave everything as it is. If a clear was interrupted,
+	// some of its buckets might be partly gone, which fails when reading them.
+	readOnly := opts.OpenMode.readOnly()
+	if err := checkNameConf(opts.FS, dir, opts.BucketNameConf, !readOnly); err != nil {
+		return nil, err
+	}
+
+	if !readOnly {
+		if err := finishClear(opts.FS, dir, opts.BucketNameConf.Format); err != nil {
+			return nil, fmt.Errorf("finish interrupted clear: %w", err)
+		}
 	}
 
-	ents, err := os.ReadDir(dir)
+	ents, err := opts.FS.ReadDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("read-dir: %w", err)
 	}
@@ -62,12 +186,18 @@ func loadAllBuckets(dir string, opts Options) (*buckets, error) {
 	// so don't be alert.
 	expectedFiles := 0
 
+	// the manifest is only there if the queue was closed properly:
+	manifest, err := readLenManifest(opts.FS, dir, !readOnly)
+	if err != nil {
+		// it's just a cache, we can read the trailers from the buckets instead.
+		opts.Logger.Printf("failed to read len manifest: %v", err)
+	}
+
 	var dirsHandled int
 	tree := btree.Map[item.Key, *bucket]{}
-	trailers := make(map[trailerKey]index.Trailer, len(ents))
 	for _, ent := range ents {
 		switch ent.Name() {
-		case splitConfFile:
+		case splitConfFile, nameConfFile, lenManifestFile, forksFile, forkActivityFile, totalsFile, reserveFile, userMetaFile, seqStateFile, roleStateFile, formatFile, queueLockFile, writerLockFile:
 			expectedFiles++
 		}
 
@@ -76,7 +206,7 @@ func loadAllBuckets(dir string, opts Options) (*buckets, error) {
 		}
 
 		buckPath := filepath.Join(dir, ent.Name())
-		key, err := item.KeyFromString(filepath.Base(buckPath))
+		key, err := opts.BucketNameConf.Parse(ent.Name())
 		if err != nil {
 			if opts.ErrorMode == ErrorModeAbort {
 				return nil, err
@@ -88,18 +218,7 @@ func loadAllBuckets(dir string, opts Options) (*buckets, error) {
 
 		dirsHandled++
 
-		if err := index.ReadTrailers(buckPath, func(fork string, trailer index.Trailer) {
-			// nil entries indicate buckets that were not loaded yet:
-			trailers[trailerKey{
-				Key:  key,
-				fork: ForkName(fork),
-			}] = trailer
-		}); err != nil {
-			// reading trailers is not too fatal, but applications may break in unexpected
-			// ways when Len() returns wrong results.
-			return nil, err
-		}
-
+		// nil entries indicate buckets that were not loaded yet:
 		tree.Set(key, nil)
 	}
 
@@ -107,12 +226,51 @@ func loadAllBuckets(dir string, opts Options) (*buckets, error) {
 		return nil, fmt.Errorf("%s is not empty; refusing to create db", dir)
 	}
 
+	if !hasFormat && !readOnly {
+		if err := writeFormat(opts.FS, dir, FormatVersion); err != nil {
+			return nil, fmt.Errorf("format: %w", err)
+		}
+	}
+
+	trailers := manifest
+	if !manifestMatches(manifest, &tree) {
+		trailers = make(map[trailerKey]index.Trailer, tree.Len())
+		for _, key := range tree.Keys() {
+			buckPath := filepath.Join(dir, opts.BucketNameConf.Format(key))
+			if err := index.ReadTrailers(buckPath, func(fork string, trailer index.Trailer) {
+				trailers[trailerKey{
+					Key:  key,
+					fork: ForkName(fork),
+				}] = trailer
+			}); err != nil {
+				// reading trailers is not too fatal, but applications may break in unexpected
+				// ways when Len() returns wrong results.
+				return nil, err
+			}
+		}
+	}
+
+	opLog := &opLogger{Logger: opts.Logger}
+	opts.Logger = opLog
+
 	bs := &buckets{
 		dir:      dir,
 		tree:     tree,
 		opts:     opts,
 		trailers: trailers,
+		lens:     make(map[ForkName]*atomic.Int64),
 		readBuf:  make(Items, 2000),
+		metrics:  metrics{opened: time.Now()},
+		opLog:    opLog,
+		lock:     lock,
+
+		adaptiveLimit: opts.MaxParallelOpenBuckets,
+		memUsage:      processRSS,
+	}
+
+	bs.lenOf("") // the queue itself always has a counter.
+	for tk, trailer := range trailers {
+		bs.lenOf(tk.fork).Add(int64(trailer.TotalEntries))
 	}
 
 	forks, err := bs.fetchForks()
@@ -121,21 +279,112 @@ func loadAllBuckets(dir string, opts Options) (*buckets, error) {
 	}
 
 	bs.forks = forks
+	if err := bs.loadForkActivity(); err != nil {
+		return nil, fmt.Errorf("failed to load fork activity: %w", err)
+	}
+
+	userMeta, err := readUserMeta(opts.FS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	bs.userMeta = userMeta
+	if err := bs.loadTotals(); err != nil {
+		return nil, fmt.Errorf("failed to load totals: %w", err)
+	}
+
+	if err := bs.loadRole(); err != nil {
+		return nil, fmt.Errorf("failed to load role: %w", err)
+	}
+
+	if readOnly {
+		return bs, nil
+	}
+
+	if opts.RecordSequence {
+		if err := bs.loadSeq(); err != nil {
+			return nil, fmt.Errorf("failed to load sequence: %w", err)
+		}
+	}
+
+	if opts.DiskReserveSize <= 0 {
+		// remove the reserve of an earlier run, if any:
+		if err := createReserve(opts.FS, dir, 0); err != nil {
+			return nil, fmt.Errorf("disk reserve: %w", err)
+		}
+	} else if err := bs.restoreReserve(); err != nil {
+		// the disk might be full already; do not prevent consumers from draining.
+		opts.Logger.Printf("%v", err)
+	}
+
 	return bs, nil
 }
 
+// manifestMatches checks if `manifest` knows about exactly the buckets in `tree`.
+func manifestMatches(manifest map[trailerKey]index.Trailer, tree *btree.Map[item.Key, *bucket]) bool {
+	if manifest == nil {
+		return false
+	}
+
+	for tk := range manifest {
+		if _, ok := tree.Get(tk.Key); !ok {
+			return false
+		}
+	}
+
+	for _, key := range tree.Keys() {
+		if _, ok := manifest[trailerKey{Key: key}]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lenOf returns the item counter of `fork` and creates it if needed.
+func (bs *buckets) lenOf(fork ForkName) *atomic.Int64 {
+	counter, ok := bs.lens[fork]
+	if !ok {
+		counter = &atomic.Int64{}
+		bs.lens[fork] = counter
+	}
+
+	return counter
+}
+
+// LenCounter returns the counter that tracks the number of items in `fork`.
+// It can be read without locking and stays valid when the fork is removed.
+func (bs *buckets) LenCounter(fork ForkName) *atomic.Int64 {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.lenOf(fork)
+}
+
+// recount updates the trailers and lens after `buck` was modified.
+func (bs *buckets) recount(key item.Key, buck *bucket) {
+	buck.Trailers(func(fork ForkName, trailer index.Trailer) {
+		tk := trailerKey{Key: key, fork: fork}
+		bs.lenOf(fork).Add(int64(trailer.TotalEntries) - int64(bs.trailers[tk].TotalEntries))
+		bs.trailers[tk] = trailer
+	})
+}
+
 // ValidateBucketKeys checks if the keys in the buckets correspond to the result
 // of the key func. Failure here indicates that the key function changed. No error
 // does not guarantee that the key func did not change though (e.g. the identity func
 // would produce no error in this check)
 func (bs *buckets) ValidateBucketKeys(bucketFn BucketSplitConf) error {
 	namePath := filepath.Join(bs.dir, splitConfFile)
-	nameData, err := os.ReadFile(namePath)
+	nameData, err := bs.opts.FS.ReadFile(namePath)
 	if err != nil {
 		// write the split name so we can figure it out later again.
-		if err := renameio.WriteFile(namePath, []byte(bucketFn.Name), 0600); err != nil {
-			// if we couldn't read and write it, then something is very likely wrong.
-			return err
+		// Read-only queues leave that to the next writer.
+		if !bs.opts.OpenMode.readOnly() {
+			if err := bs.opts.FS.WriteFile(namePath, []byte(bucketFn.Name), 0600); err != nil {
+				// if we couldn't read and write it, then something is very likely wrong.
+				return err
+			}
 		}
 	} else {
 		// split file was valid, go check if it's still the desired split func.
@@ -169,7 +418,7 @@ func (bs *buckets) ValidateBucketKeys(bucketFn BucketSplitConf) error {
 }
 
 func (bs *buckets) buckPath(key item.Key) string {
-	return filepath.Join(bs.dir, key.String())
+	return filepath.Join(bs.dir, bs.opts.BucketNameConf.Format(key))
 }
 
 // forKey returns a bucket for the specified key and creates if not there yet.
@@ -179,11 +428,12 @@ func (bs *buckets) forKey(key item.Key) (*bucket, error) {
 	buck, _ := bs.tree.Get(key)
 	if buck != nil {
 		// fast path:
+		bs.metrics.bucketHits++
 		return buck, nil
 	}
 
 	// make room for one so we don't jump over the maximum:
-	if err := bs.closeUnused(bs.opts.MaxParallelOpenBuckets - 1); err != nil {
+	if err := bs.closeUnused(bs.openLimit() - 1); err != nil {
 		return nil, err
 	}
 
@@ -193,7 +443,12 @@ func (bs *buckets) forKey(key item.Key) (*bucket, error) {
 		return nil, err
 	}
 
+	bs.metrics.recordOpen(key)
+	delete(bs.sizes, key)
+
+	// the loaded index might differ from the trailer (e.g. after recovery):
 	bs.tree.Set(key, buck)
+	bs.recount(key, buck)
 	return buck, nil
 }
 
@@ -203,8 +458,13 @@ func (bs *buckets) delete(key item.Key) error {
 		return fmt.Errorf("no bucket with key %v", key)
 	}
 
-	for tk := range bs.trailers {
+	if err := bs.saveSeq(); err != nil {
+		return err
+	}
+
+	for tk, trailer := range bs.trailers {
 		if tk.Key == key {
+			bs.lenOf(tk.fork).Add(-int64(trailer.TotalEntries))
 			delete(bs.trailers, tk)
 		}
 	}
@@ -221,8 +481,11 @@ func (bs *buckets) delete(key item.Key) error {
 	}
 
 	bs.tree.Delete(key)
+	bs.metrics.recordRemove(key, buck != nil)
+	delete(bs.sizes, key)
+	bs.notifyFreed()
 
-	return errors.Join(err, removeBucketDir(dir, bs.forks))
+	return errors.Join(err, removeBucketDir(bs.opts.FS, dir, bs.forks))
 }
 
 type iterMode int
@@ -249,6 +512,12 @@ var errIterStop = errors.New("iteration stopped")
 // MaxParallelOpenBuckets option, i.e. when the mode is `Load` it will immediately close
 // old buckets again before proceeding.
 func (bs *buckets) iter(mode iterMode, fn func(key item.Key, b *bucket) error) error {
+	return bs.iterWhere(mode, nil, fn)
+}
+
+// iterWhere is like iter, but skips the buckets for which `where`
+// returns false before loading them. A nil `where` skips nothing.
+func (bs *buckets) iterWhere(mode iterMode, where func(key item.Key) bool, fn func(key item.Key, b *bucket) error) error {
 	// NOTE: We cannot directly iterate over the tree here, we need to make a copy
 	// of they keys, as the btree library does not like if the tree is modified during iteration.
 	// Modifications can happen in forKey() (which might close unused buckets) or in the user-supplied
@@ -264,6 +533,10 @@ func (bs *buckets) iter(mode iterMode, fn func(key item.Key, b *bucket) error) e
 			continue
 		}
 
+		if where != nil && !where(key) {
+			continue
+		}
+
 		if buck == nil {
 			if mode == loadedOnly {
 				continue
@@ -278,6 +551,8 @@ func (bs *buckets) iter(mode iterMode, fn func(key item.Key, b *bucket) error) e
 					return err
 				}
 			}
+		} else if mode == load {
+			bs.metrics.bucketHits++
 		}
 
 		if err := fn(key, buck); err != nil {
@@ -297,6 +572,13 @@ func (bs *buckets) Sync() error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	start := time.Now()
+	defer bs.metrics.sync.record(start, 0)
+
 	_ = bs.iter(loadedOnly, func(_ item.Key, b *bucket) error {
 		// try to sync as much as possible:
 		err = errors.Join(err, b.Sync(true))
@@ -306,143 +588,595 @@ func (bs *buckets) Sync() error {
 	return err
 }
 
-func (bs *buckets) Clear() error {
+// SyncRange syncs the buckets that may contain keys between `from` and `to`
+// (inclusive). Buckets that are not loaded were synced when they were closed.
+func (bs *buckets) SyncRange(from, to item.Key) error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
-	return bs.clear()
-}
+	if bs.closing.Load() {
+		return ErrClosed
+	}
 
-func (bs *buckets) clear() error {
-	keys := bs.tree.Keys()
-	for _, key := range keys {
-		if err := bs.delete(key); err != nil {
-			return err
+	start := time.Now()
+	defer bs.metrics.sync.record(start, 0)
+
+	var err error
+	toBuckKey := bs.opts.BucketSplitConf.Func(to)
+	bs.tree.Ascend(bs.opts.BucketSplitConf.Func(from), func(key item.Key, b *bucket) bool {
+		if key > toBuckKey {
+			return false
 		}
-	}
 
-	return nil
+		if b != nil {
+			err = errors.Join(err, b.Sync(true))
+		}
+
+		return true
+	})
+
+	return err
 }
 
-func (bs *buckets) Close() error {
+// SetOptions applies `patch` to the options of the queue and all loaded buckets.
+func (bs *buckets) SetOptions(patch OptionsPatch) error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
-	return bs.iter(loadedOnly, func(_ item.Key, b *bucket) error {
-		return b.Close()
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	opts := patch.apply(bs.opts)
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if opts.Logger != bs.opLog {
+		bs.opLog.Logger = opts.Logger
+		opts.Logger = bs.opLog
+	}
+
+	bs.opts = opts
+
+	var err error
+	_ = bs.iter(loadedOnly, func(_ item.Key, b *bucket) error {
+		b.setOptions(opts)
+
+		// flush what was written before syncing was enabled:
+		err = errors.Join(err, b.Sync(false))
+		return nil
 	})
+
+	return errors.Join(err, bs.closeUnused(opts.MaxParallelOpenBuckets))
 }
 
-func (bs *buckets) Len(fork ForkName) int {
-	var len int
+// Prewarm loads up to `n` buckets, starting with the lowest key and advises
+// the kernel to read their data. The number of loaded buckets is limited by
+// MaxParallelOpenBuckets.
+func (bs *buckets) Prewarm(n int) error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
-	_ = bs.iter(includeNil, func(key item.Key, b *bucket) error {
-		if b == nil {
-			trailer, ok := bs.trailers[trailerKey{
-				Key:  key,
-				fork: fork,
-			}]
+	if bs.closing.Load() {
+		return ErrClosed
+	}
 
-			if !ok {
-				bs.opts.Logger.Printf("bug: no trailer for %v", key)
-				return nil
-			}
+	if maxBucks := bs.opts.MaxParallelOpenBuckets; maxBucks > 0 && n > maxBucks {
+		n = maxBucks
+	}
 
-			len += int(trailer.TotalEntries)
-			return nil
+	var nwarmed int
+	return bs.iter(includeNil, func(key item.Key, _ *bucket) error {
+		if nwarmed >= n {
+			return errIterStop
 		}
 
-		len += b.Len(fork)
-		return nil
+		buck, err := bs.forKey(key)
+		if err != nil {
+			return err
+		}
+
+		nwarmed++
+		return buck.WillNeed()
 	})
+}
 
-	return len
+// Clear deletes all items and all forks.
+func (bs *buckets) Clear() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if err := bs.checkWritable(); err != nil {
+		return err
+	}
+
+	return bs.clear(true)
 }
 
-func (bs *buckets) Shovel(dstBs *buckets, fork ForkName) (int, error) {
+// ClearData deletes all items, but keeps the forks.
+func (bs *buckets) ClearData() error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
-	dstBs.mu.Lock()
-	defer dstBs.mu.Unlock()
+	if bs.closing.Load() {
+		return ErrClosed
+	}
 
-	var ntotalcopied int
-	err := bs.iter(includeNil, func(key item.Key, _ *bucket) error {
-		if _, ok := dstBs.tree.Get(key); !ok {
-			// fast path: We can just move the bucket directory.
-			dstPath := dstBs.buckPath(key)
-			srcPath := bs.buckPath(key)
-			dstBs.tree.Set(key, nil)
+	if err := bs.checkWritable(); err != nil {
+		return err
+	}
 
-			if err := index.ReadTrailers(srcPath, func(srcfork string, trailer index.Trailer) {
-				if fork == ForkName(srcfork) {
-					ntotalcopied += int(trailer.TotalEntries)
-				}
+	return bs.clear(false)
+}
 
-				dstBs.trailers[trailerKey{
-					Key:  key,
-					fork: ForkName(srcfork),
-				}] = trailer
-			}); err != nil {
-				return err
-			}
+// clear deletes all buckets and, if `dropForks` is true, all forks.
+// A tombstone is written before, so that an interrupted clear
+// is finished on the next open. See finishClear().
+func (bs *buckets) clear(dropForks bool) error {
+	keys := bs.tree.Keys()
+	if len(keys) == 0 && (!dropForks || len(bs.forks) == 0) {
+		return nil
+	}
 
-			return moveFileOrDir(srcPath, dstPath)
-		}
+	// finishClear() does not know about sequences:
+	if err := bs.saveSeq(); err != nil {
+		return err
+	}
 
-		// In this case we have to copy the items more intelligently,
-		// since we have to append it to the destination
+	if err := writeClearTombstone(bs.opts.FS, bs.dir, keys, dropForks); err != nil {
+		return fmt.Errorf("clear tombstone: %w", err)
+	}
 
-		srcBuck, err := bs.forKey(key)
-		if err != nil {
+	for _, key := range keys {
+		if err := bs.delete(key); err != nil {
 			return err
 		}
+	}
 
-		// NOTE: This assumes that the destination has the same bucket func.
-		dstBuck, err := dstBs.forKey(key)
-		if err != nil {
+	if dropForks {
+		for _, fork := range bs.forks {
+			bs.lenOf(fork).Store(0)
+		}
+
+		bs.forks = []ForkName{}
+		clear(bs.lastRead)
+		if err := writeForks(bs.opts.FS, bs.dir, bs.forks); err != nil {
 			return err
 		}
+	}
 
-		return srcBuck.Read(math.MaxInt, &bs.readBuf, fork, func(items item.Items) (ReadOp, error) {
-			if err := dstBuck.Push(items, true, fork); err != nil {
-				return ReadOpPeek, err
-			}
+	return removeAndSyncDir(bs.opts.FS, filepath.Join(bs.dir, clearTombstoneFile))
+}
 
-			ntotalcopied += len(items)
-			return ReadOpPop, nil
-		})
-	})
+func (bs *buckets) Close() error {
+	return bs.CloseWithContext(context.Background())
+}
 
-	if err != nil {
-		return ntotalcopied, err
+// CloseWithContext makes all new operations return ErrClosed, waits until
+// the running ones are done and then closes all buckets. If `ctx` is done
+// before, ctx.Err() is returned and the buckets are not closed.
+func (bs *buckets) CloseWithContext(ctx context.Context) (err error) {
+	bs.closing.Store(true)
+
+	locked := make(chan struct{})
+	go func() {
+		bs.mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		// we will get the lock at some point; give it back then.
+		go func() {
+			<-locked
+			bs.mu.Unlock()
+		}()
+
+		return ctx.Err()
 	}
 
-	if err := bs.clear(); err != nil {
-		return ntotalcopied, err
+	defer bs.mu.Unlock()
+
+	if bs.closed {
+		return nil
 	}
 
-	return ntotalcopied, err
-}
+	bs.closed = true
+	defer func() {
+		err = errors.Join(err, bs.lock.Unlock())
+	}()
 
-func (bs *buckets) nloaded() int {
-	var nloaded int
-	bs.tree.Scan(func(_ item.Key, buck *bucket) bool {
-		if buck != nil {
-			nloaded++
+	if bs.opts.OpenMode.readOnly() {
+		return bs.iter(loadedOnly, func(_ item.Key, b *bucket) error {
+			return b.Close()
+		})
+	}
+
+	// A failed trim must not keep us from closing, as a second
+	// Close() would do nothing and the buckets would stay open.
+	var trimErr error
+	if bs.opts.TrimOnClose {
+		if err := bs.trim(); err != nil {
+			trimErr = fmt.Errorf("trim: %w", err)
 		}
-		return true
+	}
+
+	err = bs.iter(loadedOnly, func(_ item.Key, b *bucket) error {
+		return b.Close()
 	})
 
-	return nloaded
+	err = errors.Join(err, bs.saveSeq(), bs.saveForkActivity(), bs.saveTotals())
+	if err != nil || bs.tree.Len() == 0 {
+		return errors.Join(trimErr, err)
+	}
+
+	return errors.Join(trimErr, writeLenManifest(bs.opts.FS, bs.dir, bs.trailers))
 }
 
-// closeUnused closes as many buckets as needed to reach `maxBucks` total loaded buckets.
-// The closed buckets are marked as nil and can be loaded again afterwards.
-// If `maxBucks` is negative, this is a no-op.
-func (bs *buckets) closeUnused(maxBucks int) error {
+// Len returns the number of items in `fork`. This does not touch any bucket.
+func (bs *buckets) Len(fork ForkName) int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.len(fork)
+}
+
+func (bs *buckets) len(fork ForkName) int {
+	if counter, ok := bs.lens[fork]; ok {
+		return int(counter.Load())
+	}
+
+	return 0
+}
+
+// CountByBucket returns the number of items in `fork` for each
+// non-empty bucket, sorted by key. No bucket is loaded for this.
+func (bs *buckets) CountByBucket(fork ForkName) []BucketCount {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	counts := []BucketCount{}
+	bs.tree.Scan(func(key item.Key, _ *bucket) bool {
+		trailer := bs.trailers[trailerKey{Key: key, fork: fork}]
+		if trailer.TotalEntries > 0 {
+			count := BucketCount{
+				Key:         key,
+				Len:         int(trailer.TotalEntries),
+				PoppedItems: trailer.Meta.PoppedItems,
+				PoppedBytes: trailer.Meta.PoppedBytes,
+				Tags:        maps.Clone(trailer.Meta.Tags),
+			}
+
+			if trailer.Meta.LastPop != 0 {
+				count.LastPop = time.Unix(0, trailer.Meta.LastPop)
+			}
+
+			counts = append(counts, count)
+		}
+		return true
+	})
+
+	return counts
+}
+
+// SetTag sets a tag of `fork` in the bucket of `key`. See Queue.SetTag().
+func (bs *buckets) SetTag(fork ForkName, key item.Key, name, value string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if bs.opts.OpenMode.readOnly() {
+		return ErrReadOnly
+	}
+
+	key = bs.opts.BucketSplitConf.Func(key)
+	if _, ok := bs.tree.Get(key); !ok {
+		return fmt.Errorf("no bucket with key %v", key)
+	}
+
+	buck, err := bs.forKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := buck.SetTag(fork, name, value); err != nil {
+		return err
+	}
+
+	bs.recount(key, buck)
+	return nil
+}
+
+// SetMeta sets the metadata `key` to `val`. See Queue.SetMeta().
+func (bs *buckets) SetMeta(key, val []byte) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if err := bs.checkWritable(); err != nil {
+		return err
+	}
+
+	meta := maps.Clone(bs.userMeta)
+	if val == nil {
+		delete(meta, string(key))
+	} else {
+		meta[string(key)] = slices.Clone(val)
+	}
+
+	// only take over the change if it was written:
+	if err := writeUserMeta(bs.opts.FS, bs.dir, meta); err != nil {
+		return fmt.Errorf("meta: %w", err)
+	}
+
+	bs.userMeta = meta
+	return nil
+}
+
+// GetMeta returns a copy of the metadata `key`. See Queue.GetMeta().
+func (bs *buckets) GetMeta(key []byte) ([]byte, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	val, ok := bs.userMeta[string(key)]
+	return slices.Clone(val), ok
+}
+
+// Trim removes buckets that are empty for all consumers and files of
+// forks that do not exist anymore. See Queue.Trim().
+func (bs *buckets) Trim() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if bs.opts.OpenMode.readOnly() {
+		return ErrReadOnly
+	}
+
+	return bs.trim()
+}
+
+func (bs *buckets) trim() error {
+	for tk, trailer := range bs.trailers {
+		if tk.fork != "" && !slices.Contains(bs.forks, tk.fork) {
+			bs.lenOf(tk.fork).Add(-int64(trailer.TotalEntries))
+			delete(bs.trailers, tk)
+		}
+	}
+
+	return bs.iter(includeNil, func(key item.Key, buck *bucket) error {
+		if err := trimBucketDir(bs.opts.FS, bs.buckPath(key), bs.forks); err != nil {
+			return err
+		}
+
+		if buck != nil {
+			if buck.AllEmpty() {
+				return bs.delete(key)
+			}
+
+			return nil
+		}
+
+		for tk, trailer := range bs.trailers {
+			if tk.Key == key && trailer.TotalEntries > 0 {
+				return nil
+			}
+		}
+
+		return bs.delete(key)
+	})
+}
+
+// Metrics returns a snapshot of the queue's statistics.
+func (bs *buckets) Metrics() Metrics {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	m := bs.metrics.snapshot()
+	m.Totals = bs.totals.clone()
+	m.BucketsLoaded = bs.nloaded()
+	m.Buckets = bs.tree.Len()
+	m.OpenBucketLimit = bs.opts.MaxParallelOpenBuckets
+	if bs.opts.MemorySoftLimit > 0 {
+		m.OpenBucketLimit = bs.adaptiveLimit
+	}
+
+	return m
+}
+
+// LenExact counts the items in `fork` by summing up the index of each
+// loaded bucket and the trailers of the unloaded ones. The cached count
+// is corrected, in case it drifted.
+func (bs *buckets) LenExact(fork ForkName) int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.lenExact(fork)
+}
+
+func (bs *buckets) lenExact(fork ForkName) int {
+	var len int
+	_ = bs.iter(includeNil, func(key item.Key, b *bucket) error {
+		if b == nil {
+			len += int(bs.trailers[trailerKey{Key: key, fork: fork}].TotalEntries)
+			return nil
+		}
+
+		len += b.Len(fork)
+		return nil
+	})
+
+	if counter, ok := bs.lens[fork]; ok {
+		if prev := counter.Swap(int64(len)); prev != int64(len) {
+			bs.opts.Logger.Printf("bug: cached len of fork »%s« was %d, not %d", fork, prev, len)
+		}
+	}
+
+	return len
+}
+
+func (bs *buckets) Shovel(dstBs *buckets, fork ForkName) (ntotalcopied int, err error) {
+	op := bs.opLog.newOp("shovel")
+	defer func() { err = op.wrap(err) }()
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return 0, ErrClosed
+	}
+
+	defer bs.opLog.enter(op)()
+	defer bs.labelOp("shovel")()
+
+	if err := bs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	dstBs.mu.Lock()
+	defer dstBs.mu.Unlock()
+
+	if dstBs.closing.Load() {
+		return 0, ErrClosed
+	}
+
+	if err := dstBs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	// the destination logs with the same ID:
+	defer dstBs.opLog.enter(op)()
+
+	err = bs.iter(includeNil, func(key item.Key, buck *bucket) error {
+		defer bs.labelBucket(key)()
+
+		if _, ok := dstBs.tree.Get(key); !ok {
+			// fast path: We can just move the bucket directory.
+			dstPath := dstBs.buckPath(key)
+			srcPath := bs.buckPath(key)
+			dstBs.tree.Set(key, nil)
+
+			// the trailers are read from disk below and the bucket
+			// must not write to the directory after it was moved:
+			if buck != nil {
+				if err := buck.Sync(true); err != nil {
+					return err
+				}
+			}
+
+			if err := index.ReadTrailers(srcPath, func(srcfork string, trailer index.Trailer) {
+				if fork == ForkName(srcfork) {
+					ntotalcopied += int(trailer.TotalEntries)
+				}
+
+				dstBs.trailers[trailerKey{
+					Key:  key,
+					fork: ForkName(srcfork),
+				}] = trailer
+				dstBs.lenOf(ForkName(srcfork)).Add(int64(trailer.TotalEntries))
+			}); err != nil {
+				return err
+			}
+
+			return moveFileOrDir(bs.opts.FS, srcPath, dstPath)
+		}
+
+		// In this case we have to copy the items more intelligently,
+		// since we have to append it to the destination
+
+		srcBuck, err := bs.forKey(key)
+		if err != nil {
+			return err
+		}
+
+		// NOTE: This assumes that the destination has the same bucket func.
+		dstBuck, err := dstBs.forKey(key)
+		if err != nil {
+			return err
+		}
+
+		defer dstBs.recount(key, dstBuck)
+		return srcBuck.Read(math.MaxInt, &bs.readBuf, fork, func(items item.Items) (ReadOp, error) {
+			if err := dstBuck.Push(items, true, fork); err != nil {
+				return ReadOpPeek, err
+			}
+
+			ntotalcopied += len(items)
+			return ReadOpPop, nil
+		})
+	})
+
+	if err != nil {
+		return ntotalcopied, err
+	}
+
+	if ntotalcopied > 0 {
+		dstBs.notifyPushed()
+	}
+
+	if err := bs.clear(false); err != nil {
+		return ntotalcopied, err
+	}
+
+	return ntotalcopied, err
+}
+
+// MergeFrom pops the items of `fork` in `src` and pushes them to `bs`.
+// See Queue.MergeFrom().
+func (bs *buckets) MergeFrom(src *buckets, fork ForkName) (int, error) {
+	if bs == src {
+		return 0, errors.New("merge: cannot merge a queue into itself")
+	}
+
+	var nmerged int
+	err := src.Read(-1, fork, func(_ Transaction, items Items) (ReadOp, error) {
+		// NOTE: items are only popped once they were pushed to `bs`.
+		if err := bs.Push(items, true); err != nil {
+			return ReadOpPeek, err
+		}
+
+		nmerged += len(items)
+		return ReadOpPop, nil
+	})
+
+	if err != nil {
+		return nmerged, fmt.Errorf("merge: %w", err)
+	}
+
+	return nmerged, nil
+}
+
+func (bs *buckets) nloaded() int {
+	var nloaded int
+	bs.tree.Scan(func(_ item.Key, buck *bucket) bool {
+		if buck != nil {
+			nloaded++
+		}
+		return true
+	})
+
+	return nloaded
+}
+
+// closeUnused closes as many buckets as needed to reach `maxBucks` total loaded buckets.
+// The closed buckets are marked as nil and can be loaded again afterwards.
+// If `maxBucks` is negative, this is a no-op.
+func (bs *buckets) closeUnused(maxBucks int) error {
 	if maxBucks < 0 {
 		// This disables this feature. You likely do not want that.
 		return nil
@@ -477,196 +1211,765 @@ func (bs *buckets) closeUnused(maxBucks int) error {
 			realIdx = pivotIdx + idx/2
 		}
 
-		key, buck, ok := bs.tree.GetAt(realIdx)
-		if !ok {
-			// should not happen, but better be safe.
-			continue
+		key, buck, ok := bs.tree.GetAt(realIdx)
+		if !ok {
+			// should not happen, but better be safe.
+			continue
+		}
+
+		if buck == nil {
+			// already closed.
+			continue
+		}
+
+		if bs.view != nil && buck == bs.view.current {
+			// a transaction push needs room, but this one is being read.
+			continue
+		}
+
+		// We need to store the trailers of each fork, so we know how to
+		// calculcate the length of the queue without having to load everything.
+		bs.recount(key, buck)
+		bs.cacheSize(key, buck.DataSize())
+
+		if err := buck.Close(); err != nil {
+			switch bs.opts.ErrorMode {
+			case ErrorModeAbort:
+				closeErrs = errors.Join(closeErrs, err)
+			case ErrorModeContinue:
+				bs.opts.Logger.Printf("failed to reap bucket %s", key)
+			}
+		}
+
+		bs.tree.Set(key, nil)
+		bs.metrics.recordEvict(key)
+		nClosed++
+	}
+
+	return closeErrs
+}
+
+// binsplit returns the first index of `items` that would
+// not go to the bucket `comp`. There are two assumptions:
+//
+// * "items" is not empty.
+// * "comp" exists for at least one fn(item.Key)
+// * The first key in `items` must be fn(key) == comp
+//
+// If assumptions are not fulfilled you will get bogus results.
+func binsplit(items item.Items, comp item.Key, fn func(item.Key) item.Key) int {
+	l := len(items)
+	if l == 0 {
+		return 0
+	}
+	if l == 1 {
+		return 1
+	}
+
+	pivotIdx := l / 2
+	pivotKey := fn(items[pivotIdx].Key)
+	if pivotKey != comp {
+		// search left:
+		return binsplit(items[:pivotIdx], comp, fn)
+	}
+
+	// search right:
+	return pivotIdx + binsplit(items[pivotIdx:], comp, fn)
+}
+
+func (bs *buckets) Push(items item.Items, locked bool) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+
+	op := bs.opLog.newOp("push")
+	defer func() { err = op.wrap(err) }()
+
+	// validate before sorting, so the indexes in the error match the caller's:
+	items, pushErr := validateItems(items)
+	repl, err := bs.push(op, items, pushErr, locked)
+	if err != nil {
+		return err
+	}
+
+	// Pushes in a transaction are not replicated.
+	// Those are usually re-queues of items that the replicas have already.
+	if locked {
+		if err := repl.replicate(items); err != nil {
+			return err
+		}
+	}
+
+	if pushErr != nil {
+		return pushErr
+	}
+
+	return nil
+}
+
+// push pushes the valid `items` of a batch; `pushErr` tells about the
+// invalid ones, if any. It returns the replicas as they were configured
+// while bs.mu was held, so they can be used after it was released.
+func (bs *buckets) push(op opID, items item.Items, pushErr *PushError, locked bool) (replication, error) {
+	slices.SortFunc(items, func(i, j item.Item) int {
+		return int(i.Key - j.Key)
+	})
+
+	if locked {
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+
+		if bs.closing.Load() {
+			return replication{}, ErrClosed
+		}
+
+		// re-queues in a transaction are fine, see Queue.Demote().
+		if bs.follower {
+			return replication{}, ErrFollower
+		}
+	}
+
+	if pushErr != nil {
+		if bs.opts.ErrorMode == ErrorModeAbort || len(items) == 0 {
+			return replication{}, pushErr
+		}
+
+		pushErr.Written = true
+	}
+
+	defer bs.opLog.enter(op)()
+	defer bs.labelOp("push")()
+
+	if err := bs.checkWritable(); err != nil {
+		return replication{}, err
+	}
+
+	// pushes in a transaction are not limited; those are usually re-queues.
+	if locked && bs.isFull() {
+		return replication{}, ErrQueueFull
+	}
+
+	start := time.Now()
+	err := bs.diskFull(bs.pushSorted(items, true, "", bs.nextSeq()))
+	bs.metrics.push.record(start, len(items))
+	if err == nil {
+		bs.totals.Pushed = bs.totals.Pushed.plus(volumeOf(items))
+	}
+
+	bs.checkLags()
+	bs.notifyPushed()
+	return bs.replication(), err
+}
+
+// Sort items into the respective buckets. `all`, `fork` and
+// `seq` have the same meaning as for bucket.PushSeq().
+func (bs *buckets) pushSorted(items item.Items, all bool, fork ForkName, seq uint64) error {
+	for len(items) > 0 {
+		keyMod := bs.opts.BucketSplitConf.Func(items[0].Key)
+		nextIdx := binsplit(items, keyMod, bs.opts.BucketSplitConf.Func)
+		restoreLabels := bs.labelBucket(keyMod)
+		buck, err := bs.forKey(keyMod)
+		if err != nil {
+			restoreLabels()
+			if bs.opts.ErrorMode == ErrorModeAbort {
+				return fmt.Errorf("bucket: for-key: %w", err)
+			}
+
+			bs.opts.Logger.Printf("failed to push: %v", err)
+		} else {
+			bs.view.notePush(keyMod, buck)
+			err := buck.PushSeq(items[:nextIdx], all, fork, seq)
+			restoreLabels()
+			bs.recount(keyMod, buck)
+			if err != nil {
+				if bs.opts.ErrorMode == ErrorModeAbort {
+					return fmt.Errorf("bucket: push: %w", err)
+				}
+
+				bs.opts.Logger.Printf("failed to push: %v", err)
+			}
+		}
+
+		items = items[nextIdx:]
+	}
+
+	return nil
+}
+
+// lockActive locks `buck` in memory and unlocks the previously locked bucket.
+func (bs *buckets) lockActive(key item.Key, buck *bucket) {
+	if !bs.opts.LockActiveBucket || bs.locked == buck {
+		return
+	}
+
+	// The old bucket might have been closed already,
+	// which also releases the lock, so check first.
+	if curr, _ := bs.tree.Get(bs.lockedKey); bs.locked != nil && curr == bs.locked {
+		if err := bs.locked.Unlock(); err != nil {
+			bs.opts.Logger.Printf("failed to unlock bucket %v: %v", bs.lockedKey, err)
+		}
+	}
+
+	bs.locked, bs.lockedKey = nil, 0
+	if err := buck.Lock(); err != nil {
+		bs.opts.Logger.Printf("failed to lock bucket %v: %v", key, err)
+		return
+	}
+
+	bs.locked, bs.lockedKey = buck, key
+}
+
+// readAhead pages in the start of the bucket after `key` in a helper
+// goroutine, so it is in memory once Read() gets there. `n` is the number
+// of items that are still to be read. The returned function stops the
+// helper and waits for it; it has to be called before the lock is released.
+// See Options.ReadAhead.
+func (bs *buckets) readAhead(key item.Key, fork ForkName, n int, where func(key item.Key) bool) func() {
+	if bs.opts.ReadAhead <= 0 {
+		return func() {}
+	}
+
+	var nextKey item.Key
+	var next *bucket
+	var found bool
+	bs.tree.Ascend(key, func(k item.Key, b *bucket) bool {
+		if k == key || (where != nil && !where(k)) {
+			return true
+		}
+
+		nextKey, next, found = k, b, true
+		return false
+	})
+
+	if !found {
+		return func() {}
+	}
+
+	done := make(chan error, 1)
+	if next == nil {
+		// not loaded yet; the page cache is the best we can fill.
+		path := filepath.Join(bs.buckPath(nextKey), dataLogName)
+		go func() {
+			done <- vlog.PageInFile(path, bs.opts.ReadAhead)
+		}()
+
+		return func() {
+			// the bucket might have been deleted in the meantime:
+			if err := filterIsNotExist(<-done); err != nil {
+				bs.opts.Logger.Printf("failed to read ahead bucket %v: %v", nextKey, err)
+			}
+		}
+	}
+
+	region := next.readAheadRegion(fork, n, bs.opts.ReadAhead)
+	if len(region) == 0 {
+		return func() {}
+	}
+
+	// the transaction might push to (or close) the next bucket meanwhile:
+	log := next.log
+	log.Pin()
+
+	var stop atomic.Bool
+	go func() {
+		vlog.PageIn(region, &stop)
+		done <- nil
+	}()
+
+	return func() {
+		stop.Store(true)
+		<-done
+		if err := log.Unpin(); err != nil {
+			bs.opts.Logger.Printf("failed to read ahead bucket %v: %v", nextKey, err)
+		}
+	}
+}
+
+func (bs *buckets) Read(n int, fork ForkName, fn TransactionFn) (err error) {
+	return bs.ReadWhere(n, fork, nil, fn)
+}
+
+// ReadWhere is like Read, but only reads from the buckets
+// for which `where` returns true. See iterWhere().
+func (bs *buckets) ReadWhere(n int, fork ForkName, where func(key item.Key) bool, fn TransactionFn) (err error) {
+	if n < 0 {
+		// use max value to select all.
+		n = int(^uint(0) >> 1)
+	}
+
+	op := bs.opLog.newOp("read")
+	defer func() { err = op.wrap(err) }()
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() && bs.tree.Len() > 0 {
+		// reading an empty queue is still fine, nothing gets touched.
+		return ErrClosed
+	}
+
+	defer bs.opLog.enter(op)()
+	defer bs.labelOp("read")()
+
+	bs.noteRead(fork)
+	if bs.paused[fork] {
+		return nil
+	}
+
+	var count, npopped = n, 0
+	start := time.Now()
+	defer func() {
+		bs.metrics.read.record(start, npopped)
+		bs.checkLags()
+		if npopped > 0 {
+			bs.notifyFreed()
+		}
+	}()
+
+	tx := &tx{bs: bs}
+	view := &readView{}
+	bs.view = view
+	defer func() { bs.view = nil }()
+
+	openedBefore := bs.metrics.bucketsOpened
+	err = bs.iterWhere(load, where, func(key item.Key, b *bucket) error {
+		defer bs.labelBucket(key)()
+		view.current = b
+
+		if count == n && where == nil {
+			// first bucket we read from is the active one:
+			bs.lockActive(key, b)
+		}
+
+		// pushes of the transaction to this bucket change its length,
+		// so count the popped items instead of comparing lengths.
+		var bucketPopped int
+
+		// wrap the bucket call into something that knows about
+		// transactions - bucket itself does not care about that.
+		wrappedFn := func(items Items) (ReadOp, error) {
+			if len(items) > 0 {
+				tx.stats.Buckets++
+				tx.stats.Batches += b.lastBatches()
+				tx.stats.Bytes += int64(items.StorageSize())
+			}
+
+			tx.stats.Loaded = int(bs.metrics.bucketsOpened - openedBefore)
+
+			op, err := fn(tx, items)
+			if err == nil && op == ReadOpPop && bs.opts.OpenMode.readOnly() {
+				return ReadOpPeek, ErrReadOnly
+			}
+
+			if err == nil && op == ReadOpPop {
+				npopped += len(items)
+				bucketPopped += len(items)
+				bs.metrics.recordQueueTime(time.Now(), items)
+				bs.totals.notePopped(fork, volumeOf(items))
+			}
+
+			return op, err
+		}
+
+		waitReadAhead := bs.readAhead(key, fork, count, where)
+		err := b.ReadBelow(count, &bs.readBuf, fork, view.limit(key), wrappedFn)
+		waitReadAhead()
+		bs.recount(key, b)
+		if err != nil {
+			if bs.opts.ErrorMode == ErrorModeAbort || errors.Is(err, ErrReadOnly) {
+				return err
+			}
+
+			// try with the next bucket in the hope that it works:
+			bs.opts.Logger.Printf("failed to pop: %v", err)
+			return nil
+		}
+
+		if b.AllEmpty() && !bs.opts.OpenMode.readOnly() {
+			if err := bs.delete(key); err != nil {
+				return fmt.Errorf("failed to delete bucket: %w", err)
+			}
+		}
+
+		count -= bucketPopped
+		if count <= 0 {
+			return errIterStop
+		}
+
+		return nil
+	})
+
+	// pops write to the index logs, so they can fail on a full disk too:
+	return bs.diskFull(err)
+}
+
+// readView keeps what a single Read() sees stable while its transaction
+// pushes: items pushed by the transaction are not returned by the same
+// Read(), even if they go to a bucket that is read later on, and the bucket
+// that is being read is not closed to make room for other buckets.
+// Other goroutines cannot push during Read(), as it holds the lock.
+type readView struct {
+	// current is the bucket that is being read.
+	current *bucket
+
+	// limits holds the size of the value log of each bucket before
+	// the first push to it during the read. Later batches are not read.
+	limits map[item.Key]item.Off
+}
+
+// notePush must be called before pushing to `buck`. A nil view does nothing.
+func (v *readView) notePush(key item.Key, buck *bucket) {
+	if v == nil {
+		return
+	}
+
+	if _, ok := v.limits[key]; ok {
+		return
+	}
+
+	if v.limits == nil {
+		v.limits = make(map[item.Key]item.Off)
+	}
+
+	v.limits[key] = item.Off(buck.log.Size())
+}
+
+// limit returns what can be passed to bucket.ReadBelow() for `key`.
+func (v *readView) limit(key item.Key) item.Off {
+	if below, ok := v.limits[key]; ok {
+		return below
+	}
+
+	return allOffs
+}
+
+// PeekRef peeks at up to `n` items of `fork` without copying them.
+// See Queue.PeekRef() for details.
+func (bs *buckets) PeekRef(n int, fork ForkName) (ItemsRef, error) {
+	if n < 0 {
+		// use max value to select all.
+		n = int(^uint(0) >> 1)
+	}
+
+	items, logs, ok := bs.peekShared(n, fork)
+	if !ok {
+		bs.mu.Lock()
+		var err error
+		items, logs, err = bs.peekLocked(n, fork, logs)
+		bs.mu.Unlock()
+
+		if err != nil {
+			return ItemsRef{}, err
+		}
+	}
+
+	var released bool
+	return ItemsRef{
+		Items: items,
+		release: func() error {
+			bs.mu.Lock()
+			defer bs.mu.Unlock()
+
+			if released {
+				return nil
+			}
+
+			// NOTE: The logs might be closed already, but
+			// they keep their memory until they're unpinned.
+			released = true
+			return unpinAll(logs)
+		},
+	}, nil
+}
+
+// peekShared is PeekRef() for the common case that the buckets to peek at
+// are loaded already. It only takes the read lock, so several goroutines can
+// peek at the same time. ok is false if a bucket would need to be loaded or
+// something else went wrong; peekLocked() has to be used then. The logs are
+// pinned in any case, but may only be unpinned with the write lock held.
+func (bs *buckets) peekShared(n int, fork ForkName) (items Items, logs []*vlog.Log, ok bool) {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	if bs.closing.Load() && bs.tree.Len() > 0 {
+		return nil, nil, false
+	}
+
+	bs.noteRead(fork)
+	if bs.paused[fork] {
+		return nil, nil, true
+	}
+
+	ok = true
+	bs.tree.Scan(func(_ item.Key, b *bucket) bool {
+		if b == nil {
+			ok = false
+			return false
+		}
+
+		peeked, log, err := b.PeekPinned(n-len(items), fork)
+		if err != nil {
+			ok = false
+			return false
+		}
+
+		if log != nil {
+			logs = append(logs, log)
+		}
+
+		items = append(items, peeked...)
+		return len(items) < n
+	})
+
+	return items, logs, ok
+}
+
+// peekLocked is PeekRef() with the write lock held, which loads buckets if
+// needed. `pinned` are logs from peekShared() that are unpinned first.
+func (bs *buckets) peekLocked(n int, fork ForkName, pinned []*vlog.Log) (Items, []*vlog.Log, error) {
+	if err := unpinAll(pinned); err != nil {
+		return nil, nil, err
+	}
+
+	if bs.closing.Load() && bs.tree.Len() > 0 {
+		return nil, nil, ErrClosed
+	}
+
+	bs.noteRead(fork)
+	if bs.paused[fork] {
+		return nil, nil, nil
+	}
+
+	var items Items
+	var logs []*vlog.Log
+	err := bs.iter(load, func(key item.Key, b *bucket) error {
+		peeked, log, err := b.PeekPinned(n-len(items), fork)
+		if err != nil {
+			if bs.opts.ErrorMode == ErrorModeAbort {
+				return err
+			}
+
+			// try with the next bucket in the hope that it works:
+			bs.opts.Logger.Printf("failed to peek: %v", err)
+			return nil
+		}
+
+		if log != nil {
+			logs = append(logs, log)
 		}
 
-		if buck == nil {
-			// already closed.
-			continue
+		items = append(items, peeked...)
+		if len(items) >= n {
+			return errIterStop
 		}
 
-		// We need to store the trailers of each fork, so we know how to
-		// calculcate the length of the queue without having to load everything.
-		buck.Trailers(func(fork ForkName, trailer index.Trailer) {
-			bs.trailers[trailerKey{
-				Key:  key,
-				fork: fork,
-			}] = trailer
-		})
+		return nil
+	})
 
-		if err := buck.Close(); err != nil {
-			switch bs.opts.ErrorMode {
-			case ErrorModeAbort:
-				closeErrs = errors.Join(closeErrs, err)
-			case ErrorModeContinue:
-				bs.opts.Logger.Printf("failed to reap bucket %s", key)
-			}
-		}
+	if err != nil {
+		return nil, nil, errors.Join(err, unpinAll(logs))
+	}
 
-		bs.tree.Set(key, nil)
-		// bs.trailers[key] = trailer
-		nClosed++
+	return items, logs, nil
+}
+
+func unpinAll(logs []*vlog.Log) error {
+	var err error
+	for _, log := range logs {
+		err = errors.Join(err, log.Unpin())
 	}
 
-	return closeErrs
+	return err
 }
 
-// binsplit returns the first index of `items` that would
-// not go to the bucket `comp`. There are two assumptions:
-//
-// * "items" is not empty.
-// * "comp" exists for at least one fn(item.Key)
-// * The first key in `items` must be fn(key) == comp
-//
-// If assumptions are not fulfilled you will get bogus results.
-func binsplit(items item.Items, comp item.Key, fn func(item.Key) item.Key) int {
-	l := len(items)
-	if l == 0 {
-		return 0
+func (bs *buckets) Delete(fork ForkName, from, to item.Key) (DeleteResult, error) {
+	if to < from {
+		return DeleteResult{}, fmt.Errorf("delete: `to` must be >= `from`")
 	}
-	if l == 1 {
-		return 1
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return DeleteResult{}, ErrClosed
 	}
 
-	pivotIdx := l / 2
-	pivotKey := fn(items[pivotIdx].Key)
-	if pivotKey != comp {
-		// search left:
-		return binsplit(items[:pivotIdx], comp, fn)
+	if err := bs.checkWritable(); err != nil {
+		return DeleteResult{}, err
 	}
 
-	// search right:
-	return pivotIdx + binsplit(items[pivotIdx:], comp, fn)
+	var res DeleteResult
+	err := bs.deleteRange(&res, fork, from, to, nil, nil)
+	return res, err
 }
 
-func (bs *buckets) Push(items item.Items, locked bool) error {
-	if len(items) == 0 {
-		return nil
+// DeleteFunc is like Delete, but only deletes items for which `keep` returns false.
+func (bs *buckets) DeleteFunc(fork ForkName, from, to item.Key, keep func(item.Item) bool) (int, error) {
+	if to < from {
+		return 0, fmt.Errorf("delete: `to` must be >= `from`")
 	}
 
-	slices.SortFunc(items, func(i, j item.Item) int {
-		return int(i.Key - j.Key)
-	})
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
 
-	if locked {
-		bs.mu.Lock()
-		defer bs.mu.Unlock()
+	if bs.closing.Load() {
+		return 0, ErrClosed
 	}
 
-	return bs.pushSorted(items)
+	if err := bs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	var res DeleteResult
+	err := bs.deleteRange(&res, fork, from, to, keep, nil)
+	return res.Items, err
 }
 
-// Sort items into the respective buckets:
-func (bs *buckets) pushSorted(items item.Items) error {
-	for len(items) > 0 {
-		keyMod := bs.opts.BucketSplitConf.Func(items[0].Key)
-		nextIdx := binsplit(items, keyMod, bs.opts.BucketSplitConf.Func)
-		buck, err := bs.forKey(keyMod)
-		if err != nil {
-			if bs.opts.ErrorMode == ErrorModeAbort {
-				return fmt.Errorf("bucket: for-key: %w", err)
-			}
+// PopDelete is like Delete, but passes the items to `fn` before deleting them.
+func (bs *buckets) PopDelete(fork ForkName, from, to item.Key, fn func(item.Items) error) (int, error) {
+	if to < from {
+		return 0, fmt.Errorf("delete: `to` must be >= `from`")
+	}
 
-			bs.opts.Logger.Printf("failed to push: %v", err)
-		} else {
-			if err := buck.Push(items[:nextIdx], true, ""); err != nil {
-				if bs.opts.ErrorMode == ErrorModeAbort {
-					return fmt.Errorf("bucket: push: %w", err)
-				}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
 
-				bs.opts.Logger.Printf("failed to push: %v", err)
-			}
-		}
+	if bs.closing.Load() {
+		return 0, ErrClosed
+	}
 
-		items = items[nextIdx:]
+	if err := bs.checkWritable(); err != nil {
+		return 0, err
 	}
 
-	return nil
+	var res DeleteResult
+	err := bs.deleteRange(&res, fork, from, to, nil, fn)
+	return res.Items, err
 }
 
-func (bs *buckets) Read(n int, fork ForkName, fn TransactionFn) error {
-	if n < 0 {
-		// use max value to select all.
-		n = int(^uint(0) >> 1)
+// Reprioritize changes the key of all items of `fork` between `from` and `to`
+// to what `shift` returns. See Queue.Reprioritize().
+func (bs *buckets) Reprioritize(fork ForkName, from, to item.Key, shift func(item.Key) item.Key) (int, error) {
+	if to < from {
+		return 0, fmt.Errorf("reprioritize: `to` must be >= `from`")
 	}
 
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
-	var count = n
-	return bs.iter(load, func(key item.Key, b *bucket) error {
-		lenBefore := b.Len(fork)
+	if bs.closing.Load() {
+		return 0, ErrClosed
+	}
 
-		// wrap the bucket call into something that knows about
-		// transactions - bucket itself does not care about that.
-		wrappedFn := func(items Items) (ReadOp, error) {
-			return fn(&tx{bs}, items)
+	if err := bs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	// loading buckets changes the tree, so don't do it while iterating:
+	var buckKeys []item.Key
+	toBuckKey := bs.opts.BucketSplitConf.Func(to)
+	bs.tree.Ascend(bs.opts.BucketSplitConf.Func(from), func(key item.Key, _ *bucket) bool {
+		if key > toBuckKey {
+			return false
 		}
 
-		if err := b.Read(count, &bs.readBuf, fork, wrappedFn); err != nil {
-			if bs.opts.ErrorMode == ErrorModeAbort {
-				return err
-			}
+		buckKeys = append(buckKeys, key)
+		return true
+	})
 
-			// try with the next bucket in the hope that it works:
-			bs.opts.Logger.Printf("failed to pop: %v", err)
-			return nil
+	var items item.Items
+	for _, key := range buckKeys {
+		buck, err := bs.forKey(key)
+		if err != nil {
+			return 0, err
 		}
 
-		if b.AllEmpty() {
-			if err := bs.delete(key); err != nil {
-				return fmt.Errorf("failed to delete bucket: %w", err)
-			}
+		buckItems, err := buck.collectRange(fork, from, to, nil)
+		if err != nil {
+			return 0, err
 		}
 
-		lenAfter := b.Len(fork)
+		items = append(items, buckItems...)
+	}
 
-		count -= (lenBefore - lenAfter)
-		if count <= 0 {
-			return errIterStop
-		}
+	if len(items) == 0 {
+		return 0, nil
+	}
 
-		return nil
+	moved := make(map[string]int, len(items))
+	shifted := make(item.Items, 0, len(items))
+	for _, it := range items {
+		moved[itemID(it)]++
+		shifted = append(shifted, item.Item{Key: shift(it.Key), Blob: it.Blob})
+	}
+
+	slices.SortStableFunc(shifted, func(a, b item.Item) int {
+		return cmp.Compare(a.Key, b.Key)
 	})
+
+	// push first, so a crash in between leads to duplicates and not to lost items.
+	if err := bs.diskFull(bs.pushSorted(shifted, false, fork, 0)); err != nil {
+		return 0, err
+	}
+
+	bs.checkLags()
+	bs.notifyPushed()
+
+	// the new keys might be in the range too, so only delete the old items:
+	err := bs.deleteRange(&DeleteResult{}, fork, from, to, func(it item.Item) bool {
+		id := itemID(it)
+		if moved[id] > 0 {
+			moved[id]--
+			return false
+		}
+
+		return true
+	}, nil)
+
+	return len(items), err
 }
 
-func (bs *buckets) Delete(fork ForkName, from, to item.Key) (int, error) {
+// deleteRange deletes the items between `from` and `to` in `fork`
+// and adds what it deleted to `res`, also if an error is returned.
+// If `keep` is not nil, only the items for which it returns false are deleted.
+// If `onDelete` is not nil, it gets the items of each bucket before they are
+// deleted. Errors returned by it stop the deletion.
+func (bs *buckets) deleteRange(
+	res *DeleteResult,
+	fork ForkName,
+	from, to item.Key,
+	keep func(item.Item) bool,
+	onDelete func(item.Items) error,
+) error {
 	var numDeleted int
 	var deletableBucks []item.Key
 
-	if to < from {
-		return 0, fmt.Errorf("delete: `to` must be >= `from`")
-	}
-
-	bs.mu.Lock()
-	defer bs.mu.Unlock()
-
 	// use the bucket func to figure out which buckets the range limits would be in.
 	// those buckets might not really exist though.
 	toBuckKey := bs.opts.BucketSplitConf.Func(to)
 	fromBuckKey := bs.opts.BucketSplitConf.Func(from)
 
 	iter := bs.tree.Iter()
-	if !iter.Seek(fromBuckKey) {
-		// all buckets that we have are > to. Nothing to delete.
-		return 0, nil
-	}
-
-	// Seek() already sets the iter.Value(), so iteration becomes a bit awkward.
-	for {
+	for ok := iter.Seek(fromBuckKey); ok; ok = iter.Next() {
 		buckKey := iter.Key()
 		if buckKey > toBuckKey {
 			// too far, stop it.
 			break
 		}
 
+		if keep == nil && onDelete == nil && bs.deletableWhole(fork, buckKey, from, to) {
+			// no need to load the bucket just to mark everything as deleted:
+			numDeletedOfBucket := int(bs.trailers[trailerKey{Key: buckKey, fork: fork}].TotalEntries)
+			res.add(buckKey, numDeletedOfBucket)
+			numDeleted += numDeletedOfBucket
+			deletableBucks = append(deletableBucks, buckKey)
+			continue
+		}
+
 		buck, err := bs.forKey(buckKey)
 		if err != nil {
 			if bs.opts.ErrorMode == ErrorModeAbort {
-				return numDeleted, err
+				return err
 			}
 
 			// try with the next bucket in the hope that it works:
@@ -676,34 +1979,173 @@ func (bs *buckets) Delete(fork ForkName, from, to item.Key) (int, error) {
 				err,
 			)
 		} else {
-			numDeletedOfBucket, err := buck.Delete(fork, from, to)
+			if onDelete != nil {
+				items, err := buck.collectRange(fork, from, to, keep)
+				if err != nil {
+					return err
+				}
+
+				if len(items) > 0 {
+					if err := onDelete(items); err != nil {
+						return err
+					}
+				}
+			}
+
+			var numDeletedOfBucket int
+			if keep == nil {
+				numDeletedOfBucket, err = buck.Delete(fork, from, to)
+			} else {
+				numDeletedOfBucket, err = buck.DeleteFunc(fork, from, to, keep)
+			}
+
+			bs.recount(buckKey, buck)
 			if err != nil {
 				if bs.opts.ErrorMode == ErrorModeAbort {
-					return numDeleted, err
+					return err
 				}
 
 				// try with the next bucket in the hope that it works:
 				bs.opts.Logger.Printf("failed to delete : %v", err)
 			} else {
+				res.add(buckKey, numDeletedOfBucket)
 				numDeleted += numDeletedOfBucket
 				if buck.AllEmpty() {
 					deletableBucks = append(deletableBucks, buckKey)
 				}
 			}
 		}
+	}
 
-		if !iter.Next() {
-			break
-		}
+	if numDeleted > 0 {
+		bs.notifyFreed()
 	}
 
 	for _, bucketKey := range deletableBucks {
-		if err := bs.delete(bucketKey); err != nil {
-			return numDeleted, fmt.Errorf("bucket delete: %w", err)
+		if err := bs.dropBucket(res, bucketKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropBucket removes the bucket with `key` and adds it to `res`.
+func (bs *buckets) dropBucket(res *DeleteResult, key item.Key) error {
+	buck, _ := bs.tree.Get(key)
+	size := bs.bucketSize(key, buck)
+	if err := bs.delete(key); err != nil {
+		return fmt.Errorf("bucket delete: %w", err)
+	}
+
+	res.drop(key, size)
+	return nil
+}
+
+// coversBucket returns true if all keys that go to the bucket
+// with `key` lie between `from` and `to` (both including).
+func (bs *buckets) coversBucket(key, from, to item.Key) bool {
+	// The bucket func is monotonic, so if the bucket before `from` is a
+	// different one, the bucket contains only keys >= from. The bucket key
+	// itself says nothing about that, keys below it may go to the bucket too.
+	if from != math.MinInt64 && bs.opts.BucketSplitConf.Func(from-1) >= key {
+		return false
+	}
+
+	// Likewise, if the bucket after `to` is a different
+	// one, the bucket contains only keys <= to.
+	return to == math.MaxInt64 || bs.opts.BucketSplitConf.Func(to+1) > key
+}
+
+// deletableWhole returns true if the bucket with `key` can be removed
+// when deleting `from` to `to` of `fork`: the range has to cover it
+// and the other consumers must not have items in it.
+func (bs *buckets) deletableWhole(fork ForkName, key, from, to item.Key) bool {
+	if !bs.coversBucket(key, from, to) {
+		return false
+	}
+
+	for _, consumer := range append([]ForkName{""}, bs.forks...) {
+		if consumer == fork {
+			continue
+		}
+
+		if bs.trailers[trailerKey{Key: key, fork: consumer}].TotalEntries > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ClearRange deletes the items from `from` to `to` (both including) for the
+// queue and all of its forks. Buckets that are completely covered by the
+// range are removed without loading them.
+func (bs *buckets) ClearRange(from, to item.Key) (DeleteResult, error) {
+	if to < from {
+		return DeleteResult{}, fmt.Errorf("clear range: `to` must be >= `from`")
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return DeleteResult{}, ErrClosed
+	}
+
+	if err := bs.checkWritable(); err != nil {
+		return DeleteResult{}, err
+	}
+
+	consumers := append([]ForkName{""}, bs.forks...)
+
+	var res DeleteResult
+	var coveredBucks []item.Key
+	toBuckKey := bs.opts.BucketSplitConf.Func(to)
+	bs.tree.Ascend(bs.opts.BucketSplitConf.Func(from), func(key item.Key, _ *bucket) bool {
+		if key > toBuckKey {
+			return false
+		}
+
+		if !bs.coversBucket(key, from, to) {
+			// bucket at the edges of the range.
+			return true
+		}
+
+		for _, consumer := range consumers {
+			trailer := bs.trailers[trailerKey{Key: key, fork: consumer}]
+			res.add(key, int(trailer.TotalEntries))
+		}
+
+		coveredBucks = append(coveredBucks, key)
+		return true
+	})
+
+	for _, key := range coveredBucks {
+		if err := bs.dropBucket(&res, key); err != nil {
+			return res, err
 		}
 	}
 
-	return numDeleted, nil
+	// only the buckets at the edges of the range are left now:
+	for _, consumer := range consumers {
+		if err := bs.deleteRange(&res, consumer, from, to, nil, nil); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// Truncate deletes all items with a key lower than `before` for the queue
+// and all of its forks. See Queue.Truncate().
+func (bs *buckets) Truncate(before item.Key) (DeleteResult, error) {
+	if before == math.MinInt64 {
+		// nothing can be lower than that.
+		return DeleteResult{}, nil
+	}
+
+	return bs.ClearRange(math.MinInt64, before-1)
 }
 
 func (bs *buckets) Fork(src, dst ForkName) error {
@@ -716,13 +2158,26 @@ func (bs *buckets) Fork(src, dst ForkName) error {
 		return nil
 	}
 
+	if bs.opts.OpenMode.readOnly() {
+		return ErrReadOnly
+	}
+
 	err := bs.iter(includeNil, func(key item.Key, buck *bucket) error {
 		if buck != nil {
-			return buck.Fork(src, dst)
+			err := buck.Fork(src, dst)
+			bs.recount(key, buck)
+			return err
+		}
+
+		buckDir := bs.buckPath(key)
+		if err := forkOffline(buckDir, src, dst); err != nil {
+			return err
 		}
 
-		buckDir := filepath.Join(bs.dir, key.String())
-		return forkOffline(buckDir, src, dst)
+		trailer := bs.trailers[trailerKey{Key: key, fork: src}]
+		bs.trailers[trailerKey{Key: key, fork: dst}] = trailer
+		bs.lenOf(dst).Add(int64(trailer.TotalEntries))
+		return nil
 	})
 
 	if err != nil {
@@ -730,22 +2185,56 @@ func (bs *buckets) Fork(src, dst ForkName) error {
 	}
 
 	bs.forks = append(bs.forks, dst)
-	return nil
+	bs.addForkActivity(dst)
+	return writeForks(bs.opts.FS, bs.dir, bs.forks)
 }
 
 func (bs *buckets) RemoveFork(fork ForkName) error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
 
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if bs.opts.OpenMode.readOnly() {
+		return ErrReadOnly
+	}
+
 	if err := fork.Validate(); err != nil {
 		return err
 	}
 
+	return bs.removeFork(fork)
+}
+
+// removeFork is RemoveFork() without the checks. The lock has to be held.
+func (bs *buckets) removeFork(fork ForkName) error {
 	// Remove fork from fork list to avoid creating it again:
 	bs.forks = slices.DeleteFunc(bs.forks, func(candidate ForkName) bool {
 		return fork == candidate
 	})
 
+	if err := writeForks(bs.opts.FS, bs.dir, bs.forks); err != nil {
+		return err
+	}
+
+	for tk := range bs.trailers {
+		if tk.fork == fork {
+			delete(bs.trailers, tk)
+		}
+	}
+
+	delete(bs.paused, fork)
+	delete(bs.lastRead, fork)
+	delete(bs.totals.Popped, fork)
+	bs.notifyFreed()
+
+	// keep the counter, there might still be handles to it:
+	if counter, ok := bs.lens[fork]; ok {
+		counter.Store(0)
+	}
+
 	return bs.iter(includeNil, func(key item.Key, buck *bucket) error {
 		if buck != nil {
 			if err := buck.RemoveFork(fork); err != nil {
@@ -764,8 +2253,8 @@ func (bs *buckets) RemoveFork(fork ForkName) error {
 		// considered AllEmpty() after the fork deletion. We defer that to the next Open() of this
 		// bucket to avoid having to load all buckets here. We can have a clean up  logic in Open()
 		// that re-initializes the bucket freshly when the index Len() is zero (and no recover needed).
-		buckDir := filepath.Join(bs.dir, key.String())
-		return removeForkOffline(buckDir, fork)
+		buckDir := bs.buckPath(key)
+		return removeForkOffline(bs.opts.FS, buckDir, fork)
 	})
 }
 
@@ -777,32 +2266,24 @@ func (bs *buckets) Forks() []ForkName {
 }
 
 // fetchForks actually checks the disk to find the current forks.
+// NOTE: This uses the trailers read on load and does not load a bucket,
+// since loading a bucket requires knowing the forks already.
 func (bs *buckets) fetchForks() ([]ForkName, error) {
-	var buck *bucket
-	for iter := bs.tree.Iter(); iter.Next(); {
-		buck = iter.Value()
-		if buck == nil {
-			continue
-		}
+	forks, err := readForks(bs.opts.FS, bs.dir)
+	if err != nil {
+		return nil, err
 	}
 
-	if buck == nil {
-		// if no bucket was loaded yet, above for will not find any.
-		// no luck, we gonna need to load one for this operation.
-		iter := bs.tree.Iter()
-		if iter.First() {
-			var err error
-			buck, err = bs.forKey(iter.Key())
-			if err != nil {
-				return nil, err
-			}
-		}
+	if forks == nil {
+		forks = []ForkName{}
 	}
 
-	if buck == nil {
-		// still nil? The tree is probably empty.
-		return []ForkName{}, nil
+	for tk := range bs.trailers {
+		if tk.fork != "" && !slices.Contains(forks, tk.fork) {
+			forks = append(forks, tk.fork)
+		}
 	}
 
-	return buck.Forks(), nil
+	slices.Sort(forks)
+	return forks, nil
 }
@@ -1,14 +1,17 @@
 package timeq
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/sahib/timeq/item"
 	"github.com/sahib/timeq/item/testutils"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func writeDummyBucket(t *testing.T, dir string, key item.Key, items item.Items) {
@@ -278,3 +281,105 @@ func TestBucketsForkMultipleBuckets(t *testing.T) {
 	require.Empty(t, bs.Forks())
 	require.NoError(t, bs.Close())
 }
+
+func TestBucketsDiskFull(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-bucketstest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.DiskReserveSize = 4096
+	bs, err := loadAllBuckets(dir, opts)
+	require.NoError(t, err)
+
+	reservePath := filepath.Join(dir, reserveFile)
+	info, err := os.Stat(reservePath)
+	require.NoError(t, err)
+	require.Equal(t, int64(4096), info.Size())
+
+	// other errors are not touched:
+	otherErr := errors.New("other")
+	require.Equal(t, otherErr, bs.diskFull(otherErr))
+	require.FileExists(t, reservePath)
+
+	err = bs.diskFull(fmt.Errorf("push: %w", unix.ENOSPC))
+	require.ErrorIs(t, err, ErrDiskFull)
+	require.ErrorIs(t, err, unix.ENOSPC)
+	require.NoFileExists(t, reservePath)
+
+	require.NoError(t, bs.Maintain())
+	require.FileExists(t, reservePath)
+	require.NoError(t, bs.Close())
+
+	// disabling the reserve removes it:
+	bs, err = loadAllBuckets(dir, DefaultOptions())
+	require.NoError(t, err)
+	require.NoFileExists(t, reservePath)
+	require.NoError(t, bs.Close())
+}
+
+func TestBucketsCheckFaultDiskFull(t *testing.T) {
+	t.Parallel()
+
+	// the filesystem is small enough to always count as almost full:
+	testutils.WithTempMount(t, func(ext4Dir string) {
+		err := errors.New("unknown fork")
+		checkFaultDiskFull(ext4Dir, &err)
+		require.NotErrorIs(t, err, ErrDiskFull)
+
+		err = func() (err error) {
+			defer checkFaultDiskFull(ext4Dir, &err)
+			defer recoverMmapError(&err)
+			panic("fault")
+		}()
+		require.ErrorIs(t, err, ErrDiskFull)
+		require.ErrorIs(t, err, errMmapFault)
+
+		err = fmt.Errorf("push: %w", unix.ENOSPC)
+		checkFaultDiskFull(ext4Dir, &err)
+		require.ErrorIs(t, err, ErrDiskFull)
+	})
+}
+
+func TestBucketsMemorySoftLimit(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-bucketstest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.MaxParallelOpenBuckets = 8
+	opts.MemorySoftLimit = 1000
+	bs, err := loadAllBuckets(dir, opts)
+	require.NoError(t, err)
+
+	usage := int64(0)
+	bs.memUsage = func() int64 { return usage }
+
+	for key := item.Key(0); key < 8; key++ {
+		_, err := bs.forKey(key)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 8, bs.nloaded())
+
+	// under pressure, half of the buckets are closed on the next load:
+	usage = 2000
+	bs.memChecked = time.Time{}
+	_, err = bs.forKey(8)
+	require.NoError(t, err)
+	require.Equal(t, 4, bs.nloaded())
+	require.Equal(t, 4, bs.Metrics().OpenBucketLimit)
+
+	// without pressure, the limit grows slowly, but not above the maximum:
+	usage = 0
+	for idx := 0; idx < 10; idx++ {
+		bs.memChecked = time.Time{}
+		require.Equal(t, min(5+idx, 8), bs.openLimit())
+	}
+
+	require.NoError(t, bs.Close())
+}
@@ -0,0 +1,254 @@
+package timeq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/sahib/timeq/index"
+	"github.com/sahib/timeq/item"
+)
+
+// ErrPositionMismatch is returned by RestorePosition() if the position
+// references data that the queue does not have.
+var ErrPositionMismatch = errors.New("position does not match the data of the queue")
+
+const positionMagic = "tqpos\x01"
+
+// bucketPosition is the state of a consumer in a single bucket.
+type bucketPosition struct {
+	Key     item.Key
+	LogSize int64
+	Locs    []item.Location
+}
+
+func encodePositions(positions []bucketPosition) []byte {
+	buf := []byte(positionMagic)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(positions)))
+	for _, pos := range positions {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(pos.Key))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(pos.LogSize))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(pos.Locs)))
+		for _, loc := range pos.Locs {
+			buf = binary.BigEndian.AppendUint64(buf, uint64(loc.Key))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(loc.Off))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(loc.Len))
+		}
+	}
+
+	return buf
+}
+
+func decodePositions(buf []byte) (map[item.Key]*bucketPosition, error) {
+	errMalformed := errors.New("position: malformed token")
+	if len(buf) < len(positionMagic)+4 || string(buf[:len(positionMagic)]) != positionMagic {
+		return nil, errMalformed
+	}
+
+	buf = buf[len(positionMagic):]
+	count := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+
+	positions := make(map[item.Key]*bucketPosition)
+	for idx := uint32(0); idx < count; idx++ {
+		if len(buf) < 20 {
+			return nil, errMalformed
+		}
+
+		pos := &bucketPosition{
+			Key:     item.Key(binary.BigEndian.Uint64(buf)),
+			LogSize: int64(binary.BigEndian.Uint64(buf[8:])),
+		}
+
+		nlocs := binary.BigEndian.Uint32(buf[16:])
+		buf = buf[20:]
+		if uint64(len(buf)) < uint64(nlocs)*24 {
+			return nil, errMalformed
+		}
+
+		for ; nlocs > 0; nlocs-- {
+			pos.Locs = append(pos.Locs, item.Location{
+				Key: item.Key(binary.BigEndian.Uint64(buf)),
+				Off: item.Off(binary.BigEndian.Uint64(buf[8:])),
+				Len: item.Off(binary.BigEndian.Uint64(buf[16:])),
+			})
+			buf = buf[24:]
+		}
+
+		positions[pos.Key] = pos
+	}
+
+	if len(buf) > 0 {
+		return nil, errMalformed
+	}
+
+	return positions, nil
+}
+
+// position returns the locations of `fork` in this bucket.
+func (b *bucket) position(fork ForkName) (bucketPosition, error) {
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return bucketPosition{}, err
+	}
+
+	pos := bucketPosition{Key: b.key, LogSize: b.log.Size()}
+	for iter := idx.Mem.Iter(); iter.Next(); {
+		pos.Locs = append(pos.Locs, iter.Value())
+	}
+
+	return pos, nil
+}
+
+// restorePosition replaces the index of `fork` by the locations in `pos` and
+// the items pushed after it was exported. `pos` is nil if the bucket did not
+// exist then.
+func (b *bucket) restorePosition(fork ForkName, pos *bucketPosition) (outErr error) {
+	defer recoverMmapError(&outErr)
+
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return err
+	}
+
+	mem := index.New(indexKind(b.opts.IndexStructure))
+
+	var since int64
+	if pos != nil {
+		if pos.LogSize > b.log.Size() {
+			return fmt.Errorf("%w: %s was smaller", ErrPositionMismatch, b.key)
+		}
+
+		for _, loc := range pos.Locs {
+			if loc.Len == 0 || int64(loc.Off) >= pos.LogSize {
+				return fmt.Errorf("%w: %s: bad location %s", ErrPositionMismatch, b.key, loc)
+			}
+
+			mem.Set(loc)
+		}
+
+		since = pos.LogSize
+	}
+
+	// Add the items pushed since. They are appended in batches, which are
+	// sorted by key each, so every run of ascending keys is one location.
+	var run item.Location
+	var lastKey item.Key
+	logIter := b.log.At(item.Location{Key: b.key, Off: item.Off(since), Len: math.MaxUint64}, false)
+	for logIter.Next() {
+		it := logIter.Item()
+		if run.Len > 0 && it.Key >= lastKey {
+			run.Len++
+		} else {
+			if run.Len > 0 {
+				mem.Set(run)
+			}
+
+			run = item.Location{Key: it.Key, Off: logIter.CurrentLocation().Off, Len: 1}
+		}
+
+		lastKey = it.Key
+	}
+
+	if err := logIter.Err(); err != nil {
+		return err
+	}
+
+	if run.Len > 0 {
+		mem.Set(run)
+	}
+
+	oldMem := idx.Mem
+	if err := b.rewriteIndex(fork, idx, mem); err != nil {
+		return err
+	}
+
+	return oldMem.Close()
+}
+
+// ExportPosition returns the position of `fork`. See Queue.ExportPosition().
+func (bs *buckets) ExportPosition(fork ForkName) ([]byte, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return nil, ErrClosed
+	}
+
+	if fork != "" && !slices.Contains(bs.forks, fork) {
+		return nil, ErrNoSuchFork
+	}
+
+	var positions []bucketPosition
+	for _, key := range bs.bucketKeys() {
+		buck, err := bs.forKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		pos, err := buck.position(fork)
+		if err != nil {
+			return nil, err
+		}
+
+		positions = append(positions, pos)
+	}
+
+	return encodePositions(positions), nil
+}
+
+// RestorePosition sets the position of `fork`. See Queue.RestorePosition().
+func (bs *buckets) RestorePosition(fork ForkName, token []byte) error {
+	positions, err := decodePositions(token)
+	if err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if err := bs.checkWritable(); err != nil {
+		return err
+	}
+
+	if fork != "" && !slices.Contains(bs.forks, fork) {
+		if err := bs.Fork("", fork); err != nil {
+			return err
+		}
+	}
+
+	// buckets that are gone were consumed by everyone, so they are not needed.
+	for _, key := range bs.bucketKeys() {
+		buck, err := bs.forKey(key)
+		if err != nil {
+			return err
+		}
+
+		err = buck.restorePosition(fork, positions[key])
+		bs.recount(key, buck)
+		if err != nil {
+			return fmt.Errorf("restore: %s: %w", key, err)
+		}
+	}
+
+	bs.notifyPushed()
+	return nil
+}
+
+// bucketKeys returns the keys of all buckets. Loading buckets
+// changes the tree, so it should not be done while iterating it.
+func (bs *buckets) bucketKeys() []item.Key {
+	keys := make([]item.Key, 0, bs.tree.Len())
+	bs.tree.Scan(func(key item.Key, _ *bucket) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	return keys
+}
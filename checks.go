@@ -0,0 +1,210 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sahib/timeq/item"
+)
+
+// ErrCorrupted is returned by Open() if Options.VerifyOnOpen found problems.
+var ErrCorrupted = errors.New("queue is corrupted")
+
+// Violation is an inconsistency that was found by CheckInvariants().
+type Violation struct {
+	// Bucket is the key of the affected bucket.
+	// It is zero for violations that affect the whole queue.
+	Bucket Key
+
+	// Fork is the affected consumer; empty for the queue itself.
+	Fork ForkName
+
+	// Msg describes what is wrong.
+	Msg string
+
+	// Repaired is true if the problem was corrected already.
+	// This is the case for cached counts, as checking recounts them.
+	Repaired bool
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("bucket %v: consumer »%s«: %s", v.Bucket, v.Fork, v.Msg)
+}
+
+// check verifies the index of `fork` against the value log and calls `fn`
+// for each violation that was found. The items are only read if `full` is set.
+func (b *bucket) check(fork ForkName, full bool, fn func(msg string)) {
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		fn("no index")
+		return
+	}
+
+	var (
+		nitems  item.Off
+		prevKey item.Key
+		logSize = b.log.Size()
+		split   = b.opts.BucketSplitConf.Func
+	)
+
+	for iter := idx.Mem.Iter(); iter.Next(); {
+		loc := iter.Value()
+		if nitems > 0 && loc.Key < prevKey {
+			fn(fmt.Sprintf("index not sorted: %v after %v", loc, prevKey))
+		}
+
+		prevKey = loc.Key
+		nitems += loc.Len
+
+		if loc.Len == 0 || int64(loc.Off)+item.HeaderSize > logSize {
+			fn(fmt.Sprintf("location %v out of bounds (log has %d bytes)", loc, logSize))
+			continue
+		}
+
+		if !full {
+			// every item takes at least its header and trailer:
+			minEnd := int64(loc.Off) + int64(loc.Len)*(item.HeaderSize+item.TrailerSize)
+			if minEnd > logSize {
+				fn(fmt.Sprintf("location %v needs at least %d bytes, log has %d", loc, minEnd, logSize))
+			}
+
+			continue
+		}
+
+		var nread item.Off
+		logIter := b.log.At(loc, false)
+		for logIter.Next() {
+			it := logIter.Item()
+			if nread == 0 && it.Key != loc.Key {
+				fn(fmt.Sprintf("location %v points to key %v", loc, it.Key))
+			}
+
+			if bucketKey := split(it.Key); bucketKey != b.key {
+				fn(fmt.Sprintf("key %v of location %v belongs to bucket %v", it.Key, loc, bucketKey))
+			}
+
+			nread++
+		}
+
+		if err := logIter.Err(); err != nil {
+			fn(fmt.Sprintf("location %v: %v", loc, err))
+		} else if nread != loc.Len {
+			fn(fmt.Sprintf("location %v: only %d items in log", loc, nread))
+		}
+	}
+
+	if nitems != idx.Mem.Len() {
+		fn(fmt.Sprintf("index counts %d items, but has %d", idx.Mem.Len(), nitems))
+	}
+}
+
+// CheckInvariants loads every bucket and checks the in-memory state against
+// the disk. See Queue.CheckInvariants().
+func (bs *buckets) CheckInvariants() ([]Violation, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return nil, ErrClosed
+	}
+
+	return bs.violations(true)
+}
+
+// violations loads every bucket and returns all violations.
+// The items are only read if `full` is set.
+func (bs *buckets) violations(full bool) ([]Violation, error) {
+	consumers := append([]ForkName{""}, bs.forks...)
+	violations := []Violation{}
+
+	// loading and closing buckets corrects the counts, so remember them before:
+	cached := make(map[trailerKey]item.Off, len(bs.trailers))
+	for tk, trailer := range bs.trailers {
+		cached[tk] = trailer.TotalEntries
+	}
+
+	cachedLens := make(map[ForkName]int64, len(consumers))
+	for _, fork := range consumers {
+		cachedLens[fork] = bs.lenOf(fork).Load()
+	}
+
+	keys := bs.tree.Keys()
+	for _, fork := range consumers {
+		var sum int64
+		for _, key := range keys {
+			sum += int64(cached[trailerKey{Key: key, fork: fork}])
+		}
+
+		if cachedLens[fork] != sum {
+			violations = append(violations, Violation{
+				Fork:     fork,
+				Msg:      fmt.Sprintf("cached len is %d, but buckets count %d items", cachedLens[fork], sum),
+				Repaired: true,
+			})
+		}
+	}
+
+	for _, key := range keys {
+		buck, err := bs.forKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %v: %w", key, err)
+		}
+
+		for _, fork := range consumers {
+			buck.check(fork, full, func(msg string) {
+				violations = append(violations, Violation{Bucket: key, Fork: fork, Msg: msg})
+			})
+
+			tk := trailerKey{Key: key, fork: fork}
+			if n := buck.Len(fork); item.Off(n) != cached[tk] {
+				violations = append(violations, Violation{
+					Bucket:   key,
+					Fork:     fork,
+					Msg:      fmt.Sprintf("cached count is %d, but index has %d items", cached[tk], n),
+					Repaired: true,
+				})
+			}
+		}
+	}
+
+	// the loaded buckets have their counts right now, so the sums are too:
+	for _, fork := range consumers {
+		var sum int64
+		for _, key := range bs.tree.Keys() {
+			sum += int64(bs.trailers[trailerKey{Key: key, fork: fork}].TotalEntries)
+		}
+
+		bs.lenOf(fork).Store(sum)
+	}
+
+	return violations, nil
+}
+
+// verify checks the queue once after opening it. See Options.VerifyOnOpen.
+func (bs *buckets) verify() error {
+	if bs.opts.VerifyOnOpen == VerifyOff {
+		return nil
+	}
+
+	violations, err := bs.violations(bs.opts.VerifyOnOpen == VerifyFull)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	var unrepaired []Violation
+	for _, violation := range violations {
+		if violation.Repaired {
+			bs.opts.Logger.Printf("verify: repaired: %v", violation)
+			continue
+		}
+
+		bs.opts.Logger.Printf("verify: %v", violation)
+		unrepaired = append(unrepaired, violation)
+	}
+
+	if len(unrepaired) == 0 || bs.opts.ErrorMode == ErrorModeContinue {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d problems, first: %v", ErrCorrupted, len(unrepaired), unrepaired[0])
+}
@@ -0,0 +1,308 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/otiai10/copy"
+	"github.com/sahib/timeq/item"
+	"github.com/sahib/timeq/vlog"
+)
+
+// Clone() hardlinks the files of all buckets to the clone. The files that are
+// appended to in place (value log, push times and index logs) are replaced by
+// a private copy before a bucket writes to them for the first time, in the
+// original and in the clone. All other files are replaced atomically on
+// write, which breaks the link anyways.
+
+// linkCount returns the number of hardlinks of the file at `path`.
+func linkCount(fsys FS, path string) (uint64, error) {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1, nil
+	}
+
+	return uint64(stat.Nlink), nil
+}
+
+// sharedFiles checks if the files of the bucket at `dir` are hardlinked.
+func sharedFiles(fsys FS, dir string) (data, index bool, err error) {
+	ents, err := fsys.ReadDir(dir)
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, ent := range ents {
+		name := ent.Name()
+		isData := name == dataLogName || name == pushStampsName || name == seqLogName
+		isIndex := strings.HasSuffix(name, "idx.log")
+		if !isData && !isIndex {
+			continue
+		}
+
+		nlinks, err := linkCount(fsys, filepath.Join(dir, name))
+		if err != nil {
+			return false, false, err
+		}
+
+		if nlinks > 1 {
+			data = data || isData
+			index = index || isIndex
+		}
+	}
+
+	return data, index, nil
+}
+
+// unshareFile replaces the file at `path` by a private copy,
+// if it is hardlinked. It returns true if it was copied.
+func unshareFile(fsys FS, path string) (bool, error) {
+	nlinks, err := linkCount(fsys, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if nlinks <= 1 {
+		return false, nil
+	}
+
+	tmpPath := path + ".unshare"
+	if err := copy.Copy(path, tmpPath, copy.Options{Sync: true}); err != nil {
+		return false, err
+	}
+
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return false, errors.Join(err, fsys.Remove(tmpPath))
+	}
+
+	return true, nil
+}
+
+// unshare gives the bucket private copies of the files it is about to write
+// to: the index logs and, if `data` is true, the value log and push times.
+// Items read from the old value log stay valid until the bucket is closed.
+func (b *bucket) unshare(data bool) error {
+	if b.sharedIndex {
+		for fork, idx := range b.indexes {
+			path := idxPath(b.dir, fork)
+			copied, err := unshareFile(b.opts.FS, path)
+			if err != nil {
+				return fmt.Errorf("unshare: %w", err)
+			}
+
+			if !copied {
+				continue
+			}
+
+			// NOTE: Nothing is buffered in the writer, since
+			// the bucket did not write since it was cloned.
+			if err := idx.Log.Close(); err != nil {
+				return err
+			}
+
+			idx.Log, err = openIndexWriter(path, b.opts)
+			if err != nil {
+				return err
+			}
+
+			b.indexes[fork] = idx
+		}
+
+		b.sharedIndex = false
+	}
+
+	if !data || !b.sharedData {
+		return nil
+	}
+
+	logPath := filepath.Join(b.dir, dataLogName)
+	copied, err := unshareFile(b.opts.FS, logPath)
+	if err != nil {
+		return fmt.Errorf("unshare: %w", err)
+	}
+
+	if copied {
+		// A Push() during a Read() replaces the log while
+		// the read items still point to the old mapping.
+		b.log.Pin()
+		b.unsharedLogs = append(b.unsharedLogs, b.log)
+
+		locked := b.log.Locked()
+		logOpts := logOptions(b.opts)
+		logOpts.SizeHint = b.log.Size()
+		if err := b.log.Close(); err != nil {
+			return err
+		}
+
+		b.log, err = vlog.OpenWithOptions(logPath, logOpts)
+		if err != nil {
+			return err
+		}
+
+		if locked {
+			if err := b.log.Lock(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := b.unshareBatchLog(&b.stamps, pushStampsName); err != nil {
+		return err
+	}
+
+	if err := b.unshareBatchLog(&b.seqs, seqLogName); err != nil {
+		return err
+	}
+
+	b.sharedData = false
+	return nil
+}
+
+// unshareBatchLog copies the batch log `name` if it is shared and reopens it.
+func (b *bucket) unshareBatchLog(bl **batchLog, name string) error {
+	if *bl == nil {
+		return nil
+	}
+
+	path := filepath.Join(b.dir, name)
+	copied, err := unshareFile(b.opts.FS, path)
+	if err != nil {
+		return fmt.Errorf("unshare: %w", err)
+	}
+
+	if !copied {
+		return nil
+	}
+
+	if err := (*bl).Close(); err != nil {
+		return err
+	}
+
+	*bl, err = openBatchLog(b.opts.FS, path, b.opts.SyncMode&SyncData > 0)
+	return err
+}
+
+// linkOrCopy hardlinks `src` to `dst` or copies it,
+// if both are not on the same filesystem.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); !errors.Is(err, syscall.EXDEV) {
+		// NOTE: this includes err==nil
+		return err
+	}
+
+	return copy.Copy(src, dst, copy.Options{Sync: true})
+}
+
+// cloneBucketDir hardlinks the files of the bucket at `src` to `dst`.
+func cloneBucketDir(fsys FS, src, dst string) error {
+	if err := fsys.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	ents, err := fsys.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range ents {
+		if ent.IsDir() {
+			continue
+		}
+
+		name := ent.Name()
+		if err := linkOrCopy(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+
+	return fsys.SyncDir(dst)
+}
+
+// Clone creates a copy of the queue at `dstDir`. See Queue.Clone().
+func (bs *buckets) Clone(dstDir string) (outErr error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	fsys := bs.opts.FS
+	if err := fsys.MkdirAll(dstDir, 0700); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+
+	ents, err := fsys.ReadDir(dstDir)
+	if err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+
+	if len(ents) > 0 {
+		return fmt.Errorf("clone: %s is not empty", dstDir)
+	}
+
+	defer func() {
+		if outErr != nil {
+			outErr = errors.Join(outErr, fsys.RemoveAll(dstDir))
+		}
+	}()
+
+	// everything has to be on disk before it gets linked:
+	var syncErr error
+	bs.tree.Scan(func(_ item.Key, b *bucket) bool {
+		if b != nil {
+			syncErr = errors.Join(syncErr, b.Sync(true))
+		}
+
+		return true
+	})
+
+	if syncErr != nil {
+		return fmt.Errorf("clone: sync: %w", syncErr)
+	}
+
+	for _, key := range bs.tree.Keys() {
+		if err := cloneBucketDir(fsys, bs.buckPath(key), filepath.Join(dstDir, bs.opts.BucketNameConf.Format(key))); err != nil {
+			return fmt.Errorf("clone: bucket %s: %w", key, err)
+		}
+	}
+
+	for _, name := range []string{splitConfFile, nameConfFile, forksFile, forkActivityFile, userMetaFile, formatFile} {
+		data, err := fsys.ReadFile(filepath.Join(bs.dir, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return fmt.Errorf("clone: %w", err)
+		}
+
+		if err := fsys.WriteFile(filepath.Join(dstDir, name), data, 0600); err != nil {
+			return fmt.Errorf("clone: %w", err)
+		}
+	}
+
+	// the loaded buckets have to copy their files before writing now:
+	bs.tree.Scan(func(_ item.Key, b *bucket) bool {
+		if b != nil {
+			b.sharedData, b.sharedIndex = true, true
+		}
+
+		return true
+	})
+
+	return fsys.SyncDir(dstDir)
+}
@@ -1,15 +1,21 @@
 package parser
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/sahib/timeq"
+	"github.com/sahib/timeq/bench"
 	"github.com/sahib/timeq/item"
 	"github.com/sahib/timeq/vlog"
 	"github.com/urfave/cli"
@@ -165,6 +171,80 @@ func Run(args []string) error {
 					Required: true,
 				},
 			},
+		}, {
+			Name:      "follow",
+			Usage:     "Print new items as they arrive (like tail -f)",
+			ArgsUsage: "[dir]",
+			Description: "Opens the queue when it changed (or every --interval) and pops (or peeks) all items.\n" +
+				"   The directory can be given as argument instead of --dir. Note that a\n" +
+				"   queue must not be opened by several processes at the same time, so this\n" +
+				"   only works with producers that open the queue briefly (like 'timeq push').",
+			Action: handleFollow,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "f,fork",
+					Usage: "Follow this fork instead of the queue",
+				},
+				cli.BoolFlag{
+					Name:  "p,peek",
+					Usage: "Do not pop the items; only print items with a higher key than the last one",
+				},
+				cli.DurationFlag{
+					Name:  "i,interval",
+					Usage: "How often to check for new items, in case changes are not noticed",
+					Value: time.Second,
+				},
+				cli.StringFlag{
+					Name:  "d,decode",
+					Usage: "How to print the blob ('raw', 'hex', 'base64' or 'none')",
+					Value: "raw",
+				},
+			},
+		}, {
+			Name:      "bench",
+			Usage:     "Measure push and pop throughput and latency",
+			ArgsUsage: "[dir]",
+			Description: "Pushes and pops items in a temporary queue below the directory (--dir or argument),\n" +
+				"   so the disk of the directory is measured. --sync-mode and --bucket-size apply.",
+			Action: handleBench,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "n,number",
+					Usage: "How many items to push and pop",
+					Value: 100000,
+				},
+				cli.IntFlag{
+					Name:  "s,item-size",
+					Usage: "Size of each item in bytes",
+					Value: 40,
+				},
+				cli.IntFlag{
+					Name:  "b,batch-size",
+					Usage: "How many items to push or pop at once",
+					Value: 2000,
+				},
+				cli.DurationFlag{
+					Name:  "k,key-step",
+					Usage: "Distance between the keys of consecutive items",
+					Value: time.Millisecond,
+				},
+			},
+		}, {
+			Name:   "downgrade",
+			Usage:  "Write a copy of the queue that older versions can open",
+			Action: withQueue(handleDowngrade),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "d,dest",
+					Usage:    "Directory of the copy",
+					Required: true,
+				},
+				cli.IntFlag{
+					Name:  "v,version",
+					Usage: "Format version the older version supports",
+					Value: timeq.FormatVersion,
+				},
+			},
 		}, {
 			Name:  "fork",
 			Usage: "Utilities for forks",
@@ -197,6 +277,39 @@ func Run(args []string) error {
 					},
 				},
 			},
+		}, {
+			Name:  "bucket",
+			Usage: "Utilities for single buckets",
+			Subcommands: []cli.Command{
+				{
+					Name:   "export",
+					Usage:  "Write the bucket of a key to an archive",
+					Action: withQueue(handleBucketExport),
+					Flags: []cli.Flag{
+						cli.Int64Flag{
+							Name:     "k,key",
+							Usage:    "Any key of the bucket",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name:     "o,output",
+							Usage:    "Path of the archive",
+							Required: true,
+						},
+					},
+				}, {
+					Name:   "import",
+					Usage:  "Add a bucket from an archive written by export",
+					Action: withQueue(handleBucketImport),
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "i,input",
+							Usage:    "Path of the archive",
+							Required: true,
+						},
+					},
+				},
+			},
 		}, {
 			Name:  "log",
 			Usage: "Utilities for checking value logs",
@@ -295,15 +408,40 @@ func handleClear(ctx *cli.Context, q *timeq.Queue) error {
 		to = math.MaxInt64
 	}
 
-	deleted, err := q.Delete(timeq.Key(from), timeq.Key(to))
+	res, err := q.Delete(timeq.Key(from), timeq.Key(to))
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("deleted %v items\n", deleted)
+	fmt.Printf("deleted %v items, dropped %v buckets\n", res.Items, res.DroppedBuckets)
 	return nil
 }
 
+func handleBench(ctx *cli.Context) error {
+	dir := ctx.GlobalString("dir")
+	if ctx.NArg() > 0 {
+		dir = ctx.Args().First()
+	}
+
+	opts, err := optionsFromCtx(ctx)
+	if err != nil {
+		return fmt.Errorf("options: %w", err)
+	}
+
+	res, err := bench.Run(dir, bench.Options{
+		Items:     ctx.Int("number"),
+		ItemSize:  ctx.Int("item-size"),
+		BatchSize: ctx.Int("batch-size"),
+		KeyStep:   ctx.Duration("key-step"),
+		Queue:     &opts,
+	})
+	if err != nil {
+		return err
+	}
+
+	return res.Print(os.Stdout)
+}
+
 func handleShovel(ctx *cli.Context, srcQueue *timeq.Queue) error {
 	dstDir := ctx.String("dest")
 
@@ -326,6 +464,40 @@ func handleShovel(ctx *cli.Context, srcQueue *timeq.Queue) error {
 	return dstQueue.Close()
 }
 
+func handleDowngrade(ctx *cli.Context, q *timeq.Queue) error {
+	return q.ExportFormat(ctx.String("dest"), ctx.Int("version"))
+}
+
+func handleBucketExport(ctx *cli.Context, q *timeq.Queue) error {
+	fd, err := os.Create(ctx.String("output"))
+	if err != nil {
+		return err
+	}
+
+	if err := q.ExportBucket(timeq.Key(ctx.Int64("key")), fd); err != nil {
+		return errors.Join(err, fd.Close())
+	}
+
+	return errors.Join(fd.Sync(), fd.Close())
+}
+
+func handleBucketImport(ctx *cli.Context, q *timeq.Queue) error {
+	fd, err := os.Open(ctx.String("input"))
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	key, err := q.ImportBucket(fd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported bucket %v\n", key)
+	return nil
+}
+
 func handleLogDump(ctx *cli.Context) error {
 	log, err := vlog.Open(ctx.String("path"), true)
 	if err != nil {
@@ -341,6 +513,174 @@ func handleLogDump(ctx *cli.Context) error {
 	return log.Close()
 }
 
+func blobDecoder(name string) (func(blob []byte) string, error) {
+	switch name {
+	case "raw":
+		return func(blob []byte) string { return string(blob) }, nil
+	case "hex":
+		return hex.EncodeToString, nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString, nil
+	case "none":
+		return func([]byte) string { return "" }, nil
+	default:
+		return nil, fmt.Errorf("invalid decode mode: %s", name)
+	}
+}
+
+func handleFollow(ctx *cli.Context) error {
+	dir := ctx.GlobalString("dir")
+	if ctx.NArg() > 0 {
+		dir = ctx.Args().First()
+	}
+
+	opts, err := optionsFromCtx(ctx)
+	if err != nil {
+		return fmt.Errorf("options: %w", err)
+	}
+
+	decode, err := blobDecoder(ctx.String("decode"))
+	if err != nil {
+		return err
+	}
+
+	interval := ctx.Duration("interval")
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval: %v", interval)
+	}
+
+	sigCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	f := follower{
+		fork:   timeq.ForkName(ctx.String("fork")),
+		peek:   ctx.Bool("peek"),
+		decode: decode,
+	}
+
+	if err := f.poll(dir, opts); err != nil {
+		return err
+	}
+
+	// poll on changes; the interval is only a fallback if watching fails.
+	var changed <-chan struct{}
+	if watcher, err := timeq.WatchDir(dir); err == nil {
+		defer watcher.Close()
+		changed = watcher.C()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigCtx.Done():
+			return nil
+		case <-ticker.C:
+		case <-changed:
+			// the writer is likely not done yet; wait until it settled.
+			settleChanges(changed, 100*time.Millisecond)
+		}
+
+		if err := f.poll(dir, opts); err != nil {
+			return err
+		}
+	}
+}
+
+// settleChanges returns once nothing arrived on `changed` for `quiet`.
+func settleChanges(changed <-chan struct{}, quiet time.Duration) {
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return
+		case _, ok := <-changed:
+			if !ok {
+				return
+			}
+
+			timer.Reset(quiet)
+		}
+	}
+}
+
+// follower prints the items of a queue that were added since the last poll.
+type follower struct {
+	fork   timeq.ForkName
+	peek   bool
+	decode func(blob []byte) string
+
+	// last printed key in peek mode:
+	lastKey  timeq.Key
+	hasFirst bool
+}
+
+func (f *follower) print(it timeq.Item) {
+	fmt.Printf("%d\t%d\t%s\n", it.Key, len(it.Blob), f.decode(it.Blob))
+}
+
+func (f *follower) poll(dir string, opts timeq.Options) error {
+	queue, err := timeq.Open(dir, opts)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	var consumer timeq.Consumer = queue
+	if f.fork != "" {
+		if !slices.Contains(queue.Forks(), f.fork) {
+			return errors.Join(timeq.ErrNoSuchFork, queue.Close())
+		}
+
+		if consumer, err = queue.Fork(f.fork); err != nil {
+			return errors.Join(err, queue.Close())
+		}
+	}
+
+	if err := f.read(consumer); err != nil {
+		return errors.Join(err, queue.Close())
+	}
+
+	return queue.Close()
+}
+
+func (f *follower) read(consumer timeq.Consumer) error {
+	if f.peek {
+		// peeking always starts at the lowest key,
+		// so skip what we printed already.
+		return consumer.Read(consumer.Len(), func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+			for _, it := range items {
+				if f.hasFirst && it.Key <= f.lastKey {
+					continue
+				}
+
+				f.print(it)
+				f.lastKey, f.hasFirst = it.Key, true
+			}
+
+			return timeq.ReadOpPeek, nil
+		})
+	}
+
+	for {
+		var nread int
+		err := consumer.Read(1000, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+			for _, it := range items {
+				f.print(it)
+			}
+
+			nread = len(items)
+			return timeq.ReadOpPop, nil
+		})
+
+		if err != nil || nread == 0 {
+			return err
+		}
+	}
+}
+
 func handleForkCreate(ctx *cli.Context, q *timeq.Queue) error {
 	name := ctx.String("name")
 	_, err := q.Fork(timeq.ForkName(name))
@@ -0,0 +1,207 @@
+package timeq
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+// CoalesceOptions configure a Coalescer. See Queue.NewCoalescer().
+type CoalesceOptions struct {
+	// MaxBytes is the size of the staged items (as stored on disk) after
+	// which they are pushed as one batch. Defaults to 1MB.
+	MaxBytes int
+
+	// MaxDelay is the longest time an item stays staged
+	// before it is pushed. Defaults to 10ms.
+	MaxDelay time.Duration
+
+	// OnError is called when pushing the staged items failed in the
+	// background. The items are lost then. By default, the error is
+	// logged with the Logger of the queue.
+	OnError func(err error)
+}
+
+func (opts *CoalesceOptions) setDefaults(logger Logger) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 1 << 20
+	}
+
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 10 * time.Millisecond
+	}
+
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			logger.Printf("coalesce: %v", err)
+		}
+	}
+}
+
+// Coalescer collects small pushes and pushes them to the queue as one
+// batch once they reach CoalesceOptions.MaxBytes or the oldest of them
+// waited for CoalesceOptions.MaxDelay. Every push to a bucket maps, writes
+// and syncs the logs once, so a few big batches are a lot cheaper than
+// many tiny ones. It is safe to use from several go-routines.
+//
+// Staged items are only kept in memory: they are lost on a crash and are
+// not visible to Read() or Len() until they were pushed.
+type Coalescer struct {
+	q         *Queue
+	opts      CoalesceOptions
+	errorMode ErrorMode
+
+	mu     sync.Mutex
+	items  item.Items
+	size   int
+	timer  *time.Timer
+	closed bool
+
+	// inflight counts pushes of taken items by Push() or the timer that
+	// did not return yet. idle is signaled once it drops to zero.
+	inflight int
+	idle     *sync.Cond
+}
+
+func (bs *buckets) newCoalescer(q *Queue, opts CoalesceOptions) *Coalescer {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+
+	opts.setDefaults(bs.opts.Logger)
+	c := &Coalescer{
+		q:         q,
+		opts:      opts,
+		errorMode: bs.opts.ErrorMode,
+	}
+
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// Push stages a copy of `items`. Invalid items are reported right away
+// like Queue.Push() does, so they do not fail the batch of other callers.
+// If the staged items reach MaxBytes, they are pushed before Push() returns
+// and the error of that push is returned.
+func (c *Coalescer) Push(items Items) error {
+	items, pushErr := validateItems(items)
+	if pushErr != nil {
+		if c.errorMode == ErrorModeAbort || len(items) == 0 {
+			return pushErr
+		}
+
+		pushErr.Written = true
+		if err := c.stage(items); err != nil {
+			return err
+		}
+
+		return pushErr
+	}
+
+	return c.stage(items)
+}
+
+func (c *Coalescer) stage(items item.Items) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+
+	c.items = append(c.items, items.Copy()...)
+	c.size += int(items.StorageSize())
+	if c.size < c.opts.MaxBytes {
+		if c.timer == nil && len(c.items) > 0 {
+			c.timer = time.AfterFunc(c.opts.MaxDelay, c.flushLater)
+		}
+
+		c.mu.Unlock()
+		return nil
+	}
+
+	staged := c.take()
+	c.inflight++
+	c.mu.Unlock()
+
+	return c.push(staged)
+}
+
+// Flush pushes the staged items now. It also waits
+// for pushes that were started before by the timer.
+func (c *Coalescer) Flush() error {
+	c.mu.Lock()
+	staged := c.take()
+	c.mu.Unlock()
+
+	err := c.q.Push(staged)
+	c.waitIdle()
+	return err
+}
+
+// Close pushes the staged items and makes further calls to Push() return
+// ErrClosed. It has to be called before the queue is closed and waits
+// until all pushes that were started before are done.
+func (c *Coalescer) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	staged := c.take()
+	c.mu.Unlock()
+
+	err := c.q.Push(staged)
+	c.waitIdle()
+	return err
+}
+
+// push pushes items that were taken with c.inflight incremented.
+func (c *Coalescer) push(staged item.Items) error {
+	err := c.q.Push(staged)
+
+	c.mu.Lock()
+	c.inflight--
+	if c.inflight == 0 {
+		c.idle.Broadcast()
+	}
+
+	c.mu.Unlock()
+	return err
+}
+
+// waitIdle waits until no push of taken items is running anymore.
+func (c *Coalescer) waitIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.inflight > 0 {
+		c.idle.Wait()
+	}
+}
+
+// take returns the staged items and starts over. c.mu must be held.
+func (c *Coalescer) take() item.Items {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	staged := c.items
+	c.items, c.size = nil, 0
+	return staged
+}
+
+// flushLater is called by the timer once MaxDelay passed.
+func (c *Coalescer) flushLater() {
+	c.mu.Lock()
+	staged := c.take()
+	if len(staged) == 0 {
+		// Flush() or Close() came first.
+		c.mu.Unlock()
+		return
+	}
+
+	c.inflight++
+	c.mu.Unlock()
+
+	if err := c.push(staged); err != nil {
+		c.opts.OnError(err)
+	}
+}
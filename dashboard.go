@@ -0,0 +1,222 @@
+package timeq
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+// dashboardHistorySize is the number of length samples kept for the chart.
+const dashboardHistorySize = 300
+
+type dashboardConsumer struct {
+	Fork      ForkName `json:"fork"`
+	Len       int      `json:"len"`
+	OldestKey Key      `json:"oldest_key"`
+	Paused    bool     `json:"paused"`
+}
+
+type dashboardSample struct {
+	Time int64 `json:"time"`
+	Len  int   `json:"len"`
+}
+
+type dashboardStats struct {
+	Consumers []dashboardConsumer `json:"consumers"`
+	Buckets   []BucketCount       `json:"buckets"`
+	DataSize  int64               `json:"data_size"`
+	Frozen    bool                `json:"frozen"`
+	History   []dashboardSample   `json:"history"`
+}
+
+// dashboardStats collects everything the dashboard shows, without loading buckets.
+func (bs *buckets) dashboardStats() dashboardStats {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	stats := dashboardStats{
+		DataSize: bs.dataSize(),
+		Frozen:   bs.frozen,
+		Buckets:  []BucketCount{},
+	}
+
+	for _, fork := range append([]ForkName{""}, bs.forks...) {
+		consumer := dashboardConsumer{
+			Fork:   fork,
+			Len:    bs.len(fork),
+			Paused: bs.paused[fork],
+		}
+
+		if consumer.Len > 0 {
+			consumer.OldestKey = bs.oldestKey(fork)
+		}
+
+		stats.Consumers = append(stats.Consumers, consumer)
+	}
+
+	bs.tree.Scan(func(key Key, _ *bucket) bool {
+		if trailer := bs.trailers[trailerKey{Key: key, fork: ""}]; trailer.TotalEntries > 0 {
+			stats.Buckets = append(stats.Buckets, BucketCount{Key: key, Len: int(trailer.TotalEntries)})
+		}
+		return true
+	})
+
+	return stats
+}
+
+type dashboard struct {
+	q *Queue
+
+	mu      sync.Mutex
+	history []dashboardSample
+}
+
+// record adds the current length to the history, at most once per second.
+func (d *dashboard) record(now time.Time, qlen int) []dashboardSample {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sample := dashboardSample{Time: now.Unix(), Len: qlen}
+	if n := len(d.history); n > 0 && d.history[n-1].Time == sample.Time {
+		d.history[n-1] = sample
+	} else {
+		d.history = append(d.history, sample)
+	}
+
+	if len(d.history) > dashboardHistorySize {
+		d.history = d.history[len(d.history)-dashboardHistorySize:]
+	}
+
+	return slices.Clone(d.history)
+}
+
+func (d *dashboard) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fork := ForkName(r.FormValue("fork"))
+	if fork != "" && !slices.Contains(d.q.Forks(), fork) {
+		http.Error(w, ErrNoSuchFork.Error(), http.StatusNotFound)
+		return
+	}
+
+	d.q.buckets.SetReadsPaused(fork, paused)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "stats":
+		stats := d.q.buckets.dashboardStats()
+		stats.History = d.record(time.Now(), stats.Consumers[0].Len)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			d.q.buckets.opLog.Logger.Printf("dashboard: %v", err)
+		}
+	case "pause":
+		d.setPaused(w, r, true)
+	case "resume":
+		d.setPaused(w, r, false)
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(dashboardHTML))
+	}
+}
+
+// Dashboard returns a http.Handler that serves a small HTML page with the
+// state of the queue: its length over time, the number of items per bucket,
+// the length and oldest key of each fork and the size of the data on disk.
+// Reads of the queue and each fork can be paused and resumed from there.
+// The length history is only recorded while the page is open.
+//
+// Mount it with a trailing slash, e.g. mux.Handle("/timeq/", http.StripPrefix("/timeq", h)).
+// The handler has no authentication, so only expose it where this is fine.
+func (q *Queue) Dashboard() http.Handler {
+	return &dashboard{q: q}
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>timeq</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: right; }
+svg { border: 1px solid #ccc; margin-bottom: 2em; }
+.frozen { color: #b00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>timeq</h1>
+<p>Data on disk: <span id="size"></span> <span id="frozen" class="frozen"></span></p>
+<h2>Length</h2>
+<svg id="chart" width="600" height="150"><polyline id="line" fill="none" stroke="#36c" stroke-width="2"/></svg>
+<h2>Consumers</h2>
+<table><thead><tr><th>Fork</th><th>Length</th><th>Oldest key</th><th>Reads</th></tr></thead><tbody id="consumers"></tbody></table>
+<h2>Buckets</h2>
+<table><thead><tr><th>Key</th><th>Length</th></tr></thead><tbody id="buckets"></tbody></table>
+<script>
+function cell(row, text) {
+	const td = document.createElement("td");
+	td.textContent = text;
+	row.appendChild(td);
+	return td;
+}
+
+function setPaused(fork, paused) {
+	const body = new URLSearchParams({fork: fork});
+	fetch(paused ? "pause" : "resume", {method: "POST", body: body}).then(refresh);
+}
+
+function render(stats) {
+	document.getElementById("size").textContent = (stats.data_size / 1024 / 1024).toFixed(2) + " MiB";
+	document.getElementById("frozen").textContent = stats.frozen ? "(frozen)" : "";
+
+	const consumers = document.getElementById("consumers");
+	consumers.replaceChildren();
+	for (const c of stats.consumers) {
+		const row = document.createElement("tr");
+		cell(row, c.fork === "" ? "(queue)" : c.fork);
+		cell(row, c.len);
+		cell(row, c.len > 0 ? c.oldest_key : "");
+		const button = document.createElement("button");
+		button.textContent = c.paused ? "Resume" : "Pause";
+		button.onclick = () => setPaused(c.fork, !c.paused);
+		cell(row, "").appendChild(button);
+		consumers.appendChild(row);
+	}
+
+	const buckets = document.getElementById("buckets");
+	buckets.replaceChildren();
+	for (const b of stats.buckets) {
+		const row = document.createElement("tr");
+		cell(row, b.Key);
+		cell(row, b.Len);
+		buckets.appendChild(row);
+	}
+
+	const hist = stats.history;
+	const max = Math.max(1, ...hist.map(s => s.len));
+	const first = hist[0].time, span = Math.max(1, hist[hist.length - 1].time - first);
+	const points = hist.map(s => [(s.time - first) / span * 590 + 5, 145 - s.len / max * 140].join(","));
+	document.getElementById("line").setAttribute("points", points.join(" "));
+}
+
+function refresh() {
+	fetch("stats").then(resp => resp.json()).then(render);
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,76 @@
+package timeq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sahib/timeq/item/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDashboard(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-dashboardtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 20, 1)))
+
+	mux := http.NewServeMux()
+	mux.Handle("/timeq/", http.StripPrefix("/timeq", queue.Dashboard()))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/timeq/")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = http.PostForm(srv.URL+"/timeq/pause", url.Values{"fork": {"fork"}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+	require.True(t, fork.ReadsPaused())
+	require.False(t, queue.ReadsPaused())
+
+	resp, err = http.PostForm(srv.URL+"/timeq/pause", url.Values{"fork": {"nope"}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = http.Get(srv.URL + "/timeq/resume")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = http.Get(srv.URL + "/timeq/stats")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json"))
+
+	var stats dashboardStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.NoError(t, resp.Body.Close())
+
+	require.Equal(t, []dashboardConsumer{
+		{Fork: "", Len: 20},
+		{Fork: "fork", Len: 20, Paused: true},
+	}, stats.Consumers)
+	require.Equal(t, []BucketCount{{Key: 0, Len: 10}, {Key: 10, Len: 10}}, stats.Buckets)
+	require.Len(t, stats.History, 1)
+	require.Equal(t, 20, stats.History[0].Len)
+	require.Greater(t, stats.DataSize, int64(0))
+}
@@ -0,0 +1,216 @@
+// Package dedup skips items that were processed already, e.g. because the
+// process crashed after handling an item, but before it was popped.
+//
+// Reading from timeq is at-least-once: items are popped after the callback of
+// Read() returned, so a crash in between hands out the same items again. Process()
+// records every handled item in a Journal before it is popped and skips items
+// that are in the journal already. This makes processing effectively-once,
+// unless the crash happens between handling an item and recording it.
+//
+// Items are identified by their key and a hash of their blob. Two items with
+// the same key and blob are therefore treated as the same item.
+package dedup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/renameio"
+	"github.com/sahib/timeq"
+)
+
+const idSize = 8 + 16
+
+// ID identifies an item by its key and the hash of its blob.
+type ID [idSize]byte
+
+// IDOf returns the ID of `it`.
+func IDOf(it timeq.Item) ID {
+	var id ID
+	binary.BigEndian.PutUint64(id[:8], uint64(it.Key))
+	sum := sha256.Sum256(it.Blob)
+	copy(id[8:], sum[:16])
+	return id
+}
+
+// Journal is an append-only file of IDs of processed items. Only the
+// last `size` IDs are remembered; this needs to be more than the number of
+// items that can be handed out again after a crash (i.e. the batch size).
+// A Journal must not be used by several goroutines at the same time.
+type Journal struct {
+	path  string
+	size  int
+	fd    *os.File
+	seen  map[ID]struct{}
+	order []ID
+}
+
+// OpenJournal opens (or creates) the journal at `path` that
+// remembers the last `size` IDs. An incomplete last entry
+// (e.g. after a crash) is ignored.
+func OpenJournal(path string, size int) (*Journal, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("journal: invalid size: %d", size)
+	}
+
+	j := &Journal{
+		path: path,
+		size: size,
+		seen: make(map[ID]struct{}, size),
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	// rewrite it, so it does not grow over time and has no partial entry:
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	fd, err := os.Open(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	r := bufio.NewReader(fd)
+	for {
+		var id ID
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+
+			return fmt.Errorf("journal: %w", err)
+		}
+
+		j.remember(id)
+	}
+}
+
+func (j *Journal) remember(id ID) {
+	if _, ok := j.seen[id]; ok {
+		return
+	}
+
+	j.seen[id] = struct{}{}
+	j.order = append(j.order, id)
+	if len(j.order) > j.size {
+		delete(j.seen, j.order[0])
+		j.order = j.order[1:]
+	}
+}
+
+// compact rewrites the journal with the remembered IDs only.
+func (j *Journal) compact() error {
+	buf := make([]byte, 0, len(j.order)*idSize)
+	for _, id := range j.order {
+		buf = append(buf, id[:]...)
+	}
+
+	if err := renameio.WriteFile(j.path, buf, 0600); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+
+	if j.fd != nil {
+		j.fd.Close()
+	}
+
+	fd, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+
+	j.fd = fd
+
+	// the copy of `order` in the file is compact now; trim the slice too:
+	j.order = append(make([]ID, 0, j.size+1), j.order...)
+	return nil
+}
+
+// Seen returns true if `id` was recorded before.
+func (j *Journal) Seen(id ID) bool {
+	_, ok := j.seen[id]
+	return ok
+}
+
+// Record adds `id` to the journal. The write is not synced; call Sync()
+// before relying on it surviving a power loss.
+func (j *Journal) Record(id ID) error {
+	if _, err := j.fd.Write(id[:]); err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+
+	j.remember(id)
+
+	// the file holds at most twice as many entries as needed:
+	stat, err := j.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+
+	if stat.Size() >= int64(2*j.size*idSize) {
+		return j.compact()
+	}
+
+	return nil
+}
+
+// Sync makes all recorded IDs durable.
+func (j *Journal) Sync() error {
+	return j.fd.Sync()
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.fd.Close()
+}
+
+// Process reads up to `n` items of `c` and calls `fn` for each item that is
+// not in `journal` yet. Every item for which `fn` succeeded is recorded in the
+// journal, which is synced before the items are popped. If `fn` fails, the
+// items stay in the queue, but the ones handled before are skipped next time.
+// It returns the number of items passed to `fn` successfully.
+func Process(c timeq.Consumer, n int, journal *Journal, fn func(it timeq.Item) error) (int, error) {
+	var nprocessed int
+	err := c.Read(n, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+		for _, it := range items {
+			id := IDOf(it)
+			if journal.Seen(id) {
+				continue
+			}
+
+			if err := fn(it); err != nil {
+				return timeq.ReadOpPeek, errors.Join(err, journal.Sync())
+			}
+
+			nprocessed++
+			if err := journal.Record(id); err != nil {
+				return timeq.ReadOpPeek, err
+			}
+		}
+
+		if err := journal.Sync(); err != nil {
+			return timeq.ReadOpPeek, fmt.Errorf("journal: %w", err)
+		}
+
+		return timeq.ReadOpPop, nil
+	})
+
+	return nprocessed, err
+}
@@ -0,0 +1,89 @@
+package dedup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sahib/timeq"
+	"github.com/sahib/timeq/timeqtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournalReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	items := timeqtest.Sequential(0, 10)
+
+	journal, err := OpenJournal(path, 4)
+	require.NoError(t, err)
+	for _, it := range items {
+		require.NoError(t, journal.Record(IDOf(it)))
+	}
+
+	require.NoError(t, journal.Sync())
+	require.NoError(t, journal.Close())
+
+	// the file never grows beyond twice the size:
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Less(t, stat.Size(), int64(2*4*idSize))
+
+	// simulate a crash while writing an entry:
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	journal, err = OpenJournal(path, 4)
+	require.NoError(t, err)
+	defer journal.Close()
+
+	for idx, it := range items {
+		require.Equal(t, idx >= 6, journal.Seen(IDOf(it)), idx)
+	}
+
+	// same key, but other blob:
+	require.False(t, journal.Seen(IDOf(timeq.Item{Key: 9, Blob: []byte("other")})))
+}
+
+func TestProcess(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	require.NoError(t, timeqtest.FillSequential(queue, 20))
+
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal"), 100)
+	require.NoError(t, err)
+	defer journal.Close()
+
+	// the items were handled before, but the process crashed before popping:
+	for _, it := range timeqtest.Sequential(0, 5) {
+		require.NoError(t, journal.Record(IDOf(it)))
+	}
+
+	var handled timeq.Items
+	n, err := Process(queue, 10, journal, func(it timeq.Item) error {
+		if it.Key == 8 {
+			return errors.New("failed")
+		}
+
+		handled = append(handled, it.Copy())
+		return nil
+	})
+
+	require.Error(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, timeqtest.Sequential(5, 3), handled)
+	require.Equal(t, 20, queue.Len())
+
+	handled = nil
+	n, err = Process(queue, 10, journal, func(it timeq.Item) error {
+		handled = append(handled, it.Copy())
+		return nil
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, timeqtest.Sequential(8, 2), handled)
+	require.Equal(t, 10, queue.Len())
+}
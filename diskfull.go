@@ -0,0 +1,116 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrDiskFull is returned when an operation failed because there is no space
+// left on the device (or the disk quota is exceeded).
+var ErrDiskFull = errors.New("disk is full")
+
+const (
+	reserveFile = "disk.reserve"
+
+	// faultFreeSpace is the free space below which a fault while writing to
+	// the memory map is treated as ENOSPC. The kernel does not tell us why
+	// a page could not be allocated, but a nearly full disk is the usual reason.
+	faultFreeSpace = 1024 * 1024
+)
+
+func isDiskFullErr(err error) bool {
+	return errors.Is(err, unix.ENOSPC) || errors.Is(err, unix.EDQUOT)
+}
+
+// checkFaultDiskFull marks `*err` as ErrDiskFull if it is caused by a full
+// disk. It has to be deferred before recoverMmapError(), so it runs after it.
+// Only faults of the memory map are checked against the free space, other
+// errors (e.g. an unknown fork) are not related to it.
+func checkFaultDiskFull(dir string, err *error) {
+	if *err == nil || errors.Is(*err, ErrDiskFull) {
+		return
+	}
+
+	if isDiskFullErr(*err) {
+		*err = fmt.Errorf("%w: %w", ErrDiskFull, *err)
+		return
+	}
+
+	if !errors.Is(*err, errMmapFault) {
+		return
+	}
+
+	var stat unix.Statfs_t
+	if unix.Statfs(dir, &stat) == nil && stat.Bavail*uint64(stat.Bsize) < faultFreeSpace {
+		*err = fmt.Errorf("%w: %w", ErrDiskFull, *err)
+	}
+}
+
+// createReserve makes sure that the reserve file in `dir` has `size` bytes
+// of disk space allocated. A size <= 0 removes the reserve file.
+func createReserve(fsys FS, dir string, size int64) error {
+	path := filepath.Join(dir, reserveFile)
+	if size <= 0 {
+		return filterIsNotExist(fsys.Remove(path))
+	}
+
+	fd, err := fsys.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = unix.Fallocate(int(fd.Fd()), 0, 0, size)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		// filesystem cannot allocate blocks without writing them:
+		_, err = fd.WriteAt(make([]byte, size), 0)
+	}
+
+	if err != nil {
+		// a half allocated reserve is of no use:
+		return errors.Join(err, fd.Close(), fsys.Remove(path))
+	}
+
+	return errors.Join(fd.Sync(), fd.Close())
+}
+
+// diskFull checks if `err` was caused by a full disk. If so, the reserve is
+// released so that consumers can go on popping (and thereby free space) and
+// the error is returned as ErrDiskFull.
+func (bs *buckets) diskFull(err error) error {
+	if err == nil || (!errors.Is(err, ErrDiskFull) && !isDiskFullErr(err)) {
+		return err
+	}
+
+	if bs.reserved {
+		bs.reserved = false
+		if rmErr := bs.opts.FS.Remove(filepath.Join(bs.dir, reserveFile)); rmErr != nil {
+			bs.opts.Logger.Printf("failed to release disk reserve: %v", rmErr)
+		} else {
+			bs.opts.Logger.Printf("disk is full: released %d bytes of reserve", bs.opts.DiskReserveSize)
+		}
+	}
+
+	if errors.Is(err, ErrDiskFull) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrDiskFull, err)
+}
+
+// restoreReserve re-creates the reserve if it was released before.
+func (bs *buckets) restoreReserve() error {
+	if bs.reserved || bs.opts.DiskReserveSize <= 0 {
+		return nil
+	}
+
+	if err := createReserve(bs.opts.FS, bs.dir, bs.opts.DiskReserveSize); err != nil {
+		return fmt.Errorf("disk reserve: %w", err)
+	}
+
+	bs.reserved = true
+	return nil
+}
@@ -0,0 +1,99 @@
+package timeq
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/sahib/timeq/item"
+)
+
+// dump writes a human-readable listing of the bucket to `w`. The cached
+// trailers of the queue are passed in `cached`, so they can be compared
+// against the indexes.
+func (b *bucket) dump(w io.Writer, consumers []ForkName, cached map[ForkName]item.Off) {
+	fmt.Fprintf(w, "bucket %s (%s)\n", b.key, b.dir)
+	fmt.Fprintf(w, "value log: %d bytes\n", b.log.Size())
+
+	for _, fork := range consumers {
+		fmt.Fprintf(w, "\nconsumer »%s«:\n", fork)
+
+		idx, err := b.idxForFork(fork)
+		if err != nil {
+			fmt.Fprintf(w, "  no index: %v\n", err)
+			continue
+		}
+
+		fmt.Fprintf(w, "  items:         %d\n", idx.Mem.Len())
+		fmt.Fprintf(w, "  index entries: %d\n", idx.Mem.NEntries())
+		fmt.Fprintf(w, "  trailer:       %d\n", idx.Mem.Trailer().TotalEntries)
+		fmt.Fprintf(w, "  cached count:  %d\n", cached[fork])
+		fmt.Fprintf(w, "  popped:        %d items, %d bytes\n", idx.Meta.PoppedItems, idx.Meta.PoppedBytes)
+		if len(idx.Meta.Tags) > 0 {
+			fmt.Fprintf(w, "  tags:          %v\n", idx.Meta.Tags)
+		}
+		for iter := idx.Mem.Iter(); iter.Next(); {
+			fmt.Fprintf(w, "  %s\n", iter.Value())
+		}
+	}
+
+	fmt.Fprintf(w, "\nitem headers:\n")
+	logIter := b.log.At(item.Location{Key: b.key, Len: math.MaxUint64}, false)
+	for logIter.Next() {
+		it := logIter.Item()
+		fmt.Fprintf(
+			w,
+			"  off=%d key=%d size=%d\n",
+			logIter.CurrentLocation().Off,
+			it.Key,
+			len(it.Blob),
+		)
+	}
+
+	if err := logIter.Err(); err != nil {
+		fmt.Fprintf(w, "  error: %v\n", err)
+	}
+}
+
+// DumpBucket writes a listing of the bucket that `key` belongs to.
+// See Queue.DumpBucket().
+func (bs *buckets) DumpBucket(key item.Key, w io.Writer) error {
+	// buffer the listing, so a slow writer does not block the queue:
+	var buf bytes.Buffer
+	if err := bs.dumpBucket(key, &buf); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (bs *buckets) dumpBucket(key item.Key, w io.Writer) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	key = bs.opts.BucketSplitConf.Func(key)
+	if _, ok := bs.tree.Get(key); !ok {
+		return fmt.Errorf("no bucket with key %v", key)
+	}
+
+	// remember them before loading, as loading corrects them:
+	consumers := append([]ForkName{""}, bs.forks...)
+	cached := make(map[ForkName]item.Off, len(consumers))
+	for _, fork := range consumers {
+		cached[fork] = bs.trailers[trailerKey{Key: key, fork: fork}].TotalEntries
+	}
+
+	buck, err := bs.forKey(key)
+	if err != nil {
+		return err
+	}
+
+	buck.dump(w, consumers, cached)
+	return nil
+}
@@ -0,0 +1,336 @@
+package timeq
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sahib/timeq/index"
+	"github.com/sahib/timeq/item"
+	"github.com/sahib/timeq/vlog"
+)
+
+// A bucket archive is a tar file with the files of a single bucket. The first
+// entry is bucketInfoName, which holds bucketInfoHeader, the key of the bucket
+// and the name of the BucketSplitConf, each on its own line. The index
+// snapshots are not exported, as they are only a cache.
+const (
+	bucketInfoName   = "bucket.info"
+	bucketInfoHeader = "timeq-bucket 1"
+)
+
+// isExportedFile returns the fork of the index file `name` or "" for the
+// value log, push times and sequences. ok is false if the file is not exported.
+func isExportedFile(name string) (fork ForkName, ok bool) {
+	switch {
+	case name == dataLogName, name == pushStampsName, name == seqLogName:
+		return "", true
+	case strings.HasSuffix(name, "idx.log"):
+		return ForkName(strings.TrimSuffix(strings.TrimSuffix(name, "idx.log"), ".")), true
+	case strings.HasSuffix(name, "idx.meta"):
+		return ForkName(strings.TrimSuffix(strings.TrimSuffix(name, "idx.meta"), ".")), true
+	default:
+		return "", false
+	}
+}
+
+// ExportBucket writes the bucket that `key` belongs to as archive to `w`.
+// See Queue.ExportBucket().
+func (bs *buckets) ExportBucket(key item.Key, w io.Writer) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	key = bs.opts.BucketSplitConf.Func(key)
+	if _, ok := bs.tree.Get(key); !ok {
+		return fmt.Errorf("export: no bucket with key %v", key)
+	}
+
+	buck, err := bs.forKey(key)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	if err := buck.Sync(true); err != nil {
+		return fmt.Errorf("export: sync: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	info := fmt.Sprintf("%s\n%d\n%s\n", bucketInfoHeader, key, bs.opts.BucketSplitConf.Name)
+	if err := writeTarFile(tw, bucketInfoName, strings.NewReader(info), int64(len(info))); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	ents, err := bs.opts.FS.ReadDir(buck.dir)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	for _, ent := range ents {
+		name := ent.Name()
+		if _, ok := isExportedFile(name); !ok || ent.IsDir() {
+			continue
+		}
+
+		if err := exportFile(tw, buck, name); err != nil {
+			return fmt.Errorf("export: %s: %w", name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+func exportFile(tw *tar.Writer, buck *bucket, name string) error {
+	fd, err := os.Open(filepath.Join(buck.dir, name))
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	if name == dataLogName {
+		// skip the pre-allocated space:
+		size = buck.log.Size()
+	}
+
+	return writeTarFile(tw, name, fd, size)
+}
+
+func writeTarFile(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+// ImportBucket adds the bucket in the archive read from `r`.
+// See Queue.ImportBucket().
+func (bs *buckets) ImportBucket(r io.Reader) (item.Key, error) {
+	// extract outside of the queue, so a broken archive leaves nothing behind:
+	tmpDir, err := os.MkdirTemp("", "timeq-import")
+	if err != nil {
+		return 0, fmt.Errorf("import: %w", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	key, splitName, err := extractBucket(r, tmpDir)
+	if err != nil {
+		return 0, fmt.Errorf("import: %w", err)
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return 0, ErrClosed
+	}
+
+	if err := bs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if splitName != bs.opts.BucketSplitConf.Name || bs.opts.BucketSplitConf.Func(key) != key {
+		return 0, fmt.Errorf(
+			"import: %w: bucket was exported with »%s« but »%s« is configured",
+			ErrChangedSplitFunc,
+			splitName,
+			bs.opts.BucketSplitConf.Name,
+		)
+	}
+
+	if _, ok := bs.tree.Get(key); ok {
+		return 0, fmt.Errorf("import: bucket %v exists already", key)
+	}
+
+	// forks of the archive that we do not have are dropped,
+	// our forks that the archive does not have start where the queue is:
+	if err := bs.keepForks(tmpDir); err != nil {
+		return 0, fmt.Errorf("import: %w", err)
+	}
+
+	for _, fork := range bs.forks {
+		if err := forkOffline(tmpDir, "", fork); err != nil {
+			return 0, fmt.Errorf("import: fork %s: %w", fork, err)
+		}
+	}
+
+	trailers := make(map[trailerKey]index.Trailer)
+	if err := index.ReadTrailers(tmpDir, func(fork string, trailer index.Trailer) {
+		trailers[trailerKey{Key: key, fork: ForkName(fork)}] = trailer
+	}); err != nil {
+		return 0, fmt.Errorf("import: %w", err)
+	}
+
+	if err := moveFileOrDir(bs.opts.FS, tmpDir, bs.buckPath(key)); err != nil {
+		return 0, fmt.Errorf("import: %w", err)
+	}
+
+	bs.tree.Set(key, nil)
+	for tk, trailer := range trailers {
+		bs.trailers[tk] = trailer
+		bs.lenOf(tk.fork).Add(int64(trailer.TotalEntries))
+	}
+
+	bs.notifyPushed()
+	return key, nil
+}
+
+// extractBucket writes the files of the archive in `r` to `dir`.
+func extractBucket(r io.Reader, dir string) (key item.Key, splitName string, err error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, "", err
+	}
+
+	if hdr.Name != bucketInfoName {
+		return 0, "", errors.New("not a bucket archive")
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(tr, 4096))
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if len(lines) < 3 || lines[0] != bucketInfoHeader {
+		return 0, "", errors.New("bad bucket info")
+	}
+
+	if _, err := fmt.Sscanf(lines[1], "%d", &key); err != nil {
+		return 0, "", fmt.Errorf("bad bucket key: %w", err)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return 0, "", err
+		}
+
+		// only plain files we know about; also prevents writing outside `dir`:
+		if _, ok := isExportedFile(hdr.Name); !ok || hdr.Typeflag != tar.TypeReg || filepath.Base(hdr.Name) != hdr.Name {
+			return 0, "", fmt.Errorf("unexpected file in archive: %s", hdr.Name)
+		}
+
+		if err := extractFile(tr, filepath.Join(dir, hdr.Name)); err != nil {
+			return 0, "", err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, dataLogName)); err != nil {
+		return 0, "", fmt.Errorf("no value log in archive: %w", err)
+	}
+
+	return key, lines[2], nil
+}
+
+func extractFile(r io.Reader, path string) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(fd, r); err != nil {
+		return errors.Join(err, fd.Close())
+	}
+
+	return errors.Join(fd.Sync(), fd.Close())
+}
+
+// keepForks removes the index files in `dir` of forks that the queue does not have.
+func (bs *buckets) keepForks(dir string) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, ent := range ents {
+		fork, ok := isExportedFile(ent.Name())
+		if !ok || bs.knowsFork(fork) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, ent.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// knowsFork is like hasFork(), but expects bs.mu to be held.
+func (bs *buckets) knowsFork(fork ForkName) bool {
+	return fork == "" || slices.Contains(bs.forks, fork)
+}
+
+// RestoreRange pushes the items of the archive in `r` with a key in the
+// inclusive range [`from`, `to`]. See Queue.RestoreRange().
+func (bs *buckets) RestoreRange(r io.Reader, from, to item.Key) (int, error) {
+	tmpDir, err := os.MkdirTemp("", "timeq-restore")
+	if err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	key, _, err := extractBucket(r, tmpDir)
+	if err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+
+	log, err := vlog.Open(filepath.Join(tmpDir, dataLogName), false)
+	if err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+
+	// NOTE: The whole value log is read, not only what the indexes still
+	// reference, since the items were likely popped or deleted since.
+	var items item.Items
+	iter := log.At(item.Location{Key: key, Len: math.MaxUint64}, false)
+	for iter.Next() {
+		it := iter.Item()
+		if it.Key < from || it.Key > to {
+			continue
+		}
+
+		items = append(items, it.Copy())
+	}
+
+	if err := errors.Join(iter.Err(), log.Close()); err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+
+	if err := bs.Push(items, true); err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+
+	return len(items), nil
+}
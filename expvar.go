@@ -0,0 +1,49 @@
+package timeq
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// expvarMu makes the check and the publish in PublishExpvar() atomic.
+var expvarMu sync.Mutex
+
+// expvarStats is what gets published by PublishExpvar().
+type expvarStats struct {
+	Len      int              `json:"len"`
+	ForkLens map[ForkName]int `json:"fork_lens"`
+	Metrics  Metrics          `json:"metrics"`
+}
+
+// PublishExpvar registers the length of the queue (and its forks) and the
+// values returned by Metrics() under the name `prefix` in the expvar package.
+// They can then be inspected via /debug/vars, if your service exposes it.
+// The values are only collected when they are requested.
+//
+// As expvar does not allow to remove or replace variables, you can only
+// publish one queue per name. An error is returned if `prefix` is taken already.
+// It is safe to call concurrently.
+func (q *Queue) PublishExpvar(prefix string) error {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if expvar.Get(prefix) != nil {
+		return fmt.Errorf("expvar: %s is already published", prefix)
+	}
+
+	expvar.Publish(prefix, expvar.Func(func() any {
+		forkLens := make(map[ForkName]int)
+		for _, fork := range q.Forks() {
+			forkLens[fork] = q.buckets.Len(fork)
+		}
+
+		return expvarStats{
+			Len:      q.Len(),
+			ForkLens: forkLens,
+			Metrics:  q.Metrics(),
+		}
+	}))
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sahib/timeq/item"
+)
+
+const (
+	roleStateFile   = "role.state"
+	roleStateHeader = "timeq-role"
+)
+
+var (
+	// ErrFollower is returned by Push() if the queue was demoted.
+	// See Queue.Demote().
+	ErrFollower = errors.New("queue is a follower")
+
+	// ErrFenced is returned by PushReplicated() if the pushing primary
+	// was replaced by a newer one. See Queue.Promote().
+	ErrFenced = errors.New("fenced by a newer primary")
+)
+
+// The role (primary or follower) and the epoch (the fencing token) are kept
+// in roleStateFile and written right away whenever one of them changes, so a
+// demoted queue stays a follower after a restart. A queue without the file
+// is a primary of epoch zero, like all queues before Promote() was called.
+
+func (bs *buckets) loadRole() error {
+	follower, epoch, err := readRoleState(bs.opts.FS, bs.dir)
+	if err != nil {
+		return err
+	}
+
+	bs.follower, bs.epoch = follower, epoch
+	return nil
+}
+
+// setRole changes and saves the role. bs.mu must be held.
+func (bs *buckets) setRole(follower bool, epoch uint64) error {
+	if bs.opts.OpenMode.readOnly() {
+		return ErrReadOnly
+	}
+
+	if err := writeRoleState(bs.opts.FS, bs.dir, follower, epoch); err != nil {
+		return fmt.Errorf("role: %w", err)
+	}
+
+	bs.follower, bs.epoch = follower, epoch
+	return nil
+}
+
+// Promote makes the queue the primary with a new epoch. See Queue.Promote().
+func (bs *buckets) Promote() (uint64, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return 0, ErrClosed
+	}
+
+	epoch := bs.epoch + 1
+	if err := bs.setRole(false, epoch); err != nil {
+		return 0, err
+	}
+
+	return epoch, nil
+}
+
+// Demote makes the queue a follower. See Queue.Demote().
+func (bs *buckets) Demote() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if bs.follower {
+		return nil
+	}
+
+	return bs.setRole(true, bs.epoch)
+}
+
+// Role returns if the queue is a follower and its epoch.
+func (bs *buckets) Role() (follower bool, epoch uint64) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.follower, bs.epoch
+}
+
+// fence checks the epoch of a replicated push. A newer epoch means that
+// another queue was promoted, so this one follows it from now on. bs.mu
+// must be held.
+func (bs *buckets) fence(epoch uint64) error {
+	switch {
+	case epoch < bs.epoch:
+		return fmt.Errorf("%w: epoch %d is older than %d", ErrFenced, epoch, bs.epoch)
+	case epoch > bs.epoch:
+		return bs.setRole(true, epoch)
+	case epoch > 0 && !bs.follower:
+		// Two primaries with the same epoch; both were promoted from the
+		// same one. Epoch zero is fine, queues start out as primaries.
+		return fmt.Errorf("%w: another primary has epoch %d too", ErrFenced, epoch)
+	default:
+		return nil
+	}
+}
+
+// PushReplicated pushes items of the primary. See Queue.PushReplicated().
+func (bs *buckets) PushReplicated(epoch uint64, items item.Items) (err error) {
+	if len(items) == 0 {
+		return nil
+	}
+
+	op := bs.opLog.newOp("push")
+	defer func() { err = op.wrap(err) }()
+
+	items, pushErr := validateItems(items)
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if err := bs.fence(epoch); err != nil {
+		return err
+	}
+
+	// followers do not replicate any further:
+	if _, err := bs.push(op, items, pushErr, false); err != nil {
+		return err
+	}
+
+	if pushErr != nil {
+		return pushErr
+	}
+
+	return nil
+}
+
+func readRoleState(fsys FS, dir string) (follower bool, epoch uint64, err error) {
+	data, err := fsys.ReadFile(filepath.Join(dir, roleStateFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, 0, nil
+		}
+
+		return false, 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 || fields[0] != roleStateHeader {
+		return false, 0, fmt.Errorf("bad role file: %q", data)
+	}
+
+	switch fields[1] {
+	case "primary":
+	case "follower":
+		follower = true
+	default:
+		return false, 0, fmt.Errorf("bad role: %q", fields[1])
+	}
+
+	epoch, err = strconv.ParseUint(fields[2], 10, 64)
+	return follower, epoch, err
+}
+
+func writeRoleState(fsys FS, dir string, follower bool, epoch uint64) error {
+	role := "primary"
+	if follower {
+		role = "follower"
+	}
+
+	data := fmt.Sprintf("%s %s %d\n", roleStateHeader, role, epoch)
+	if err := fsys.WriteFile(filepath.Join(dir, roleStateFile), []byte(data), 0600); err != nil {
+		return err
+	}
+
+	// make sure that the rename of WriteFile() hit the disk too:
+	return fsys.SyncDir(dir)
+}
@@ -0,0 +1,114 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FormatVersion is the version of the on-disk format that this version of
+// timeq writes. It is increased on every change that older versions cannot
+// read. It is stored in the root directory of every queue.
+const FormatVersion = 1
+
+// minFormatVersion is the oldest format that ExportFormat() can write.
+const minFormatVersion = 1
+
+const (
+	formatFile   = "format.version"
+	formatHeader = "timeq-format"
+)
+
+var (
+	// ErrFormatTooNew is returned by Open() if the queue was written by a
+	// newer version of timeq. Use errors.As() with *FormatError to get the
+	// versions.
+	ErrFormatTooNew = errors.New("format is too new")
+)
+
+// FormatError is returned by Open() if the format version of the queue
+// is not supported. It wraps ErrFormatTooNew.
+type FormatError struct {
+	// Version is the format version of the queue on disk.
+	Version int
+
+	// Supported is the newest format version that can be read (FormatVersion).
+	Supported int
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf(
+		"%v: queue has format version %d, but only up to %d is supported"+
+			" - use ExportFormat() of a newer version to downgrade",
+		ErrFormatTooNew,
+		e.Version,
+		e.Supported,
+	)
+}
+
+func (e *FormatError) Unwrap() error {
+	return ErrFormatTooNew
+}
+
+// readFormat returns the format version of the queue at `dir`. Queues
+// written before the version was stored are of version 1. It returns a
+// *FormatError if the version is newer than FormatVersion.
+func readFormat(fsys FS, dir string) (version int, exists bool, err error) {
+	data, err := fsys.ReadFile(filepath.Join(dir, formatFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 1, false, nil
+		}
+
+		return 0, false, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] != formatHeader {
+		return 0, true, fmt.Errorf("bad format file: %q", data)
+	}
+
+	version, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, true, fmt.Errorf("bad format version: %w", err)
+	}
+
+	if version > FormatVersion {
+		return version, true, &FormatError{Version: version, Supported: FormatVersion}
+	}
+
+	return version, true, nil
+}
+
+func writeFormat(fsys FS, dir string, version int) error {
+	data := fmt.Sprintf("%s %d\n", formatHeader, version)
+	return fsys.WriteFile(filepath.Join(dir, formatFile), []byte(data), 0600)
+}
+
+// ExportFormat writes a copy of the queue in format `version` to `dstDir`.
+// See Queue.ExportFormat().
+func (bs *buckets) ExportFormat(dstDir string, version int) error {
+	if version < minFormatVersion || version > FormatVersion {
+		return fmt.Errorf(
+			"export: cannot write format version %d, only %d to %d are supported",
+			version,
+			minFormatVersion,
+			FormatVersion,
+		)
+	}
+
+	// NOTE: There is only one format so far. Once there is a second one,
+	// this needs to convert the cloned buckets if version < FormatVersion.
+	if err := bs.Clone(dstDir); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	if err := writeFormat(bs.opts.FS, dstDir, version); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	return bs.opts.FS.SyncDir(dstDir)
+}
@@ -0,0 +1,76 @@
+package timeq
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/google/renameio"
+)
+
+// FS abstracts the filesystem operations that timeq does on the directory
+// structure of a queue: creating and listing bucket directories, removing
+// buckets and forks, reading or writing the small metadata files next to
+// them and opening the lock files, batch logs and the disk reserve. This
+// allows tests and embedders to inject faults or to observe what the queue
+// does on disk.
+//
+// NOTE: The value logs and index logs are memory-mapped and therefore always
+// opened via the OS. An FS must hence operate on real directories; the usual
+// way to implement one is to wrap OSFS() and only override some methods.
+type FS interface {
+	MkdirAll(path string, perm fs.FileMode) error
+	ReadDir(path string) ([]fs.DirEntry, error)
+	Stat(path string) (fs.FileInfo, error)
+	ReadFile(path string) ([]byte, error)
+
+	// OpenFile is like os.OpenFile. The returned file is locked,
+	// truncated, allocated and synced, so it has to be a real file.
+	OpenFile(path string, flag int, perm fs.FileMode) (*os.File, error)
+
+	// WriteFile must replace the contents of `path` atomically,
+	// i.e. readers see either the old or the new contents.
+	WriteFile(path string, data []byte, perm fs.FileMode) error
+
+	Rename(src, dst string) error
+	Remove(path string) error
+	RemoveAll(path string) error
+
+	// SyncDir makes sure that changes to the entries of the
+	// directory at `path` (e.g. removed files) hit the disk.
+	SyncDir(path string) error
+}
+
+type osFS struct{}
+
+// OSFS returns the FS that is used by default. It calls the
+// respective functions of the os package.
+func OSFS() FS {
+	return osFS{}
+}
+
+func (osFS) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) ReadDir(path string) ([]fs.DirEntry, error)   { return os.ReadDir(path) }
+func (osFS) Stat(path string) (fs.FileInfo, error)        { return os.Stat(path) }
+func (osFS) ReadFile(path string) ([]byte, error)         { return os.ReadFile(path) }
+func (osFS) Rename(src, dst string) error                 { return os.Rename(src, dst) }
+func (osFS) Remove(path string) error                     { return os.Remove(path) }
+func (osFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+
+func (osFS) OpenFile(path string, flag int, perm fs.FileMode) (*os.File, error) {
+	return os.OpenFile(path, flag, perm)
+}
+
+func (osFS) WriteFile(path string, data []byte, perm fs.FileMode) error {
+	return renameio.WriteFile(path, data, perm)
+}
+
+func (osFS) SyncDir(path string) error {
+	fd, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(fd.Sync(), fd.Close())
+}
@@ -0,0 +1,187 @@
+package timeq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+// collectBucket returns a copy of all items of `fork` in the bucket `key`.
+func (bs *buckets) collectBucket(fork ForkName, key item.Key) (item.Items, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return nil, ErrClosed
+	}
+
+	if _, ok := bs.tree.Get(key); !ok {
+		return nil, fs.ErrNotExist
+	}
+
+	buck, err := bs.forKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return buck.collectRange(fork, math.MinInt64, math.MaxInt64, nil)
+}
+
+func (bs *buckets) hasFork(fork ForkName) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return fork == "" || slices.Contains(bs.forks, fork)
+}
+
+// readOnlyFS is a read-only view of the items of a consumer.
+// See Queue.ReadOnlyFS().
+type readOnlyFS struct {
+	bs   *buckets
+	fork ForkName
+}
+
+func (rfs *readOnlyFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	file, err := rfs.open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return file, nil
+}
+
+func (rfs *readOnlyFS) open(name string) (fs.File, error) {
+	if !rfs.bs.hasFork(rfs.fork) {
+		return nil, ErrNoSuchFork
+	}
+
+	if name == "." {
+		var ents []fileInfo
+		for _, count := range rfs.bs.CountByBucket(rfs.fork) {
+			ents = append(ents, fileInfo{name: count.Key.String(), mode: fs.ModeDir | 0o555})
+		}
+
+		return &memDir{info: fileInfo{name: ".", mode: fs.ModeDir | 0o555}, ents: ents}, nil
+	}
+
+	buckName, itemName, _ := strings.Cut(name, "/")
+	var key item.Key
+	if _, err := fmt.Sscanf(buckName, "K%d", &key); err != nil || key.String() != buckName {
+		return nil, fs.ErrNotExist
+	}
+
+	items, err := rfs.bs.collectBucket(rfs.fork, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items) == 0 {
+		// buckets that are empty for this fork are not listed either.
+		return nil, fs.ErrNotExist
+	}
+
+	ents := itemFileInfos(items)
+	if itemName == "" {
+		return &memDir{info: fileInfo{name: buckName, mode: fs.ModeDir | 0o555}, ents: ents}, nil
+	}
+
+	for idx, ent := range ents {
+		if ent.name == itemName {
+			return &memFile{info: ent, Reader: bytes.NewReader(items[idx].Blob)}, nil
+		}
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+// itemFileInfos names the files of `items` (which must be sorted) by their
+// key. Items with the same key get a ".1", ".2", ... suffix.
+func itemFileInfos(items item.Items) []fileInfo {
+	infos := make([]fileInfo, 0, len(items))
+	var dup int
+	for idx, it := range items {
+		name := fmt.Sprintf("%020d", it.Key)
+		if idx > 0 && items[idx-1].Key == it.Key {
+			dup++
+			name = fmt.Sprintf("%s.%d", name, dup)
+		} else {
+			dup = 0
+		}
+
+		infos = append(infos, fileInfo{
+			name:    name,
+			size:    int64(len(it.Blob)),
+			mode:    0o444,
+			modTime: time.Unix(0, int64(it.Key)),
+		})
+	}
+
+	return infos
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string               { return fi.name }
+func (fi fileInfo) Size() int64                { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() any                   { return nil }
+func (fi fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+type memFile struct {
+	*bytes.Reader
+	info fileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+type memDir struct {
+	info fileInfo
+	ents []fileInfo
+	off  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.ents[d.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+
+	d.off += len(rest)
+	ents := make([]fs.DirEntry, 0, len(rest))
+	for _, ent := range rest {
+		ents = append(ents, ent)
+	}
+
+	return ents, nil
+}
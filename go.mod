@@ -3,6 +3,7 @@ module github.com/sahib/timeq
 go 1.21.0
 
 require (
+	github.com/google/renameio v1.0.1
 	github.com/otiai10/copy v1.14.0
 	github.com/stretchr/testify v1.8.4
 	github.com/tidwall/btree v1.7.0
@@ -13,7 +14,6 @@ require (
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/google/renameio v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	golang.org/x/sync v0.3.0 // indirect
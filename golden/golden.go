@@ -0,0 +1,215 @@
+// Package golden ships small queues that were written by each on-disk format
+// version of timeq and checks that the current code can still read them.
+// Long-lived queues are opened by many releases of timeq, so an accidental
+// change of the format would lose data. Call Verify() in your own tests or
+// canary setups to make sure the version of timeq you use is compatible.
+package golden
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sahib/timeq"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// fixture describes the contents of one of the queues in fixtures/.
+type fixture struct {
+	// name is the directory below fixtures/ and the format version.
+	name string
+
+	// split is the split conf that was used to write the queue.
+	split timeq.BucketSplitConf
+
+	// expect is what each consumer yields when being drained.
+	expect map[timeq.ForkName]timeq.Items
+}
+
+// all fixtures, oldest first. The last one is the one that generate() writes.
+// When the format changes, add a new fixture instead of changing the old ones
+// and write it with "go test ./golden -update" (the files are embedded at
+// compile time, so run the test once more afterwards).
+var fixtureList = []fixture{
+	{
+		name:  "v1",
+		split: timeq.FixedSizeBucketSplitConf(50),
+		expect: map[timeq.ForkName]timeq.Items{
+			"":     genItems(10, 100),
+			"fork": genItems(20, 100),
+		},
+	},
+}
+
+func genItems(start, stop int) timeq.Items {
+	items := make(timeq.Items, 0, stop-start)
+	for idx := start; idx < stop; idx++ {
+		items = append(items, timeq.Item{
+			Key:  timeq.Key(idx),
+			Blob: []byte(fmt.Sprintf("%d", idx)),
+		})
+	}
+
+	return items
+}
+
+// generate writes the latest fixture to `dir` with the current code.
+func generate(dir string) error {
+	fx := fixtureList[len(fixtureList)-1]
+
+	opts := timeq.DefaultOptions()
+	opts.BucketSplitConf = fx.split
+	queue, err := timeq.Open(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	fork, err := queue.Fork("fork")
+	if err != nil {
+		return errors.Join(err, queue.Close())
+	}
+
+	if err := queue.Push(genItems(0, 100)); err != nil {
+		return errors.Join(err, queue.Close())
+	}
+
+	pop := func(consumer timeq.Consumer, n int) error {
+		return consumer.Read(n, func(_ timeq.Transaction, _ timeq.Items) (timeq.ReadOp, error) {
+			return timeq.ReadOpPop, nil
+		})
+	}
+
+	if err := errors.Join(pop(queue, 10), pop(fork, 20)); err != nil {
+		return errors.Join(err, queue.Close())
+	}
+
+	return queue.Close()
+}
+
+// collectLogger remembers all messages that were logged.
+type collectLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *collectLogger) Printf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+// copyFixture copies the fixture `name` from the embedded files to `dst`.
+func copyFixture(name, dst string) error {
+	src := filepath.Join("fixtures", name)
+	return fs.WalkDir(fixtures, src, func(path string, ent fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		dstPath := filepath.Join(dst, rel)
+		if ent.IsDir() {
+			return os.MkdirAll(dstPath, 0700)
+		}
+
+		data, err := fixtures.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(dstPath, data, 0600)
+	})
+}
+
+func drain(consumer timeq.Consumer) (timeq.Items, error) {
+	var drained timeq.Items
+	for {
+		var nread int
+		err := consumer.Read(1000, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+			nread = len(items)
+			drained = append(drained, items.Copy()...)
+			return timeq.ReadOpPop, nil
+		})
+
+		if err != nil || nread == 0 {
+			return drained, err
+		}
+	}
+}
+
+func verifyFixture(fx fixture, dir string) error {
+	if err := copyFixture(fx.name, dir); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+
+	logger := &collectLogger{}
+	opts := timeq.DefaultOptions()
+	opts.BucketSplitConf = fx.split
+	opts.Logger = logger
+
+	queue, err := timeq.Open(dir, opts)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	defer queue.Close()
+
+	for name, expect := range fx.expect {
+		var consumer timeq.Consumer = queue
+		if name != "" {
+			if consumer, err = queue.Fork(name); err != nil {
+				return fmt.Errorf("fork %s: %w", name, err)
+			}
+		}
+
+		if n := consumer.Len(); n != len(expect) {
+			return fmt.Errorf("consumer »%s«: len is %d, expected %d", name, n, len(expect))
+		}
+
+		items, err := drain(consumer)
+		if err != nil {
+			return fmt.Errorf("consumer »%s«: read: %w", name, err)
+		}
+
+		if len(items) != len(expect) {
+			return fmt.Errorf("consumer »%s«: read %d items, expected %d", name, len(items), len(expect))
+		}
+
+		for idx := range items {
+			if items[idx].Key != expect[idx].Key || string(items[idx].Blob) != string(expect[idx].Blob) {
+				return fmt.Errorf("consumer »%s«: item %d is %v, expected %v", name, idx, items[idx], expect[idx])
+			}
+		}
+	}
+
+	if len(logger.msgs) > 0 {
+		return fmt.Errorf("unexpected warnings: %v", logger.msgs)
+	}
+
+	return queue.Close()
+}
+
+// Verify opens each embedded fixture with the current code and checks that
+// all consumers yield the expected items and that no recovery was needed.
+// The fixtures are copied to sub-directories of `dir` first, which should
+// be empty; they are left there for inspection.
+func Verify(dir string) error {
+	for _, fx := range fixtureList {
+		if err := verifyFixture(fx, filepath.Join(dir, fx.name)); err != nil {
+			return fmt.Errorf("fixture %s: %w", fx.name, err)
+		}
+	}
+
+	return nil
+}
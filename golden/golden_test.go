@@ -0,0 +1,22 @@
+package golden
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "re-generate the latest fixture")
+
+func TestVerify(t *testing.T) {
+	if *update {
+		dir := filepath.Join("fixtures", fixtureList[len(fixtureList)-1].name)
+		require.NoError(t, os.RemoveAll(dir))
+		require.NoError(t, generate(dir))
+	}
+
+	require.NoError(t, Verify(t.TempDir()))
+}
@@ -0,0 +1,187 @@
+package timeq
+
+import (
+	"errors"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+// ErrNotMember is returned by GroupMember.Read() after GroupMember.Leave().
+var ErrNotMember = errors.New("not a member of the group")
+
+// Group splits the buckets of the queue or of a fork among its members, like
+// a consumer group in Kafka. Each member only reads from the buckets assigned
+// to it, so several consumers can work on the same queue in parallel without
+// getting the same items. Items are still popped in key order per bucket,
+// but not across buckets.
+//
+// Buckets are assigned with rendezvous hashing: every member gets roughly the
+// same number of buckets, and if a member joins or leaves, only the buckets
+// of this member move. There is no hand-over though: if a bucket moves while
+// its old owner processes items that it peeked, both might see them.
+//
+// Members in other processes can join via the ipc package.
+type Group struct {
+	q    *Queue
+	fork ForkName
+
+	mu      sync.Mutex
+	members map[string]time.Time
+}
+
+// GroupMember reads from the buckets of a Group that are assigned to it.
+type GroupMember struct {
+	g  *Group
+	id string
+}
+
+// Group returns the group of the queue (if `fork` is empty) or of `fork`.
+// All calls with the same `fork` return the same group. The group is
+// not persisted; members have to join again after Open().
+func (q *Queue) Group(fork ForkName) *Group {
+	q.groupsMu.Lock()
+	defer q.groupsMu.Unlock()
+
+	if g, ok := q.groups[fork]; ok {
+		return g
+	}
+
+	if q.groups == nil {
+		q.groups = make(map[ForkName]*Group)
+	}
+
+	g := &Group{q: q, fork: fork, members: make(map[string]time.Time)}
+	q.groups[fork] = g
+	return g
+}
+
+// Join adds the member `id` to the group. Joining with the ID of an existing
+// member (e.g. after a restart of a consumer) returns the same membership.
+func (g *Group) Join(id string) *GroupMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.members[id] = time.Now()
+	return &GroupMember{g: g, id: id}
+}
+
+// Members returns the IDs of all current members, sorted.
+func (g *Group) Members() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.expire(time.Now())
+	return g.memberIDs()
+}
+
+// expire removes members that exceeded Options.GroupSessionTimeout.
+func (g *Group) expire(now time.Time) {
+	timeout := g.q.buckets.opts.GroupSessionTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	for id, seen := range g.members {
+		if now.Sub(seen) > timeout {
+			delete(g.members, id)
+		}
+	}
+}
+
+func (g *Group) memberIDs() []string {
+	ids := make([]string, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+
+	slices.Sort(ids)
+	return ids
+}
+
+// owner returns the member of `members` that the bucket `key` is assigned to.
+func owner(members []string, key item.Key) string {
+	var best string
+	var bestWeight uint64
+	for _, id := range members {
+		h := fnv.New64a()
+		h.Write([]byte(id))
+
+		// fnv alone does not mix the high bits well enough for similar
+		// inputs, so finish with the splitmix64 finalizer:
+		weight := h.Sum64() ^ uint64(key)
+		weight = (weight ^ (weight >> 30)) * 0xbf58476d1ce4e5b9
+		weight = (weight ^ (weight >> 27)) * 0x94d049bb133111eb
+		weight ^= weight >> 31
+
+		if best == "" || weight > bestWeight {
+			best, bestWeight = id, weight
+		}
+	}
+
+	return best
+}
+
+// ID returns the ID that the member joined with.
+func (m *GroupMember) ID() string {
+	return m.id
+}
+
+// touch marks the member as alive and returns all members.
+func (m *GroupMember) touch() ([]string, error) {
+	m.g.mu.Lock()
+	defer m.g.mu.Unlock()
+
+	if _, ok := m.g.members[m.id]; !ok {
+		return nil, ErrNotMember
+	}
+
+	now := time.Now()
+	m.g.members[m.id] = now
+	m.g.expire(now)
+	return m.g.memberIDs(), nil
+}
+
+// Buckets returns the keys of the non-empty buckets that are
+// currently assigned to the member.
+func (m *GroupMember) Buckets() ([]Key, error) {
+	members, err := m.touch()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	for _, count := range m.g.q.buckets.CountByBucket(m.g.fork) {
+		if owner(members, count.Key) == m.id {
+			keys = append(keys, count.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Read is like Queue.Read(), but only reads from the buckets that are
+// assigned to the member. It returns ErrNotMember after Leave() or if the
+// member was removed by Options.GroupSessionTimeout.
+func (m *GroupMember) Read(n int, fn TransactionFn) error {
+	members, err := m.touch()
+	if err != nil {
+		return err
+	}
+
+	return m.g.q.buckets.ReadWhere(n, m.g.fork, func(key item.Key) bool {
+		return owner(members, key) == m.id
+	}, fn)
+}
+
+// Leave removes the member from the group. Its buckets
+// are assigned to the remaining members.
+func (m *GroupMember) Leave() {
+	m.g.mu.Lock()
+	defer m.g.mu.Unlock()
+
+	delete(m.g.members, m.id)
+}
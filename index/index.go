@@ -1,6 +1,7 @@
 package index
 
 import (
+	"errors"
 	"os"
 
 	"github.com/sahib/timeq/item"
@@ -8,18 +9,25 @@ import (
 	"github.com/tidwall/btree"
 )
 
-// Index is an in-memory representation of the batch index as b-tree structure.
+// Index is an in-memory representation of the batch index. The data
+// structure behind it can be chosen with Kind, a b-tree is the default.
+// Optionally, most of it can live in a memory-mapped snapshot (see LoadMapped).
 type Index struct {
-	m        btree.Map[item.Key, []item.Location]
+	m        structure
+	kind     Kind
 	len      item.Off
 	nentries item.Off
+
+	// base is only set if the index was loaded from a snapshot.
+	// In this case `m` only holds the changes made after it.
+	base *mapped
 }
 
 // FromVlog produces an index from the data in the value log. It's
 // main use is to re-generate the index in case the index file is
 // damaged or broken in some way. The resulting index is likely not
 // the same as before, but will include items that were popped already.
-func FromVlog(log *vlog.Log) (*Index, error) {
+func FromVlog(log *vlog.Log, kind Kind) (*Index, error) {
 	// we're cheating a little here by trusting the iterator
 	// to go not over the end, even if the Len is bogus.
 	iter := log.At(item.Location{
@@ -27,7 +35,7 @@ func FromVlog(log *vlog.Log) (*Index, error) {
 		Len: ^item.Off(0),
 	}, true)
 
-	index := &Index{}
+	index := New(kind)
 
 	var prevLoc item.Location
 	var lastLoc item.Location
@@ -66,7 +74,12 @@ func FromVlog(log *vlog.Log) (*Index, error) {
 	return index, nil
 }
 
-func Load(path string) (*Index, error) {
+// New returns a new, empty index that uses the structure of `kind`.
+func New(kind Kind) *Index {
+	return &Index{m: newStructure(kind), kind: kind}
+}
+
+func Load(path string, kind Kind) (*Index, error) {
 	flags := os.O_CREATE | os.O_RDONLY
 	fd, err := os.OpenFile(path, flags, 0600)
 	if err != nil {
@@ -75,11 +88,37 @@ func Load(path string) (*Index, error) {
 
 	defer fd.Close()
 
-	rdr := NewReader(fd)
+	index := New(kind)
+	_, err = replay(index, NewReader(fd))
+	return index, err
+}
+
+// LoadReadOnly works like Load(), but does not create a missing index log.
+// It returns an empty index then. Snapshots are not used, since they might
+// have to be written.
+func LoadReadOnly(path string, kind Kind) (*Index, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return New(kind), nil
+		}
+
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	index := New(kind)
+	_, err = replay(index, NewReader(fd))
+	return index, err
+}
 
-	var index Index
+// replay applies all entries of `rdr` to `index`
+// and returns the number of replayed entries.
+func replay(index *Index, rdr *Reader) (int, error) {
+	var n int
 	var loc item.Location
-	for rdr.Next(&loc) {
+	for ; rdr.Next(&loc); n++ {
 		if loc.Len == 0 {
 			// len=0 means that the specific batch was fully consumed.
 			// delete any previously read values.
@@ -89,33 +128,44 @@ func Load(path string) (*Index, error) {
 		}
 	}
 
-	return &index, rdr.Err()
+	return n, rdr.Err()
+}
+
+// mem returns the structure that holds the heap part of the index.
+// The zero value of Index uses a b-tree.
+func (i *Index) mem() structure {
+	if i.m == nil {
+		i.m = newStructure(i.kind)
+	}
+
+	return i.m
 }
 
 func (i *Index) Set(loc item.Location) (item.Location, int) {
-	oldLocs, _ := i.m.Get(loc.Key)
-	i.m.Set(loc.Key, append(oldLocs, loc))
+	i.mem().set(loc)
 	i.len += loc.Len
 	i.nentries += loc.Len
 	return loc, 0
 }
 
 func (i *Index) Delete(key item.Key) (loc item.Location) {
-	oldLocs, ok := i.m.Get(key)
-	if !ok {
-		return
+	if i.base != nil {
+		// locations in the snapshot are older, so they go first:
+		if loc, ok := i.base.delete(key); ok {
+			i.len -= loc.Len
+			i.nentries += loc.Len
+			return loc
+		}
 	}
 
-	i.len -= oldLocs[0].Len
-	i.nentries += oldLocs[0].Len
-	if len(oldLocs) > 1 {
-		// delete one of the keys:
-		i.m.Set(key, oldLocs[1:])
-		return oldLocs[0]
+	loc, ok := i.mem().delete(key)
+	if !ok {
+		return
 	}
 
-	i.m.Delete(key)
-	return oldLocs[0]
+	i.len -= loc.Len
+	i.nentries += loc.Len
+	return loc
 }
 
 // Len returns the number of items in the WAL.
@@ -138,21 +188,69 @@ func (i *Index) Trailer() Trailer {
 }
 
 func (i *Index) Copy() *Index {
+	var base *mapped
+	if i.base != nil {
+		base = i.base.copy()
+	}
+
 	return &Index{
-		m:        *i.m.Copy(),
+		m:        i.mem().copy(),
+		kind:     i.kind,
 		len:      i.len,
 		nentries: i.nentries,
+		base:     base,
 	}
 }
 
+// Close releases the resources of the index, if any.
+// This is only necessary for indexes returned by LoadMapped().
+func (i *Index) Close() error {
+	if i.base == nil {
+		return nil
+	}
+
+	base := i.base
+	i.base = nil
+	return base.close()
+}
+
 ////////////
 
 type Iter struct {
+	// only used by the b-tree:
 	iter btree.MapIter[item.Key, []item.Location]
 	curr []item.Location
+
+	// only used by the sorted slice and the radix tree,
+	// where `locs` are the locations of the current leaf:
+	locs     []item.Location
+	pos      int
+	isSorted bool
+	stack    []radixStep
+
+	// only used if the index has a snapshot:
+	base    *mapped
+	baseIdx int
+	heapOk  bool
+	heapLoc item.Location
+	val     item.Location
+	started bool
 }
 
-func (i *Iter) Next() bool {
+func (i *Iter) nextHeap() bool {
+	if i.isSorted {
+		i.pos++
+		for i.pos >= len(i.locs) {
+			if !i.nextLeaf() {
+				return false
+			}
+
+			i.pos = 0
+		}
+
+		return true
+	}
+
 	if len(i.curr) > 1 {
 		i.curr = i.curr[1:]
 		return true
@@ -166,7 +264,74 @@ func (i *Iter) Next() bool {
 	return false
 }
 
-func (i *Iter) Value() item.Location {
+// nextLeaf moves `locs` to the next leaf of the radix tree.
+func (i *Iter) nextLeaf() bool {
+	for len(i.stack) > 0 {
+		top := &i.stack[len(i.stack)-1]
+		node := top.node
+		if node.isLeaf() {
+			i.stack = i.stack[:len(i.stack)-1]
+			i.locs = node.locs
+			return true
+		}
+
+		for top.idx < len(node.children) && node.children[top.idx] == nil {
+			top.idx++
+		}
+
+		if top.idx == len(node.children) {
+			i.stack = i.stack[:len(i.stack)-1]
+			continue
+		}
+
+		top.idx++
+		i.stack = append(i.stack, radixStep{node: node.children[top.idx-1]})
+	}
+
+	return false
+}
+
+func (i *Iter) Next() bool {
+	if i.base == nil {
+		return i.nextHeap()
+	}
+
+	// merge the snapshot and the heap by key:
+	if !i.started {
+		i.started = true
+		i.baseIdx = i.base.next(0)
+		if i.heapOk = i.nextHeap(); i.heapOk {
+			i.heapLoc = i.valueHeap()
+		}
+	}
+
+	baseOk := i.baseIdx < i.base.n
+	switch {
+	case baseOk && (!i.heapOk || i.base.keyAt(i.baseIdx) <= i.heapLoc.Key):
+		// snapshot entries are older, so they win on equal keys.
+		i.val = i.base.at(i.baseIdx)
+		i.baseIdx = i.base.next(i.baseIdx + 1)
+	case i.heapOk:
+		i.val = i.heapLoc
+		if i.heapOk = i.nextHeap(); i.heapOk {
+			i.heapLoc = i.valueHeap()
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (i *Iter) valueHeap() item.Location {
+	if i.isSorted {
+		if i.pos < 0 || i.pos >= len(i.locs) {
+			return item.Location{}
+		}
+
+		return i.locs[i.pos]
+	}
+
 	if len(i.curr) == 0 {
 		// this should not happen in case of correct api usage.
 		// just a guard if someone calls Value() without Next()
@@ -176,6 +341,16 @@ func (i *Iter) Value() item.Location {
 	return i.curr[0]
 }
 
+func (i *Iter) Value() item.Location {
+	if i.base != nil {
+		return i.val
+	}
+
+	return i.valueHeap()
+}
+
 func (i *Index) Iter() Iter {
-	return Iter{iter: i.m.Iter()}
+	iter := i.mem().iter()
+	iter.base = i.base
+	return iter
 }
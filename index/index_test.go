@@ -3,6 +3,7 @@ package index
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/sahib/timeq/item"
@@ -34,7 +35,7 @@ func TestIndexLoad(t *testing.T) {
 
 	require.NoError(t, w.Close())
 
-	index, err := Load(indexPath)
+	index, err := Load(indexPath, KindBTree)
 	require.NoError(t, err)
 
 	// if length=0 then Load() considers the entry
@@ -75,19 +76,22 @@ func testIndexFromVlog(t *testing.T, pushes []item.Items, expLocs [][]item.Locat
 		require.NoError(t, err)
 	}
 
-	index, err := FromVlog(log)
-	require.NoError(t, err)
-
-	gotLocs := index.m.Values()
-	gotKeys := index.m.Keys()
-
-	expKeys := []item.Key{}
+	flatExpLocs := []item.Location{}
 	for _, expSlice := range expLocs {
-		expKeys = append(expKeys, expSlice[0].Key)
+		flatExpLocs = append(flatExpLocs, expSlice...)
 	}
 
-	require.Equal(t, expLocs, gotLocs)
-	require.Equal(t, expKeys, gotKeys)
+	for _, kind := range []Kind{KindBTree, KindSorted} {
+		index, err := FromVlog(log, kind)
+		require.NoError(t, err)
+
+		gotLocs := []item.Location{}
+		for iter := index.Iter(); iter.Next(); {
+			gotLocs = append(gotLocs, iter.Value())
+		}
+
+		require.Equal(t, flatExpLocs, gotLocs)
+	}
 }
 
 func TestIndexFromVlog(t *testing.T) {
@@ -213,3 +217,162 @@ func TestIndexNoCrashOnBadAPIUsage(t *testing.T) {
 	iter := index.Iter()
 	iter.Value() // this should not crash
 }
+
+func TestIndexLoadMapped(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-indextest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	idxPath := filepath.Join(tmpDir, "idx.log")
+	w, err := NewWriter(idxPath, true)
+	require.NoError(t, err)
+
+	// two locations per key, some deleted:
+	var exp []item.Location
+	for idx := 0; idx < 100; idx++ {
+		for _, off := range []item.Off{0, 1000} {
+			loc := item.Location{
+				Key: item.Key(idx),
+				Off: item.Off(idx) + off,
+				Len: 1,
+			}
+			require.NoError(t, w.Push(loc, Trailer{}))
+			exp = append(exp, loc)
+		}
+	}
+
+	// delete the first location of the first 10 keys:
+	for idx := 0; idx < 10; idx++ {
+		require.NoError(t, w.Push(item.Location{Key: item.Key(idx)}, Trailer{}))
+		exp = slices.DeleteFunc(exp, func(loc item.Location) bool {
+			return loc.Key == item.Key(idx) && loc.Off < 1000
+		})
+	}
+
+	require.NoError(t, w.Close())
+
+	collect := func(index *Index) []item.Location {
+		var locs []item.Location
+		for iter := index.Iter(); iter.Next(); {
+			locs = append(locs, iter.Value())
+		}
+		return locs
+	}
+
+	heapIndex, err := Load(idxPath, KindBTree)
+	require.NoError(t, err)
+	require.Equal(t, exp, collect(heapIndex))
+
+	// first load writes the snapshot:
+	index, err := LoadMapped(idxPath, KindBTree)
+	require.NoError(t, err)
+	require.NotNil(t, index.base)
+	require.Equal(t, 0, index.m.count())
+	require.Equal(t, heapIndex.Len(), index.Len())
+	require.Equal(t, heapIndex.NEntries(), index.NEntries())
+	require.Equal(t, exp, collect(index))
+	require.FileExists(t, SnapshotPath(idxPath))
+
+	// modify the index and check the merged view:
+	copied := index.Copy()
+	index.Delete(0)
+	index.Delete(50)
+	index.Delete(50)
+	index.Delete(50) // no-op
+	newLoc := item.Location{Key: 50, Off: 2000, Len: 5}
+	index.Set(newLoc)
+
+	exp = slices.DeleteFunc(exp, func(loc item.Location) bool {
+		return loc.Key == 0 || loc.Key == 50
+	})
+	exp = slices.Insert(exp, slices.IndexFunc(exp, func(loc item.Location) bool {
+		return loc.Key > 50
+	}), newLoc)
+	require.Equal(t, exp, collect(index))
+	require.Equal(t, item.Off(len(exp)+4), index.Len())
+
+	// copy should not be affected:
+	require.Equal(t, heapIndex.Len(), copied.Len())
+	require.Equal(t, collect(heapIndex), collect(copied))
+	require.NoError(t, copied.Close())
+	require.NoError(t, index.Close())
+
+	// second load with a small tail should re-use the snapshot:
+	w, err = NewWriter(idxPath, true)
+	require.NoError(t, err)
+	require.NoError(t, w.Push(item.Location{Key: 1}, Trailer{}))
+	require.NoError(t, w.Close())
+
+	heapIndex, err = Load(idxPath, KindBTree)
+	require.NoError(t, err)
+
+	index, err = LoadMapped(idxPath, KindBTree)
+	require.NoError(t, err)
+	require.Equal(t, 0, index.m.count())
+	require.Equal(t, collect(heapIndex), collect(index))
+	require.Equal(t, heapIndex.Len(), index.Len())
+	require.NoError(t, index.Close())
+
+	// broken snapshots should be rebuilt:
+	require.NoError(t, os.WriteFile(SnapshotPath(idxPath), []byte("garbage"), 0600))
+	index, err = LoadMapped(idxPath, KindBTree)
+	require.NoError(t, err)
+	require.Equal(t, collect(heapIndex), collect(index))
+	require.NoError(t, index.Close())
+}
+
+func TestIndexLoadCheckpointed(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-indextest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	idxPath := filepath.Join(tmpDir, "idx.log")
+	w, err := NewWriter(idxPath, true)
+	require.NoError(t, err)
+
+	for idx := 0; idx < 100; idx++ {
+		loc := item.Location{Key: item.Key(idx), Off: item.Off(idx), Len: 1}
+		require.NoError(t, w.Push(loc, Trailer{}))
+	}
+
+	// checkpoint in the middle of the log:
+	checkpoint, err := Load(idxPath, KindBTree)
+	require.NoError(t, err)
+	require.NoError(t, WriteSnapshot(checkpoint, SnapshotPath(idxPath), w.Size()))
+
+	// the tail has deletes of entries in the snapshot and new entries:
+	for idx := 0; idx < 10; idx++ {
+		require.NoError(t, w.Push(item.Location{Key: item.Key(idx)}, Trailer{}))
+	}
+
+	for idx := 5; idx < 15; idx++ {
+		loc := item.Location{Key: item.Key(idx), Off: item.Off(idx + 1000), Len: 2}
+		require.NoError(t, w.Push(loc, Trailer{}))
+	}
+
+	require.Equal(t, int64(120*LocationSize), w.Size())
+	require.NoError(t, w.Close())
+
+	heapIndex, err := Load(idxPath, KindBTree)
+	require.NoError(t, err)
+
+	for _, kind := range []Kind{KindBTree, KindSorted} {
+		index, err := LoadCheckpointed(idxPath, kind)
+		require.NoError(t, err)
+		require.Nil(t, index.base)
+		require.Equal(t, heapIndex.Len(), index.Len())
+		require.Equal(t, heapIndex.NEntries(), index.NEntries())
+		require.Equal(t, collectLocs(heapIndex), collectLocs(index))
+	}
+
+	// a snapshot that covers more than the index log (e.g. because the
+	// log was not synced before a crash) must not be used:
+	require.NoError(t, WriteSnapshot(checkpoint, SnapshotPath(idxPath), 1000*LocationSize))
+	index, err := LoadCheckpointed(idxPath, KindSorted)
+	require.NoError(t, err)
+	require.Equal(t, collectLocs(heapIndex), collectLocs(index))
+}
@@ -0,0 +1,352 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/renameio"
+	"github.com/sahib/timeq/item"
+	"golang.org/x/sys/unix"
+)
+
+// Snapshot layout:
+//
+//	magic (4) | version (4) | covered (8) | nentries (8) | count (8)
+//
+// ...followed by `count` entries of key (8), off (8) and len (4), sorted by
+// key. Entries with the same key are kept in insertion order. `covered` is
+// the size of the index log that was merged into the snapshot. Everything
+// after that offset is the tail that needs to be replayed on load.
+const (
+	snapshotMagic      = "TQIS"
+	snapshotVersion    = 1
+	snapshotHeaderSize = 4 + 4 + 8 + 8 + 8
+	snapshotEntrySize  = LocationSize - TrailerSize
+)
+
+// snapshotTailFactor decides when the tail of the index log got so big
+// compared to the snapshot that it's worth writing a new snapshot on load.
+const snapshotTailFactor = 4
+
+// SnapshotPath returns the path of the snapshot that belongs
+// to the index log at `path`.
+func SnapshotPath(path string) string {
+	return strings.TrimSuffix(path, ".log") + ".snap"
+}
+
+// mapped is a read-only, memory-mapped and sorted list of locations.
+// Deletion is done by remembering how many locations were deleted
+// from the front of each key's run, as the data cannot be modified.
+type mapped struct {
+	data    []byte
+	locs    []byte
+	n       int
+	head    int
+	deleted map[item.Key]int
+	refs    *int
+}
+
+func (m *mapped) keyAt(idx int) item.Key {
+	return item.Key(binary.BigEndian.Uint64(m.locs[idx*snapshotEntrySize:]))
+}
+
+func (m *mapped) at(idx int) item.Location {
+	buf := m.locs[idx*snapshotEntrySize:]
+	return item.Location{
+		Key: item.Key(binary.BigEndian.Uint64(buf[0:])),
+		Off: item.Off(binary.BigEndian.Uint64(buf[8:])),
+		Len: item.Off(binary.BigEndian.Uint32(buf[16:])),
+	}
+}
+
+// search returns the first index whose key is >= `key`.
+func (m *mapped) search(key item.Key) int {
+	return m.head + sort.Search(m.n-m.head, func(idx int) bool {
+		return m.keyAt(m.head+idx) >= key
+	})
+}
+
+// next returns the first index >= idx that was not deleted.
+// `idx` must be either the start of a run or after its deleted part.
+func (m *mapped) next(idx int) int {
+	idx = max(idx, m.head)
+	for idx < m.n {
+		key := m.keyAt(idx)
+		if idx > m.head && m.keyAt(idx-1) == key {
+			// somewhere in the middle of a run.
+			return idx
+		}
+
+		ndel := m.deleted[key]
+		if ndel == 0 {
+			return idx
+		}
+
+		// skip the deleted ones. This either lands in the
+		// same run or exactly on the start of the next one.
+		idx += ndel
+		if idx < m.n && m.keyAt(idx) == key {
+			return idx
+		}
+	}
+
+	return m.n
+}
+
+// delete marks the first not yet deleted location of `key` as deleted.
+func (m *mapped) delete(key item.Key) (item.Location, bool) {
+	start := m.search(key)
+	end := start
+	for end < m.n && m.keyAt(end) == key {
+		end++
+	}
+
+	ndel := m.deleted[key]
+	if start+ndel >= end {
+		// no (more) entries for this key in the snapshot.
+		return item.Location{}, false
+	}
+
+	loc := m.at(start + ndel)
+	ndel++
+
+	if start == m.head && start+ndel == end {
+		// the lowest run was fully deleted. This is the common case
+		// for pops, so avoid having the deleted map grow forever.
+		m.head = end
+		delete(m.deleted, key)
+	} else {
+		m.deleted[key] = ndel
+	}
+
+	return loc, true
+}
+
+func (m *mapped) copy() *mapped {
+	deleted := make(map[item.Key]int, len(m.deleted))
+	for key, ndel := range m.deleted {
+		deleted[key] = ndel
+	}
+
+	*m.refs++
+	return &mapped{
+		data:    m.data,
+		locs:    m.locs,
+		n:       m.n,
+		head:    m.head,
+		deleted: deleted,
+		refs:    m.refs,
+	}
+}
+
+func (m *mapped) close() error {
+	*m.refs--
+	if *m.refs > 0 {
+		return nil
+	}
+
+	return unix.Munmap(m.data)
+}
+
+type snapshotHeader struct {
+	covered  int64
+	nentries item.Off
+	count    int
+}
+
+func readSnapshot(path string) (*mapped, snapshotHeader, error) {
+	var hdr snapshotHeader
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, hdr, err
+	}
+
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, hdr, err
+	}
+
+	if info.Size() < snapshotHeaderSize {
+		return nil, hdr, errors.New("snapshot: too small")
+	}
+
+	data, err := unix.Mmap(int(fd.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, hdr, fmt.Errorf("snapshot: mmap: %w", err)
+	}
+
+	if string(data[:4]) != snapshotMagic || binary.BigEndian.Uint32(data[4:]) != snapshotVersion {
+		return nil, hdr, errors.Join(errors.New("snapshot: bad header"), unix.Munmap(data))
+	}
+
+	hdr.covered = int64(binary.BigEndian.Uint64(data[8:]))
+	hdr.nentries = item.Off(binary.BigEndian.Uint64(data[16:]))
+	hdr.count = int(binary.BigEndian.Uint64(data[24:]))
+	if int64(snapshotHeaderSize+hdr.count*snapshotEntrySize) != info.Size() {
+		return nil, hdr, errors.Join(errors.New("snapshot: bad size"), unix.Munmap(data))
+	}
+
+	refs := 1
+	return &mapped{
+		data:    data,
+		locs:    data[snapshotHeaderSize:],
+		n:       hdr.count,
+		deleted: make(map[item.Key]int),
+		refs:    &refs,
+	}, hdr, nil
+}
+
+// WriteSnapshot writes all locations of `idx` in sorted order to `path`.
+// `covered` is the size of the index log whose state is reflected by `idx`.
+func WriteSnapshot(idx *Index, path string, covered int64) error {
+	var count int
+	for iter := idx.Iter(); iter.Next(); {
+		count++
+	}
+
+	buf := make([]byte, snapshotHeaderSize+count*snapshotEntrySize)
+	copy(buf, snapshotMagic)
+	binary.BigEndian.PutUint32(buf[4:], snapshotVersion)
+	binary.BigEndian.PutUint64(buf[8:], uint64(covered))
+	binary.BigEndian.PutUint64(buf[16:], uint64(idx.nentries))
+	binary.BigEndian.PutUint64(buf[24:], uint64(count))
+
+	off := snapshotHeaderSize
+	for iter := idx.Iter(); iter.Next(); off += snapshotEntrySize {
+		loc := iter.Value()
+		binary.BigEndian.PutUint64(buf[off+0:], uint64(loc.Key))
+		binary.BigEndian.PutUint64(buf[off+8:], uint64(loc.Off))
+		binary.BigEndian.PutUint32(buf[off+16:], uint32(loc.Len))
+	}
+
+	// NOTE: WriteFile() syncs and renames atomically. A crash
+	// will always leave either the old or the new snapshot.
+	return renameio.WriteFile(path, buf, 0600)
+}
+
+// LoadMapped works like Load(), but keeps the bulk of the index in a sorted
+// snapshot file that is memory-mapped instead of loading it to the heap.
+// Only changes made after the snapshot was written are kept on the heap.
+// If there is no snapshot yet or the index log grew a lot since the
+// snapshot was written, a new snapshot is written.
+func LoadMapped(path string, kind Kind) (*Index, error) {
+	return loadSnapshot(path, kind, true)
+}
+
+// LoadCheckpointed works like Load(), but starts from the snapshot (if any
+// and still valid) and only replays the part of the index log that was
+// appended after it. Unlike LoadMapped() the whole index is kept on the heap.
+// A new snapshot is written under the same conditions as for LoadMapped().
+func LoadCheckpointed(path string, kind Kind) (*Index, error) {
+	return loadSnapshot(path, kind, false)
+}
+
+func loadSnapshot(path string, kind Kind, keepMapped bool) (*Index, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	index := New(kind)
+	snapPath := SnapshotPath(path)
+	base, hdr, err := readSnapshot(snapPath)
+	hasBase := false
+	switch {
+	case err == nil && hdr.covered <= info.Size() && hdr.covered%LocationSize == 0:
+		hasBase = true
+		index.base = base
+		index.len = base.len()
+		index.nentries = hdr.nentries
+		if _, err := fd.Seek(hdr.covered, io.SeekStart); err != nil {
+			return nil, errors.Join(err, index.Close())
+		}
+
+		if !keepMapped {
+			if err := index.inline(); err != nil {
+				return nil, err
+			}
+		}
+	case err == nil:
+		// snapshot does not belong to this index log; start over.
+		hdr = snapshotHeader{}
+		if err := base.close(); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		// broken snapshot; it's just a cache, so build a new one.
+		hdr = snapshotHeader{}
+	}
+
+	ntail, err := replay(index, NewReader(fd))
+	if err != nil {
+		return nil, errors.Join(err, index.Close())
+	}
+
+	if hasBase && ntail*snapshotTailFactor < hdr.count+1024 {
+		// tail is still small enough, keep it on the heap.
+		return index, nil
+	}
+
+	if err := WriteSnapshot(index, snapPath, info.Size()); err != nil {
+		return nil, errors.Join(err, index.Close())
+	}
+
+	if !keepMapped {
+		return index, nil
+	}
+
+	if err := index.Close(); err != nil {
+		return nil, err
+	}
+
+	base, _, err = readSnapshot(snapPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Index{
+		m:        newStructure(kind),
+		kind:     kind,
+		base:     base,
+		len:      base.len(),
+		nentries: index.nentries,
+	}, nil
+}
+
+// inline moves all locations of the snapshot to the heap.
+// It must be called before anything else was added to the heap.
+func (i *Index) inline() error {
+	base := i.base
+	i.base = nil
+
+	mem := i.mem()
+	for idx := base.next(0); idx < base.n; idx = base.next(idx + 1) {
+		mem.set(base.at(idx))
+	}
+
+	return base.close()
+}
+
+func (m *mapped) len() item.Off {
+	var l item.Off
+	for idx := m.next(0); idx < m.n; idx = m.next(idx + 1) {
+		l += m.at(idx).Len
+	}
+
+	return l
+}
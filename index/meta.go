@@ -0,0 +1,169 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/renameio"
+)
+
+// Meta layout:
+//
+//	magic (4) | version (4) | last pop (8) | popped items (8) | popped bytes (8) | ntags (4)
+//
+// ...followed by `ntags` tags of key len (2), key, value len (4) and value.
+// Version 2 added the log size (8) after the tags. Later versions may only
+// append fields at the end, so that older readers can still read the fields
+// they know about.
+const (
+	metaMagic      = "TQMT"
+	metaVersion    = 2
+	metaHeaderSize = 4 + 4 + 8 + 8 + 8 + 4
+)
+
+// Meta is the extended trailer of an index log. The fixed-size entries of the
+// index log only have room for the number of entries, so everything else is
+// stored in a separate file next to it (see MetaPath).
+type Meta struct {
+	// LastPop is the time of the last pop in unix nanoseconds, or zero.
+	LastPop int64
+
+	// PoppedItems and PoppedBytes count what was popped through this
+	// index. Bytes are counted like they are stored in the value log.
+	PoppedItems uint64
+	PoppedBytes uint64
+
+	// Tags are user-defined key-value pairs.
+	Tags map[string]string
+
+	// LogSize is the logical size of the value log when the metadata was
+	// written, or zero if unknown. It is only set for the index of the queue
+	// itself and spares scanning the pre-allocated end of the log on open.
+	LogSize int64
+}
+
+// MetaPath returns the path of the metadata that belongs
+// to the index log at `path`.
+func MetaPath(path string) string {
+	return strings.TrimSuffix(path, ".log") + ".meta"
+}
+
+// MarshalBinary encodes `m` like it is stored on disk.
+func (m Meta) MarshalBinary() ([]byte, error) {
+	keys := make([]string, 0, len(m.Tags))
+	for key := range m.Tags {
+		keys = append(keys, key)
+	}
+
+	// keep the output stable:
+	sort.Strings(keys)
+
+	buf := make([]byte, 0, metaHeaderSize)
+	buf = append(buf, metaMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, metaVersion)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(m.LastPop))
+	buf = binary.BigEndian.AppendUint64(buf, m.PoppedItems)
+	buf = binary.BigEndian.AppendUint64(buf, m.PoppedBytes)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(keys)))
+	for _, key := range keys {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(key)))
+		buf = append(buf, key...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Tags[key])))
+		buf = append(buf, m.Tags[key]...)
+	}
+
+	buf = binary.BigEndian.AppendUint64(buf, uint64(m.LogSize))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes data written by MarshalBinary() of this or a later version.
+func (m *Meta) UnmarshalBinary(buf []byte) error {
+	errMalformed := errors.New("meta: malformed")
+	if len(buf) < metaHeaderSize || string(buf[:4]) != metaMagic {
+		return errMalformed
+	}
+
+	version := binary.BigEndian.Uint32(buf[4:])
+	if version < 1 {
+		return fmt.Errorf("meta: bad version: %d", version)
+	}
+
+	*m = Meta{
+		LastPop:     int64(binary.BigEndian.Uint64(buf[8:])),
+		PoppedItems: binary.BigEndian.Uint64(buf[16:]),
+		PoppedBytes: binary.BigEndian.Uint64(buf[24:]),
+	}
+
+	ntags := binary.BigEndian.Uint32(buf[32:])
+	buf = buf[metaHeaderSize:]
+	for ; ntags > 0; ntags-- {
+		if len(buf) < 2 {
+			return errMalformed
+		}
+
+		keyLen := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+keyLen+4 {
+			return errMalformed
+		}
+
+		key := string(buf[2 : 2+keyLen])
+		buf = buf[2+keyLen:]
+
+		valLen := int(binary.BigEndian.Uint32(buf))
+		if len(buf) < 4+valLen {
+			return errMalformed
+		}
+
+		if m.Tags == nil {
+			m.Tags = make(map[string]string)
+		}
+
+		m.Tags[key] = string(buf[4 : 4+valLen])
+		buf = buf[4+valLen:]
+	}
+
+	if version >= 2 {
+		if len(buf) < 8 {
+			return errMalformed
+		}
+
+		m.LogSize = int64(binary.BigEndian.Uint64(buf))
+	}
+
+	// anything left was added by a later version.
+	return nil
+}
+
+// ReadMeta reads the metadata at `path`.
+// If there is none, an empty Meta is returned.
+func ReadMeta(path string) (Meta, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Meta{}, nil
+		}
+
+		return Meta{}, err
+	}
+
+	var m Meta
+	if err := m.UnmarshalBinary(buf); err != nil {
+		return Meta{}, err
+	}
+
+	return m, nil
+}
+
+// WriteMeta atomically replaces the metadata at `path` with `m`.
+func WriteMeta(path string, m Meta) error {
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return renameio.WriteFile(path, buf, 0600)
+}
@@ -0,0 +1,380 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"sort"
+
+	"github.com/sahib/timeq/item"
+)
+
+const (
+	// leaves with more locations than this are split up,
+	// unless all of them have the same key.
+	radixLeafSize = 256
+
+	// sparse nodes with more children than this become dense.
+	radixDenseLimit = 48
+
+	// dense nodes with less children than this become sparse again.
+	// It is lower than radixDenseLimit to avoid flapping between both.
+	radixSparseLimit = 16
+)
+
+// radixKey returns the bytes of `key` in an order that sorts like the key.
+func radixKey(key item.Key) [8]byte {
+	var kb [8]byte
+	binary.BigEndian.PutUint64(kb[:], uint64(key)^(1<<63))
+	return kb
+}
+
+// radixNode is a node of an adaptive radix tree over the bytes of the key.
+// Inner nodes branch on the key byte at `depth`. The bytes before that,
+// which all keys below share since the parent, are kept in `prefix`.
+// Leaves are expanded lazily: they hold all locations whose keys share
+// the bytes before `depth` and are only split up once they grow too big.
+type radixNode struct {
+	prefix []byte
+	depth  int
+
+	// Inner nodes are sparse at first: `edges` are the sorted key bytes
+	// of `children`. Dense nodes have no edges, but 256 children that are
+	// indexed by the key byte directly. `size` counts the children.
+	// Leaves have no children.
+	edges    []byte
+	children []*radixNode
+	size     int
+
+	// locs are the locations of a leaf, sorted by key.
+	// Locations with the same key are kept in insertion order.
+	locs []item.Location
+}
+
+func (n *radixNode) isLeaf() bool {
+	return n.children == nil
+}
+
+func (n *radixNode) isDense() bool {
+	return len(n.children) == 256
+}
+
+// child returns the index of the child for `edge` in n.children or -1.
+func (n *radixNode) child(edge byte) int {
+	if n.isDense() {
+		if n.children[edge] == nil {
+			return -1
+		}
+
+		return int(edge)
+	}
+
+	idx, ok := slices.BinarySearch(n.edges, edge)
+	if !ok {
+		return -1
+	}
+
+	return idx
+}
+
+func (n *radixNode) addChild(edge byte, child *radixNode) {
+	n.size++
+	if !n.isDense() && len(n.edges) >= radixDenseLimit {
+		children := make([]*radixNode, 256)
+		for idx, edge := range n.edges {
+			children[edge] = n.children[idx]
+		}
+
+		n.edges, n.children = nil, children
+	}
+
+	if n.isDense() {
+		n.children[edge] = child
+		return
+	}
+
+	idx, _ := slices.BinarySearch(n.edges, edge)
+	n.edges = slices.Insert(n.edges, idx, edge)
+	n.children = slices.Insert(n.children, idx, child)
+}
+
+// removeChild removes the child at `idx`, as returned by child().
+func (n *radixNode) removeChild(idx int) {
+	n.size--
+	if !n.isDense() {
+		n.edges = slices.Delete(n.edges, idx, idx+1)
+		n.children = slices.Delete(n.children, idx, idx+1)
+		return
+	}
+
+	n.children[idx] = nil
+	if n.size >= radixSparseLimit {
+		return
+	}
+
+	edges := make([]byte, 0, n.size)
+	children := make([]*radixNode, 0, n.size)
+	for edge, child := range n.children {
+		if child != nil {
+			edges = append(edges, byte(edge))
+			children = append(children, child)
+		}
+	}
+
+	n.edges, n.children = edges, children
+}
+
+func (n *radixNode) insert(loc item.Location) {
+	count := len(n.locs)
+	if count == 0 || n.locs[count-1].Key <= loc.Key {
+		// fast path: keys are usually ascending.
+		n.locs = append(n.locs, loc)
+		return
+	}
+
+	// insert after all locations with the same key:
+	idx := sort.Search(count, func(idx int) bool {
+		return n.locs[idx].Key > loc.Key
+	})
+
+	n.locs = slices.Insert(n.locs, idx, loc)
+}
+
+// split turns a leaf that grew too big into an inner node that branches on
+// the first byte where its keys differ. The new leaves start right after it.
+func (n *radixNode) split() {
+	first := radixKey(n.locs[0].Key)
+	last := radixKey(n.locs[len(n.locs)-1].Key)
+
+	at := n.depth
+	for first[at] == last[at] {
+		at++
+	}
+
+	locs := n.locs
+	n.prefix = append(slices.Clone(n.prefix), first[n.depth:at]...)
+	n.depth, n.locs = at, nil
+	n.children = []*radixNode{}
+
+	for len(locs) > 0 {
+		// locations are sorted, so each child gets a contiguous run:
+		edge := radixKey(locs[0].Key)[at]
+		run := sort.Search(len(locs), func(idx int) bool {
+			return radixKey(locs[idx].Key)[at] > edge
+		})
+
+		n.addChild(edge, &radixNode{depth: at + 1, locs: slices.Clone(locs[:run])})
+		locs = locs[run:]
+	}
+}
+
+func (n *radixNode) remove(key item.Key) (item.Location, bool) {
+	idx := sort.Search(len(n.locs), func(idx int) bool {
+		return n.locs[idx].Key >= key
+	})
+
+	if idx >= len(n.locs) || n.locs[idx].Key != key {
+		return item.Location{}, false
+	}
+
+	loc := n.locs[idx]
+	if idx == 0 {
+		// pops usually happen at the front.
+		n.locs = n.locs[1:]
+	} else {
+		n.locs = slices.Delete(n.locs, idx, idx+1)
+	}
+
+	return loc, true
+}
+
+func (n *radixNode) copy() *radixNode {
+	// prefixes are never modified in place, so they can be shared.
+	cpy := &radixNode{
+		prefix: n.prefix,
+		depth:  n.depth,
+		edges:  slices.Clone(n.edges),
+		size:   n.size,
+		locs:   slices.Clone(n.locs),
+	}
+
+	if n.children != nil {
+		cpy.children = make([]*radixNode, len(n.children))
+		for idx, child := range n.children {
+			if child != nil {
+				cpy.children[idx] = child.copy()
+			}
+		}
+	}
+
+	return cpy
+}
+
+////////////
+
+// radixTree is an adaptive radix tree (ART) with path compression and lazy
+// expansion. Dense keys like timestamps share most of their bytes, so the
+// tree stays flat and the locations of up to radixLeafSize keys are kept
+// in a single slice per leaf.
+type radixTree struct {
+	root *radixNode
+	n    int
+}
+
+type radixStep struct {
+	node *radixNode
+	idx  int
+}
+
+func (rt *radixTree) set(loc item.Location) {
+	rt.n++
+
+	kb := radixKey(loc.Key)
+	slot, depth := &rt.root, 0
+	for {
+		node := *slot
+		if node == nil {
+			*slot = &radixNode{depth: depth, locs: []item.Location{loc}}
+			return
+		}
+
+		pfx := node.prefix
+		for m := range pfx {
+			if pfx[m] == kb[depth+m] {
+				continue
+			}
+
+			// the key leaves the compressed path; split it up:
+			inner := &radixNode{prefix: pfx[:m], depth: depth + m, children: []*radixNode{}}
+			node.prefix = pfx[m+1:]
+			inner.addChild(pfx[m], node)
+			inner.addChild(kb[depth+m], &radixNode{
+				depth: depth + m + 1,
+				locs:  []item.Location{loc},
+			})
+			*slot = inner
+			return
+		}
+
+		depth = node.depth
+		if node.isLeaf() {
+			node.insert(loc)
+			if len(node.locs) > radixLeafSize && node.locs[0].Key != node.locs[len(node.locs)-1].Key {
+				node.split()
+			}
+
+			return
+		}
+
+		idx := node.child(kb[depth])
+		if idx < 0 {
+			node.addChild(kb[depth], &radixNode{
+				depth: depth + 1,
+				locs:  []item.Location{loc},
+			})
+			return
+		}
+
+		slot, depth = &node.children[idx], depth+1
+	}
+}
+
+func (rt *radixTree) delete(key item.Key) (item.Location, bool) {
+	kb := radixKey(key)
+
+	var path [8]radixStep
+	var npath, depth int
+
+	node := rt.root
+	for node != nil {
+		if !bytes.Equal(node.prefix, kb[depth:node.depth]) {
+			return item.Location{}, false
+		}
+
+		if node.isLeaf() {
+			break
+		}
+
+		depth = node.depth
+		idx := node.child(kb[depth])
+		if idx < 0 {
+			return item.Location{}, false
+		}
+
+		path[npath] = radixStep{node: node, idx: idx}
+		npath++
+		node, depth = node.children[idx], depth+1
+	}
+
+	if node == nil {
+		return item.Location{}, false
+	}
+
+	loc, ok := node.remove(key)
+	if !ok {
+		return item.Location{}, false
+	}
+
+	rt.n--
+	if len(node.locs) > 0 {
+		return loc, true
+	}
+
+	// remove the empty leaf and all parents that became empty with it:
+	for {
+		if npath == 0 {
+			rt.root = nil
+			return loc, true
+		}
+
+		npath--
+		step := path[npath]
+		step.node.removeChild(step.idx)
+		if step.node.size > 0 {
+			break
+		}
+	}
+
+	parent := path[npath].node
+	if parent.size > 1 {
+		return loc, true
+	}
+
+	// a single child is left, merge it into the parent to keep the path compressed.
+	// (only sparse nodes can have a single child)
+	slot := &rt.root
+	if npath > 0 {
+		up := path[npath-1]
+		slot = &up.node.children[up.idx]
+	}
+
+	child := parent.children[0]
+	pfx := make([]byte, 0, len(parent.prefix)+1+len(child.prefix))
+	pfx = append(pfx, parent.prefix...)
+	pfx = append(pfx, parent.edges[0])
+	child.prefix = append(pfx, child.prefix...)
+	*slot = child
+	return loc, true
+}
+
+func (rt *radixTree) iter() Iter {
+	iter := Iter{pos: -1, isSorted: true}
+	if rt.root != nil {
+		iter.stack = []radixStep{{node: rt.root}}
+	}
+
+	return iter
+}
+
+func (rt *radixTree) count() int {
+	return rt.n
+}
+
+func (rt *radixTree) copy() structure {
+	cpy := &radixTree{n: rt.n}
+	if rt.root != nil {
+		cpy.root = rt.root.copy()
+	}
+
+	return cpy
+}
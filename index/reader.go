@@ -17,8 +17,11 @@ const TrailerSize = 4
 // (8 for the key, 8 for the wal offset, 4 for the len)
 const LocationSize = 8 + 8 + 4 + TrailerSize
 
+// Trailer describes the state of an index log. TotalEntries is stored with
+// every entry, Meta is stored separately and only updated now and then.
 type Trailer struct {
 	TotalEntries item.Off
+	Meta         Meta
 }
 
 // Reader gives access to a single index on disk
@@ -82,8 +85,19 @@ func ReadTrailers(dir string, fn func(consumerName string, trailer Trailer)) err
 }
 
 // ReadTrailer reads the trailer of the index log.
-// It contains the number of entries in the index.
+// It contains the number of entries in the index and its metadata.
 func ReadTrailer(path string) (Trailer, error) {
+	meta, err := ReadMeta(MetaPath(path))
+	if err != nil {
+		return Trailer{}, err
+	}
+
+	trailer, err := readEntriesTrailer(path)
+	trailer.Meta = meta
+	return trailer, err
+}
+
+func readEntriesTrailer(path string) (Trailer, error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		return Trailer{}, err
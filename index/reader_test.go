@@ -1,8 +1,10 @@
 package index
 
 import (
+	"encoding/binary"
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 
 	"github.com/sahib/timeq/item"
@@ -36,3 +38,63 @@ func TestIndexReadTrailer(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, item.Off(123), trailer.TotalEntries)
 }
+
+func TestIndexReadTrailerMeta(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	idxPath := filepath.Join(tmpDir, "fork.idx.log")
+	idxWriter, err := NewWriter(idxPath, true)
+	require.NoError(t, err)
+	require.NoError(t, idxWriter.Push(item.Location{Key: 1, Len: 3}, Trailer{TotalEntries: 3}))
+	require.NoError(t, idxWriter.Close())
+
+	// no metadata yet:
+	trailer, err := ReadTrailer(idxPath)
+	require.NoError(t, err)
+	require.Equal(t, Trailer{TotalEntries: 3}, trailer)
+
+	meta := Meta{
+		LastPop:     42,
+		PoppedItems: 2,
+		PoppedBytes: 100,
+		Tags:        map[string]string{"source": "backfill", "empty": ""},
+		LogSize:     4096,
+	}
+
+	metaPath := MetaPath(idxPath)
+	require.Equal(t, filepath.Join(tmpDir, "fork.idx.meta"), metaPath)
+	require.NoError(t, WriteMeta(metaPath, meta))
+
+	var trailers []Trailer
+	require.NoError(t, ReadTrailers(tmpDir, func(consumerName string, trailer Trailer) {
+		require.Equal(t, "fork", consumerName)
+		trailers = append(trailers, trailer)
+	}))
+	require.Equal(t, []Trailer{{TotalEntries: 3, Meta: meta}}, trailers)
+
+	// fields of later versions are ignored:
+	data, err := os.ReadFile(metaPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(metaPath, append(data, 1, 2, 3), 0600))
+	got, err := ReadMeta(metaPath)
+	require.NoError(t, err)
+	require.Equal(t, meta, got)
+
+	// truncated data is not:
+	require.NoError(t, os.WriteFile(metaPath, data[:len(data)-1], 0600))
+	_, err = ReadMeta(metaPath)
+	require.Error(t, err)
+
+	// version 1 had no log size:
+	v1 := slices.Clone(data[:len(data)-8])
+	binary.BigEndian.PutUint32(v1[4:], 1)
+	require.NoError(t, os.WriteFile(metaPath, v1, 0600))
+	got, err = ReadMeta(metaPath)
+	require.NoError(t, err)
+	meta.LogSize = 0
+	require.Equal(t, meta, got)
+}
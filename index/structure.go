@@ -0,0 +1,180 @@
+package index
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/sahib/timeq/item"
+	"github.com/tidwall/btree"
+)
+
+// Kind selects the in-memory data structure used by an Index.
+type Kind int
+
+const (
+	// KindBTree keeps the locations in a b-tree. It handles keys that
+	// are pushed in random order well.
+	KindBTree = Kind(iota)
+
+	// KindSorted keeps all locations in a single sorted slice. It needs
+	// less than half the memory of the b-tree and iterates faster, as
+	// long as keys are pushed (and popped) in mostly ascending order,
+	// like timestamps usually are. Inserting or deleting somewhere in the
+	// middle needs to move the rest of the slice though.
+	KindSorted
+
+	// KindRadix keeps the locations in an adaptive radix tree. Like
+	// KindSorted it is made for dense keys like timestamps, but keys
+	// that are pushed or popped out of order only need to move the
+	// locations of a single leaf (up to 256 keys).
+	KindRadix
+)
+
+// structure is the in-memory data structure behind an Index. It keeps
+// all locations sorted by key; locations with the same key are kept in
+// insertion order.
+type structure interface {
+	// set adds `loc` after all locations with the same key.
+	set(loc item.Location)
+
+	// delete removes the first location with `key`.
+	delete(key item.Key) (item.Location, bool)
+
+	// iter returns an iterator over all locations.
+	iter() Iter
+
+	// count returns the number of locations.
+	count() int
+
+	copy() structure
+}
+
+func newStructure(kind Kind) structure {
+	switch kind {
+	case KindSorted:
+		return &sortedSlice{}
+	case KindRadix:
+		return &radixTree{}
+	default:
+		return &btreeMap{}
+	}
+}
+
+////////////
+
+type btreeMap struct {
+	m btree.Map[item.Key, []item.Location]
+	n int
+}
+
+func (bm *btreeMap) set(loc item.Location) {
+	oldLocs, _ := bm.m.Get(loc.Key)
+	bm.m.Set(loc.Key, append(oldLocs, loc))
+	bm.n++
+}
+
+func (bm *btreeMap) delete(key item.Key) (item.Location, bool) {
+	oldLocs, ok := bm.m.Get(key)
+	if !ok {
+		return item.Location{}, false
+	}
+
+	bm.n--
+	if len(oldLocs) > 1 {
+		// delete one of the keys:
+		bm.m.Set(key, oldLocs[1:])
+		return oldLocs[0], true
+	}
+
+	bm.m.Delete(key)
+	return oldLocs[0], true
+}
+
+func (bm *btreeMap) iter() Iter {
+	return Iter{iter: bm.m.Iter()}
+}
+
+func (bm *btreeMap) count() int {
+	return bm.n
+}
+
+func (bm *btreeMap) copy() structure {
+	return &btreeMap{
+		m: *bm.m.Copy(),
+		n: bm.n,
+	}
+}
+
+////////////
+
+type sortedSlice struct {
+	// locs[:head] were deleted already. We do not move
+	// the whole slice on every delete at the front.
+	locs []item.Location
+	head int
+}
+
+func (ss *sortedSlice) set(loc item.Location) {
+	n := len(ss.locs)
+	if n == ss.head || ss.locs[n-1].Key <= loc.Key {
+		// fast path: keys are usually ascending.
+		ss.locs = append(ss.locs, loc)
+		return
+	}
+
+	// insert after all locations with the same key:
+	idx := ss.head + sort.Search(n-ss.head, func(idx int) bool {
+		return ss.locs[ss.head+idx].Key > loc.Key
+	})
+
+	ss.locs = slices.Insert(ss.locs, idx, loc)
+}
+
+func (ss *sortedSlice) delete(key item.Key) (item.Location, bool) {
+	n := len(ss.locs)
+	idx := ss.head + sort.Search(n-ss.head, func(idx int) bool {
+		return ss.locs[ss.head+idx].Key >= key
+	})
+
+	if idx >= n || ss.locs[idx].Key != key {
+		return item.Location{}, false
+	}
+
+	loc := ss.locs[idx]
+	if idx != ss.head {
+		ss.locs = slices.Delete(ss.locs, idx, idx+1)
+		return loc, true
+	}
+
+	ss.head++
+	switch {
+	case ss.head == n:
+		// all gone, start from the front again.
+		ss.locs = ss.locs[:0]
+		ss.head = 0
+	case ss.head > 64 && ss.head > n/2:
+		// reclaim space once the deleted part dominates:
+		ss.locs = ss.locs[:copy(ss.locs, ss.locs[ss.head:])]
+		ss.head = 0
+	}
+
+	return loc, true
+}
+
+func (ss *sortedSlice) iter() Iter {
+	return Iter{
+		locs:     ss.locs[ss.head:],
+		pos:      -1,
+		isSorted: true,
+	}
+}
+
+func (ss *sortedSlice) count() int {
+	return len(ss.locs) - ss.head
+}
+
+func (ss *sortedSlice) copy() structure {
+	return &sortedSlice{
+		locs: slices.Clone(ss.locs[ss.head:]),
+	}
+}
@@ -0,0 +1,194 @@
+package index
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/sahib/timeq/item"
+	"github.com/stretchr/testify/require"
+)
+
+func collectLocs(idx *Index) []item.Location {
+	locs := []item.Location{}
+	for iter := idx.Iter(); iter.Next(); {
+		locs = append(locs, iter.Value())
+	}
+
+	return locs
+}
+
+func TestIndexStructureVsBTree(t *testing.T) {
+	t.Parallel()
+
+	for _, kind := range []Kind{KindSorted, KindRadix} {
+		for _, spread := range []int{1, 1 << 20, math.MaxInt32} {
+			kind, spread := kind, spread
+			t.Run(fmt.Sprintf("kind-%d-spread-%d", kind, spread), func(t *testing.T) {
+				t.Parallel()
+				testIndexStructureVsBTree(t, kind, spread)
+			})
+		}
+	}
+}
+
+func testIndexStructureVsBTree(t *testing.T, kind Kind, spread int) {
+	rnd := rand.New(rand.NewSource(23))
+	btree, other := New(KindBTree), New(kind)
+	for idx := 0; idx < 5000; idx++ {
+		// mostly ascending keys with some stragglers and duplicates,
+		// spread over the key space (and below zero) depending on `spread`:
+		key := item.Key(idx * spread)
+		if rnd.Intn(10) == 0 {
+			key = item.Key(rnd.Intn(idx+1) * spread)
+		}
+
+		if spread > 1 && rnd.Intn(2) == 0 {
+			key = -key
+		}
+
+		if rnd.Intn(3) == 0 {
+			// delete mostly from the front, sometimes random keys.
+			delKey := item.Key(rnd.Intn(idx+1) * spread)
+			if iter := btree.Iter(); rnd.Intn(4) != 0 && iter.Next() {
+				delKey = iter.Value().Key
+			}
+
+			require.Equal(t, btree.Delete(delKey), other.Delete(delKey))
+			continue
+		}
+
+		loc := item.Location{Key: key, Off: item.Off(idx), Len: 1}
+		btree.Set(loc)
+		other.Set(loc)
+	}
+
+	require.Equal(t, btree.Len(), other.Len())
+	require.Equal(t, btree.m.count(), other.m.count())
+	require.Equal(t, collectLocs(btree), collectLocs(other))
+
+	// copies must not affect each other:
+	otherCopy := other.Copy()
+	exp := collectLocs(other)
+	for iter := other.Iter(); iter.Next(); {
+		otherCopy.Delete(iter.Value().Key)
+	}
+
+	require.Equal(t, exp, collectLocs(other))
+	require.Empty(t, collectLocs(otherCopy))
+	require.Equal(t, 0, otherCopy.m.count())
+
+	// drain it completely in key order:
+	for _, loc := range exp {
+		require.Equal(t, loc, other.Delete(loc.Key))
+	}
+
+	require.Empty(t, collectLocs(other))
+	require.Equal(t, item.Off(0), other.Len())
+}
+
+func TestIndexStructureZeroValue(t *testing.T) {
+	t.Parallel()
+
+	// mem() creates the configured structure lazily:
+	idx := &Index{kind: KindRadix}
+	idx.Set(item.Location{Key: 23, Len: 1})
+	require.IsType(t, &radixTree{}, idx.m)
+	require.IsType(t, &radixTree{}, idx.Copy().m)
+
+	idx = &Index{}
+	idx.Set(item.Location{Key: 23, Len: 1})
+	require.IsType(t, &btreeMap{}, idx.m)
+}
+
+func TestIndexStructureSortedDrain(t *testing.T) {
+	t.Parallel()
+
+	idx := New(KindSorted)
+	for key := 0; key < 1000; key++ {
+		idx.Set(item.Location{Key: item.Key(key), Len: 1})
+	}
+
+	for key := 0; key < 1000; key++ {
+		loc := idx.Delete(item.Key(key))
+		require.Equal(t, item.Key(key), loc.Key)
+
+		iter := idx.Iter()
+		if key < 999 {
+			require.True(t, iter.Next())
+			require.Equal(t, item.Key(key+1), iter.Value().Key)
+		} else {
+			require.False(t, iter.Next())
+		}
+	}
+
+	require.Equal(t, item.Off(0), idx.Len())
+
+	// deleting non-existing keys is a no-op:
+	require.Equal(t, item.Location{}, idx.Delete(42))
+}
+
+func BenchmarkIndexStructure(b *testing.B) {
+	const n = 100_000
+
+	// dense, ascending keys like timestamps:
+	build := func(kind Kind) *Index {
+		idx := New(kind)
+		for key := 0; key < n; key++ {
+			idx.Set(item.Location{Key: item.Key(1e18 + key*1000), Len: 1})
+		}
+
+		return idx
+	}
+
+	kinds := []struct {
+		name string
+		kind Kind
+	}{
+		{"btree", KindBTree},
+		{"sorted", KindSorted},
+		{"radix", KindRadix},
+	}
+
+	for _, kind := range kinds {
+		kind := kind
+		b.Run("set-"+kind.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			idx := build(kind.kind)
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(idx)
+
+			b.ResetTimer()
+			for run := 0; run < b.N; run++ {
+				build(kind.kind)
+			}
+
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/n, "heap-bytes/loc")
+		})
+
+		b.Run("iter-"+kind.name, func(b *testing.B) {
+			idx := build(kind.kind)
+			b.ResetTimer()
+			for run := 0; run < b.N; run++ {
+				for iter := idx.Iter(); iter.Next(); {
+				}
+			}
+		})
+
+		b.Run("delete-"+kind.name, func(b *testing.B) {
+			for run := 0; run < b.N; run++ {
+				b.StopTimer()
+				idx := build(kind.kind)
+				b.StartTimer()
+				for key := 0; key < n; key++ {
+					idx.Delete(item.Key(1e18 + key*1000))
+				}
+			}
+		})
+	}
+}
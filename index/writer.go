@@ -5,14 +5,27 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/sahib/timeq/item"
 )
 
 type Writer struct {
-	fd     *os.File
-	locBuf [LocationSize]byte
-	sync   bool
+	fd       *os.File
+	locBuf   [LocationSize]byte
+	sync     bool
+	size     int64
+	unsynced bool
+
+	// buf holds entries that were not written yet. See SetBuffer().
+	buf           []byte
+	bufSize       int
+	flushInterval time.Duration
+	bufferedSince time.Time
+
+	// syncEvery and batches thin out the syncs. See SetSyncEvery().
+	syncEvery int
+	batches   int
 }
 
 func NewWriter(path string, sync bool) (*Writer, error) {
@@ -22,32 +35,160 @@ func NewWriter(path string, sync bool) (*Writer, error) {
 		return nil, err
 	}
 
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, errors.Join(err, fd.Close())
+	}
+
 	return &Writer{
 		fd:   fd,
 		sync: sync,
+		size: info.Size(),
 	}, nil
 }
 
+// ErrReadOnly is returned by Push() of a writer from NewReadOnlyWriter().
+var ErrReadOnly = errors.New("index is opened read-only")
+
+// NewReadOnlyWriter returns a writer for the index log at `path` that does
+// not open the file for writing. Push() fails, but Size(), Sync() and
+// Close() work, so it can stand in for a real writer of read-only queues.
+// A missing index log has size zero.
+func NewReadOnlyWriter(path string) (*Writer, error) {
+	info, err := os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var size int64
+	if info != nil {
+		size = info.Size()
+	}
+
+	return &Writer{size: size}, nil
+}
+
 func (w *Writer) Push(loc item.Location, trailer Trailer) error {
+	if w.fd == nil {
+		return ErrReadOnly
+	}
+
 	binary.BigEndian.PutUint64(w.locBuf[0:], uint64(loc.Key))
 	binary.BigEndian.PutUint64(w.locBuf[8:], uint64(loc.Off))
 	binary.BigEndian.PutUint32(w.locBuf[16:], uint32(loc.Len))
 	binary.BigEndian.PutUint32(w.locBuf[20:], uint32(trailer.TotalEntries))
-	_, err := w.fd.Write(w.locBuf[:])
+
+	if w.bufSize <= 0 {
+		n, err := w.fd.Write(w.locBuf[:])
+		w.size += int64(n)
+		w.unsynced = true
+		return err
+	}
+
+	if len(w.buf) == 0 {
+		w.bufferedSince = time.Now()
+	}
+
+	w.buf = append(w.buf, w.locBuf[:]...)
+	w.size += LocationSize
+	if w.flushDue() {
+		return w.Flush()
+	}
+
+	return nil
+}
+
+// SetBuffer makes Push() collect entries in memory until they reach `size`
+// bytes or the oldest entry is older than `interval`, instead of writing
+// every entry on its own. The age is only checked on Push() and Sync(),
+// so there is no background flush. Buffered entries are lost on a crash.
+// A size <= 0 disables buffering.
+func (w *Writer) SetBuffer(size int, interval time.Duration) error {
+	w.bufSize = size
+	w.flushInterval = interval
+	if size <= 0 {
+		return w.Flush()
+	}
+
+	return nil
+}
+
+func (w *Writer) flushDue() bool {
+	if len(w.buf) == 0 {
+		return false
+	}
+
+	if len(w.buf) >= w.bufSize {
+		return true
+	}
+
+	return w.flushInterval > 0 && time.Since(w.bufferedSince) >= w.flushInterval
+}
+
+// Flush writes all buffered entries. It does not sync them.
+func (w *Writer) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	n, err := w.fd.Write(w.buf)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	w.unsynced = true
 	return err
 }
 
+// Size returns the size of the index log in bytes,
+// including the entries that are still buffered.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
 func (w *Writer) Close() error {
+	if w.fd == nil {
+		return nil
+	}
+
+	flushErr := w.Flush()
 	syncErr := w.fd.Sync()
 	closeErr := w.fd.Close()
-	return errors.Join(syncErr, closeErr)
+	return errors.Join(flushErr, syncErr, closeErr)
+}
+
+// SetSync changes if every push is synced to disk.
+func (w *Writer) SetSync(sync bool) {
+	w.sync = sync
 }
 
+// SetSyncEvery makes only every `n`th call to Sync(false) sync the index
+// log, if syncing is enabled. Buffered entries are still written as usual.
+// A forced sync resets the count. A `n` <= 1 syncs on every call.
+func (w *Writer) SetSyncEvery(n int) {
+	w.syncEvery = n
+	w.batches = 0
+}
+
+// Sync writes buffered entries if forced or if they are due (see
+// SetBuffer()) and syncs the index log if syncing is enabled or forced.
 func (w *Writer) Sync(force bool) error {
-	if !w.sync && !force {
+	if force || w.flushDue() {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if w.fd == nil || (!force && (!w.sync || !w.unsynced)) {
 		return nil
 	}
 
+	if !force && w.syncEvery > 1 {
+		w.batches++
+		if w.batches < w.syncEvery {
+			return nil
+		}
+	}
+
+	w.batches = 0
+	w.unsynced = false
 	return w.fd.Sync()
 }
 
@@ -63,12 +204,11 @@ func WriteIndex(idx *Index, path string) error {
 	var totalEntries item.Off
 	for iter.Next() {
 		loc := iter.Value()
+		totalEntries += loc.Len
 		if err := writer.Push(loc, Trailer{TotalEntries: totalEntries}); err != nil {
-			return fmt.Errorf("push: %w", err)
+			return errors.Join(fmt.Errorf("push: %w", err), writer.Close())
 		}
-
-		totalEntries++
 	}
 
-	return nil
+	return writer.Close()
 }
@@ -4,7 +4,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/sahib/timeq/item"
 	"github.com/stretchr/testify/require"
 )
 
@@ -21,3 +23,144 @@ func TestIndexWriterEmpty(t *testing.T) {
 	require.NoError(t, idxWriter.Sync(false))
 	require.NoError(t, idxWriter.Close())
 }
+
+func TestIndexWriteIndexTrailer(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	index := &Index{}
+	index.Set(item.Location{Key: 1, Off: 0, Len: 10})
+	index.Set(item.Location{Key: 2, Off: 100, Len: 20})
+
+	idxPath := filepath.Join(tmpDir, "idx.log")
+	require.NoError(t, WriteIndex(index, idxPath))
+
+	trailer, err := ReadTrailer(idxPath)
+	require.NoError(t, err)
+	require.Equal(t, index.Len(), trailer.TotalEntries)
+}
+
+func TestIndexWriterBuffer(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	idxPath := filepath.Join(tmpDir, "idx.log")
+	idxWriter, err := NewWriter(idxPath, true)
+	require.NoError(t, err)
+	require.NoError(t, idxWriter.SetBuffer(3*LocationSize, time.Hour))
+
+	fileSize := func() int64 {
+		info, err := os.Stat(idxPath)
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	push := func(key item.Key) {
+		require.NoError(t, idxWriter.Push(item.Location{Key: key, Len: 1}, Trailer{TotalEntries: item.Off(key)}))
+	}
+
+	push(1)
+	push(2)
+	require.NoError(t, idxWriter.Sync(false))
+	require.Equal(t, int64(2*LocationSize), idxWriter.Size())
+	require.Equal(t, int64(0), fileSize())
+
+	// the third entry fills the buffer:
+	push(3)
+	require.Equal(t, int64(3*LocationSize), fileSize())
+
+	push(4)
+	require.NoError(t, idxWriter.Sync(true))
+	require.Equal(t, int64(4*LocationSize), fileSize())
+
+	// flush by age:
+	require.NoError(t, idxWriter.SetBuffer(100*LocationSize, time.Millisecond))
+	push(5)
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, idxWriter.Sync(false))
+	require.Equal(t, int64(5*LocationSize), fileSize())
+
+	// disabling the buffer writes what is left:
+	push(6)
+	require.NoError(t, idxWriter.SetBuffer(0, 0))
+	require.Equal(t, int64(6*LocationSize), fileSize())
+
+	push(7)
+	require.NoError(t, idxWriter.SetBuffer(100*LocationSize, 0))
+	push(8)
+	require.NoError(t, idxWriter.Close())
+
+	trailer, err := ReadTrailer(idxPath)
+	require.NoError(t, err)
+	require.Equal(t, item.Off(8), trailer.TotalEntries)
+}
+
+func TestIndexWriterSyncEvery(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	idxWriter, err := NewWriter(filepath.Join(tmpDir, "idx.log"), true)
+	require.NoError(t, err)
+	idxWriter.SetSyncEvery(3)
+
+	for key := item.Key(1); key <= 6; key++ {
+		require.NoError(t, idxWriter.Push(item.Location{Key: key, Len: 1}, Trailer{}))
+		require.NoError(t, idxWriter.Sync(false))
+
+		// only every third batch is synced:
+		require.Equal(t, key%3 != 0, idxWriter.unsynced)
+	}
+
+	require.NoError(t, idxWriter.Push(item.Location{Key: 7, Len: 1}, Trailer{}))
+	require.NoError(t, idxWriter.Sync(true))
+	require.False(t, idxWriter.unsynced)
+	require.Zero(t, idxWriter.batches)
+	require.NoError(t, idxWriter.Close())
+}
+
+func TestIndexWriterReadOnly(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// missing index logs are empty and not created:
+	idxPath := filepath.Join(tmpDir, "idx.log")
+	roWriter, err := NewReadOnlyWriter(idxPath)
+	require.NoError(t, err)
+	require.Zero(t, roWriter.Size())
+	require.NoError(t, roWriter.Close())
+
+	idx, err := LoadReadOnly(idxPath, KindBTree)
+	require.NoError(t, err)
+	require.Zero(t, idx.Len())
+	_, err = os.Stat(idxPath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	idxWriter, err := NewWriter(idxPath, true)
+	require.NoError(t, err)
+	require.NoError(t, idxWriter.Push(item.Location{Key: 1, Len: 1}, Trailer{TotalEntries: 1}))
+	require.NoError(t, idxWriter.Close())
+	require.NoError(t, os.Chmod(idxPath, 0400))
+
+	roWriter, err = NewReadOnlyWriter(idxPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(LocationSize), roWriter.Size())
+	require.ErrorIs(t, roWriter.Push(item.Location{Key: 2, Len: 1}, Trailer{}), ErrReadOnly)
+	require.NoError(t, roWriter.Sync(true))
+	require.NoError(t, roWriter.Close())
+
+	idx, err = LoadReadOnly(idxPath, KindBTree)
+	require.NoError(t, err)
+	require.Equal(t, item.Off(1), idx.Len())
+}
@@ -0,0 +1,216 @@
+package ipc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/sahib/timeq"
+)
+
+// RemoteError is an error that was reported by the server.
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return "ipc: remote: " + e.Msg
+}
+
+// Client talks to a Server. It is mostly meant as reference for clients in
+// other languages, but can be used from Go as well, e.g. as Options.Replicas
+// of another queue. It is safe to use from several goroutines, but requests
+// are sent one after another.
+type Client struct {
+	// MaxFrameSize limits the size of a single response.
+	// Defaults to DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Check that Client can be used as replica of a queue.
+var _ timeq.FencedReplica = &Client{}
+
+// Dial connects to the server listening on the unix socket at `path`.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+// NewClient returns a client that uses `conn`.
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) roundtrip(op Op, fork timeq.ForkName, body []byte) ([]byte, error) {
+	req, err := appendRequestHeader(nil, op, fork)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := writeFrame(c.w, append(req, body...)); err != nil {
+		return nil, err
+	}
+
+	maxSize := c.MaxFrameSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+
+	resp, err := readFrame(c.r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) == 0 {
+		return nil, ErrMalformed
+	}
+
+	if resp[0] != statusOK {
+		return nil, &RemoteError{Msg: string(resp[1:])}
+	}
+
+	return resp[1:], nil
+}
+
+// Push pushes `items` to the queue.
+func (c *Client) Push(items timeq.Items) error {
+	_, err := c.roundtrip(OpPush, "", appendItems(nil, items))
+	return err
+}
+
+// PushReplicated pushes `items` that were replicated by a primary
+// of `epoch`. See timeq.Queue.PushReplicated().
+func (c *Client) PushReplicated(epoch uint64, items timeq.Items) error {
+	body := binary.BigEndian.AppendUint64(nil, epoch)
+	_, err := c.roundtrip(OpReplicate, "", appendItems(body, items))
+	return err
+}
+
+// Pop pops up to `n` items from the queue or `fork`.
+func (c *Client) Pop(fork timeq.ForkName, n int) (timeq.Items, error) {
+	return c.read(OpPop, fork, n)
+}
+
+// Peek returns up to `n` items of the queue or `fork` without removing them.
+func (c *Client) Peek(fork timeq.ForkName, n int) (timeq.Items, error) {
+	return c.read(OpPeek, fork, n)
+}
+
+func (c *Client) read(op Op, fork timeq.ForkName, n int) (timeq.Items, error) {
+	if n < 0 {
+		return nil, errors.New("negative number of items")
+	}
+
+	resp, err := c.roundtrip(op, fork, binary.BigEndian.AppendUint32(nil, uint32(n)))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeItems(resp)
+}
+
+// Len returns the number of items in the queue or `fork`.
+func (c *Client) Len(fork timeq.ForkName) (int, error) {
+	resp, err := c.roundtrip(OpLen, fork, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp) != 8 {
+		return 0, ErrMalformed
+	}
+
+	return int(binary.BigEndian.Uint64(resp)), nil
+}
+
+// Ack pops exactly `items` from the queue or `fork`. The items have to be
+// returned by Peek() before; items that are not in the queue anymore are ignored.
+func (c *Client) Ack(fork timeq.ForkName, items timeq.Items) error {
+	_, err := c.roundtrip(OpAck, fork, appendItems(nil, items))
+	return err
+}
+
+// Delete deletes all items of the queue or `fork` between `from` and `to`
+// (both inclusive) and returns what was deleted. DeleteResult.Buckets
+// is not transferred and always empty.
+func (c *Client) Delete(fork timeq.ForkName, from, to timeq.Key) (timeq.DeleteResult, error) {
+	body := binary.BigEndian.AppendUint64(nil, uint64(from))
+	body = binary.BigEndian.AppendUint64(body, uint64(to))
+	resp, err := c.roundtrip(OpDelete, fork, body)
+	if err != nil {
+		return timeq.DeleteResult{}, err
+	}
+
+	if len(resp) != 24 {
+		return timeq.DeleteResult{}, ErrMalformed
+	}
+
+	// the buckets are not sent over the wire:
+	return timeq.DeleteResult{
+		Items:          int(binary.BigEndian.Uint64(resp)),
+		DroppedBuckets: int(binary.BigEndian.Uint64(resp[8:])),
+		ReclaimedBytes: int64(binary.BigEndian.Uint64(resp[16:])),
+	}, nil
+}
+
+// Join makes this connection the member `id` of the timeq.Group of the queue
+// or `fork`. Pop() and Peek() of `fork` (and Consumer.Read()) only return
+// items of the buckets assigned to the member afterwards. The member leaves
+// the group when the client is closed. Joining again replaces the membership,
+// e.g. after Read() returned an error because of Options.GroupSessionTimeout.
+func (c *Client) Join(fork timeq.ForkName, id string) error {
+	_, err := c.roundtrip(OpJoin, fork, []byte(id))
+	return err
+}
+
+// Fork forks the queue or `fork` into `name`, like Queue.Fork() does.
+func (c *Client) Fork(fork, name timeq.ForkName) error {
+	if err := name.Validate(); err != nil {
+		return err
+	}
+
+	_, err := c.roundtrip(OpFork, fork, []byte(name))
+	return err
+}
+
+// NextSeq reserves `n` sequence numbers of the served queue and returns the
+// first one. See timeq.Queue.NextSeq().
+func (c *Client) NextSeq(n int) (uint64, error) {
+	if n <= 0 {
+		return 0, errors.New("number of sequences must be positive")
+	}
+
+	resp, err := c.roundtrip(OpSeq, "", binary.BigEndian.AppendUint32(nil, uint32(n)))
+	if err != nil {
+		return 0, err
+	}
+
+	if len(resp) != 8 {
+		return 0, ErrMalformed
+	}
+
+	return binary.BigEndian.Uint64(resp), nil
+}
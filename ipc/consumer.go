@@ -0,0 +1,203 @@
+package ipc
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/sahib/timeq"
+)
+
+// ErrNotSupported is returned by Consumer methods that cannot work remotely.
+var ErrNotSupported = errors.New("ipc: not supported by remote consumers")
+
+// readAllBatchSize is the number of items Consumer.Read() asks for at once
+// if it should read everything.
+const readAllBatchSize = 1000
+
+// Consumer implements timeq.Consumer for a queue or fork that is served by
+// a Server, so code written against timeq.Consumer can use a remote queue
+// by only changing how the consumer is constructed.
+//
+// Items are peeked first and acked once `fn` decided to pop them, so they
+// stay in the queue if the client dies during Read(). The differences to
+// a local queue are:
+//
+//   - Peeking in Read() returns only the items of the first bucket.
+//   - Fork() cannot return a *timeq.Fork; use Client.Fork() and
+//     Client.Consumer() instead.
+//   - DeleteFunc(), PopDelete() and Reprioritize() take callbacks and
+//     return ErrNotSupported.
+//   - The Len() variants return 0 if the server cannot be reached.
+//   - CountByBucket() returns nil.
+//   - PauseReads() only pauses this Consumer, not the served queue.
+//   - Transaction.Stats() in Read() only knows Buckets and Bytes.
+type Consumer struct {
+	client *Client
+	fork   timeq.ForkName
+	paused atomic.Bool
+}
+
+// Check that Consumer implements timeq.Consumer.
+var _ timeq.Consumer = &Consumer{}
+
+// Consumer returns a Consumer for the queue (if `fork` is empty) or for
+// `fork`, which has to exist already.
+func (c *Client) Consumer(fork timeq.ForkName) *Consumer {
+	return &Consumer{client: c, fork: fork}
+}
+
+// readTx pushes to the remote queue and counts what a Read() received.
+type readTx struct {
+	*Client
+	stats timeq.ReadStats
+}
+
+func (tx *readTx) Stats() timeq.ReadStats {
+	return tx.stats
+}
+
+// Read is like Queue.Read(). The transaction pushes to the remote queue.
+func (c *Consumer) Read(n int, fn timeq.TransactionFn) error {
+	if c.paused.Load() {
+		return nil
+	}
+
+	tx := &readTx{Client: c.client}
+	for n != 0 {
+		size := n
+		if size < 0 {
+			size = readAllBatchSize
+		}
+
+		items, err := c.client.Peek(c.fork, size)
+		if err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			return nil
+		}
+
+		// every peek returns the items of a single bucket:
+		tx.stats.Buckets++
+		tx.stats.Bytes += int64(items.StorageSize())
+
+		op, err := fn(tx, items)
+		if err != nil {
+			return err
+		}
+
+		if op != timeq.ReadOpPop {
+			// peeking again would return the same items.
+			return nil
+		}
+
+		if err := c.client.Ack(c.fork, items); err != nil {
+			return err
+		}
+
+		if n > 0 {
+			n -= len(items)
+		}
+	}
+
+	return nil
+}
+
+// ReadBuffered is like Read(). The items are always copies, so `buf` is not used.
+func (c *Consumer) ReadBuffered(n int, _ *timeq.ReadBuffer, fn timeq.TransactionFn) error {
+	return c.Read(n, fn)
+}
+
+// PeekRef returns up to `n` items of the first bucket. Release() is a no-op.
+func (c *Consumer) PeekRef(n int) (timeq.ItemsRef, error) {
+	if n < 0 {
+		n = readAllBatchSize
+	}
+
+	items, err := c.client.Peek(c.fork, n)
+	return timeq.ItemsRef{Items: items}, err
+}
+
+// Delete is like Queue.Delete().
+func (c *Consumer) Delete(from, to timeq.Key) (timeq.DeleteResult, error) {
+	return c.client.Delete(c.fork, from, to)
+}
+
+// DeleteFunc returns ErrNotSupported.
+func (c *Consumer) DeleteFunc(_, _ timeq.Key, _ func(timeq.Item) bool) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// PopDelete returns ErrNotSupported.
+func (c *Consumer) PopDelete(_, _ timeq.Key, _ func(timeq.Items) error) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Reprioritize returns ErrNotSupported.
+func (c *Consumer) Reprioritize(_, _ timeq.Key, _ func(timeq.Key) timeq.Key) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Shovel moves all items of the remote queue to the local queue `dst`.
+// Items are only popped once they were pushed to `dst`.
+func (c *Consumer) Shovel(dst *timeq.Queue) (int, error) {
+	var nshoveled int
+	err := c.Read(-1, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+		if err := dst.Push(items); err != nil {
+			return timeq.ReadOpPeek, err
+		}
+
+		nshoveled += len(items)
+		return timeq.ReadOpPop, nil
+	})
+
+	return nshoveled, err
+}
+
+// Len returns the number of items of the remote queue or fork.
+func (c *Consumer) Len() int {
+	n, err := c.client.Len(c.fork)
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// LenApprox is the same as Len().
+func (c *Consumer) LenApprox() int {
+	return c.Len()
+}
+
+// LenExact is the same as Len().
+func (c *Consumer) LenExact() int {
+	return c.Len()
+}
+
+// CountByBucket returns nil, the server does not expose buckets.
+func (c *Consumer) CountByBucket() []timeq.BucketCount {
+	return nil
+}
+
+// PauseReads makes Read() of this Consumer return without items until
+// ResumeReads() is called.
+func (c *Consumer) PauseReads() {
+	c.paused.Store(true)
+}
+
+// ResumeReads undoes PauseReads().
+func (c *Consumer) ResumeReads() {
+	c.paused.Store(false)
+}
+
+// ReadsPaused returns true if PauseReads() was called without ResumeReads().
+func (c *Consumer) ReadsPaused() bool {
+	return c.paused.Load()
+}
+
+// Fork returns ErrNotSupported, as a *timeq.Fork only works with a local
+// queue. Use Client.Fork() and Client.Consumer() instead.
+func (c *Consumer) Fork(_ timeq.ForkName) (*timeq.Fork, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,249 @@
+// Package ipc lets other processes push to and pop from a queue that is owned
+// by a Go process. The queue is served over a unix domain socket with a small
+// binary protocol, so that clients can be written in any language without
+// linking Go code.
+//
+// All integers are big endian. Every request and response is a frame:
+//
+//	frame    = length:uint32 payload:[length]byte
+//	request  = op:uint8 fork_len:uint8 fork:[fork_len]byte body
+//	response = status:uint8 body
+//
+// The fork is empty to address the queue itself. The body depends on the op:
+//
+//	op            request body     response body
+//	1 (push)      items            (empty)
+//	2 (pop)       n:uint32         items
+//	3 (peek)      n:uint32         items
+//	4 (len)       (empty)          len:uint64
+//	5 (ack)       items            (empty)
+//	6 (delete)    from:int64 to:int64  deleted:uint64 dropped:uint64 reclaimed:uint64
+//	7 (fork)      name:[]byte      (empty)
+//	8 (join)      member:[]byte    (empty)
+//	9 (seq)       n:uint32         first:uint64
+//	10 (replicate) epoch:uint64 items  (empty)
+//
+//	items = count:uint32 { key:int64 blob_len:uint32 blob:[blob_len]byte }
+//
+// Pop and peek return the items of at most one bucket per request, so they
+// might return less than n items while the queue has more. Ack pops exactly
+// the items that a peek returned before, even if items with lower keys were
+// pushed since. Fork forks the queue or the fork in the request into `name`.
+//
+// Join makes the connection a member of the timeq.Group of the fork in the
+// request. Pop and peek of this fork on the connection only return items of
+// the buckets assigned to the member then. The member leaves the group when
+// the connection is closed, so its buckets go to the remaining members.
+//
+// Seq reserves n sequence numbers with timeq.Queue.NextSeq(), so producers
+// in other processes draw from the same counter. The fork is ignored.
+//
+// Replicate pushes items that were replicated by a primary of `epoch` with
+// timeq.Queue.PushReplicated(), which rejects them if the primary was
+// replaced in the meantime. Only the queue itself can be addressed.
+//
+// If status is not zero, the body of the response is an error message and
+// nothing was changed in the queue. Requests on one connection are processed
+// in order; use several connections to process them concurrently.
+package ipc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sahib/timeq"
+)
+
+// Op is the operation of a request.
+type Op uint8
+
+const (
+	// OpPush pushes the items in the request.
+	OpPush Op = iota + 1
+
+	// OpPop pops up to n items. Popped items are gone once they were written
+	// to the socket, even if the client dies before reading them.
+	OpPop
+
+	// OpPeek returns up to n items without removing them.
+	OpPeek
+
+	// OpLen returns the number of items.
+	OpLen
+
+	// OpAck pops the items in the request, which were peeked before.
+	OpAck
+
+	// OpDelete deletes all items in a key range.
+	OpDelete
+
+	// OpFork creates a fork. Forking an existing fork is not an error.
+	OpFork
+
+	// OpJoin joins the consumer group of the fork.
+	OpJoin
+
+	// OpSeq reserves sequence numbers.
+	OpSeq
+
+	// OpReplicate pushes the items of a primary.
+	OpReplicate
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpPush:
+		return "push"
+	case OpPop:
+		return "pop"
+	case OpPeek:
+		return "peek"
+	case OpLen:
+		return "len"
+	case OpAck:
+		return "ack"
+	case OpDelete:
+		return "delete"
+	case OpFork:
+		return "fork"
+	case OpJoin:
+		return "join"
+	case OpSeq:
+		return "seq"
+	case OpReplicate:
+		return "replicate"
+	default:
+		return fmt.Sprintf("op(%d)", uint8(op))
+	}
+}
+
+const (
+	statusOK    = 0
+	statusError = 1
+)
+
+// DefaultMaxFrameSize is the default for Server.MaxFrameSize.
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+// ErrFrameTooLarge is returned when a frame exceeds the maximum frame size.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrMalformed is returned when a frame could not be decoded.
+var ErrMalformed = errors.New("malformed frame")
+
+func readFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:])
+	if uint64(size) > uint64(maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func writeFrame(w *bufio.Writer, payload []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func appendItems(buf []byte, items timeq.Items) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(items)))
+	for _, it := range items {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(it.Key))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(it.Blob)))
+		buf = append(buf, it.Blob...)
+	}
+
+	return buf
+}
+
+// decodeItems decodes `buf` into items. The blobs point into `buf`.
+func decodeItems(buf []byte) (timeq.Items, error) {
+	if len(buf) < 4 {
+		return nil, ErrMalformed
+	}
+
+	count := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+
+	// every item takes at least 12 bytes; don't trust count blindly:
+	if uint64(count)*12 > uint64(len(buf)) {
+		return nil, ErrMalformed
+	}
+
+	items := make(timeq.Items, 0, count)
+	for idx := uint32(0); idx < count; idx++ {
+		if len(buf) < 12 {
+			return nil, ErrMalformed
+		}
+
+		key := timeq.Key(binary.BigEndian.Uint64(buf))
+		size := binary.BigEndian.Uint32(buf[8:])
+		buf = buf[12:]
+		if uint64(size) > uint64(len(buf)) {
+			return nil, ErrMalformed
+		}
+
+		items = append(items, timeq.Item{Key: key, Blob: buf[:size:size]})
+		buf = buf[size:]
+	}
+
+	if len(buf) > 0 {
+		return nil, ErrMalformed
+	}
+
+	return items, nil
+}
+
+type request struct {
+	op   Op
+	fork timeq.ForkName
+	body []byte
+}
+
+func appendRequestHeader(buf []byte, op Op, fork timeq.ForkName) ([]byte, error) {
+	if len(fork) > 255 {
+		return nil, fmt.Errorf("fork name too long: %d bytes", len(fork))
+	}
+
+	buf = append(buf, byte(op), byte(len(fork)))
+	return append(buf, fork...), nil
+}
+
+func decodeRequest(buf []byte) (request, error) {
+	if len(buf) < 2 {
+		return request{}, ErrMalformed
+	}
+
+	op, forkLen := Op(buf[0]), int(buf[1])
+	if len(buf) < 2+forkLen {
+		return request{}, ErrMalformed
+	}
+
+	return request{
+		op:   op,
+		fork: timeq.ForkName(buf[2 : 2+forkLen]),
+		body: buf[2+forkLen:],
+	}, nil
+}
@@ -0,0 +1,433 @@
+package ipc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/sahib/timeq"
+)
+
+// Server serves a queue to other processes. See the package documentation
+// for the protocol.
+type Server struct {
+	// Queue is the queue that is served.
+	Queue *timeq.Queue
+
+	// MaxFrameSize limits the size of a single request. Responses are
+	// not limited; clients choose their size by the number of items they
+	// read. Defaults to DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	// Logger is used to report broken connections. Defaults to timeq.NullLogger().
+	Logger timeq.Logger
+
+	mu       sync.Mutex
+	closed   bool
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// ListenAndServe listens on the unix socket at `path` and serves it until
+// Close() is called. A stale socket file at `path` is removed first.
+func (s *Server) ListenAndServe(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on `l` until Close() is called, which
+// makes it return nil. The listener is closed when Serve returns.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+
+	s.listener = l
+	s.mu.Unlock()
+
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.serveConn(conn)
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	conn.Close()
+}
+
+// Close stops the server, closes all connections and waits for
+// running requests. It does not close the queue.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *Server) maxFrameSize() int {
+	if s.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+
+	return s.MaxFrameSize
+}
+
+func (s *Server) logf(fmtStr string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(fmtStr, args...)
+	}
+}
+
+// connState is what the server remembers about a connection.
+type connState struct {
+	// member is set after OpJoin for the fork `memberFork`.
+	member     *timeq.GroupMember
+	memberFork timeq.ForkName
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	state := &connState{}
+	defer func() {
+		if state.member != nil {
+			state.member.Leave()
+		}
+	}()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		frame, err := readFrame(r, s.maxFrameSize())
+		if err != nil {
+			// EOF is the normal way for a client to go away.
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				s.logf("ipc: read: %v", err)
+			}
+			return
+		}
+
+		if err := s.handle(w, frame, state); err != nil {
+			s.logf("ipc: write: %v", err)
+			return
+		}
+	}
+}
+
+// handle processes a single request and writes the response.
+// Only errors when writing the response are returned.
+func (s *Server) handle(w *bufio.Writer, frame []byte, state *connState) error {
+	req, err := decodeRequest(frame)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	consumer, err := s.consumer(req.fork)
+	if err != nil {
+		return writeError(w, err)
+	}
+
+	switch req.op {
+	case OpPush:
+		if req.fork != "" {
+			return writeError(w, errors.New("cannot push to a fork"))
+		}
+
+		items, err := decodeItems(req.body)
+		if err != nil {
+			return writeError(w, err)
+		}
+
+		if err := s.Queue.Push(items); err != nil {
+			return writeError(w, err)
+		}
+
+		return writeFrame(w, []byte{statusOK})
+	case OpReplicate:
+		if req.fork != "" {
+			return writeError(w, errors.New("cannot push to a fork"))
+		}
+
+		if len(req.body) < 8 {
+			return writeError(w, ErrMalformed)
+		}
+
+		items, err := decodeItems(req.body[8:])
+		if err != nil {
+			return writeError(w, err)
+		}
+
+		if err := s.Queue.PushReplicated(binary.BigEndian.Uint64(req.body), items); err != nil {
+			return writeError(w, err)
+		}
+
+		return writeFrame(w, []byte{statusOK})
+	case OpPop, OpPeek:
+		if len(req.body) != 4 {
+			return writeError(w, ErrMalformed)
+		}
+
+		var rdr reader = consumer
+		if state.member != nil && state.memberFork == req.fork {
+			rdr = state.member
+		}
+
+		return s.handleRead(w, rdr, req.op, int(binary.BigEndian.Uint32(req.body)))
+	case OpLen:
+		resp := binary.BigEndian.AppendUint64([]byte{statusOK}, uint64(consumer.Len()))
+		return writeFrame(w, resp)
+	case OpAck:
+		items, err := decodeItems(req.body)
+		if err != nil {
+			return writeError(w, err)
+		}
+
+		if err := popExactly(consumer, items); err != nil {
+			return writeError(w, err)
+		}
+
+		return writeFrame(w, []byte{statusOK})
+	case OpDelete:
+		if len(req.body) != 16 {
+			return writeError(w, ErrMalformed)
+		}
+
+		from := timeq.Key(binary.BigEndian.Uint64(req.body))
+		to := timeq.Key(binary.BigEndian.Uint64(req.body[8:]))
+		res, err := consumer.Delete(from, to)
+		if err != nil {
+			return writeError(w, err)
+		}
+
+		resp := binary.BigEndian.AppendUint64([]byte{statusOK}, uint64(res.Items))
+		resp = binary.BigEndian.AppendUint64(resp, uint64(res.DroppedBuckets))
+		resp = binary.BigEndian.AppendUint64(resp, uint64(res.ReclaimedBytes))
+		return writeFrame(w, resp)
+	case OpFork:
+		if _, err := consumer.Fork(timeq.ForkName(req.body)); err != nil {
+			return writeError(w, err)
+		}
+
+		return writeFrame(w, []byte{statusOK})
+	case OpJoin:
+		if len(req.body) == 0 {
+			return writeError(w, errors.New("empty member id"))
+		}
+
+		if state.member != nil {
+			// e.g. after it was removed by Options.GroupSessionTimeout.
+			state.member.Leave()
+		}
+
+		state.member = s.Queue.Group(req.fork).Join(string(req.body))
+		state.memberFork = req.fork
+		return writeFrame(w, []byte{statusOK})
+	case OpSeq:
+		if len(req.body) != 4 {
+			return writeError(w, ErrMalformed)
+		}
+
+		first, err := s.Queue.NextSeq(int(binary.BigEndian.Uint32(req.body)))
+		if err != nil {
+			return writeError(w, err)
+		}
+
+		return writeFrame(w, binary.BigEndian.AppendUint64([]byte{statusOK}, first))
+	default:
+		return writeError(w, fmt.Errorf("unknown op: %v", req.op))
+	}
+}
+
+// reader is a timeq.Consumer or a timeq.GroupMember.
+type reader interface {
+	Read(n int, fn timeq.TransactionFn) error
+}
+
+func (s *Server) handleRead(w *bufio.Writer, rdr reader, op Op, n int) error {
+	var (
+		written  bool
+		writeErr error
+		readOp   timeq.ReadOp = timeq.ReadOpPeek
+	)
+
+	if op == OpPop {
+		readOp = timeq.ReadOpPop
+	}
+
+	err := rdr.Read(n, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+		if written {
+			// fn is called once per bucket, but only one frame may be sent.
+			// The client has to ask again for the items of the next bucket.
+			return timeq.ReadOpPeek, nil
+		}
+
+		// the blobs are only valid in here, so write the response right away.
+		// If it fails, the items stay in the queue.
+		written = true
+		writeErr = writeFrame(w, appendItems([]byte{statusOK}, items))
+		if writeErr != nil {
+			return timeq.ReadOpPeek, writeErr
+		}
+
+		return readOp, nil
+	})
+
+	if writeErr != nil {
+		return writeErr
+	}
+
+	if err != nil {
+		if !written {
+			return writeError(w, err)
+		}
+
+		// the client got the items already; nothing we can tell it.
+		s.logf("ipc: %v: %v", op, err)
+	}
+
+	if !written {
+		// fn is not called when there is nothing to read.
+		return writeFrame(w, appendItems([]byte{statusOK}, nil))
+	}
+
+	return nil
+}
+
+// consumer returns the queue or the fork `name`. Forks are not created.
+func (s *Server) consumer(name timeq.ForkName) (timeq.Consumer, error) {
+	if name == "" {
+		return s.Queue, nil
+	}
+
+	if !slices.Contains(s.Queue.Forks(), name) {
+		return nil, timeq.ErrNoSuchFork
+	}
+
+	return s.Queue.Fork(name)
+}
+
+// popExactly pops `items`, which were peeked from `consumer` before.
+func popExactly(consumer timeq.Consumer, items timeq.Items) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	var matched bool
+	err := consumer.Read(len(items), func(_ timeq.Transaction, peeked timeq.Items) (timeq.ReadOp, error) {
+		if !matched && slices.EqualFunc(peeked, items, itemEqual) {
+			matched = true
+			return timeq.ReadOpPop, nil
+		}
+
+		return timeq.ReadOpPeek, nil
+	})
+
+	if err != nil || matched {
+		return err
+	}
+
+	// items with lower keys were pushed since peeking,
+	// so we have to delete exactly the acked ones:
+	acked := make(map[string]int, len(items))
+	for _, it := range items {
+		acked[itemID(it)]++
+	}
+
+	_, err = consumer.DeleteFunc(items[0].Key, items[len(items)-1].Key, func(it timeq.Item) bool {
+		id := itemID(it)
+		if acked[id] > 0 {
+			acked[id]--
+			return false
+		}
+
+		return true
+	})
+
+	return err
+}
+
+func itemEqual(a, b timeq.Item) bool {
+	return a.Key == b.Key && bytes.Equal(a.Blob, b.Blob)
+}
+
+func itemID(it timeq.Item) string {
+	return fmt.Sprintf("%d:%s", it.Key, it.Blob)
+}
+
+func writeError(w *bufio.Writer, err error) error {
+	return writeFrame(w, append([]byte{statusError}, err.Error()...))
+}
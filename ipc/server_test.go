@@ -0,0 +1,282 @@
+package ipc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sahib/timeq"
+	"github.com/sahib/timeq/timeqtest"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, queue *timeq.Queue) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "timeq.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	srv := &Server{Queue: queue}
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(l) }()
+
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+		require.NoError(t, <-done)
+	})
+
+	return path
+}
+
+func TestServerPushPop(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	_, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	client, err := Dial(startServer(t, queue))
+	require.NoError(t, err)
+	defer client.Close()
+
+	exp := timeqtest.Sequential(0, 100)
+	require.NoError(t, client.Push(exp))
+
+	n, err := client.Len("")
+	require.NoError(t, err)
+	require.Equal(t, 100, n)
+
+	got, err := client.Peek("", 10)
+	require.NoError(t, err)
+	require.Equal(t, exp[:10], got)
+
+	got, err = client.Pop("", 60)
+	require.NoError(t, err)
+	require.Equal(t, exp[:60], got)
+	require.Equal(t, 40, queue.Len())
+
+	// forks are not affected by popping the queue:
+	got, err = client.Pop("fork", 1000)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+
+	got, err = client.Pop("fork", 10)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	n, err = client.Len("fork")
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestServerErrors(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	path := startServer(t, queue)
+
+	client, err := Dial(path)
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Pop("nope", 10)
+	require.ErrorContains(t, err, timeq.ErrNoSuchFork.Error())
+
+	var remoteErr *RemoteError
+	require.ErrorAs(t, err, &remoteErr)
+
+	// forks are not created by the server:
+	require.Empty(t, queue.Forks())
+
+	// the connection is still usable after an error:
+	require.NoError(t, client.Push(timeqtest.Sequential(0, 1)))
+
+	// malformed requests are answered with an error:
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	require.NoError(t, writeFrame(w, []byte{byte(OpPush), 0, 0, 0, 0, 1}))
+	resp, err := readFrame(r, DefaultMaxFrameSize)
+	require.NoError(t, err)
+	require.Equal(t, byte(statusError), resp[0])
+
+	// too large frames close the connection:
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], DefaultMaxFrameSize+1)
+	_, err = conn.Write(hdr[:])
+	require.NoError(t, err)
+	_, err = readFrame(r, DefaultMaxFrameSize)
+	require.Error(t, err)
+
+	require.Equal(t, 1, queue.Len())
+}
+
+func TestDecodeItemsMalformed(t *testing.T) {
+	valid := appendItems(nil, timeqtest.Sequential(0, 3))
+	items, err := decodeItems(valid)
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+
+	for size := 0; size < len(valid); size++ {
+		_, err := decodeItems(valid[:size])
+		require.ErrorIs(t, err, ErrMalformed, size)
+	}
+
+	_, err = decodeItems(append(valid, 0))
+	require.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestConsumer(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	client, err := Dial(startServer(t, queue))
+	require.NoError(t, err)
+	defer client.Close()
+
+	var consumer timeq.Consumer = client.Consumer("")
+
+	exp := timeqtest.Sequential(0, 100)
+	require.NoError(t, client.Push(exp))
+	require.NoError(t, client.Fork("", "fork"))
+	require.Equal(t, []timeq.ForkName{"fork"}, queue.Forks())
+
+	got, err := timeq.PeekCopy(consumer, 10)
+	require.NoError(t, err)
+	require.Equal(t, exp[:10], got)
+
+	// failing transactions do not pop anything:
+	err = consumer.Read(10, func(_ timeq.Transaction, _ timeq.Items) (timeq.ReadOp, error) {
+		return timeq.ReadOpPop, net.ErrClosed
+	})
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.Equal(t, 100, consumer.Len())
+
+	got, err = timeq.PopCopy(consumer, 10)
+	require.NoError(t, err)
+	require.Equal(t, exp[:10], got)
+	require.Equal(t, 90, queue.Len())
+
+	// lower keys were pushed after peeking; only the peeked items are acked:
+	err = consumer.Read(10, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+		require.NoError(t, queue.Push(timeqtest.Sequential(0, 5)))
+		return timeq.ReadOpPop, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 85, queue.Len())
+
+	ndeleted, err := consumer.Delete(0, 4)
+	require.NoError(t, err)
+	require.Equal(t, 5, ndeleted.Items)
+
+	consumer.PauseReads()
+	got, err = timeq.PopCopy(consumer, -1)
+	require.NoError(t, err)
+	require.Empty(t, got)
+	consumer.ResumeReads()
+
+	dst := timeqtest.TempQueue(t)
+	nshoveled, err := consumer.Shovel(dst)
+	require.NoError(t, err)
+	require.Equal(t, 80, nshoveled)
+	require.Equal(t, 0, consumer.Len())
+	got, err = timeq.PopCopy(dst, -1)
+	require.NoError(t, err)
+	require.Equal(t, exp[20:], got)
+
+	// the fork only got the pushed items:
+	got, err = timeq.PopCopy(client.Consumer("fork"), -1)
+	require.NoError(t, err)
+	require.Len(t, got, 105)
+
+	_, err = consumer.Fork("other")
+	require.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestServerJoin(t *testing.T) {
+	opts := timeq.DefaultOptions()
+	opts.BucketSplitConf = timeq.FixedSizeBucketSplitConf(10)
+	queue := timeqtest.TempQueueWithOptions(t, opts)
+	require.NoError(t, queue.Push(timeqtest.Sequential(0, 100)))
+
+	path := startServer(t, queue)
+	client1, err := Dial(path)
+	require.NoError(t, err)
+	defer client1.Close()
+
+	client2, err := Dial(path)
+	require.NoError(t, err)
+
+	require.NoError(t, client1.Join("", "a"))
+	require.NoError(t, client2.Join("", "b"))
+	require.Equal(t, []string{"a", "b"}, queue.Group("").Members())
+
+	m1 := queue.Group("").Join("a")
+	buckets, err := m1.Buckets()
+	require.NoError(t, err)
+
+	// only the items of the own buckets are returned:
+	got, err := client1.Peek("", 100)
+	require.NoError(t, err)
+	require.NotEmpty(t, got)
+	require.Equal(t, buckets[0], got[0].Key)
+
+	// closing the connection leaves the group:
+	require.NoError(t, client2.Close())
+	require.Eventually(t, func() bool {
+		return len(queue.Group("").Members()) == 1
+	}, time.Second, time.Millisecond)
+
+	n := 0
+	for {
+		got, err := client1.Pop("", 100)
+		require.NoError(t, err)
+		if len(got) == 0 {
+			break
+		}
+
+		n += len(got)
+	}
+
+	require.Equal(t, 100, n)
+}
+
+func TestServerNextSeq(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	path := startServer(t, queue)
+	client, err := Dial(path)
+	require.NoError(t, err)
+	defer client.Close()
+
+	first, err := client.NextSeq(10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+
+	first, err = queue.NextSeq(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), first)
+
+	_, err = client.NextSeq(0)
+	require.Error(t, err)
+}
+
+func TestServerReplicate(t *testing.T) {
+	replica := timeqtest.TempQueue(t)
+	require.NoError(t, replica.Demote())
+
+	client, err := Dial(startServer(t, replica))
+	require.NoError(t, err)
+	defer client.Close()
+
+	exp := timeqtest.Sequential(0, 10)
+	require.NoError(t, client.PushReplicated(2, exp))
+	require.Equal(t, uint64(2), replica.Epoch())
+
+	// batches of older primaries are rejected:
+	var remoteErr *RemoteError
+	require.ErrorAs(t, client.PushReplicated(1, timeqtest.Sequential(10, 20)), &remoteErr)
+
+	got, err := client.Peek("", 100)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+}
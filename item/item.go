@@ -5,11 +5,16 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	HeaderSize  = 12
 	TrailerSize = 2
+
+	// MaxBlobSize is the biggest blob that can be stored in an item.
+	MaxBlobSize = 64 * 1024 * 1024
 )
 
 // Key is a priority key in the queue. It has to be unique
@@ -39,6 +44,15 @@ type Off uint64
 type Item struct {
 	Key  Key
 	Blob []byte
+
+	// PushedAt is the time the item was pushed. It is not stored with the
+	// item and is only set on read if push times are recorded.
+	PushedAt time.Time
+
+	// Seq is the sequence number of the push that added the item. All items
+	// of one push share it. It is not stored with the item and is only set
+	// on read if sequence numbers are recorded. Zero means unknown.
+	Seq uint64
 }
 
 func (i Item) String() string {
@@ -53,8 +67,10 @@ func (i *Item) Copy() Item {
 	blob := make([]byte, len(i.Blob))
 	copy(blob, i.Blob)
 	return Item{
-		Key:  i.Key,
-		Blob: blob,
+		Key:      i.Key,
+		Blob:     blob,
+		PushedAt: i.PushedAt,
+		Seq:      i.Seq,
 	}
 }
 
@@ -91,11 +107,15 @@ func (items Items) Copy() Items {
 	itemsCopy := make(Items, len(items))
 	copyBuf := make([]byte, bufSize)
 	for idx := 0; idx < len(items); idx++ {
-		blobCopy := copyBuf[:len(items[idx].Blob)]
+		// limit the capacity, so appending to a blob does not overwrite the next one:
+		blobLen := len(items[idx].Blob)
+		blobCopy := copyBuf[:blobLen:blobLen]
 		copy(blobCopy, items[idx].Blob)
 		itemsCopy[idx] = Item{
-			Key:  items[idx].Key,
-			Blob: blobCopy,
+			Key:      items[idx].Key,
+			Blob:     blobCopy,
+			PushedAt: items[idx].PushedAt,
+			Seq:      items[idx].Seq,
 		}
 
 		copyBuf = copyBuf[len(blobCopy):]
@@ -104,6 +124,60 @@ func (items Items) Copy() Items {
 	return itemsCopy
 }
 
+// CopyInto works like Copy() but re-uses the memory of `dst` where possible.
+// The items in `dst` (up to its capacity) are overwritten, including the
+// memory their blobs point to. Use the returned slice instead of `dst`
+// afterwards. If you copy many items in a loop, this will not allocate
+// anymore once `dst` has grown big enough.
+func (items Items) CopyInto(dst Items) Items {
+	if cap(dst) < len(items) {
+		// keep the already allocated blobs beyond len(dst):
+		dst = append(dst[:cap(dst)], make(Items, len(items)-cap(dst))...)
+	}
+
+	dst = dst[:len(items)]
+	for idx := 0; idx < len(items); idx++ {
+		dst[idx].Key = items[idx].Key
+		dst[idx].Blob = append(dst[idx].Blob[:0], items[idx].Blob...)
+		dst[idx].PushedAt = items[idx].PushedAt
+		dst[idx].Seq = items[idx].Seq
+	}
+
+	return dst
+}
+
+var (
+	itemsPool = sync.Pool{}
+
+	// holderPool has the *Items that Release() puts into itemsPool,
+	// so it does not need to allocate a new one each time.
+	holderPool = sync.Pool{New: func() any { return new(Items) }}
+)
+
+// CopyPooled works like CopyInto() but takes the memory from an internal
+// pool. Once you do not need the copied items anymore you should call
+// Release() on them, so the memory can be re-used by the next call.
+// Not calling Release() is not a leak, but defeats the purpose.
+func (items Items) CopyPooled() Items {
+	holder, _ := itemsPool.Get().(*Items)
+	if holder == nil {
+		return items.CopyInto(nil)
+	}
+
+	dst := *holder
+	*holder = nil
+	holderPool.Put(holder)
+	return items.CopyInto(dst)
+}
+
+// Release hands the memory of `items` back to the pool used by CopyPooled().
+// The items (and their blobs) must not be used after calling Release().
+func (items Items) Release() {
+	holder := holderPool.Get().(*Items)
+	*holder = items[:0]
+	itemsPool.Put(holder)
+}
+
 func (items Items) StorageSize() Off {
 	sum := Off(len(items)) * (HeaderSize + TrailerSize)
 	for idx := 0; idx < len(items); idx++ {
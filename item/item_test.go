@@ -2,6 +2,7 @@ package item
 
 import (
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/stretchr/testify/require"
@@ -54,6 +55,66 @@ func TestItemsCopy(t *testing.T) {
 	require.True(t, unsafe.SliceData(items) != unsafe.SliceData(copied))
 }
 
+func TestItemsCopyInto(t *testing.T) {
+	items := Items{
+		Item{Key: 17, Blob: []byte("blob")},
+		Item{Key: 23, Blob: []byte("blub")},
+	}
+
+	// growing from nil:
+	dst := items.CopyInto(nil)
+	require.Equal(t, items, dst)
+	require.True(t, unsafe.SliceData(items[0].Blob) != unsafe.SliceData(dst[0].Blob))
+
+	// blob memory of the first copy should be re-used:
+	blobPtr := unsafe.SliceData(dst[1].Blob)
+	other := Items{
+		Item{Key: 1, Blob: []byte("a")},
+		Item{Key: 2, Blob: []byte("b")},
+	}
+	dst = other.CopyInto(dst)
+	require.Equal(t, other, dst)
+	require.True(t, blobPtr == unsafe.SliceData(dst[1].Blob))
+
+	// shrinking and growing again should keep the blobs:
+	dst = items[:1].CopyInto(dst)
+	require.Equal(t, items[:1], dst)
+	dst = items.CopyInto(dst)
+	require.Equal(t, items, dst)
+	require.True(t, blobPtr == unsafe.SliceData(dst[1].Blob))
+}
+
+func TestItemsCopyIntoCopy(t *testing.T) {
+	items := Items{
+		Item{Key: 17, Blob: []byte("a")},
+		Item{Key: 23, Blob: []byte("hello")},
+	}
+
+	// the blobs of Copy() share one buffer; a longer
+	// blob must not overwrite the one after it:
+	dst := items.Copy()
+	second := dst[1]
+	other := Items{Item{Key: 1, Blob: []byte("XYZ")}}
+
+	dst = other.CopyInto(dst)
+	require.Equal(t, other, dst)
+	require.Equal(t, items[1], second)
+}
+
+func TestItemsCopyPooled(t *testing.T) {
+	items := Items{
+		Item{Key: 17, Blob: []byte("blob")},
+		Item{Key: 23, Blob: []byte("blub")},
+	}
+
+	for idx := 0; idx < 10; idx++ {
+		copied := items.CopyPooled()
+		require.Equal(t, items, copied)
+		require.True(t, unsafe.SliceData(items[0].Blob) != unsafe.SliceData(copied[0].Blob))
+		copied.Release()
+	}
+}
+
 func TestItemStorageSize(t *testing.T) {
 	var items Items
 	require.Zero(t, items.StorageSize())
@@ -71,3 +132,17 @@ func TestItemStorageSize(t *testing.T) {
 
 	require.Equal(t, Off(48), items.StorageSize())
 }
+
+func TestKeyTime(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 30, 15, 42, time.UTC)
+	key := KeyFromTime(now)
+	require.True(t, now.Equal(key.Time()))
+	require.Equal(t, "2024-05-01T12-30", key.Format("2006-01-02T15-04"))
+
+	parsed, err := ParseKey("2006-01-02T15-04", key.Format("2006-01-02T15-04"))
+	require.NoError(t, err)
+	require.Equal(t, KeyFromTime(now.Truncate(time.Minute)), parsed)
+
+	_, err = ParseKey("2006-01-02T15-04", "K00000000000000000001")
+	require.Error(t, err)
+}
@@ -0,0 +1,32 @@
+package item
+
+import "time"
+
+// Time returns the key as time, assuming that it is
+// a nanosecond unix timestamp like time.UnixNano() returns.
+func (k Key) Time() time.Time {
+	return time.Unix(0, int64(k))
+}
+
+// KeyFromTime is the reverse of Key.Time(). Like time.UnixNano(), the
+// result is undefined for times before 1678 or after 2262.
+func KeyFromTime(t time.Time) Key {
+	return Key(t.UnixNano())
+}
+
+// Format formats the key as UTC time with `layout` (see time.Layout).
+// Parts of the key that are not in the layout are lost.
+func (k Key) Format(layout string) string {
+	return k.Time().UTC().Format(layout)
+}
+
+// ParseKey is the reverse of Key.Format(). Times without
+// a zone in `layout` are assumed to be in UTC.
+func ParseKey(layout, s string) (Key, error) {
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return 0, err
+	}
+
+	return KeyFromTime(t), nil
+}
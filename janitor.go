@@ -0,0 +1,140 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+// janitorCompactFactor is the ratio of index log entries to live
+// locations after which the janitor compacts an index log.
+const janitorCompactFactor = 4
+
+// janitor runs Maintain() periodically in the background.
+type janitor struct {
+	bs       *buckets
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func startJanitor(bs *buckets, interval time.Duration) *janitor {
+	j := &janitor{
+		bs:       bs,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go j.run()
+	return j
+}
+
+// nextDelay returns the interval with +/- 25% of jitter,
+// so that several queues do not all do their work at the same time.
+func (j *janitor) nextDelay() time.Duration {
+	jitter := time.Duration(rand.Int63n(int64(j.interval)/2 + 1))
+	return j.interval - j.interval/4 + jitter
+}
+
+func (j *janitor) run() {
+	defer close(j.done)
+
+	timer := time.NewTimer(j.nextDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-timer.C:
+			if err := j.bs.Maintain(); err != nil && !errors.Is(err, ErrClosed) {
+				j.bs.opLog.Logger.Printf("janitor: %v", err)
+			}
+
+			timer.Reset(j.nextDelay())
+		}
+	}
+}
+
+// Stop stops the janitor and waits until it finished its current work.
+func (j *janitor) Stop() {
+	close(j.stop)
+	<-j.done
+}
+
+// Maintain runs all maintenance tasks once:
+//
+// - Remove forks that were not read for Options.ForkExpiry (see Options.OnForkExpire).
+// - Delete items that are older than Options.JanitorRetention (see Options.OnExpire).
+// - Remove buckets that are empty for all consumers and stale files (see Trim()).
+// - Write buffered index entries (see Options.IndexBufferSize).
+// - Compact index logs of loaded buckets that grew too much.
+// - Release the memory of consumed data (see Options.AdviseFreeConsumed).
+// - Correct the cached item counts, if they drifted.
+// - Re-create the disk reserve, if it was released (see Options.DiskReserveSize).
+// - Write the fork activity and the totals (see Metrics.Totals).
+func (bs *buckets) Maintain() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	if bs.opts.OpenMode.readOnly() {
+		return ErrReadOnly
+	}
+
+	err := bs.expireForks()
+	err = errors.Join(err, bs.saveForkActivity(), bs.saveTotals())
+
+	consumers := append([]ForkName{""}, bs.forks...)
+	if retention := bs.opts.JanitorRetention; retention > 0 {
+		cutoff := item.Key(time.Now().Add(-retention).UnixNano())
+		if minKey, _, ok := bs.tree.Min(); ok && minKey <= cutoff {
+			for _, fork := range consumers {
+				var onExpire func(item.Items) error
+				if bs.opts.OnExpire != nil {
+					onExpire = func(items item.Items) error {
+						return bs.opts.OnExpire(fork, items)
+					}
+				}
+
+				if delErr := bs.deleteRange(&DeleteResult{}, fork, minKey, cutoff, nil, onExpire); delErr != nil {
+					err = errors.Join(err, fmt.Errorf("retention: %s: %w", fork, delErr))
+				}
+			}
+		}
+	}
+
+	err = errors.Join(err, bs.trim())
+	err = errors.Join(err, bs.restoreReserve())
+	_ = bs.iter(loadedOnly, func(key item.Key, buck *bucket) error {
+		if flushErr := buck.FlushIndexes(); flushErr != nil {
+			bs.opts.Logger.Printf("janitor: bucket %v: %v", key, flushErr)
+		}
+
+		if compactErr := buck.CompactIndexes(janitorCompactFactor); compactErr != nil {
+			bs.opts.Logger.Printf("janitor: bucket %v: %v", key, compactErr)
+		}
+
+		if bs.opts.AdviseFreeConsumed {
+			// only advisory, so just log it:
+			if freeErr := buck.FreeConsumed(); freeErr != nil {
+				bs.opts.Logger.Printf("janitor: bucket %v: %v", key, freeErr)
+			}
+		}
+
+		return nil
+	})
+
+	for _, fork := range consumers {
+		bs.lenExact(fork)
+	}
+
+	return err
+}
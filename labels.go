@@ -0,0 +1,46 @@
+package timeq
+
+import (
+	"context"
+	"runtime/pprof"
+
+	"github.com/sahib/timeq/item"
+)
+
+// setLabels adds the pprof labels in `kv` (key, value, key, value, ...)
+// to the calling goroutine, if Options.ProfilerLabels is set. The queue
+// directory is always added. The returned func restores the labels that
+// were set before. It must be called with bs.mu held.
+func (bs *buckets) setLabels(kv ...string) func() {
+	if !bs.opts.ProfilerLabels {
+		return func() {}
+	}
+
+	prev := bs.labels
+	base := prev
+	if base == nil {
+		base = pprof.WithLabels(context.Background(), pprof.Labels("timeq.dir", bs.dir))
+	}
+
+	bs.labels = pprof.WithLabels(base, pprof.Labels(kv...))
+	pprof.SetGoroutineLabels(bs.labels)
+	return func() {
+		bs.labels = prev
+		if prev == nil {
+			pprof.SetGoroutineLabels(context.Background())
+			return
+		}
+
+		pprof.SetGoroutineLabels(prev)
+	}
+}
+
+// labelOp labels the calling goroutine with the operation `name`.
+func (bs *buckets) labelOp(name string) func() {
+	return bs.setLabels("timeq.op", name)
+}
+
+// labelBucket labels the calling goroutine with the bucket `key`.
+func (bs *buckets) labelBucket(key item.Key) func() {
+	return bs.setLabels("timeq.bucket", key.String())
+}
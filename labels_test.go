@@ -0,0 +1,43 @@
+package timeq
+
+import (
+	"bytes"
+	"os"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/sahib/timeq/item/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func goroutineLabels(t *testing.T) string {
+	buf := &bytes.Buffer{}
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(buf, 1))
+	return buf.String()
+}
+
+// NOTE: Not parallel, so no other test sets labels at the same time.
+func TestProfilerLabels(t *testing.T) {
+	dir, err := os.MkdirTemp("", "timeq-labeltest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.ProfilerLabels = true
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 10, 1)))
+
+	err = queue.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
+		labels := goroutineLabels(t)
+		require.Contains(t, labels, `"timeq.op":"read"`)
+		require.Contains(t, labels, `"timeq.bucket":"`+Key(0).String()+`"`)
+		require.Contains(t, labels, `"timeq.dir":"`+dir+`"`)
+		return ReadOpPop, nil
+	})
+	require.NoError(t, err)
+
+	// the labels are gone after the call:
+	require.NotContains(t, goroutineLabels(t), "timeq.op")
+	require.NoError(t, queue.Close())
+}
@@ -0,0 +1,134 @@
+package timeq
+
+import (
+	"slices"
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+// LagCondition describes when a consumer is considered to be lagging behind.
+// If both limits are set, exceeding one of them is enough.
+type LagCondition struct {
+	// MaxLen is the number of unread items that is still fine.
+	// Zero disables this check.
+	MaxLen int
+
+	// MaxAge is the maximum distance between Now() and the lowest
+	// unread key. This assumes that keys are nanosecond timestamps,
+	// unless you set Now. Zero disables this check.
+	MaxAge time.Duration
+
+	// Now returns the current time as key.
+	// If nil, time.Now().UnixNano() is used.
+	Now func() Key
+}
+
+// LagAlert is passed to the callback given to OnLag().
+type LagAlert struct {
+	// Fork is the consumer that started or stopped lagging.
+	// It is empty for the queue itself.
+	Fork ForkName
+
+	// Lagging is true if the condition was just exceeded
+	// and false if the consumer caught up again.
+	Lagging bool
+
+	// Len is the number of unread items of the consumer.
+	Len int
+
+	// OldestKey is the lowest unread key. If the bucket it is in is not
+	// loaded, this is the lowest key that the bucket may contain, i.e. it
+	// might be a bit lower than the real key. Zero if Len is zero.
+	OldestKey Key
+}
+
+type lagWatch struct {
+	fork    ForkName
+	cond    LagCondition
+	fn      func(LagAlert)
+	lagging bool
+}
+
+// oldestKey returns the lowest key of `fork`, without loading any bucket.
+func (bs *buckets) oldestKey(fork ForkName) item.Key {
+	var oldest item.Key
+	bs.tree.Scan(func(key item.Key, buck *bucket) bool {
+		if buck != nil {
+			firstKey, ok := buck.FirstKey(fork)
+			oldest = firstKey
+			return !ok
+		}
+
+		if bs.trailers[trailerKey{Key: key, fork: fork}].TotalEntries > 0 {
+			oldest = key
+			return false
+		}
+
+		return true
+	})
+
+	return oldest
+}
+
+func (bs *buckets) checkLag(watch *lagWatch) {
+	alert := LagAlert{
+		Fork: watch.fork,
+		Len:  bs.len(watch.fork),
+	}
+
+	if alert.Len > 0 {
+		alert.OldestKey = bs.oldestKey(watch.fork)
+	}
+
+	if watch.cond.MaxLen > 0 && alert.Len > watch.cond.MaxLen {
+		alert.Lagging = true
+	}
+
+	if watch.cond.MaxAge > 0 && alert.Len > 0 {
+		var now Key
+		if watch.cond.Now != nil {
+			now = watch.cond.Now()
+		} else {
+			now = Key(time.Now().UnixNano())
+		}
+
+		if now-alert.OldestKey > Key(watch.cond.MaxAge) {
+			alert.Lagging = true
+		}
+	}
+
+	if alert.Lagging == watch.lagging {
+		// only report changes.
+		return
+	}
+
+	watch.lagging = alert.Lagging
+	watch.fn(alert)
+}
+
+// checkLags evaluates all lag conditions. `bs.mu` must be held.
+func (bs *buckets) checkLags() {
+	for _, watch := range bs.lagWatches {
+		bs.checkLag(watch)
+	}
+}
+
+// OnLag registers a lag watch. The returned function removes it again.
+func (bs *buckets) OnLag(fork ForkName, cond LagCondition, fn func(LagAlert)) func() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	watch := &lagWatch{fork: fork, cond: cond, fn: fn}
+	bs.lagWatches = append(bs.lagWatches, watch)
+	bs.checkLag(watch)
+
+	return func() {
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+
+		bs.lagWatches = slices.DeleteFunc(bs.lagWatches, func(candidate *lagWatch) bool {
+			return candidate == watch
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package timeq
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+
+	"github.com/sahib/timeq/item"
+)
+
+// isFull checks if Options.MaxLen or Options.MaxBytes are reached.
+func (bs *buckets) isFull() bool {
+	if maxLen := bs.opts.MaxLen; maxLen > 0 {
+		for _, counter := range bs.lens {
+			if counter.Load() >= int64(maxLen) {
+				return true
+			}
+		}
+	}
+
+	if maxBytes := bs.opts.MaxBytes; maxBytes > 0 && bs.dataSize() >= maxBytes {
+		return true
+	}
+
+	return false
+}
+
+// dataSize returns the size of the data logs of all buckets. Loaded
+// buckets know how much data they hold. For the others the size is
+// remembered when they are closed or the file size is used.
+func (bs *buckets) dataSize() int64 {
+	var total int64
+	bs.tree.Scan(func(key item.Key, buck *bucket) bool {
+		total += bs.bucketSize(key, buck)
+		return true
+	})
+
+	return total
+}
+
+// bucketSize returns the size of the data log of the bucket with `key`.
+// `buck` is nil if the bucket is not loaded.
+func (bs *buckets) bucketSize(key item.Key, buck *bucket) int64 {
+	if buck != nil {
+		return buck.DataSize()
+	}
+
+	size, ok := bs.sizes[key]
+	if !ok {
+		info, err := bs.opts.FS.Stat(filepath.Join(bs.buckPath(key), dataLogName))
+		if err == nil {
+			size = info.Size()
+		}
+
+		bs.cacheSize(key, size)
+	}
+
+	return size
+}
+
+func (bs *buckets) cacheSize(key item.Key, size int64) {
+	if bs.sizes == nil {
+		bs.sizes = make(map[item.Key]int64)
+	}
+
+	bs.sizes[key] = size
+}
+
+// notifyFreed wakes up all PushWait() calls, since there might be room now.
+func (bs *buckets) notifyFreed() {
+	if bs.freed != nil {
+		close(bs.freed)
+		bs.freed = nil
+	}
+}
+
+// PushWait is like Push, but waits until the queue is not full anymore.
+func (bs *buckets) PushWait(ctx context.Context, items item.Items) error {
+	for {
+		bs.mu.Lock()
+		if bs.closing.Load() || bs.frozen || !bs.isFull() {
+			bs.mu.Unlock()
+
+			// NOTE: Someone else might fill the queue in between,
+			// then we just get ErrQueueFull and try again.
+			err := bs.Push(items, true)
+			if !errors.Is(err, ErrQueueFull) {
+				return err
+			}
+
+			continue
+		}
+
+		if bs.freed == nil {
+			bs.freed = make(chan struct{})
+		}
+
+		freed := bs.freed
+		bs.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
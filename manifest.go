@@ -0,0 +1,340 @@
+package timeq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sahib/timeq/index"
+	"github.com/sahib/timeq/item"
+)
+
+const (
+	lenManifestFile   = "len.manifest"
+	lenManifestHeader = "timeq-len-manifest 2"
+	forksFile         = "forks.conf"
+
+	// lenManifestHeaderV1 is the header of manifests without metadata.
+	lenManifestHeaderV1 = "timeq-len-manifest 1"
+
+	clearTombstoneFile   = "clear.tombstone"
+	clearTombstoneHeader = "timeq-clear-tombstone 1"
+
+	userMetaFile   = "meta.kv"
+	userMetaHeader = "timeq-meta 1\n"
+)
+
+// writeLenManifest writes the number of items per bucket and fork to the
+// root directory, so the next Open() does not need to read the trailers of
+// every bucket. Each line has the form "<bucket>\t<fork>\t<count>\t<meta>",
+// where <meta> is the base64 encoded index.Meta of the trailer.
+//
+// It is only written on Close(). The counts of an open queue are kept in
+// memory, since a manifest written in between would be stale after a crash.
+func writeLenManifest(fsys FS, dir string, trailers map[trailerKey]index.Trailer) error {
+	var buf bytes.Buffer
+	buf.WriteString(lenManifestHeader + "\n")
+	for tk, trailer := range trailers {
+		meta, err := trailer.Meta.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(
+			&buf,
+			"%s\t%s\t%d\t%s\n",
+			tk.Key,
+			tk.fork,
+			trailer.TotalEntries,
+			base64.StdEncoding.EncodeToString(meta),
+		)
+	}
+
+	return fsys.WriteFile(filepath.Join(dir, lenManifestFile), buf.Bytes(), 0600)
+}
+
+// readLenManifest reads the manifest written by writeLenManifest() and, if
+// `remove` is true, removes it afterwards. The manifest is only valid until
+// the queue is modified, so it must not be around anymore if we crash. If
+// there is no manifest, nil is returned without an error.
+func readLenManifest(fsys FS, dir string, remove bool) (map[trailerKey]index.Trailer, error) {
+	path := filepath.Join(dir, lenManifestFile)
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if remove {
+		if err := removeAndSyncDir(fsys, path); err != nil {
+			return nil, err
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return nil, errors.New("len manifest: bad header")
+	}
+
+	ncols := 4
+	switch scanner.Text() {
+	case lenManifestHeader:
+	case lenManifestHeaderV1:
+		ncols = 3
+	default:
+		return nil, errors.New("len manifest: bad header")
+	}
+
+	trailers := make(map[trailerKey]index.Trailer)
+	for scanner.Scan() {
+		split := strings.Split(scanner.Text(), "\t")
+		if len(split) != ncols {
+			return nil, fmt.Errorf("len manifest: bad line: %q", scanner.Text())
+		}
+
+		key, err := item.KeyFromString(split[0])
+		if err != nil {
+			return nil, fmt.Errorf("len manifest: bad key: %w", err)
+		}
+
+		count, err := strconv.ParseUint(split[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("len manifest: bad count: %w", err)
+		}
+
+		var meta index.Meta
+		if ncols > 3 {
+			metaData, err := base64.StdEncoding.DecodeString(split[3])
+			if err != nil {
+				return nil, fmt.Errorf("len manifest: bad meta: %w", err)
+			}
+
+			if err := meta.UnmarshalBinary(metaData); err != nil {
+				return nil, fmt.Errorf("len manifest: %w", err)
+			}
+		}
+
+		trailers[trailerKey{
+			Key:  key,
+			fork: ForkName(split[1]),
+		}] = index.Trailer{TotalEntries: item.Off(count), Meta: meta}
+	}
+
+	return trailers, scanner.Err()
+}
+
+// removeAndSyncDir removes `path` and makes sure the removal hit the disk.
+func removeAndSyncDir(fsys FS, path string) error {
+	if err := fsys.Remove(path); err != nil {
+		return err
+	}
+
+	return fsys.SyncDir(filepath.Dir(path))
+}
+
+// writeForks stores the names of all forks, one per line. Forks are also
+// known by their index files in each bucket, but this way they are not
+// forgotten when there are no buckets (e.g. after ClearData()).
+// If there are no forks, the file is removed.
+func writeForks(fsys FS, dir string, forks []ForkName) error {
+	path := filepath.Join(dir, forksFile)
+	if len(forks) == 0 {
+		return filterIsNotExist(fsys.Remove(path))
+	}
+
+	var buf bytes.Buffer
+	for _, fork := range forks {
+		buf.WriteString(string(fork) + "\n")
+	}
+
+	return fsys.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// readForks reads the forks written by writeForks().
+// If there is no such file, no forks and no error is returned.
+func readForks(fsys FS, dir string) ([]ForkName, error) {
+	data, err := fsys.ReadFile(filepath.Join(dir, forksFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var forks []ForkName
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		fork := ForkName(line)
+		if err := fork.Validate(); err != nil {
+			return nil, fmt.Errorf("forks: %w", err)
+		}
+
+		forks = append(forks, fork)
+	}
+
+	return forks, nil
+}
+
+// writeClearTombstone notes that the buckets with `keys` are about to be
+// deleted (and all forks, if `dropForks` is set). The first line is the
+// header, the second says if forks are dropped and each further line is a key.
+func writeClearTombstone(fsys FS, dir string, keys []item.Key, dropForks bool) error {
+	var buf bytes.Buffer
+	buf.WriteString(clearTombstoneHeader + "\n")
+	fmt.Fprintf(&buf, "%v\n", dropForks)
+	for _, key := range keys {
+		buf.WriteString(key.String() + "\n")
+	}
+
+	return fsys.WriteFile(filepath.Join(dir, clearTombstoneFile), buf.Bytes(), 0600)
+}
+
+// finishClear completes a clear that was interrupted by a crash, so that
+// no mix of deleted and live buckets is left. The clear is always rolled
+// forward: all buckets noted in the tombstone are removed completely.
+// `bucketName` is Options.BucketNameConf.Format.
+func finishClear(fsys FS, dir string, bucketName func(item.Key) string) error {
+	path := filepath.Join(dir, clearTombstoneFile)
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 || lines[0] != clearTombstoneHeader {
+		return errors.New("bad tombstone header")
+	}
+
+	dropForks, err := strconv.ParseBool(lines[1])
+	if err != nil {
+		return fmt.Errorf("bad tombstone: %w", err)
+	}
+
+	for _, line := range lines[2:] {
+		key, err := item.KeyFromString(line)
+		if err != nil {
+			return fmt.Errorf("bad tombstone key: %w", err)
+		}
+
+		// the bucket might be partly removed already, so don't be picky:
+		if err := fsys.RemoveAll(filepath.Join(dir, bucketName(key))); err != nil {
+			return err
+		}
+	}
+
+	if dropForks {
+		if err := writeForks(fsys, dir, nil); err != nil {
+			return err
+		}
+	}
+
+	return removeAndSyncDir(fsys, path)
+}
+
+// writeUserMeta stores the metadata set by Queue.SetMeta(). After the header,
+// each entry is the key and the value, both prefixed with their length as
+// big endian uint32. If there is no metadata, the file is removed.
+func writeUserMeta(fsys FS, dir string, meta map[string][]byte) error {
+	path := filepath.Join(dir, userMetaFile)
+	if len(meta) == 0 {
+		if err := filterIsNotExist(fsys.Remove(path)); err != nil {
+			return err
+		}
+
+		return fsys.SyncDir(dir)
+	}
+
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+
+	// keep the output stable:
+	slices.Sort(keys)
+
+	buf := []byte(userMetaHeader)
+	for _, key := range keys {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+		buf = append(buf, key...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(meta[key])))
+		buf = append(buf, meta[key]...)
+	}
+
+	if err := fsys.WriteFile(path, buf, 0600); err != nil {
+		return err
+	}
+
+	// make sure that the rename of WriteFile() hit the disk too:
+	return fsys.SyncDir(dir)
+}
+
+// readUserMeta reads the metadata written by writeUserMeta().
+// If there is no such file, an empty map is returned.
+func readUserMeta(fsys FS, dir string) (map[string][]byte, error) {
+	meta := make(map[string][]byte)
+	data, err := fsys.ReadFile(filepath.Join(dir, userMetaFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return meta, nil
+		}
+
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(userMetaHeader)) {
+		return nil, errors.New("meta: bad header")
+	}
+
+	data = data[len(userMetaHeader):]
+
+	// next returns the next length-prefixed field of `data`:
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+
+		size := binary.BigEndian.Uint32(data)
+		if uint64(len(data)-4) < uint64(size) {
+			return nil, false
+		}
+
+		field := data[4 : 4+size]
+		data = data[4+size:]
+		return field, true
+	}
+
+	for len(data) > 0 {
+		key, ok := next()
+		if !ok {
+			return nil, errors.New("meta: truncated key")
+		}
+
+		val, ok := next()
+		if !ok {
+			return nil, errors.New("meta: truncated value")
+		}
+
+		meta[string(key)] = val
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,134 @@
+package timeq
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memoryCheckInterval limits how often the memory usage is read
+// when Options.MemorySoftLimit is set.
+const memoryCheckInterval = time.Second
+
+// processRSS returns the resident set size of the process, which includes
+// the pages of the memory maps. Without /proc, the memory that the Go
+// runtime got from the OS is used instead.
+func processRSS() int64 {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) > 1 {
+			pages, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.Sys)
+}
+
+// openLimit returns how many buckets may be loaded at the same time.
+// This is Options.MaxParallelOpenBuckets, unless Options.MemorySoftLimit
+// is exceeded. Then the limit is halved, down to a single bucket, and it
+// grows again by one bucket per check once the usage dropped below 3/4
+// of the soft limit.
+func (bs *buckets) openLimit() int {
+	maxBucks := bs.opts.MaxParallelOpenBuckets
+	softLimit := bs.opts.MemorySoftLimit
+	if softLimit <= 0 {
+		return maxBucks
+	}
+
+	now := time.Now()
+	if now.Sub(bs.memChecked) < memoryCheckInterval {
+		return bs.adaptiveLimit
+	}
+
+	bs.memChecked = now
+	switch usage := bs.memUsage(); {
+	case usage > softLimit:
+		bs.adaptiveLimit = max(1, bs.nloaded()/2)
+	case usage < softLimit/4*3 && bs.adaptiveLimit >= 0:
+		bs.adaptiveLimit++
+	}
+
+	if maxBucks >= 0 && (bs.adaptiveLimit < 0 || bs.adaptiveLimit > maxBucks) {
+		bs.adaptiveLimit = maxBucks
+	}
+
+	return bs.adaptiveLimit
+}
+
+// MemoryLimit returns the memory limit of the process in bytes, which is
+// the lower one of GOMEMLIMIT (or debug.SetMemoryLimit()) and memory.max of
+// its cgroup (v2 only) or of one of its parents. Zero means there is no limit.
+func MemoryLimit() int64 {
+	limit := cgroupMemoryLimit("/")
+	if goLimit := debug.SetMemoryLimit(-1); goLimit < math.MaxInt64 && (limit == 0 || goLimit < limit) {
+		limit = goLimit
+	}
+
+	return limit
+}
+
+// cgroupMemoryLimit returns the lowest memory.max of the cgroup of the
+// process and its parents. `root` is prepended to all paths for tests.
+func cgroupMemoryLimit(root string) int64 {
+	data, err := os.ReadFile(filepath.Join(root, "proc/self/cgroup"))
+	if err != nil {
+		return 0
+	}
+
+	// cgroup v2 has a single line like "0::/user.slice/session.scope":
+	var group string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			group = path
+			break
+		}
+	}
+
+	if group == "" {
+		return 0
+	}
+
+	var limit int64
+	for dir := filepath.Clean(group); ; dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(root, "sys/fs/cgroup", dir, "memory.max"))
+		if err == nil {
+			// "max" means no limit and fails to parse:
+			val, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+			if err == nil && (limit == 0 || val < limit) {
+				limit = val
+			}
+		}
+
+		if dir == "/" || dir == "." {
+			return limit
+		}
+	}
+}
+
+// applyMemoryLimit sets MemorySoftLimit to 3/4 of MemoryLimit(), if
+// DetectMemoryLimit is set and MemorySoftLimit is not. This closes cold
+// buckets early enough to stay clear of the hard limit.
+func (o *Options) applyMemoryLimit() {
+	if !o.DetectMemoryLimit || o.MemorySoftLimit > 0 {
+		return
+	}
+
+	if limit := MemoryLimit(); limit > 0 {
+		o.MemorySoftLimit = limit / 4 * 3
+	}
+}
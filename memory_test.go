@@ -0,0 +1,55 @@
+package timeq
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCgroupLimit(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	writeFile := func(path, data string) {
+		path = filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	}
+
+	// no cgroup v2 at all:
+	require.Equal(t, int64(0), cgroupMemoryLimit(root))
+	writeFile("proc/self/cgroup", "4:memory:/old\n")
+	require.Equal(t, int64(0), cgroupMemoryLimit(root))
+
+	// the lowest limit of the cgroup and its parents wins:
+	writeFile("proc/self/cgroup", "4:memory:/old\n0::/app.slice/app.service\n")
+	writeFile("sys/fs/cgroup/app.slice/app.service/memory.max", "max\n")
+	require.Equal(t, int64(0), cgroupMemoryLimit(root))
+	writeFile("sys/fs/cgroup/app.slice/memory.max", "4096\n")
+	require.Equal(t, int64(4096), cgroupMemoryLimit(root))
+	writeFile("sys/fs/cgroup/app.slice/app.service/memory.max", "2048\n")
+	require.Equal(t, int64(2048), cgroupMemoryLimit(root))
+}
+
+func TestMemoryApplyLimit(t *testing.T) {
+	opts := DefaultOptions()
+	opts.applyMemoryLimit()
+	require.Equal(t, int64(0), opts.MemorySoftLimit)
+
+	opts.DetectMemoryLimit = true
+	opts.MemorySoftLimit = 10
+	opts.applyMemoryLimit()
+	require.Equal(t, int64(10), opts.MemorySoftLimit)
+
+	// GOMEMLIMIT counts too, unless the cgroup's limit is lower:
+	oldLimit := debug.SetMemoryLimit(1 << 50)
+	defer debug.SetMemoryLimit(oldLimit)
+
+	opts.MemorySoftLimit = 0
+	opts.applyMemoryLimit()
+	require.Greater(t, opts.MemorySoftLimit, int64(0))
+	require.LessOrEqual(t, opts.MemorySoftLimit, int64(1<<50)/4*3)
+}
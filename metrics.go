@@ -0,0 +1,253 @@
+package timeq
+
+import (
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+// rateWindow is the time span over which rates are calculated.
+const rateWindow = 60
+
+// OpMetrics describes one kind of operation on the queue.
+type OpMetrics struct {
+	// Calls is the number of times the operation was called.
+	Calls uint64
+
+	// Items is the number of items that were processed by all calls.
+	Items uint64
+
+	// ItemsPerSecond is the average rate of processed
+	// items during the last minute (or since opening the queue).
+	ItemsPerSecond float64
+
+	// AvgBatchSize is the average number of items per call.
+	AvgBatchSize float64
+
+	// AvgLatency and MaxLatency describe the time spent in the
+	// operation, including syncing. For Read() this includes the
+	// time spent in the callback.
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+}
+
+// Metrics is a snapshot of the statistics that a queue keeps about itself.
+// All numbers are counted since the queue was opened, except Totals.
+type Metrics struct {
+	// Push covers all calls to Push(), including those in transactions.
+	Push OpMetrics
+
+	// Read covers all calls to Read() of the queue and its forks.
+	// Items only counts the items that were popped.
+	Read OpMetrics
+
+	// Sync covers explicit calls to Sync() and SyncRange().
+	Sync OpMetrics
+
+	// BucketHits is the number of times a bucket was accessed while
+	// it was loaded already.
+	BucketHits uint64
+
+	// BucketsOpened is the number of times a bucket was loaded,
+	// i.e. it was accessed while it was not loaded.
+	BucketsOpened uint64
+
+	// BucketsClosed is the number of times a loaded bucket was closed,
+	// either by eviction or because it was removed.
+	BucketsClosed uint64
+
+	// BucketsEvicted is the number of times a bucket was closed
+	// to stay below Options.MaxParallelOpenBuckets.
+	BucketsEvicted uint64
+
+	// BucketsReopened is the number of times an evicted bucket was loaded
+	// again. If this grows about as fast as BucketsOpened, the buckets are
+	// thrashing and Options.MaxParallelOpenBuckets is likely too low.
+	BucketsReopened uint64
+
+	// BucketsRemoved is the number of buckets that were removed
+	// because they were empty.
+	BucketsRemoved uint64
+
+	// BucketsLoaded is the number of currently loaded buckets.
+	BucketsLoaded int
+
+	// Buckets is the number of currently existing buckets.
+	Buckets int
+
+	// OpenBucketLimit is the number of buckets that may be loaded at the
+	// same time. It is lower than Options.MaxParallelOpenBuckets while
+	// Options.MemorySoftLimit is exceeded. Negative means unlimited.
+	OpenBucketLimit int
+
+	// HandlerErrors is the number of batches that
+	// the handler of RunConsumer() failed to process.
+	HandlerErrors uint64
+
+	// AvgQueueTime and MaxQueueTime describe how long popped items were in
+	// the queue. Only items with a push time are counted, see Options.RecordPushTime.
+	AvgQueueTime time.Duration
+	MaxQueueTime time.Duration
+
+	// Totals are counted since the queue was created, across restarts.
+	// They are written to disk by Maintain() and Close(), so the
+	// operations since then are lost on a crash.
+	Totals Totals
+}
+
+// rateCounter counts events per second in a ring of `rateWindow` slots.
+type rateCounter struct {
+	slots [rateWindow]uint64
+	secs  [rateWindow]int64
+}
+
+func (rc *rateCounter) add(now time.Time, n uint64) {
+	sec := now.Unix()
+	idx := sec % rateWindow
+	if rc.secs[idx] != sec {
+		rc.secs[idx] = sec
+		rc.slots[idx] = 0
+	}
+
+	rc.slots[idx] += n
+}
+
+func (rc *rateCounter) perSecond(now, since time.Time) float64 {
+	sec := now.Unix()
+
+	var sum uint64
+	for idx := range rc.slots {
+		if age := sec - rc.secs[idx]; age >= 0 && age < rateWindow {
+			sum += rc.slots[idx]
+		}
+	}
+
+	window := min(now.Sub(since).Seconds(), rateWindow)
+	return float64(sum) / max(window, 1)
+}
+
+type opCounter struct {
+	calls      uint64
+	items      uint64
+	latencySum time.Duration
+	latencyMax time.Duration
+	rate       rateCounter
+}
+
+func (oc *opCounter) record(start time.Time, nitems int) {
+	now := time.Now()
+	took := now.Sub(start)
+
+	oc.calls++
+	oc.items += uint64(nitems)
+	oc.latencySum += took
+	oc.latencyMax = max(oc.latencyMax, took)
+	oc.rate.add(now, uint64(nitems))
+}
+
+func (oc *opCounter) snapshot(now, since time.Time) OpMetrics {
+	m := OpMetrics{
+		Calls:          oc.calls,
+		Items:          oc.items,
+		ItemsPerSecond: oc.rate.perSecond(now, since),
+		MaxLatency:     oc.latencyMax,
+	}
+
+	if oc.calls > 0 {
+		m.AvgBatchSize = float64(oc.items) / float64(oc.calls)
+		m.AvgLatency = oc.latencySum / time.Duration(oc.calls)
+	}
+
+	return m
+}
+
+// metrics is the mutable state behind Metrics.
+// It is guarded by the lock of buckets.
+type metrics struct {
+	opened time.Time
+	push   opCounter
+	read   opCounter
+	sync   opCounter
+
+	bucketHits      uint64
+	bucketsOpened   uint64
+	bucketsClosed   uint64
+	bucketsEvicted  uint64
+	bucketsReopened uint64
+	bucketsRemoved  uint64
+	handlerErrors   uint64
+
+	// evicted are the keys of evicted buckets that were not loaded again yet.
+	evicted map[item.Key]struct{}
+
+	queueTimeSum   time.Duration
+	queueTimeMax   time.Duration
+	queueTimeCount uint64
+}
+
+// recordQueueTime notes how long the popped `items` were queued.
+func (m *metrics) recordQueueTime(now time.Time, items Items) {
+	for idx := range items {
+		if items[idx].PushedAt.IsZero() {
+			continue
+		}
+
+		took := now.Sub(items[idx].PushedAt)
+		m.queueTimeSum += took
+		m.queueTimeMax = max(m.queueTimeMax, took)
+		m.queueTimeCount++
+	}
+}
+
+func (m *metrics) snapshot() Metrics {
+	now := time.Now()
+	var avgQueueTime time.Duration
+	if m.queueTimeCount > 0 {
+		avgQueueTime = m.queueTimeSum / time.Duration(m.queueTimeCount)
+	}
+
+	return Metrics{
+		Push:            m.push.snapshot(now, m.opened),
+		Read:            m.read.snapshot(now, m.opened),
+		Sync:            m.sync.snapshot(now, m.opened),
+		BucketHits:      m.bucketHits,
+		BucketsOpened:   m.bucketsOpened,
+		BucketsClosed:   m.bucketsClosed,
+		BucketsEvicted:  m.bucketsEvicted,
+		BucketsReopened: m.bucketsReopened,
+		BucketsRemoved:  m.bucketsRemoved,
+		HandlerErrors:   m.handlerErrors,
+		AvgQueueTime:    avgQueueTime,
+		MaxQueueTime:    m.queueTimeMax,
+	}
+}
+
+// recordOpen notes that the bucket `key` was loaded.
+func (m *metrics) recordOpen(key item.Key) {
+	m.bucketsOpened++
+	if _, ok := m.evicted[key]; ok {
+		m.bucketsReopened++
+		delete(m.evicted, key)
+	}
+}
+
+// recordEvict notes that the bucket `key` was closed to make room.
+func (m *metrics) recordEvict(key item.Key) {
+	if m.evicted == nil {
+		m.evicted = make(map[item.Key]struct{})
+	}
+
+	m.evicted[key] = struct{}{}
+	m.bucketsEvicted++
+	m.bucketsClosed++
+}
+
+// recordRemove notes that the bucket `key` was removed.
+func (m *metrics) recordRemove(key item.Key, loaded bool) {
+	if loaded {
+		m.bucketsClosed++
+	}
+
+	delete(m.evicted, key)
+	m.bucketsRemoved++
+}
@@ -0,0 +1,30 @@
+package timeq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRateCounter(t *testing.T) {
+	t.Parallel()
+
+	var rc rateCounter
+	opened := time.Unix(1000, 0)
+
+	// less than a window since opening: divide by elapsed time.
+	rc.add(opened, 100)
+	rc.add(opened.Add(9*time.Second), 100)
+	require.Equal(t, 20.0, rc.perSecond(opened.Add(10*time.Second), opened))
+
+	// old slots drop out of the window and get re-used:
+	now := opened.Add(70 * time.Second)
+	rc.add(now, 60)
+	require.Equal(t, 1.0, rc.perSecond(now, opened))
+	require.Equal(t, 0.0, rc.perSecond(now.Add(time.Hour), opened))
+
+	// nothing processed at all:
+	var empty rateCounter
+	require.Equal(t, 0.0, empty.perSecond(opened, opened))
+}
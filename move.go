@@ -0,0 +1,190 @@
+package timeq
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sahib/timeq/item"
+)
+
+// rangeItem is the location of a single item in the value log.
+type rangeItem struct {
+	Key      item.Key
+	Off, End item.Off
+}
+
+// rangeItems returns where the items of `fork`
+// between `from` and `to` (both including) are.
+func (b *bucket) rangeItems(fork ForkName, from, to item.Key) (items []rangeItem, outErr error) {
+	defer recoverMmapError(&outErr)
+
+	idx, err := b.idxForFork(fork)
+	if err != nil {
+		return nil, err
+	}
+
+	for iter := idx.Mem.Iter(); iter.Next(); {
+		loc := iter.Value()
+		if loc.Key > to {
+			break
+		}
+
+		logIter := b.logAt(loc)
+		for logIter.Next() {
+			it := logIter.Item()
+			if it.Key > to {
+				break
+			}
+
+			if it.Key >= from {
+				off := logIter.CurrentLocation().Off
+				items = append(items, rangeItem{Key: it.Key, Off: off, End: off + it.StorageSize()})
+			}
+		}
+
+		if err := logIter.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return items, nil
+}
+
+// MoveFork hands the items of `src` between `from` and `to` (both including)
+// over to `dst`. See Queue.MoveFork().
+func (b *bucket) MoveFork(src, dst ForkName, from, to item.Key) (nmoved int, outErr error) {
+	defer recoverMmapError(&outErr)
+
+	if b.key > to {
+		return 0, nil
+	}
+
+	srcItems, err := b.rangeItems(src, from, to)
+	if err != nil || len(srcItems) == 0 {
+		return 0, err
+	}
+
+	dstItems, err := b.rangeItems(dst, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := b.unshare(false); err != nil {
+		return 0, err
+	}
+
+	// only add what `dst` does not have already:
+	has := make(map[item.Off]bool, len(dstItems))
+	for _, it := range dstItems {
+		has[it.Off] = true
+	}
+
+	srcItems = slices.DeleteFunc(srcItems, func(it rangeItem) bool {
+		return has[it.Off]
+	})
+
+	slices.SortFunc(srcItems, func(a, b rangeItem) int {
+		return cmp.Compare(a.Off, b.Off)
+	})
+
+	// Items that follow each other in the log with ascending keys
+	// can share a location, just like in restorePosition().
+	var runs []item.Location
+	for idx, it := range srcItems {
+		if n := len(runs); n > 0 && it.Off == srcItems[idx-1].End && it.Key >= srcItems[idx-1].Key {
+			runs[n-1].Len++
+		} else {
+			runs = append(runs, item.Location{Key: it.Key, Off: it.Off, Len: 1})
+		}
+	}
+
+	idx, err := b.idxForFork(dst)
+	if err != nil {
+		return 0, err
+	}
+
+	var pushErr error
+	for _, run := range runs {
+		idx.Mem.Set(run)
+		pushErr = errors.Join(pushErr, idx.Log.Push(run, idx.Mem.Trailer()))
+	}
+
+	if err := errors.Join(pushErr, idx.Log.Sync(false)); err != nil {
+		return 0, fmt.Errorf("move: %s: %w", dst, err)
+	}
+
+	// `src` loses its items only after `dst` has them, so after
+	// a crash in between they are in both rather than in none.
+	nmoved, err = b.Delete(src, from, to)
+	if err != nil {
+		return 0, fmt.Errorf("move: %s: %w", src, err)
+	}
+
+	return nmoved, nil
+}
+
+// MoveFork moves items between forks. See Queue.MoveFork().
+func (bs *buckets) MoveFork(src, dst ForkName, from, to item.Key) (int, error) {
+	if to < from {
+		return 0, fmt.Errorf("move: `to` must be >= `from`")
+	}
+
+	if src == dst {
+		return 0, fmt.Errorf("move: `src` and `dst` must differ")
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return 0, ErrClosed
+	}
+
+	if err := bs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	for _, fork := range []ForkName{src, dst} {
+		if fork != "" && !slices.Contains(bs.forks, fork) {
+			return 0, ErrNoSuchFork
+		}
+	}
+
+	// loading buckets changes the tree, so don't do it while iterating:
+	var buckKeys []item.Key
+	toBuckKey := bs.opts.BucketSplitConf.Func(to)
+	bs.tree.Ascend(bs.opts.BucketSplitConf.Func(from), func(key item.Key, _ *bucket) bool {
+		if key > toBuckKey {
+			return false
+		}
+
+		buckKeys = append(buckKeys, key)
+		return true
+	})
+
+	var nmoved int
+	defer func() {
+		if nmoved > 0 {
+			bs.notifyPushed()
+		}
+	}()
+
+	for _, key := range buckKeys {
+		buck, err := bs.forKey(key)
+		if err != nil {
+			return nmoved, err
+		}
+
+		n, err := buck.MoveFork(src, dst, from, to)
+		bs.recount(key, buck)
+		if err != nil {
+			return nmoved, fmt.Errorf("move: %s: %w", key, err)
+		}
+
+		nmoved += n
+	}
+
+	return nmoved, nil
+}
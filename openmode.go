@@ -0,0 +1,148 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// queueLockFile is locked exclusively by OpenExclusive and shared by all
+	// other modes. writerLockFile is locked exclusively by OpenWriter and
+	// shared by OpenSharedRead, so that readers and a writer only conflict
+	// there. OpenReader does not lock it at all.
+	queueLockFile  = "queue.lock"
+	writerLockFile = "writer.lock"
+)
+
+var (
+	// ErrLocked is returned by Open() if another process (or another Queue
+	// of the same process) opened the queue with a conflicting OpenMode.
+	ErrLocked = errors.New("queue is locked")
+
+	// ErrReadOnly is returned by operations that would modify a queue
+	// that was opened with OpenSharedRead or OpenReader.
+	ErrReadOnly = errors.New("queue is opened read-only")
+)
+
+// queueLock holds the flock(2) locks of an opened queue.
+type queueLock struct {
+	fsys     FS
+	fds      []*os.File
+	readOnly bool
+}
+
+// lockQueue takes the locks of `mode` in `dir`. It does not wait if they
+// are held by someone else, but returns ErrLocked.
+func lockQueue(fsys FS, dir string, mode OpenMode) (*queueLock, error) {
+	var queueHow, writerHow int
+	switch mode {
+	case OpenExclusive:
+		queueHow = unix.LOCK_EX
+	case OpenSharedRead:
+		queueHow, writerHow = unix.LOCK_SH, unix.LOCK_SH
+	case OpenWriter:
+		queueHow, writerHow = unix.LOCK_SH, unix.LOCK_EX
+	case OpenReader:
+		queueHow = unix.LOCK_SH
+	}
+
+	ql := &queueLock{fsys: fsys, readOnly: mode.readOnly()}
+	if err := ql.lock(filepath.Join(dir, queueLockFile), queueHow); err != nil {
+		return nil, err
+	}
+
+	if writerHow != 0 {
+		if err := ql.lock(filepath.Join(dir, writerLockFile), writerHow); err != nil {
+			return nil, errors.Join(err, ql.Unlock())
+		}
+	} else if !ql.readOnly {
+		// create it anyways, so that read-only queues do not have to:
+		fd, err := ql.open(filepath.Join(dir, writerLockFile))
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("lock: %w", err), ql.Unlock())
+		}
+
+		if err := fd.Close(); err != nil {
+			return nil, errors.Join(fmt.Errorf("lock: %w", err), ql.Unlock())
+		}
+	}
+
+	return ql, nil
+}
+
+func (ql *queueLock) lock(path string, how int) error {
+	fd, err := ql.open(path)
+	if err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+
+	if fd == nil {
+		return nil
+	}
+
+	for {
+		err = unix.Flock(int(fd.Fd()), how|unix.LOCK_NB)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+
+	if err != nil {
+		fd.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return fmt.Errorf("%w: %s is opened with a conflicting mode", ErrLocked, filepath.Dir(path))
+		}
+
+		return fmt.Errorf("lock: %w", err)
+	}
+
+	ql.fds = append(ql.fds, fd)
+	return nil
+}
+
+// open opens the lock file at `path` and creates it if needed. Read-only
+// queues only create it if it is missing. On a read-only filesystem nobody
+// can modify the queue, so they go without the lock and a nil file is returned.
+func (ql *queueLock) open(path string) (*os.File, error) {
+	if ql.readOnly {
+		fd, err := ql.fsys.OpenFile(path, os.O_RDONLY, 0)
+		if !errors.Is(err, os.ErrNotExist) {
+			return fd, err
+		}
+	}
+
+	fd, err := ql.fsys.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if ql.readOnly && errors.Is(err, unix.EROFS) {
+		return nil, nil
+	}
+
+	return fd, err
+}
+
+// Unlock releases all locks. Closing the files is enough for that.
+func (ql *queueLock) Unlock() error {
+	var err error
+	for _, fd := range ql.fds {
+		err = errors.Join(err, fd.Close())
+	}
+
+	ql.fds = nil
+	return err
+}
+
+// checkWritable returns an error if the queue may not be modified right now.
+func (bs *buckets) checkWritable() error {
+	if bs.opts.OpenMode.readOnly() {
+		return ErrReadOnly
+	}
+
+	if bs.frozen {
+		return ErrFrozen
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package timeq
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// opID identifies a single Push(), Read() or Shovel() call. It is part of all
+// log lines and errors of that call, so logs of several operations can be
+// told apart.
+type opID struct {
+	name string
+	seq  uint64
+}
+
+func (id opID) String() string {
+	return fmt.Sprintf("%s#%d", id.name, id.seq)
+}
+
+// wrap prefixes `err` with the operation ID.
+func (id opID) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %w", id, err)
+}
+
+// opLogger prefixes all log lines with the ID of the current operation.
+// The current operation is only changed with buckets.mu held, which is also
+// held for everything logged during an operation. Code that logs without
+// the lock should use the wrapped Logger directly.
+type opLogger struct {
+	Logger
+
+	seq  atomic.Uint64
+	curr *opID
+}
+
+func (l *opLogger) Printf(fmtStr string, args ...any) {
+	if l.curr == nil {
+		l.Logger.Printf(fmtStr, args...)
+		return
+	}
+
+	l.Logger.Printf("%s: "+fmtStr, append([]any{l.curr}, args...)...)
+}
+
+// newOp returns a new operation ID. It can be called without lock.
+func (l *opLogger) newOp(name string) opID {
+	return opID{name: name, seq: l.seq.Add(1)}
+}
+
+// enter makes `id` the current operation until the returned func is called.
+// Operations can be nested, e.g. a Push() during a Read().
+func (l *opLogger) enter(id opID) func() {
+	prev := l.curr
+	l.curr = &id
+	return func() {
+		l.curr = prev
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/sahib/timeq/item"
 )
@@ -62,6 +63,152 @@ const (
 	errorModeMax
 )
 
+// IndexStructure selects the in-memory data structure of the bucket indexes.
+type IndexStructure int
+
+func (is IndexStructure) IsValid() bool {
+	return is < indexStructureMax && is >= 0
+}
+
+const (
+	// IndexStructureBTree keeps the index in a b-tree. This works well
+	// for any order of keys and is the default.
+	IndexStructureBTree = IndexStructure(iota)
+
+	// IndexStructureSorted keeps the index in a single sorted array.
+	// This needs less than half the memory per batch and iterates faster,
+	// but pushing keys lower than the highest key in a bucket (or popping
+	// from somewhere else than the front) gets slower with the bucket size.
+	// Use this if your keys are (mostly) ascending, like timestamps.
+	IndexStructureSorted
+
+	// IndexStructureRadix keeps the index in an adaptive radix tree.
+	// It needs about half the memory of the b-tree and iterates faster
+	// for dense keys like timestamps. Unlike IndexStructureSorted, keys
+	// pushed or popped out of order only move the locations of a single
+	// leaf, which holds up to 256 keys.
+	IndexStructureRadix
+
+	indexStructureMax
+)
+
+// OpenMode controls which other processes may open the same queue at the
+// same time. It is enforced with flock(2) on a file in the queue directory,
+// so Open() fails with ErrLocked if the mode conflicts with the modes the
+// queue is already opened with. Locks are held until Close().
+type OpenMode int
+
+func (om OpenMode) IsValid() bool {
+	return om < openModeMax && om >= 0
+}
+
+// readOnly returns true if queues opened with this mode may not be modified.
+func (om OpenMode) readOnly() bool {
+	return om == OpenSharedRead || om == OpenReader
+}
+
+const (
+	// OpenExclusive allows a single process to open the queue. It may read
+	// and modify the queue. This is the default.
+	OpenExclusive = OpenMode(iota)
+
+	// OpenSharedRead allows any number of processes to open the queue
+	// read-only, as long as nobody opened it with OpenExclusive or
+	// OpenWriter. Since nobody can modify the queue, all readers see
+	// the same items until they close it. Operations that would modify
+	// the queue return ErrReadOnly, including popping in Read(). Files are
+	// only opened for reading and mapped read-only, so this also works on
+	// read-only filesystems. Nothing is created, not even the queue itself,
+	// except for lock files that queues of older versions did not have.
+	OpenSharedRead
+
+	// OpenWriter allows a single process to modify the queue while other
+	// processes read it with OpenReader. It behaves like OpenExclusive
+	// otherwise.
+	OpenWriter
+
+	// OpenReader opens the queue read-only like OpenSharedRead, but allows a
+	// single process with OpenWriter at the same time. Readers see the
+	// buckets that existed when they opened the queue and the items that
+	// were in a bucket when they first read from it. Items pushed later to
+	// such a bucket are not visible until the queue is opened again, but
+	// partly written batches are never visible either. Popped items stay
+	// visible, unless the writer removed their bucket before the reader
+	// loaded it, in which case reading the bucket fails.
+	OpenReader
+
+	openModeMax
+)
+
+// VerifyMode selects how thoroughly Open() checks the queue.
+// See Options.VerifyOnOpen.
+type VerifyMode int
+
+func (vm VerifyMode) IsValid() bool {
+	return vm < verifyModeMax && vm >= 0
+}
+
+const (
+	// VerifyOff does not check anything on open. This is the default.
+	// Problems show up once the affected bucket is read.
+	VerifyOff = VerifyMode(iota)
+
+	// VerifyQuick loads every bucket and checks that the cached item counts
+	// match the indexes and that each index only points inside its value
+	// log. The items themselves are not read.
+	VerifyQuick
+
+	// VerifyFull does the same checks as CheckInvariants(), which also reads
+	// every item. This is as expensive as reading the whole queue once.
+	VerifyFull
+
+	verifyModeMax
+)
+
+// IndexFlushPolicy selects when the entries of the index logs are written
+// and synced, relative to the value log. The value log is always written
+// first and synced according to SyncMode. See Options.IndexFlush.
+type IndexFlushPolicy int
+
+func (ifp IndexFlushPolicy) IsValid() bool {
+	return ifp < indexFlushPolicyMax && ifp >= 0
+}
+
+const (
+	// IndexFlushOnPop writes the index entries of every pushed or popped
+	// batch right after the batch. If SyncMode has SyncIndex, the index log
+	// is synced after each pop or delete, which also syncs the entries of
+	// the pushes before it, but not after a push. If the process crashes,
+	// nothing is lost. If the OS crashes or the power fails, the pushes since
+	// the last pop, delete or Sync() might be lost, even with SyncFull. Pops
+	// are not handed out again. This is the default and the only policy that
+	// can be combined with Options.IndexBufferSize, which delays the writes
+	// and therefore loses the buffered entries on any crash.
+	IndexFlushOnPop = IndexFlushPolicy(iota)
+
+	// IndexFlushEveryBatch is like IndexFlushOnPop, but also syncs the index
+	// log after every push. With SyncFull, a batch is on disk once Push() or
+	// Read() returns. This costs one more sync per push and fork.
+	IndexFlushEveryBatch
+
+	// IndexFlushEveryN writes the index entries of every batch like
+	// IndexFlushEveryBatch, but syncs each index log only every
+	// Options.IndexFlushBatches pushed or popped batches. If the process
+	// crashes, nothing is lost. If the OS crashes or the power fails, up to
+	// that many batches per index log are lost: pushed items are gone and
+	// popped items are handed out again. The value log is not affected.
+	IndexFlushEveryN
+
+	// IndexFlushOnSync keeps the index entries in memory and only writes
+	// and syncs them on Sync(), Close(), Maintain() and when an index
+	// checkpoint is written. Any crash loses all batches since then, like
+	// with IndexFlushEveryN. The entries of a bucket take 24 bytes of
+	// memory per batch until then.
+	IndexFlushOnSync
+
+	indexFlushPolicyMax
+)
+
 func WriterLogger(w io.Writer) Logger {
 	return &writerLogger{w: w}
 }
@@ -102,9 +249,19 @@ type Options struct {
 	// Default is the safe SyncFull. Think twice before lowering this.
 	SyncMode SyncMode
 
+	// BucketSyncMode overrides SyncMode for single buckets, if not nil.
+	// It is called with the key of a bucket whenever it is opened (or when
+	// the options are changed) and returns the sync mode for it. This is
+	// useful if fresh items need to be durable, while a backfill of old
+	// items should be fast. An invalid return value falls back to SyncMode.
+	BucketSyncMode func(bucketKey item.Key) SyncMode
+
 	// Logger is used to output some non-critical warnigns or errors that could
 	// have been recovered. By default we print to stderr.
 	// Only warnings or errors are logged, no debug or informal messages.
+	// Messages logged during Push(), Read() and Shovel() are prefixed with
+	// an operation ID like "push#42". Errors returned by them carry the
+	// same prefix, so both can be matched up.
 	Logger Logger
 
 	// ErrorMode defines how non-critical errors are handled.
@@ -126,6 +283,15 @@ type Options struct {
 	//       old data into it.
 	BucketSplitConf BucketSplitConf
 
+	// BucketNameConf defines how the directories of the buckets are named.
+	// By default (zero value) they are named after the key with
+	// DefaultBucketNameConf. TimeBucketNameConf() uses the time instead,
+	// which is easier to navigate for humans if the keys are timestamps.
+	//
+	// NOTE: Like BucketSplitConf, this may not be changed after you opened
+	//       a queue with it. Open() fails with ErrChangedBucketNames then.
+	BucketNameConf BucketNameConf
+
 	// MaxParallelOpenBuckets limits the number of buckets that can be opened
 	// in parallel. Normally, operations like Push() will create more and more
 	// buckets with time and old buckets do not get closed automatically, as
@@ -138,6 +304,239 @@ type Options struct {
 	// If this number is <= 0, then this feature is disabled, which is not
 	// recommended.
 	MaxParallelOpenBuckets int
+
+	// MemorySoftLimit makes the queue load fewer buckets than
+	// MaxParallelOpenBuckets while the resident memory of the process
+	// (including the memory maps of the buckets) is above this many bytes.
+	// The memory is checked at most once per second when a bucket is
+	// loaded. Set it somewhat below the memory limit of the cgroup to
+	// close cold buckets before the process is killed. Zero disables it.
+	MemorySoftLimit int64
+
+	// DetectMemoryLimit sets MemorySoftLimit to 3/4 of the memory limit of
+	// the process on Open(), if it is not set already. See MemoryLimit()
+	// for how the limit is found. Without a limit, nothing is changed.
+	DetectMemoryLimit bool
+
+	// LogPreallocSize makes the value log of each bucket reserve disk space
+	// with fallocate(2) in extents of this size, instead of growing it in
+	// small steps. This lowers fragmentation and the number of resizes of
+	// the memory map during pushes, at the cost of allocating disk space
+	// that might not be used. It only makes sense if your buckets are
+	// rather big. Zero (the default) disables pre-allocation. If the
+	// filesystem does not support fallocate(2), the log is grown normally.
+	// The logical size of the log is kept in the metadata of its index
+	// (idx.meta), so opening the bucket does not need to scan the unused
+	// space; after a crash it is scanned once.
+	LogPreallocSize int64
+
+	// AdviseSequential tells the kernel that the value logs will be read in
+	// mostly sequential order (MADV_SEQUENTIAL). This triggers more aggressive
+	// read-ahead and is a good fit for consumers that drain the queue.
+	AdviseSequential bool
+
+	// AdviseFreeConsumed releases the memory of data that was already
+	// consumed by all forks (MADV_DONTNEED) whenever Maintain() runs, e.g.
+	// via JanitorInterval. The data stays on disk, but does not occupy
+	// memory anymore. This keeps the memory usage flat for long-running
+	// processes with big buckets. Finding the consumed data has to look at
+	// every index entry, which is why it is not done on every pop.
+	AdviseFreeConsumed bool
+
+	// LockActiveBucket locks the memory of the bucket that is currently
+	// being read from (i.e. the one with the lowest key) into RAM via
+	// mlock(2). This avoids read stalls when the kernel evicts pages of the
+	// bucket under memory pressure. Only one bucket is locked at a time,
+	// so choose your bucket size accordingly. Failure to lock the memory
+	// (e.g. due to RLIMIT_MEMLOCK) is logged, but not treated as error.
+	LockActiveBucket bool
+
+	// ReadAhead is the number of bytes of the next bucket that are paged
+	// into memory in the background while the callback of Read() processes
+	// the current one. This hides the page faults of cold buckets behind
+	// the work of the consumer. Only the data is prefetched, the items are
+	// decoded once they are read, as the transaction might push in the
+	// meantime. Zero (the default) disables read-ahead.
+	ReadAhead int64
+
+	// AdviseHugePages asks the kernel to use transparent huge pages
+	// (MADV_HUGEPAGE) for value logs that are bigger than 2MB. This can
+	// lower TLB pressure for big buckets, if the kernel and the filesystem
+	// support huge pages for file mappings (e.g. tmpfs with huge=advise).
+	// Otherwise this option has no effect.
+	AdviseHugePages bool
+
+	// LogDirectIO makes pushes write to the value log with O_DIRECT,
+	// bypassing the page cache. This is useful for write-heavy workloads
+	// where the data is read only much later, so caching it is wasted
+	// memory. Reads still go through the memory map. Small pushes get
+	// slower with this, since each push does a synchronous write to the
+	// device. If the filesystem does not support O_DIRECT, this option
+	// is ignored.
+	LogDirectIO bool
+
+	// MmapIndex keeps the index of each bucket in a sorted snapshot file
+	// (next to the index log) that is memory-mapped and searched directly,
+	// instead of building a b-tree of all batches on the heap. Only the
+	// changes since the last snapshot live on the heap. This costs a bit
+	// more CPU, but lowers memory usage a lot for buckets with many batches.
+	// The snapshot is rewritten on open when the index log grew too much.
+	MmapIndex bool
+
+	// IndexStructure selects the data structure used to hold the index
+	// of each bucket in memory. See IndexStructureSorted and
+	// IndexStructureRadix for the trade-offs.
+	// This can be changed between runs as it only affects memory.
+	IndexStructure IndexStructure
+
+	// IndexCheckpointInterval is the number of entries after which a sorted
+	// snapshot of the index log is written (next to the index log). On open
+	// the snapshot is loaded and only the entries appended after it are
+	// replayed, instead of the whole index log. This makes opening long-lived
+	// buckets a lot faster. Zero disables checkpoints. If MmapIndex is enabled,
+	// snapshots are used anyways, but only written on open without this option.
+	IndexCheckpointInterval int
+
+	// IndexBufferSize makes each index log collect new entries in memory
+	// until they reach this many bytes (24 per entry) before writing them
+	// in one go. This cuts the latency of small pushes and pops, but entries
+	// that were not written yet are lost on a crash: pushed items are not
+	// visible anymore and popped items are handed out again. Entries are
+	// also written on Sync(), Close() and by the janitor. Zero disables it.
+	// It can only be used with IndexFlushOnPop, the other policies decide
+	// on their own when entries are written.
+	IndexBufferSize int
+
+	// IndexFlushInterval writes buffered index entries (see IndexBufferSize)
+	// once the oldest of them is older than this. It is checked on each push
+	// or pop, there is no background flush. Zero only flushes by size.
+	// Like IndexBufferSize, it can only be used with IndexFlushOnPop.
+	IndexFlushInterval time.Duration
+
+	// IndexFlush controls when index entries are written and synced, which
+	// decides what a crash can lose. See IndexFlushPolicy for the levels.
+	// Default is IndexFlushOnPop. Other policies can not be combined with
+	// IndexBufferSize or IndexFlushInterval.
+	IndexFlush IndexFlushPolicy
+
+	// IndexFlushBatches is the number of batches between two syncs of an
+	// index log with IndexFlushEveryN. It has to be positive then.
+	IndexFlushBatches int
+
+	// JanitorInterval enables a background goroutine that does maintenance
+	// work roughly every JanitorInterval (with some random jitter): It enforces
+	// JanitorRetention, removes empty buckets and compacts index logs of
+	// loaded buckets. The goroutine is stopped by Close(). Zero disables it.
+	// You can also do the same work manually by calling Queue.Maintain().
+	JanitorInterval time.Duration
+
+	// JanitorRetention makes the janitor delete items whose key is older
+	// than now minus JanitorRetention for the queue and all forks. This
+	// assumes that your keys are nanosecond timestamps. Zero disables it.
+	JanitorRetention time.Duration
+
+	// OnExpire is called with the items that JanitorRetention is about to
+	// delete, e.g. to archive them elsewhere. It is called once per bucket
+	// for the queue and each fork (with an empty `fork` for the queue). If it
+	// returns an error, the items of this bucket are kept and passed again on
+	// the next run. The items are only valid during the call. It is called
+	// with the queue locked, so it must not use the queue.
+	OnExpire func(fork ForkName, items Items) error
+
+	// ForkExpiry makes the janitor remove forks that were not read for
+	// longer than this (see Fork.LastRead()). A forgotten fork keeps all
+	// data that was pushed after it on disk, as it might still read it.
+	// Each removal is logged. The queue itself never expires. Zero (the
+	// default) keeps forks until they are removed with Fork.Remove().
+	ForkExpiry time.Duration
+
+	// OnForkExpire is called after ForkExpiry removed `fork`, with the time
+	// it was last read. It is called with the queue locked, so it must not
+	// use the queue.
+	OnForkExpire func(fork ForkName, lastRead time.Time)
+
+	// TrimOnClose calls Queue.Trim() on Close(), so that no empty bucket
+	// directories and files of removed forks are left behind on disk.
+	TrimOnClose bool
+
+	// MaxLen limits the number of items in the queue. If the queue or one of
+	// its forks holds MaxLen items or more, Push() returns ErrQueueFull and
+	// PushWait() blocks until consumers made room. A push below the limit is
+	// always accepted, so the queue can exceed the limit by one batch.
+	// Pushes inside a read transaction are not limited. Zero disables it.
+	MaxLen int
+
+	// DiskReserveSize makes the queue allocate a file of this size in its
+	// directory. When an operation fails with ErrDiskFull, the file is
+	// removed, so that consumers can go on popping and thereby free space.
+	// It is created again by Maintain() or the next Open(). Zero disables it.
+	DiskReserveSize int64
+
+	// MaxBytes is like MaxLen, but limits the size of the data logs of all
+	// buckets. Note that the data of a bucket is only freed once all items
+	// of the bucket were consumed. For buckets that were not loaded yet, the
+	// file size is used, which may include preallocated space. Zero disables it.
+	MaxBytes int64
+
+	// RecordPushTime stores the time of each push next to the data of a
+	// bucket, independent of the keys. Read() then sets Item.PushedAt and
+	// Metrics reports how long items were queued. This is useful if the keys
+	// are no timestamps. It costs one small write per push. Changing it only
+	// affects new buckets; existing buckets keep recording push times or not.
+	RecordPushTime bool
+
+	// RecordSequence gives each Push() a sequence number that is one higher
+	// than the one of the push before, even across restarts. It is stored
+	// next to the data like the push times and Read() sets it as Item.Seq,
+	// so consumers can detect gaps or use it as idempotency key. Pushes
+	// in a transaction get a new number too; Reprioritize() loses it.
+	// Changing it only affects new buckets, like RecordPushTime.
+	RecordSequence bool
+
+	// ProfilerLabels sets pprof labels on the calling goroutine during
+	// Push(), Read(), Shovel() and reindexing: "timeq.dir" (the queue directory),
+	// "timeq.op" (the operation) and "timeq.bucket" (the key of the bucket
+	// being worked on). CPU and block profiles of the application then
+	// attribute the time to the queue. Labels that the application set on
+	// the goroutine are removed by these calls, so leave this off if you
+	// use labels yourself.
+	ProfilerLabels bool
+
+	// GroupSessionTimeout removes members of a Group that did not read or
+	// call GroupMember.Buckets() for this long, so their buckets are taken
+	// over by the other members. Zero means that members stay until they
+	// call GroupMember.Leave().
+	GroupSessionTimeout time.Duration
+
+	// FS is used for operations on the directory structure of the queue,
+	// like creating or removing buckets and writing metadata files. This is
+	// mostly useful for tests that want to inject faults. See FS for the
+	// limitations. If nil, OSFS() is used.
+	FS FS
+
+	// OpenMode controls if other processes may open the queue at the same
+	// time and if the queue is read-only. See OpenMode for the guarantees.
+	// It cannot be changed after Open().
+	OpenMode OpenMode
+
+	// VerifyOnOpen makes Open() check all buckets before the queue is used,
+	// so that corruption is found early instead of in the middle of a read.
+	// Cached item counts that do not match the indexes are corrected and
+	// logged. Other problems are logged too and make Open() fail with
+	// ErrCorrupted, unless ErrorMode is ErrorModeContinue. See VerifyMode.
+	VerifyOnOpen VerifyMode
+
+	// Replicas get a copy of every batch given to Push() or PushWait(), after
+	// it was pushed locally. Pops, deletes and other changes are not
+	// replicated, so a replica keeps every pushed item until someone pops it
+	// there. Use it to recover items after losing the local disk.
+	Replicas []Replica
+
+	// MinReplicaAcks is the number of Replicas that need to acknowledge a
+	// batch before Push() returns. If fewer do, a *ReplicationError is
+	// returned. Together with SyncFull, an acknowledged batch survives
+	// the loss of the host. Zero replicates in the background.
+	MinReplicaAcks int
 }
 
 // DefaultOptions give you a set of options that are good to enough to try some
@@ -149,7 +548,9 @@ func DefaultOptions() Options {
 		ErrorMode:              ErrorModeAbort,
 		Logger:                 DefaultLogger(),
 		BucketSplitConf:        DefaultBucketSplitConf,
+		BucketNameConf:         DefaultBucketNameConf,
 		MaxParallelOpenBuckets: 4,
+		FS:                     OSFS(),
 	}
 }
 
@@ -190,6 +591,53 @@ func FixedSizeBucketSplitConf(n uint64) BucketSplitConf {
 	}
 }
 
+// OptionsPatch holds the options that can be changed on an open queue
+// with Queue.SetOptions(). Fields that are nil stay as they are.
+type OptionsPatch struct {
+	// MaxParallelOpenBuckets is like Options.MaxParallelOpenBuckets.
+	// If lowered, buckets are closed right away.
+	MaxParallelOpenBuckets *int
+
+	// SyncMode is like Options.SyncMode. If syncing gets enabled,
+	// the data that was written before is synced right away.
+	SyncMode *SyncMode
+
+	// Logger is like Options.Logger.
+	Logger Logger
+}
+
+// apply returns a copy of `opts` with the patch applied.
+func (p OptionsPatch) apply(opts Options) Options {
+	if p.MaxParallelOpenBuckets != nil {
+		opts.MaxParallelOpenBuckets = *p.MaxParallelOpenBuckets
+	}
+
+	if p.SyncMode != nil {
+		opts.SyncMode = *p.SyncMode
+	}
+
+	if p.Logger != nil {
+		opts.Logger = p.Logger
+	}
+
+	return opts
+}
+
+// bucketSyncMode returns the sync mode of the bucket with `key`.
+func (o *Options) bucketSyncMode(key item.Key) SyncMode {
+	if o.BucketSyncMode == nil {
+		return o.SyncMode
+	}
+
+	mode := o.BucketSyncMode(key)
+	if !mode.IsValid() {
+		o.Logger.Printf("bucket %s: invalid sync mode %d, using %d", key, mode, o.SyncMode)
+		return o.SyncMode
+	}
+
+	return mode
+}
+
 func (o *Options) Validate() error {
 	if o.Logger == nil {
 		// this allows us to leave out quite some null checks when
@@ -197,6 +645,10 @@ func (o *Options) Validate() error {
 		o.Logger = NullLogger()
 	}
 
+	if o.FS == nil {
+		o.FS = OSFS()
+	}
+
 	if !o.SyncMode.IsValid() {
 		return errors.New("invalid sync mode")
 	}
@@ -205,10 +657,78 @@ func (o *Options) Validate() error {
 		return errors.New("invalid error mode")
 	}
 
+	if !o.OpenMode.IsValid() {
+		return errors.New("invalid open mode")
+	}
+
+	if !o.IndexStructure.IsValid() {
+		return errors.New("invalid index structure")
+	}
+
+	if !o.VerifyOnOpen.IsValid() {
+		return errors.New("invalid verify mode")
+	}
+
 	if o.BucketSplitConf.Func == nil {
 		return errors.New("bucket func is not allowed to be empty")
 	}
 
+	if o.BucketNameConf.Format == nil && o.BucketNameConf.Parse == nil {
+		o.BucketNameConf = DefaultBucketNameConf
+	}
+
+	if o.BucketNameConf.Format == nil || o.BucketNameConf.Parse == nil || o.BucketNameConf.Name == "" {
+		return errors.New("bucket name conf needs a format and parse func and a name")
+	}
+
+	if o.JanitorInterval < 0 || o.JanitorRetention < 0 {
+		return errors.New("janitor interval and retention may not be negative")
+	}
+
+	if o.ForkExpiry < 0 {
+		return errors.New("fork expiry may not be negative")
+	}
+
+	if o.IndexCheckpointInterval < 0 {
+		return errors.New("index checkpoint interval may not be negative")
+	}
+
+	if o.IndexBufferSize < 0 || o.IndexFlushInterval < 0 {
+		return errors.New("index buffer size and flush interval may not be negative")
+	}
+
+	if !o.IndexFlush.IsValid() {
+		return errors.New("invalid index flush policy")
+	}
+
+	if o.IndexFlush == IndexFlushEveryN && o.IndexFlushBatches <= 0 {
+		return errors.New("index flush batches must be positive with IndexFlushEveryN")
+	}
+
+	if o.IndexFlush != IndexFlushOnPop && (o.IndexBufferSize > 0 || o.IndexFlushInterval > 0) {
+		return errors.New("index buffer size and flush interval only work with IndexFlushOnPop")
+	}
+
+	if o.LogPreallocSize < 0 {
+		return errors.New("log prealloc size may not be negative")
+	}
+
+	if o.DiskReserveSize < 0 {
+		return errors.New("disk reserve size may not be negative")
+	}
+
+	if o.MinReplicaAcks < 0 || o.MinReplicaAcks > len(o.Replicas) {
+		return errors.New("min replica acks must be between zero and the number of replicas")
+	}
+
+	if o.MemorySoftLimit < 0 {
+		return errors.New("memory soft limit may not be negative")
+	}
+
+	if o.MaxLen < 0 || o.MaxBytes < 0 {
+		return errors.New("max len and max bytes may not be negative")
+	}
+
 	if o.MaxParallelOpenBuckets == 0 {
 		// For the outside, that's the same thing, but closeUnused() internally
 		// actually knows how to keep the number of buckets to zero, so be clear
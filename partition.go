@@ -0,0 +1,279 @@
+package timeq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const partitionConfFile = "partitions.conf"
+
+// ErrChangedPartitions is returned by OpenPartitioned() if the queue
+// was created with a different number of partitions.
+var ErrChangedPartitions = errors.New("number of partitions changed")
+
+// PartitionFunc returns the partition of `it`, between 0 and n-1.
+// The blob of `it` is only valid during the call.
+type PartitionFunc func(it Item, n int) int
+
+// HashPartition returns a PartitionFunc that hashes what `id` returns for an
+// item, e.g. a tenant ID in a header of the blob. Items with the same ID
+// always go to the same partition, so they keep their order.
+func HashPartition(id func(it Item) []byte) PartitionFunc {
+	return func(it Item, n int) int {
+		h := fnv.New32a()
+		h.Write(id(it))
+		return int(h.Sum32() % uint32(n))
+	}
+}
+
+// PartitionedQueue is a logical queue that is split into several queues
+// (partitions) by a PartitionFunc. The order of items is kept per partition,
+// but not across partitions. Each partition is a normal Queue with its own
+// lock, so one consumer per partition can read in parallel.
+type PartitionedQueue struct {
+	partitions []*Queue
+	partition  PartitionFunc
+}
+
+// OpenPartitioned opens (or creates) a queue with `n` partitions in `dir`.
+// Each partition is a Queue in a sub-directory, opened with `opts`. The
+// number of partitions cannot be changed later; ErrChangedPartitions is
+// returned then. Shovel() the items to a new queue to change it.
+func OpenPartitioned(dir string, n int, partition PartitionFunc, opts Options) (*PartitionedQueue, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("number of partitions must be > 0: %d", n)
+	}
+
+	if partition == nil {
+		return nil, errors.New("partition func must be set")
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := checkPartitionConf(opts.FS, dir, n, !opts.OpenMode.readOnly()); err != nil {
+		return nil, err
+	}
+
+	pq := &PartitionedQueue{partition: partition}
+	for idx := 0; idx < n; idx++ {
+		queue, err := Open(filepath.Join(dir, fmt.Sprintf("p%d", idx)), opts)
+		if err != nil {
+			return nil, errors.Join(
+				fmt.Errorf("partition %d: %w", idx, err),
+				pq.Close(),
+			)
+		}
+
+		pq.partitions = append(pq.partitions, queue)
+	}
+
+	return pq, nil
+}
+
+// checkPartitionConf makes sure that the queue in `dir` has `n` partitions.
+// The conf is written if it is missing and `write` is true.
+func checkPartitionConf(fsys FS, dir string, n int, write bool) error {
+	path := filepath.Join(dir, partitionConfFile)
+	data, err := fsys.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if !write {
+			return nil
+		}
+
+		if err := fsys.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+
+		return fsys.WriteFile(path, []byte(strconv.Itoa(n)), 0600)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	current := string(bytes.TrimSpace(data))
+	if current != strconv.Itoa(n) {
+		return fmt.Errorf(
+			"%w: queue has »%s« partitions but %d are configured",
+			ErrChangedPartitions,
+			current,
+			n,
+		)
+	}
+
+	return nil
+}
+
+// Push sorts `items` into their partitions and pushes them there. If pushing
+// to a partition fails, the items of the other partitions might be pushed
+// already. Items for which the PartitionFunc returns an invalid partition
+// fail the whole push before anything was pushed.
+func (pq *PartitionedQueue) Push(items Items) error {
+	n := len(pq.partitions)
+	batches := make([]Items, n)
+	for _, it := range items {
+		idx := pq.partition(it, n)
+		if idx < 0 || idx >= n {
+			return fmt.Errorf("partition func returned %d for %v (want 0-%d)", idx, it.Key, n-1)
+		}
+
+		batches[idx] = append(batches[idx], it)
+	}
+
+	for idx, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+
+		if err := pq.partitions[idx].Push(batch); err != nil {
+			return fmt.Errorf("partition %d: %w", idx, err)
+		}
+	}
+
+	return nil
+}
+
+// Partition returns the queue of the partition `idx`, e.g. to consume it.
+// It panics if `idx` is not between 0 and NumPartitions()-1.
+func (pq *PartitionedQueue) Partition(idx int) *Queue {
+	return pq.partitions[idx]
+}
+
+// NumPartitions returns the number of partitions.
+func (pq *PartitionedQueue) NumPartitions() int {
+	return len(pq.partitions)
+}
+
+// Len returns the number of items in all partitions.
+func (pq *PartitionedQueue) Len() int {
+	var total int
+	for _, queue := range pq.partitions {
+		total += queue.Len()
+	}
+
+	return total
+}
+
+// Close closes all partitions.
+func (pq *PartitionedQueue) Close() error {
+	var err error
+	for idx, queue := range pq.partitions {
+		if closeErr := queue.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("partition %d: %w", idx, closeErr))
+		}
+	}
+
+	return err
+}
+
+// orderedTx is the Transaction of ReadOrdered().
+type orderedTx struct {
+	pq    *PartitionedQueue
+	stats ReadStats
+}
+
+func (tx *orderedTx) Push(items Items) error {
+	return tx.pq.Push(items)
+}
+
+func (tx *orderedTx) Stats() ReadStats {
+	return tx.stats
+}
+
+// ReadOrdered reads up to `n` items of all partitions in key order, as if
+// they were a single queue. This is useful for the odd consumer that needs
+// the global order. Unlike Queue.Read(), `fn` is called at most once and the
+// items are copies. Popped items are removed from their partitions after
+// `fn` returned, so ReadOrdered should be the only consumer of the
+// partitions while it runs. Only ReadStats.Bytes is set in the transaction.
+func (pq *PartitionedQueue) ReadOrdered(n int, fn TransactionFn) error {
+	heads := make([]Items, len(pq.partitions))
+	for idx, queue := range pq.partitions {
+		items, err := peekFirst(queue, n)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", idx, err)
+		}
+
+		heads[idx] = items
+	}
+
+	merged, taken := mergeOrdered(heads, n)
+	if len(merged) == 0 {
+		return nil
+	}
+
+	tx := &orderedTx{pq: pq, stats: ReadStats{Bytes: int64(merged.StorageSize())}}
+	op, err := fn(tx, merged)
+	if err != nil || op != ReadOpPop {
+		return err
+	}
+
+	for idx, count := range taken {
+		if count == 0 {
+			continue
+		}
+
+		if err := pq.partitions[idx].buckets.popDelivered("", heads[idx][:count]); err != nil {
+			return fmt.Errorf("partition %d: %w", idx, err)
+		}
+	}
+
+	return nil
+}
+
+// peekFirst returns copies of the first `n` items of `queue`.
+// A negative `n` returns all of them.
+func peekFirst(queue *Queue, n int) (Items, error) {
+	var items Items
+	err := queue.Read(n, func(_ Transaction, peeked Items) (ReadOp, error) {
+		// Read() goes on with the next buckets when peeking:
+		if n < 0 || len(items) < n {
+			items = append(items, peeked.Copy()...)
+		}
+
+		return ReadOpPeek, nil
+	})
+
+	if n >= 0 && len(items) > n {
+		items = items[:n]
+	}
+
+	return items, err
+}
+
+// mergeOrdered merges the sorted `lists` into one sorted list of up to `n`
+// items (all if negative). It also returns how many items of each list
+// were taken. Items with the same key are taken from lower lists first.
+func mergeOrdered(lists []Items, n int) (Items, []int) {
+	taken := make([]int, len(lists))
+	var merged Items
+	for n < 0 || len(merged) < n {
+		// there are only few partitions; no need for a heap:
+		best := -1
+		for idx, list := range lists {
+			if taken[idx] >= len(list) {
+				continue
+			}
+
+			if best < 0 || list[taken[idx]].Key < lists[best][taken[best]].Key {
+				best = idx
+			}
+		}
+
+		if best < 0 {
+			break
+		}
+
+		merged = append(merged, lists[best][taken[best]])
+		taken[best]++
+	}
+
+	return merged, taken
+}
@@ -0,0 +1,45 @@
+package timeq
+
+// SetReadsPaused pauses or resumes Read() for `fork`.
+// While paused, Read() returns immediately without calling its callback.
+// Since it takes the lock, no read of `fork` is running when this returns.
+func (bs *buckets) SetReadsPaused(fork ForkName, paused bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if !paused {
+		delete(bs.paused, fork)
+		return
+	}
+
+	if bs.paused == nil {
+		bs.paused = make(map[ForkName]bool)
+	}
+
+	bs.paused[fork] = true
+}
+
+// ReadsPaused returns true if reads of `fork` are paused.
+func (bs *buckets) ReadsPaused(fork ForkName) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.paused[fork]
+}
+
+// SetFrozen makes the queue read-only or undoes it.
+// Since it takes the lock, no write is running when this returns.
+func (bs *buckets) SetFrozen(frozen bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.frozen = frozen
+}
+
+// Frozen returns true if the queue is read-only.
+func (bs *buckets) Frozen() bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return bs.frozen
+}
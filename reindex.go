@@ -0,0 +1,102 @@
+package timeq
+
+import (
+	"fmt"
+
+	"github.com/sahib/timeq/index"
+	"github.com/sahib/timeq/item"
+)
+
+// Reindex rebuilds the indexes of all forks from the value log,
+// like it happens on open when an index is damaged.
+func (b *bucket) Reindex() (outErr error) {
+	defer recoverMmapError(&outErr)
+
+	if err := b.unshare(false); err != nil {
+		return err
+	}
+
+	for fork, idx := range b.indexes {
+		mem, err := index.FromVlog(b.log, indexKind(b.opts.IndexStructure))
+		if err != nil {
+			return fmt.Errorf("%s: %w", fork, err)
+		}
+
+		oldMem := idx.Mem
+		if err := b.rewriteIndex(fork, idx, mem); err != nil {
+			return fmt.Errorf("%s: %w", fork, err)
+		}
+
+		if err := oldMem.Close(); err != nil {
+			return fmt.Errorf("%s: %w", fork, err)
+		}
+	}
+
+	return nil
+}
+
+// ReindexBucket rebuilds the indexes of the bucket
+// that `key` belongs to. See Queue.ReindexBucket().
+func (bs *buckets) ReindexBucket(key item.Key) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if err := bs.checkReindex(); err != nil {
+		return err
+	}
+
+	defer bs.labelOp("reindex")()
+
+	key = bs.opts.BucketSplitConf.Func(key)
+	if _, ok := bs.tree.Get(key); !ok {
+		return fmt.Errorf("no bucket with key %v", key)
+	}
+
+	return bs.reindex(key)
+}
+
+// ReindexAll rebuilds the indexes of all buckets. See Queue.ReindexAll().
+func (bs *buckets) ReindexAll() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if err := bs.checkReindex(); err != nil {
+		return err
+	}
+
+	defer bs.labelOp("reindex")()
+
+	for _, key := range bs.bucketKeys() {
+		if err := bs.reindex(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (bs *buckets) checkReindex() error {
+	if bs.closing.Load() {
+		return ErrClosed
+	}
+
+	return bs.checkWritable()
+}
+
+func (bs *buckets) reindex(key item.Key) error {
+	defer bs.labelBucket(key)()
+
+	buck, err := bs.forKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = buck.Reindex()
+	bs.recount(key, buck)
+	if err != nil {
+		return fmt.Errorf("reindex: %s: %w", key, err)
+	}
+
+	bs.notifyPushed()
+	return nil
+}
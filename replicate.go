@@ -0,0 +1,125 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sahib/timeq/item"
+)
+
+// Replica receives a copy of every batch that is pushed to the queue.
+// See Options.Replicas. ipc.Client implements it, so a queue that is
+// served by ipc.Server on another host can be used as replica.
+type Replica interface {
+	Push(items Items) error
+}
+
+// FencedReplica is a Replica that gets the epoch of the primary with every
+// batch, so it can reject batches of a primary that was replaced by a newer
+// one. See Queue.Promote(). Queue and ipc.Client implement it.
+type FencedReplica interface {
+	Replica
+	PushReplicated(epoch uint64, items Items) error
+}
+
+// Check that Queue can be used as fenced replica.
+var _ FencedReplica = &Queue{}
+
+// ErrReplication can be checked with errors.Is() on a *ReplicationError.
+var ErrReplication = errors.New("not enough replicas acknowledged")
+
+// ReplicationError is returned by Push() if less than
+// Options.MinReplicaAcks replicas acknowledged the batch.
+// The batch was pushed to the local queue nevertheless.
+type ReplicationError struct {
+	// Acks is the number of replicas that acknowledged the batch.
+	Acks int
+
+	// Needed is Options.MinReplicaAcks.
+	Needed int
+
+	// Err are the errors of the failed replicas.
+	Err error
+}
+
+func (e *ReplicationError) Error() string {
+	return fmt.Sprintf("replication: %d of %d needed acks: %v", e.Acks, e.Needed, e.Err)
+}
+
+func (e *ReplicationError) Unwrap() []error {
+	return []error{ErrReplication, e.Err}
+}
+
+// replication is what replicate() needs from the options. It is taken
+// while bs.mu is held, as the options might change once it is released.
+type replication struct {
+	replicas []Replica
+	needed   int
+	epoch    uint64
+	logger   Logger
+}
+
+// replication returns the current replication settings. bs.mu must be held.
+// The logger is not bs.opLog, which is only safe to use with bs.mu held.
+func (bs *buckets) replication() replication {
+	return replication{
+		replicas: bs.opts.Replicas,
+		needed:   bs.opts.MinReplicaAcks,
+		epoch:    bs.epoch,
+		logger:   bs.opLog.Logger,
+	}
+}
+
+// replicate pushes `items` to all replicas and returns once
+// Options.MinReplicaAcks of them acknowledged it.
+func (r replication) replicate(items item.Items) error {
+	replicas, needed := r.replicas, r.needed
+	if len(replicas) == 0 {
+		return nil
+	}
+
+	if len(replicas) > needed {
+		// the slower replicas might still push after we returned,
+		// but the caller is free to re-use `items` then.
+		items = items.Copy()
+	}
+
+	results := make(chan error, len(replicas))
+	for idx, replica := range replicas {
+		go func(idx int, replica Replica) {
+			var err error
+			if fenced, ok := replica.(FencedReplica); ok {
+				err = fenced.PushReplicated(r.epoch, items)
+			} else {
+				err = replica.Push(items)
+			}
+
+			if err != nil {
+				r.logger.Printf("replica #%d: %v", idx, err)
+			}
+
+			results <- err
+		}(idx, replica)
+	}
+
+	if needed == 0 {
+		return nil
+	}
+
+	// On failure, wait for all replicas, so that Acks is exact.
+	var acks int
+	var errs error
+	for range replicas {
+		if err := <-results; err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+
+		acks++
+		if acks >= needed {
+			return nil
+		}
+	}
+
+	return &ReplicationError{Acks: acks, Needed: needed, Err: errs}
+}
@@ -0,0 +1,181 @@
+// Package retry processes items of a queue and retries failed items later.
+//
+// Keys are expected to be timestamps in nanoseconds. If processing an item
+// fails, it is pushed again with the key now+backoff(attempt), so it is only
+// processed again once that time has come. The number of attempts is stored
+// in a small header in front of the blob. After MaxAttempts failed attempts,
+// the item is pushed to a dead letter queue (or dropped, if there is none).
+//
+// Items without header (i.e. pushed directly by the producer) are at their
+// first attempt. Blobs of new items should not start with Magic, otherwise
+// they are mistaken for retried items.
+package retry
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sahib/timeq"
+)
+
+// Magic is the start of the header of retried items.
+const Magic = "\x00tqr"
+
+// Wrap returns `payload` with a header that stores `attempt`.
+func Wrap(payload []byte, attempt int) []byte {
+	buf := make([]byte, 0, len(Magic)+binary.MaxVarintLen64+len(payload))
+	buf = append(buf, Magic...)
+	buf = binary.AppendUvarint(buf, uint64(attempt))
+	return append(buf, payload...)
+}
+
+// Unwrap returns the attempt stored in the header of `blob` and the payload.
+// If `blob` has no header, it returns 0 and `blob` unchanged.
+func Unwrap(blob []byte) (attempt int, payload []byte) {
+	if len(blob) < len(Magic) || string(blob[:len(Magic)]) != Magic {
+		return 0, blob
+	}
+
+	n, size := binary.Uvarint(blob[len(Magic):])
+	if size <= 0 {
+		return 0, blob
+	}
+
+	return int(n), blob[len(Magic)+size:]
+}
+
+// Exponential returns a backoff that starts with `base` and doubles with
+// every attempt, but never goes above `max`.
+func Exponential(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		backoff := base
+		for idx := 1; idx < attempt && backoff < max; idx++ {
+			backoff *= 2
+		}
+
+		if backoff > max {
+			return max
+		}
+
+		return backoff
+	}
+}
+
+// Options configure Process().
+type Options struct {
+	// MaxAttempts is the number of times an item is processed before it
+	// is given up on. Defaults to 5.
+	MaxAttempts int
+
+	// Backoff returns how long to wait before the next attempt. `attempt` is
+	// the number of failed attempts so far, starting at 1.
+	// Defaults to Exponential(time.Second, time.Hour).
+	Backoff func(attempt int) time.Duration
+
+	// DeadLetter receives items that failed MaxAttempts times. The blob
+	// still has its header, so Unwrap() tells how often it was tried.
+	// If nil, those items are dropped. It must not be the queue that is processed.
+	DeadLetter *timeq.Queue
+
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (opts *Options) setDefaults() {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+
+	if opts.Backoff == nil {
+		opts.Backoff = Exponential(time.Second, time.Hour)
+	}
+
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+}
+
+// Handler processes a single item. `it.Blob` is the payload without header
+// and only valid during the call. `attempt` starts at 0.
+type Handler func(it timeq.Item, attempt int) error
+
+// errNotDue stops reading once only items in the future are left.
+var errNotDue = errors.New("no items due")
+
+// Process pops up to `n` items of `c` whose key lies not in the future and
+// calls `fn` for each of them. Items for which `fn` fails are pushed again
+// for a later attempt or to the dead letter queue. It returns the number of
+// items that were processed successfully.
+//
+// Retries are pushed with timeq.Transaction.Push(), i.e. to the queue and all
+// of its forks. Use a queue without forks. Items are removed only after `fn`
+// was called for all items of a batch, so a crash in between processes them
+// again (i.e. at least once).
+func Process(c timeq.Consumer, n int, opts Options, fn Handler) (int, error) {
+	opts.setDefaults()
+
+	var nprocessed int
+	err := c.Read(n, func(tx timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+		now := opts.Now()
+		nowKey := timeq.Key(now.UnixNano())
+
+		ndue := len(items)
+		for idx, it := range items {
+			if it.Key > nowKey {
+				ndue = idx
+				break
+			}
+		}
+
+		if ndue == 0 {
+			return timeq.ReadOpPeek, errNotDue
+		}
+
+		var retries, dead timeq.Items
+		var nsucceeded int
+		for _, it := range items[:ndue] {
+			attempt, payload := Unwrap(it.Blob)
+			if err := fn(timeq.Item{Key: it.Key, Blob: payload}, attempt); err == nil {
+				nsucceeded++
+				continue
+			}
+
+			attempt++
+			if attempt >= opts.MaxAttempts {
+				dead = append(dead, timeq.Item{Key: it.Key, Blob: Wrap(payload, attempt)})
+				continue
+			}
+
+			retries = append(retries, timeq.Item{
+				Key:  timeq.Key(now.Add(opts.Backoff(attempt)).UnixNano()),
+				Blob: Wrap(payload, attempt),
+			})
+		}
+
+		// the items that are not due yet are popped too, so push them back:
+		for _, it := range items[ndue:] {
+			retries = append(retries, it.Copy())
+		}
+
+		if len(dead) > 0 && opts.DeadLetter != nil {
+			if err := opts.DeadLetter.Push(dead); err != nil {
+				return timeq.ReadOpPeek, fmt.Errorf("dead letter: %w", err)
+			}
+		}
+
+		if err := tx.Push(retries); err != nil {
+			return timeq.ReadOpPeek, fmt.Errorf("retry: %w", err)
+		}
+
+		nprocessed += nsucceeded
+		return timeq.ReadOpPop, nil
+	})
+
+	if errors.Is(err, errNotDue) {
+		return nprocessed, nil
+	}
+
+	return nprocessed, err
+}
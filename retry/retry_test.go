@@ -0,0 +1,106 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sahib/timeq"
+	"github.com/sahib/timeq/timeqtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapUnwrap(t *testing.T) {
+	attempt, payload := Unwrap([]byte("plain"))
+	require.Equal(t, 0, attempt)
+	require.Equal(t, "plain", string(payload))
+
+	attempt, payload = Unwrap(Wrap([]byte("retried"), 300))
+	require.Equal(t, 300, attempt)
+	require.Equal(t, "retried", string(payload))
+
+	attempt, payload = Unwrap(Wrap(nil, 1))
+	require.Equal(t, 1, attempt)
+	require.Empty(t, payload)
+}
+
+func TestExponential(t *testing.T) {
+	backoff := Exponential(time.Second, 10*time.Second)
+	require.Equal(t, time.Second, backoff(1))
+	require.Equal(t, 2*time.Second, backoff(2))
+	require.Equal(t, 8*time.Second, backoff(4))
+	require.Equal(t, 10*time.Second, backoff(5))
+	require.Equal(t, 10*time.Second, backoff(1000))
+}
+
+func TestProcess(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	dlq := timeqtest.TempQueue(t)
+	require.NoError(t, timeqtest.FillSequential(queue, 10))
+
+	now := time.Unix(0, 100)
+	opts := Options{
+		MaxAttempts: 3,
+		Backoff:     func(int) time.Duration { return 10 },
+		DeadLetter:  dlq,
+		Now:         func() time.Time { return now },
+	}
+
+	// the key changes on retries, so use the blob to identify the items:
+	attempts := map[string][]int{}
+	handler := func(it timeq.Item, attempt int) error {
+		attempts[string(it.Blob)] = append(attempts[string(it.Blob)], attempt)
+		if it.Blob[0]%2 == 1 {
+			return errors.New("odd")
+		}
+
+		return nil
+	}
+
+	n, err := Process(queue, 100, opts, handler)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, 5, queue.Len())
+
+	// the retries are not due yet:
+	n, err = Process(queue, 100, opts, handler)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 5, queue.Len())
+
+	now = time.Unix(0, 110)
+	n, err = Process(queue, 100, opts, handler)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 5, queue.Len())
+
+	now = time.Unix(0, 120)
+	n, err = Process(queue, 100, opts, handler)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, queue.Len())
+
+	require.Equal(t, []int{0}, attempts["0"])
+	require.Equal(t, []int{0, 1, 2}, attempts["1"])
+
+	dead, err := timeqtest.Drain(dlq)
+	require.NoError(t, err)
+	require.Len(t, dead, 5)
+	for idx, it := range dead {
+		attempt, payload := Unwrap(it.Blob)
+		require.Equal(t, 3, attempt)
+		require.Equal(t, timeqtest.Sequential(2*idx+1, 1)[0].Blob, payload)
+	}
+}
+
+func TestProcessPartiallyDue(t *testing.T) {
+	queue := timeqtest.TempQueue(t)
+	require.NoError(t, timeqtest.FillSequential(queue, 10))
+
+	opts := Options{Now: func() time.Time { return time.Unix(0, 4) }}
+	n, err := Process(queue, 100, opts, func(timeq.Item, int) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+
+	timeqtest.AssertDrainsTo(t, queue, timeqtest.Sequential(5, 5))
+}
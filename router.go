@@ -0,0 +1,109 @@
+package timeq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNoRoute is returned by Router if an item has no destination.
+var ErrNoRoute = errors.New("no destination for item")
+
+// Router splits the items of one queue (or fork) into several destination
+// queues, e.g. to split a firehose into one queue per team. Items are pushed
+// to their destination before they are popped from the source, so a crash in
+// between leads to duplicates in the destinations, but does not lose items.
+type Router struct {
+	// Route returns the name of the destination of `it`.
+	// The blob of `it` is only valid during the call.
+	Route func(it Item) string
+
+	// Destinations maps the names returned by Route to queues.
+	// The source queue must not be one of them.
+	Destinations map[string]*Queue
+
+	// Fallback receives items whose name is not in Destinations. If it is
+	// nil, routing fails with ErrNoRoute and the items stay in the source.
+	Fallback *Queue
+}
+
+func (r *Router) destination(it Item) (*Queue, error) {
+	name := r.Route(it)
+	if dst, ok := r.Destinations[name]; ok {
+		return dst, nil
+	}
+
+	if r.Fallback != nil {
+		return r.Fallback, nil
+	}
+
+	return nil, fmt.Errorf("%w: %v routed to %q", ErrNoRoute, it.Key, name)
+}
+
+// push pushes each item of `items` to its destination.
+func (r *Router) push(src *buckets, items Items) error {
+	batches := make(map[*Queue]Items)
+	var order []*Queue
+	for _, it := range items {
+		dst, err := r.destination(it)
+		if err != nil {
+			return err
+		}
+
+		if dst.buckets == src {
+			// would deadlock, as the source is locked while reading.
+			return errors.New("router: source is used as destination")
+		}
+
+		if _, ok := batches[dst]; !ok {
+			order = append(order, dst)
+		}
+
+		batches[dst] = append(batches[dst], it)
+	}
+
+	for _, dst := range order {
+		if err := dst.Push(batches[dst]); err != nil {
+			return fmt.Errorf("router: push: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// RouteBatch moves up to `n` items of `src` to their destinations and
+// returns the number of moved items. If pushing to one destination fails,
+// the batch stays in `src` and might be pushed to the other ones again.
+func (r *Router) RouteBatch(src Consumer, n int) (int, error) {
+	var srcBs *buckets
+	switch c := src.(type) {
+	case *Queue:
+		srcBs = c.buckets
+	case *Fork:
+		if c.q == nil {
+			return 0, ErrNoSuchFork
+		}
+
+		srcBs = c.q.buckets
+	}
+
+	var nmoved int
+	err := src.Read(n, func(_ Transaction, items Items) (ReadOp, error) {
+		if err := r.push(srcBs, items); err != nil {
+			return ReadOpPeek, err
+		}
+
+		nmoved += len(items)
+		return ReadOpPop, nil
+	})
+
+	return nmoved, err
+}
+
+// Run moves the items of `src` (or of opts.Fork) to their destinations until
+// `ctx` is done. It is built on RunConsumer(), see there for the details.
+func (r *Router) Run(ctx context.Context, src *Queue, opts ConsumerOptions) error {
+	return src.RunConsumer(ctx, opts, func(_ context.Context, items Items) error {
+		return r.push(src.buckets, items)
+	})
+}
@@ -0,0 +1,147 @@
+package timeq
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ConsumerOptions configure RunConsumer().
+type ConsumerOptions struct {
+	// Fork is the fork to consume. Empty for the queue itself.
+	Fork ForkName
+
+	// BatchSize is the maximum number of items that are read at once.
+	// Defaults to 1000.
+	BatchSize int
+
+	// PollInterval is how long to wait for new items when the queue is empty,
+	// paused or frozen. Pushes to the queue end the wait early. Defaults to one second.
+	PollInterval time.Duration
+
+	// MinBackoff and MaxBackoff limit the wait after a failed batch. The wait
+	// doubles with every failure in a row. Default to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnError is called for every failed batch. By default, the error
+	// is logged with the Logger of the queue.
+	OnError func(err error)
+}
+
+func (opts *ConsumerOptions) setDefaults(logger Logger) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			logger.Printf("consumer: %v", err)
+		}
+	}
+}
+
+// ConsumerHandler processes a batch of items. The items are only valid
+// during the call. If it returns an error, the items stay in the queue and
+// are passed again after a backoff.
+type ConsumerHandler func(ctx context.Context, items Items) error
+
+// consumeBatch reads one batch and returns the number of popped items.
+func (bs *buckets) consumeBatch(ctx context.Context, opts ConsumerOptions, handler ConsumerHandler) (int, error) {
+	if bs.Frozen() {
+		// the handler might push follow-up items, which would fail.
+		return 0, nil
+	}
+
+	var npopped int
+	var handlerErr error
+	err := bs.Read(opts.BatchSize, opts.Fork, func(_ Transaction, items Items) (ReadOp, error) {
+		if handlerErr != nil {
+			// do not skip over the failed items with ErrorModeContinue:
+			return ReadOpPeek, handlerErr
+		}
+
+		if handlerErr = handler(ctx, items); handlerErr != nil {
+			// Read() holds the lock while calling us.
+			bs.metrics.handlerErrors++
+			return ReadOpPeek, handlerErr
+		}
+
+		npopped += len(items)
+		return ReadOpPop, nil
+	})
+
+	if handlerErr != nil {
+		return npopped, handlerErr
+	}
+
+	return npopped, err
+}
+
+// RunConsumer passes the items of a consumer to `handler` until `ctx` is done.
+// See Queue.RunConsumer().
+func (bs *buckets) RunConsumer(ctx context.Context, opts ConsumerOptions, handler ConsumerHandler) error {
+	opts.setDefaults(bs.opLog.Logger)
+
+	var backoff time.Duration
+	for {
+		if bs.closing.Load() {
+			// Read() does not fail on an empty, closed queue.
+			return ErrClosed
+		}
+
+		if !bs.hasFork(opts.Fork) {
+			return ErrNoSuchFork
+		}
+
+		// get the channel before reading, so no push in between is missed:
+		pushed := bs.pushedChan()
+
+		n, err := bs.consumeBatch(ctx, opts, handler)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var wait time.Duration
+		switch {
+		case errors.Is(err, ErrClosed), errors.Is(err, ErrNoSuchFork):
+			return err
+		case err != nil:
+			opts.OnError(err)
+			backoff = min(max(2*backoff, opts.MinBackoff), opts.MaxBackoff)
+			wait = backoff
+
+			// new items do not fix the error:
+			pushed = nil
+		case n > 0:
+			// there might be more, don't wait.
+			backoff = 0
+			continue
+		default:
+			backoff = 0
+			wait = opts.PollInterval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		case <-pushed:
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	seqStateFile   = "seq.state"
+	seqStateHeader = "timeq-seq"
+)
+
+// The last sequence number (see Options.RecordSequence) is only written to
+// seqStateFile on Close(), by NextSeq() and before buckets are removed.
+// After a crash, it is restored from the sequence logs of the buckets, which
+// are written before each push. Together they know the last handed out number.
+
+// loadSeq restores the last sequence number.
+func (bs *buckets) loadSeq() error {
+	seq, err := readSeqState(bs.opts.FS, bs.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range bs.tree.Keys() {
+		highest, err := readBatchLogMax(bs.opts.FS, filepath.Join(bs.buckPath(key), seqLogName))
+		if err != nil {
+			return fmt.Errorf("bucket %v: %w", key, err)
+		}
+
+		seq = max(seq, highest)
+	}
+
+	bs.seq = seq
+	bs.seqSaved = seq
+	bs.seqLoaded = true
+	return nil
+}
+
+// NextSeq hands out `n` sequence numbers. See Queue.NextSeq().
+func (bs *buckets) NextSeq(n int) (uint64, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("sequence: n must be positive, got %d", n)
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.closing.Load() {
+		return 0, ErrClosed
+	}
+
+	if err := bs.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if !bs.seqLoaded {
+		if err := bs.loadSeq(); err != nil {
+			return 0, fmt.Errorf("sequence: %w", err)
+		}
+	}
+
+	// the numbers only count as handed out once they were written:
+	prev := bs.seq
+	bs.seq += uint64(n)
+	if err := bs.saveSeq(); err != nil {
+		bs.seq = prev
+		return 0, err
+	}
+
+	return prev + 1, nil
+}
+
+// nextSeq returns the sequence number of the next push
+// or zero if Options.RecordSequence is not set.
+func (bs *buckets) nextSeq() uint64 {
+	if !bs.opts.RecordSequence {
+		return 0
+	}
+
+	bs.seq++
+	return bs.seq
+}
+
+// saveSeq writes the last sequence number, if it changed since the last
+// time. This has to be called before a bucket is removed, as its sequence
+// log might have the highest number.
+func (bs *buckets) saveSeq() error {
+	if bs.seq == bs.seqSaved {
+		return nil
+	}
+
+	if err := writeSeqState(bs.opts.FS, bs.dir, bs.seq); err != nil {
+		return fmt.Errorf("sequence: %w", err)
+	}
+
+	bs.seqSaved = bs.seq
+	return nil
+}
+
+func readSeqState(fsys FS, dir string) (uint64, error) {
+	data, err := fsys.ReadFile(filepath.Join(dir, seqStateFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] != seqStateHeader {
+		return 0, fmt.Errorf("bad sequence file: %q", data)
+	}
+
+	return strconv.ParseUint(fields[1], 10, 64)
+}
+
+func writeSeqState(fsys FS, dir string, seq uint64) error {
+	data := fmt.Sprintf("%s %d\n", seqStateHeader, seq)
+	if err := fsys.WriteFile(filepath.Join(dir, seqStateFile), []byte(data), 0600); err != nil {
+		return err
+	}
+
+	// make sure that the rename of WriteFile() hit the disk too:
+	return fsys.SyncDir(dir)
+}
@@ -0,0 +1,204 @@
+package timeq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sahib/timeq/item"
+)
+
+// subscribeRetryInterval is how often a subscription checks for items,
+// even if nothing was pushed (e.g. after an error or when reads were paused).
+const subscribeRetryInterval = time.Second
+
+// notifyPushed wakes up all subscriptions, since there might be new items.
+func (bs *buckets) notifyPushed() {
+	if bs.pushed != nil {
+		close(bs.pushed)
+		bs.pushed = nil
+	}
+}
+
+// pushedChan returns a channel that is closed on the next push.
+func (bs *buckets) pushedChan() <-chan struct{} {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.pushed == nil {
+		bs.pushed = make(chan struct{})
+	}
+
+	return bs.pushed
+}
+
+// ReadWait waits until `fork` has `n` items, `maxWait` passed or `ctx` is
+// done and reads then. See Queue.ReadWait().
+func (bs *buckets) ReadWait(ctx context.Context, n int, maxWait time.Duration, fork ForkName, fn TransactionFn) error {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	for n >= 0 {
+		// get the channel before checking, so no push in between is missed:
+		pushed := bs.pushedChan()
+		if bs.closing.Load() {
+			return ErrClosed
+		}
+
+		if !bs.hasFork(fork) {
+			return ErrNoSuchFork
+		}
+
+		if bs.Len(fork) >= n {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return bs.Read(n, fork, fn)
+		case <-pushed:
+		}
+	}
+
+	return bs.Read(n, fork, fn)
+}
+
+// peekCopy returns a copy of the next `n` items of `fork`.
+// A negative `n` returns all of them.
+func (bs *buckets) peekCopy(fork ForkName, n int) (item.Items, error) {
+	var batch item.Items
+	err := bs.Read(n, fork, func(_ Transaction, items Items) (ReadOp, error) {
+		// Read() goes on with the next buckets when peeking:
+		if n < 0 || len(batch) < n {
+			batch = append(batch, items.Copy()...)
+		}
+
+		return ReadOpPeek, nil
+	})
+
+	if n >= 0 && len(batch) > n {
+		batch = batch[:n]
+	}
+
+	return batch, err
+}
+
+func itemEqual(a, b item.Item) bool {
+	return a.Key == b.Key && bytes.Equal(a.Blob, b.Blob)
+}
+
+// itemID identifies an item by key and blob, e.g. for counting them in a map.
+func itemID(it item.Item) string {
+	return fmt.Sprintf("%d:%s", it.Key, it.Blob)
+}
+
+// popDelivered removes the items in `batch` (as returned by peekCopy()) from `fork`.
+func (bs *buckets) popDelivered(fork ForkName, batch item.Items) error {
+	// The batch may span several buckets, so Read() calls us once per
+	// bucket. Pop as long as the items match the start of what is left.
+	var popped int
+	var mismatch bool
+	err := bs.Read(len(batch), fork, func(_ Transaction, items Items) (ReadOp, error) {
+		rest := batch[popped:]
+		if mismatch || len(items) > len(rest) || !slices.EqualFunc(items, rest[:len(items)], itemEqual) {
+			mismatch = true
+			return ReadOpPeek, nil
+		}
+
+		popped += len(items)
+		return ReadOpPop, nil
+	})
+
+	batch = batch[popped:]
+	if err != nil || len(batch) == 0 {
+		return err
+	}
+
+	// items with lower keys were pushed since peeking,
+	// so we have to delete exactly the delivered ones:
+	delivered := make(map[string]int, len(batch))
+	for _, it := range batch {
+		delivered[itemID(it)]++
+	}
+
+	_, err = bs.DeleteFunc(fork, batch[0].Key, batch[len(batch)-1].Key, func(it item.Item) bool {
+		id := itemID(it)
+		if delivered[id] > 0 {
+			delivered[id]--
+			return false
+		}
+
+		return true
+	})
+
+	return err
+}
+
+func (bs *buckets) deliver(fork ForkName, batchSize int, ch chan<- item.Items, stop <-chan struct{}) {
+	for !bs.closing.Load() {
+		// get the channel before reading, so no push in between is missed:
+		pushed := bs.pushedChan()
+
+		batch, err := bs.peekCopy(fork, batchSize)
+		if err != nil {
+			if errors.Is(err, ErrClosed) || errors.Is(err, ErrNoSuchFork) {
+				return
+			}
+
+			bs.opLog.Logger.Printf("subscription: %s: %v", fork, err)
+		}
+
+		if len(batch) == 0 {
+			select {
+			case <-pushed:
+			case <-time.After(subscribeRetryInterval):
+			case <-stop:
+				return
+			}
+
+			continue
+		}
+
+		select {
+		case ch <- batch:
+		case <-stop:
+			return
+		}
+
+		if err := bs.popDelivered(fork, batch); err != nil {
+			bs.opLog.Logger.Printf("subscription: %s: failed to pop delivered items: %v", fork, err)
+		}
+	}
+}
+
+// SubscribeChan delivers the items of `fork` on a channel. See Queue.SubscribeChan().
+func (bs *buckets) SubscribeChan(fork ForkName, batchSize int) (<-chan item.Items, func()) {
+	if batchSize == 0 {
+		// would never deliver anything.
+		batchSize = 1
+	}
+
+	ch := make(chan item.Items)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer close(ch)
+		bs.deliver(fork, batchSize, ch, stop)
+	}()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+		})
+	}
+}
@@ -0,0 +1,149 @@
+// Package timeqtest contains helpers for testing code that uses timeq.
+// It saves you from writing the same setup code in every test.
+package timeqtest
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/sahib/timeq"
+	"github.com/stretchr/testify/require"
+)
+
+// testLogger forwards the log messages of the queue to the test log.
+type testLogger struct {
+	t testing.TB
+}
+
+func (l testLogger) Printf(fmt string, args ...any) {
+	l.t.Logf(fmt, args...)
+}
+
+// TempQueue opens a queue with timeq.DefaultOptions() in a temporary
+// directory. The queue is closed and the directory is removed once
+// the test finished. Log messages of the queue go to the test log.
+func TempQueue(t testing.TB) *timeq.Queue {
+	t.Helper()
+	return TempQueueWithOptions(t, timeq.DefaultOptions())
+}
+
+// TempQueueWithOptions is like TempQueue, but uses `opts`.
+// If opts.Logger is nil, log messages go to the test log.
+func TempQueueWithOptions(t testing.TB, opts timeq.Options) *timeq.Queue {
+	t.Helper()
+
+	if opts.Logger == nil {
+		opts.Logger = testLogger{t: t}
+	}
+
+	queue, err := timeq.Open(t.TempDir(), opts)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, queue.Close())
+	})
+
+	return queue
+}
+
+// Sequential returns `n` items with the keys `start` to `start+n-1`.
+// The blob of each item is its key as decimal string.
+func Sequential(start, n int) timeq.Items {
+	items := make(timeq.Items, 0, n)
+	for idx := start; idx < start+n; idx++ {
+		items = append(items, timeq.Item{
+			Key:  timeq.Key(idx),
+			Blob: []byte(fmt.Sprintf("%d", idx)),
+		})
+	}
+
+	return items
+}
+
+// FillSequential pushes Sequential(0, n) to `q`.
+func FillSequential(q *timeq.Queue, n int) error {
+	return q.Push(Sequential(0, n))
+}
+
+// Drain pops all items of `c` and returns a copy of them.
+func Drain(c timeq.Consumer) (timeq.Items, error) {
+	var drained timeq.Items
+	for {
+		var nread int
+		err := c.Read(1000, func(_ timeq.Transaction, items timeq.Items) (timeq.ReadOp, error) {
+			nread = len(items)
+			drained = append(drained, items.Copy()...)
+			return timeq.ReadOpPop, nil
+		})
+
+		if err != nil {
+			return drained, err
+		}
+
+		if nread == 0 {
+			return drained, nil
+		}
+	}
+}
+
+// AssertDrainsTo pops all items of `c` and checks that they equal `exp`
+// and that `c` is empty afterwards. Use a fork for `c` to check the contents
+// of a queue without consuming them.
+func AssertDrainsTo(t testing.TB, c timeq.Consumer, exp timeq.Items) {
+	t.Helper()
+
+	drained, err := Drain(c)
+	require.NoError(t, err)
+
+	if len(exp) == 0 {
+		require.Empty(t, drained)
+	} else {
+		require.Equal(t, exp, drained)
+	}
+
+	require.Equal(t, 0, c.Len())
+}
+
+// Generator produces items from a random source with a fixed seed, so that
+// tests get the same items on every run. Keys are strictly ascending over
+// all calls of Items() and blobs are random bytes of random size.
+type Generator struct {
+	rng  *rand.Rand
+	next timeq.Key
+
+	// MaxKeyGap is the maximum distance between two consecutive keys.
+	// It must be at least 1.
+	MaxKeyGap int64
+
+	// MaxBlobSize is the maximum size of a generated blob.
+	MaxBlobSize int
+}
+
+// NewGenerator returns a Generator for `seed` with a MaxKeyGap of 1000
+// and a MaxBlobSize of 64 bytes.
+func NewGenerator(seed int64) *Generator {
+	return &Generator{
+		rng:         rand.New(rand.NewSource(seed)),
+		MaxKeyGap:   1000,
+		MaxBlobSize: 64,
+	}
+}
+
+// Items returns the next `n` items.
+func (g *Generator) Items(n int) timeq.Items {
+	items := make(timeq.Items, 0, n)
+	for idx := 0; idx < n; idx++ {
+		blob := make([]byte, g.rng.Intn(g.MaxBlobSize+1))
+		_, _ = g.rng.Read(blob)
+
+		items = append(items, timeq.Item{
+			Key:  g.next,
+			Blob: blob,
+		})
+
+		g.next += timeq.Key(1 + g.rng.Int63n(g.MaxKeyGap))
+	}
+
+	return items
+}
@@ -0,0 +1,37 @@
+package timeqtest
+
+import (
+	"testing"
+
+	"github.com/sahib/timeq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFillAndDrain(t *testing.T) {
+	queue := TempQueue(t)
+	fork, err := queue.Fork("fork")
+	require.NoError(t, err)
+
+	require.NoError(t, FillSequential(queue, 2000))
+	require.Equal(t, 2000, queue.Len())
+
+	AssertDrainsTo(t, fork, Sequential(0, 2000))
+	AssertDrainsTo(t, queue, Sequential(0, 2000))
+	AssertDrainsTo(t, queue, nil)
+}
+
+func TestGenerator(t *testing.T) {
+	a, b := NewGenerator(42), NewGenerator(42)
+	itemsA, itemsB := a.Items(100), b.Items(100)
+	require.Equal(t, itemsA, itemsB)
+
+	more := a.Items(100)
+	require.Less(t, itemsA[len(itemsA)-1].Key, more[0].Key)
+
+	opts := timeq.DefaultOptions()
+	opts.BucketSplitConf = timeq.FixedSizeBucketSplitConf(10000)
+	queue := TempQueueWithOptions(t, opts)
+	require.NoError(t, queue.Push(itemsA))
+	require.NoError(t, queue.Push(more))
+	AssertDrainsTo(t, queue, append(itemsA, more...))
+}
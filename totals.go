@@ -0,0 +1,164 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sahib/timeq/item"
+)
+
+const (
+	totalsFile   = "totals.state"
+	totalsHeader = "timeq-totals 1"
+)
+
+// Volume is an amount of items. Bytes are counted like they are stored on disk.
+type Volume struct {
+	Items uint64
+	Bytes uint64
+}
+
+func volumeOf(items item.Items) Volume {
+	return Volume{Items: uint64(len(items)), Bytes: uint64(items.StorageSize())}
+}
+
+func (v Volume) plus(other Volume) Volume {
+	return Volume{Items: v.Items + other.Items, Bytes: v.Bytes + other.Bytes}
+}
+
+// Totals counts what went through the queue since it was created.
+type Totals struct {
+	// Pushed counts all pushes. The forks get the same items.
+	Pushed Volume
+
+	// Popped counts the items popped with Read() per consumer.
+	// The queue itself has an empty name.
+	Popped map[ForkName]Volume
+}
+
+func (t Totals) clone() Totals {
+	t.Popped = maps.Clone(t.Popped)
+	return t
+}
+
+func (t Totals) equal(other Totals) bool {
+	return t.Pushed == other.Pushed && maps.Equal(t.Popped, other.Popped)
+}
+
+// The totals are kept in memory and written to totalsFile by Maintain()
+// and Close(). After a crash, the operations since then are not counted.
+
+// loadTotals reads the totals of an earlier run.
+func (bs *buckets) loadTotals() error {
+	totals, err := readTotals(bs.opts.FS, bs.dir)
+	if err != nil {
+		return err
+	}
+
+	bs.totals = totals
+	bs.totalsSaved = totals.clone()
+	return nil
+}
+
+// saveTotals writes the totals, if they changed since the last time.
+func (bs *buckets) saveTotals() error {
+	if bs.totals.equal(bs.totalsSaved) {
+		return nil
+	}
+
+	if err := writeTotals(bs.opts.FS, bs.dir, bs.totals); err != nil {
+		return fmt.Errorf("totals: %w", err)
+	}
+
+	bs.totalsSaved = bs.totals.clone()
+	return nil
+}
+
+func (t *Totals) notePopped(fork ForkName, v Volume) {
+	if t.Popped == nil {
+		t.Popped = make(map[ForkName]Volume)
+	}
+
+	t.Popped[fork] = t.Popped[fork].plus(v)
+}
+
+// Each line after the header has the counters of one consumer: pushed
+// items and bytes (only set for the queue), popped items and bytes and
+// the name, which is empty for the queue itself.
+
+func readTotals(fsys FS, dir string) (Totals, error) {
+	var totals Totals
+	data, err := fsys.ReadFile(filepath.Join(dir, totalsFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return totals, nil
+		}
+
+		return Totals{}, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if lines[0] != totalsHeader {
+		return Totals{}, fmt.Errorf("totals: bad header: %q", lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 4 && len(fields) != 5 {
+			return Totals{}, fmt.Errorf("totals: bad line: %q", line)
+		}
+
+		var counts [4]uint64
+		for idx := range counts {
+			counts[idx], err = strconv.ParseUint(fields[idx], 10, 64)
+			if err != nil {
+				return Totals{}, fmt.Errorf("totals: %w", err)
+			}
+		}
+
+		var fork ForkName
+		if len(fields) == 5 {
+			fork = ForkName(fields[4])
+		} else {
+			totals.Pushed = Volume{Items: counts[0], Bytes: counts[1]}
+		}
+
+		if counts[2] > 0 || counts[3] > 0 {
+			totals.notePopped(fork, Volume{Items: counts[2], Bytes: counts[3]})
+		}
+	}
+
+	return totals, nil
+}
+
+func writeTotals(fsys FS, dir string, totals Totals) error {
+	forks := []ForkName{""}
+	for fork := range totals.Popped {
+		if fork != "" {
+			forks = append(forks, fork)
+		}
+	}
+
+	// keep the output stable:
+	slices.Sort(forks)
+
+	var buf strings.Builder
+	buf.WriteString(totalsHeader + "\n")
+	for _, fork := range forks {
+		var pushed Volume
+		if fork == "" {
+			pushed = totals.Pushed
+		}
+
+		popped := totals.Popped[fork]
+		fmt.Fprintf(&buf, "%d %d %d %d %s\n", pushed.Items, pushed.Bytes, popped.Items, popped.Bytes, fork)
+	}
+
+	return fsys.WriteFile(filepath.Join(dir, totalsFile), []byte(buf.String()), 0600)
+}
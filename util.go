@@ -2,14 +2,13 @@ package timeq
 
 import (
 	"errors"
-	"os"
 	"syscall"
 
 	"github.com/otiai10/copy"
 )
 
-func moveFileOrDir(src, dst string) error {
-	if err := os.Rename(src, dst); !errors.Is(err, syscall.EXDEV) {
+func moveFileOrDir(fsys FS, src, dst string) error {
+	if err := fsys.Rename(src, dst); !errors.Is(err, syscall.EXDEV) {
 		// NOTE: this includes err==nil
 		return err
 	}
@@ -21,5 +20,5 @@ func moveFileOrDir(src, dst string) error {
 		return err
 	}
 
-	return os.RemoveAll(src)
+	return fsys.RemoveAll(src)
 }
@@ -21,7 +21,7 @@ func TestMoveFileIfRenamable(t *testing.T) {
 	aPath := filepath.Join(dir, "a")
 	bPath := filepath.Join(dir, "b")
 	require.NoError(t, os.WriteFile(aPath, expData, 0600))
-	require.NoError(t, moveFileOrDir(aPath, bPath))
+	require.NoError(t, moveFileOrDir(OSFS(), aPath, bPath))
 
 	gotData, err := os.ReadFile(bPath)
 	require.NoError(t, err)
@@ -47,7 +47,7 @@ func TestMoveIfNotRenamable(t *testing.T) {
 		require.NoError(t, os.WriteFile(bPath, bData, 0600))
 
 		dstDir := filepath.Join(ext4Dir, "dst")
-		require.NoError(t, moveFileOrDir(tmpDir, dstDir))
+		require.NoError(t, moveFileOrDir(OSFS(), tmpDir, dstDir))
 
 		entries, err := os.ReadDir(dstDir)
 		require.NoError(t, err)
@@ -82,7 +82,7 @@ func TestMoveErrorIfRenamable(t *testing.T) {
 
 	badDir := filepath.Join(dir, "bad")
 	require.NoError(t, os.MkdirAll(badDir, 0400))
-	require.Error(t, moveFileOrDir(aPath, badDir))
+	require.Error(t, moveFileOrDir(OSFS(), aPath, badDir))
 
 	// Nothing should have been deleted:
 	_, err = os.Stat(aPath)
@@ -108,7 +108,7 @@ func TestMoveErrorIfNotRenamable(t *testing.T) {
 		dstDir := filepath.Join(ext4Dir, "dst")
 		require.NoError(t, os.MkdirAll(dstDir, 0400))
 
-		require.Error(t, moveFileOrDir(tmpDir, dstDir))
+		require.Error(t, moveFileOrDir(OSFS(), tmpDir, dstDir))
 
 		_, err = os.Stat(aPath)
 		require.NoError(t, err)
@@ -0,0 +1,99 @@
+package timeq
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sahib/timeq/item"
+)
+
+var (
+	// ErrBlobTooBig is returned for items with a blob bigger than MaxBlobSize.
+	ErrBlobTooBig = errors.New("blob is too big")
+)
+
+// MaxBlobSize is the biggest blob that can be pushed.
+const MaxBlobSize = item.MaxBlobSize
+
+// ItemError describes why a single item of a batch could not be pushed.
+type ItemError struct {
+	// Index is the index of the item in the batch that was passed to Push().
+	Index int
+
+	// Err is the reason, e.g. ErrBlobTooBig.
+	Err error
+}
+
+// PushError is returned by Push() if some items of the batch were invalid.
+// You can use errors.Is() to check for the reasons, e.g. ErrBlobTooBig.
+type PushError struct {
+	// Failed lists the invalid items, ordered by index.
+	Failed []ItemError
+
+	// Written is true if the valid items were pushed anyways.
+	// This is only the case with ErrorModeContinue.
+	Written bool
+}
+
+func (e *PushError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "push: %d invalid items (written: %v):", len(e.Failed), e.Written)
+	for idx, failed := range e.Failed {
+		if idx >= 10 {
+			sb.WriteString(" ...")
+			break
+		}
+
+		fmt.Fprintf(&sb, " #%d: %v;", failed.Index, failed.Err)
+	}
+
+	return sb.String()
+}
+
+func (e *PushError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, failed := range e.Failed {
+		errs = append(errs, failed.Err)
+	}
+
+	return errs
+}
+
+// validateItems checks all items of a batch before it is pushed. If some
+// items are invalid, it returns the valid items and a *PushError.
+func validateItems(items item.Items) (item.Items, *PushError) {
+	var pushErr *PushError
+	for idx, it := range items {
+		var err error
+		switch {
+		case len(it.Blob) > MaxBlobSize:
+			err = fmt.Errorf("%w: %d bytes", ErrBlobTooBig, len(it.Blob))
+		default:
+			continue
+		}
+
+		if pushErr == nil {
+			pushErr = &PushError{}
+		}
+
+		pushErr.Failed = append(pushErr.Failed, ItemError{Index: idx, Err: err})
+	}
+
+	if pushErr == nil {
+		return items, nil
+	}
+
+	valid := make(item.Items, 0, len(items)-len(pushErr.Failed))
+	failedIdx := 0
+	for idx, it := range items {
+		if failedIdx < len(pushErr.Failed) && pushErr.Failed[failedIdx].Index == idx {
+			failedIdx++
+			continue
+		}
+
+		valid = append(valid, it)
+	}
+
+	return valid, pushErr
+}
@@ -0,0 +1,86 @@
+package vlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/sahib/timeq/item"
+	"golang.org/x/sys/unix"
+)
+
+// NOTE: O_DIRECT requires that the buffer address, the file offset and the
+// write size are aligned to the logical block size of the device. We use the
+// page size for all of them, which is a multiple of it on all common devices.
+
+// openDirect opens a second, write-only handle to `path` that bypasses the
+// page cache. If the filesystem does not support O_DIRECT, nil is returned
+// and the log falls back to writing through the memory map.
+func openDirect(path string) (*os.File, error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|unix.O_DIRECT, 0600)
+	if err != nil {
+		if errors.Is(err, unix.EINVAL) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("log: open direct: %w", err)
+	}
+
+	return fd, nil
+}
+
+// alignedBuf returns a buffer of `size` bytes whose address is page aligned.
+func alignedBuf(size int64) []byte {
+	buf := make([]byte, size+PageSize)
+	off := int64(uintptr(unsafe.Pointer(unsafe.SliceData(buf))) & uintptr(PageSize-1))
+	if off != 0 {
+		off = PageSize - off
+	}
+
+	return buf[off : off+size : off+size]
+}
+
+// encodeItem writes `it` to `dst` and returns the number of bytes written.
+func encodeItem(dst []byte, it item.Item) int64 {
+	binary.BigEndian.PutUint32(dst[0:], uint32(len(it.Blob)))
+	binary.BigEndian.PutUint64(dst[4:], uint64(it.Key))
+	off := item.HeaderSize + int64(copy(dst[item.HeaderSize:], it.Blob))
+
+	// add trailer mark:
+	dst[off] = 0xFF
+	dst[off+1] = 0xFF
+	return off + item.TrailerSize
+}
+
+// pushDirect writes `items` with a single O_DIRECT write. Since the write has
+// to start at an aligned offset, the partially filled last page of the log is
+// written again. The rest of the last page is padded with zeroes, which is
+// the same as what ftruncate() would leave there. The memory map stays valid
+// and sees the new data, as the kernel invalidates the cached pages.
+func (l *Log) pushDirect(items item.Items) error {
+	start := (l.size / PageSize) * PageSize
+	head := l.size - start
+	need := head + int64(items.StorageSize())
+	bufSize := ((need + PageSize - 1) / PageSize) * PageSize
+
+	if int64(len(l.directBuf)) < bufSize {
+		l.directBuf = alignedBuf(bufSize)
+	}
+
+	buf := l.directBuf[:bufSize]
+	off := int64(copy(buf, l.mmap[start:l.size]))
+	for idx := 0; idx < len(items); idx++ {
+		off += encodeItem(buf[off:], items[idx])
+	}
+
+	clear(buf[off:])
+
+	if _, err := l.directFd.WriteAt(buf, start); err != nil {
+		return fmt.Errorf("direct write: %w", err)
+	}
+
+	l.size = start + off
+	return nil
+}
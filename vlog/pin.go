@@ -0,0 +1,72 @@
+package vlog
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Pin guarantees that all memory of the log that is mapped right now stays
+// mapped until the matching Unpin(). This makes it safe to hold on to items
+// returned by Read() beyond the next Push() or Close(). While the log is
+// pinned, growing it creates a new mapping instead of moving the old one.
+// Pin may be called concurrently with other Pin() calls and with reads.
+// Unpin is not safe for concurrent use, like the rest of Log.
+func (l *Log) Pin() {
+	l.pins.Add(1)
+}
+
+// Unpin reverts a Pin(). If it was the last one, mappings that were
+// replaced or closed in the meantime are unmapped now.
+func (l *Log) Unpin() error {
+	if l.pins.Load() <= 0 {
+		return errors.New("log: unpin without pin")
+	}
+
+	if l.pins.Add(-1) > 0 {
+		return nil
+	}
+
+	var err error
+	for _, mmap := range l.retired {
+		err = errors.Join(err, unix.Munmap(mmap))
+	}
+
+	l.retired = nil
+	return err
+}
+
+// remap grows the mapping to `size` bytes.
+func (l *Log) remap(size int) ([]byte, error) {
+	if l.pins.Load() == 0 {
+		// If we're unlucky we gonna have to move it:
+		mmap, err := unix.Mremap(l.mmap, size, unix.MREMAP_MAYMOVE)
+		if err != nil {
+			return nil, fmt.Errorf("remap: %w", err)
+		}
+
+		return mmap, nil
+	}
+
+	// the old mapping might be referenced, so it may not move:
+	mmap, err := unix.Mmap(
+		int(l.fd.Fd()),
+		0,
+		size,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED_VALIDATE,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("remap: %w", err)
+	}
+
+	if l.locked {
+		if err := unix.Mlock(mmap); err != nil {
+			return nil, errors.Join(fmt.Errorf("mlock: %w", err), unix.Munmap(mmap))
+		}
+	}
+
+	l.retired = append(l.retired, l.mmap)
+	return mmap, nil
+}
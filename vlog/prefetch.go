@@ -0,0 +1,52 @@
+package vlog
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/sahib/timeq/item"
+	"golang.org/x/sys/unix"
+)
+
+// Region returns up to `size` bytes of the mapped data from `off` on,
+// starting at the page that `off` is in. Like items, the region is only
+// valid until the next Push() or Close(), unless the log is pinned.
+func (l *Log) Region(off item.Off, size int64) []byte {
+	start := (min(int64(off), l.size) / PageSize) * PageSize
+	end := min(start+size, l.size)
+	return l.mmap[start:end]
+}
+
+// PageIn makes sure that `region` (as returned by Region()) is in memory, by
+// advising the kernel to read it and touching every page. It returns early
+// once `stop` is set. The log has to be pinned if other goroutines might
+// use it in the meantime.
+func PageIn(region []byte, stop *atomic.Bool) {
+	if len(region) == 0 {
+		return
+	}
+
+	// only a hint; the touching below works without it, just slower.
+	_ = unix.Madvise(region, unix.MADV_WILLNEED)
+
+	var sum byte
+	for off := int64(0); off < int64(len(region)) && !stop.Load(); off += PageSize {
+		sum += region[off]
+	}
+
+	runtime.KeepAlive(sum)
+}
+
+// PageInFile advises the kernel to read up to `size` bytes of the log at
+// `path` into the page cache, so that mapping it later is fast. The log
+// does not need to be open for this.
+func PageInFile(path string, size int64) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+	return unix.Fadvise(int(fd.Fd()), 0, size, unix.FADV_WILLNEED)
+}
@@ -0,0 +1,121 @@
+package vlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sahib/timeq/item"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// vectorMinItems is the number of items a push needs to have to be
+	// written with pushVectored(). Smaller pushes are cheaper to copy to
+	// the memory map directly.
+	vectorMinItems = 16
+
+	// vectorCopyLimit is the blob size from which on a blob gets its own
+	// iovec instead of being copied to the staging buffer.
+	vectorCopyLimit = 4096
+
+	// maxIovecs is IOV_MAX on linux, the max number of iovecs per call.
+	maxIovecs = 1024
+)
+
+// pushVectored writes `items` with as few pwritev(2) calls as possible.
+// Headers, trailers and small blobs are copied to a staging buffer, so that
+// a run of tiny items becomes a single large iovec. Big blobs are referenced
+// as they are, avoiding a copy. Writing via the file instead of the memory
+// map also avoids a page fault for every new page of the log. The memory
+// map shares the page cache with the file, so it sees the new data.
+func (l *Log) pushVectored(items item.Items) error {
+	// size the staging buffer up front, slices of it must stay valid:
+	var stageSize int
+	for idx := 0; idx < len(items); idx++ {
+		stageSize += item.HeaderSize + item.TrailerSize
+		if len(items[idx].Blob) < vectorCopyLimit {
+			stageSize += len(items[idx].Blob)
+		}
+	}
+
+	if cap(l.stageBuf) < stageSize {
+		l.stageBuf = make([]byte, 0, stageSize)
+	}
+
+	stage := l.stageBuf[:0]
+	iovs := l.iovBuf[:0]
+	runStart := 0
+
+	for idx := 0; idx < len(items); idx++ {
+		it := items[idx]
+		stage = binary.BigEndian.AppendUint32(stage, uint32(len(it.Blob)))
+		stage = binary.BigEndian.AppendUint64(stage, uint64(it.Key))
+		if len(it.Blob) >= vectorCopyLimit {
+			// end the current run before the big blob:
+			iovs = append(iovs, stage[runStart:], it.Blob)
+			runStart = len(stage)
+		} else {
+			stage = append(stage, it.Blob...)
+		}
+
+		// add trailer mark:
+		stage = append(stage, 0xFF, 0xFF)
+	}
+
+	iovs = append(iovs, stage[runStart:])
+
+	n, err := pwritevFull(int(l.fd.Fd()), iovs, l.size)
+
+	// do not keep the blobs of the caller alive:
+	clear(iovs)
+	l.iovBuf = iovs[:0]
+
+	if err != nil {
+		return fmt.Errorf("vectored write: %w", err)
+	}
+
+	l.size += n
+	return nil
+}
+
+// pwritevFull writes all of `iovs` at `off`, even if the kernel
+// does only partial writes or there are more than maxIovecs of them.
+func pwritevFull(fd int, iovs [][]byte, off int64) (int64, error) {
+	var total int64
+	for len(iovs) > 0 {
+		if len(iovs[0]) == 0 {
+			iovs = iovs[1:]
+			continue
+		}
+
+		n, err := unix.Pwritev(fd, iovs[:min(len(iovs), maxIovecs)], off+total)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+
+			return total, err
+		}
+
+		if n == 0 {
+			return total, io.ErrShortWrite
+		}
+
+		total += int64(n)
+
+		// skip everything that was written:
+		for n > 0 {
+			if n < len(iovs[0]) {
+				iovs[0] = iovs[0][n:]
+				break
+			}
+
+			n -= len(iovs[0])
+			iovs = iovs[1:]
+		}
+	}
+
+	return total, nil
+}
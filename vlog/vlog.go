@@ -5,18 +5,92 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"sync/atomic"
 
 	"github.com/sahib/timeq/item"
 	"golang.org/x/sys/unix"
 )
 
+// Options can be passed to OpenWithOptions() to tune the log.
+type Options struct {
+	// SyncOnWrite makes every Push() msync() the data.
+	SyncOnWrite bool
+
+	// PreallocSize makes the log reserve disk space with fallocate(2) in
+	// extents of this many bytes (rounded up to the page size), instead
+	// of growing the file in small, size dependent steps. This reduces
+	// fragmentation and the number of truncate/mremap cycles during
+	// pushes. Zero disables pre-allocation.
+	PreallocSize int64
+
+	// Sequential tells the kernel with madvise(2) that the log is mostly
+	// read in sequential order, which results in more aggressive read-ahead.
+	Sequential bool
+
+	// HugePages advises the kernel with MADV_HUGEPAGE to back the mapping
+	// with transparent huge pages once it is at least HugePageSize big.
+	// Whether this has an effect depends on the kernel and filesystem.
+	HugePages bool
+
+	// DirectIO makes Push() write the data with O_DIRECT instead of copying
+	// it to the memory map. This avoids filling the page cache with data
+	// that is likely read only much later. Reading still happens via the
+	// memory map. If the filesystem does not support O_DIRECT, the log
+	// silently uses the normal write path.
+	DirectIO bool
+
+	// ReadOnly opens the log without write access and maps it read-only.
+	// The log is neither created nor grown and Push() fails. An empty log
+	// is not mapped at all. DirectIO is ignored.
+	ReadOnly bool
+
+	// SizeHint is the logical size of the log as it was stored somewhere
+	// else on the last close, or zero if unknown. It is only used if the
+	// log has data right before it and none after it. Otherwise, the log
+	// might have been written after the hint was stored, and the end is
+	// found by scanning back over the zeroes at the end of the file.
+	SizeHint int64
+}
+
+// ErrReadOnly is returned by Push() if the log was opened with Options.ReadOnly.
+var ErrReadOnly = errors.New("log is opened read-only")
+
+// HugePageSize is the size of a (transparent) huge page on most systems.
+// Smaller mappings are not advised to use huge pages.
+const HugePageSize = 2 * 1024 * 1024
+
+// Log is the value log. Its logical size (the data that was written) is
+// smaller than its physical size (the size of file and mapping), since the
+// file is always grown ahead of the writes. The logical size is not stored
+// in the log itself; on open it is taken from Options.SizeHint or found by
+// scanning back over the zero padding at the end.
 type Log struct {
-	path        string
-	fd          *os.File
-	mmap        []byte
-	size        int64
-	syncOnWrite bool
-	isEmpty     bool
+	path    string
+	fd      *os.File
+	mmap    []byte
+	size    int64
+	opts    Options
+	isEmpty bool
+
+	// freedOff is the offset up to which pages were released by FreeBefore().
+	freedOff int64
+
+	// locked is true if the mapping was locked to memory via Lock().
+	locked bool
+
+	// directFd is only set when Options.DirectIO is used.
+	directFd  *os.File
+	directBuf []byte
+
+	// pins is the number of Pin() calls without Unpin(). Mappings that
+	// were replaced or closed while pinned are kept in retired.
+	pins    atomic.Int64
+	retired [][]byte
+
+	// buffers reused by pushVectored():
+	stageBuf []byte
+	iovBuf   [][]byte
 }
 
 var PageSize int64 = 4096
@@ -58,13 +132,70 @@ func nextSize(size int64) int64 {
 	return nextSize
 }
 
+// allocSize returns the physical size the log should have to fit `size` bytes.
+func (l *Log) allocSize(size int64) int64 {
+	next := nextSize(size)
+	if ext := l.opts.PreallocSize; ext > 0 {
+		if extSize := ((size / ext) + 1) * ext; extSize > next {
+			next = extSize
+		}
+	}
+
+	return next
+}
+
+// allocate grows the file to `size` bytes.
+func (l *Log) allocate(size int64) error {
+	if l.opts.PreallocSize > 0 {
+		// Allocate real blocks, not just a sparse region:
+		err := unix.Fallocate(int(l.fd.Fd()), 0, 0, size)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, unix.EOPNOTSUPP) {
+			return fmt.Errorf("fallocate: %w", err)
+		}
+
+		// not supported by the filesystem, fall back to truncate.
+	}
+
+	if err := l.fd.Truncate(size); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+
+	return nil
+}
+
+// Open opens the log at `path` with default options.
 func Open(path string, syncOnWrite bool) (*Log, error) {
+	return OpenWithOptions(path, Options{SyncOnWrite: syncOnWrite})
+}
+
+// OpenWithOptions opens the log at `path` and creates it if needed,
+// unless Options.ReadOnly is set.
+func OpenWithOptions(path string, opts Options) (*Log, error) {
+	if opts.PreallocSize > 0 {
+		// keep the file size page aligned:
+		opts.PreallocSize = ((opts.PreallocSize + PageSize - 1) / PageSize) * PageSize
+	}
+
+	if opts.ReadOnly {
+		opts.DirectIO = false
+	}
+
 	l := &Log{
-		path:        path,
-		syncOnWrite: syncOnWrite,
+		path: path,
+		opts: opts,
+	}
+
+	// NOTE: no O_APPEND, since pushVectored() writes at the logical size,
+	// which is usually before the end of the (pre-allocated) file.
+	flags, prot := os.O_CREATE|os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE
+	if opts.ReadOnly {
+		flags, prot = os.O_RDONLY, unix.PROT_READ
 	}
 
-	flags := os.O_APPEND | os.O_CREATE | os.O_RDWR
 	fd, err := os.OpenFile(path, flags, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("log: open: %w", err)
@@ -76,11 +207,28 @@ func Open(path string, syncOnWrite bool) (*Log, error) {
 		return nil, fmt.Errorf("log: stat: %w", err)
 	}
 
+	l.fd = fd
+
+	if opts.DirectIO {
+		l.directFd, err = openDirect(path)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+
 	mmapSize := info.Size()
+	if mmapSize == 0 && opts.ReadOnly {
+		// nothing to read and mmap(2) does not like empty mappings.
+		l.isEmpty = true
+		return l, nil
+	}
+
 	if mmapSize == 0 {
-		mmapSize = nextSize(0)
-		if err := fd.Truncate(mmapSize); err != nil {
-			return nil, fmt.Errorf("truncate: %w", err)
+		mmapSize = l.allocSize(0)
+		if err := l.allocate(mmapSize); err != nil {
+			l.closeFds()
+			return nil, err
 		}
 
 		l.isEmpty = true
@@ -90,20 +238,21 @@ func Open(path string, syncOnWrite bool) (*Log, error) {
 		int(fd.Fd()),
 		0,
 		int(mmapSize),
-		unix.PROT_READ|unix.PROT_WRITE,
+		prot,
 		unix.MAP_SHARED_VALIDATE,
 	)
 
 	if err != nil {
-		fd.Close()
+		l.closeFds()
 		return nil, fmt.Errorf("log: mmap: %w", err)
 	}
 
 	// give OS a hint that we will likely need that memory soon:
 	_ = unix.Madvise(mmap, unix.MADV_WILLNEED)
+	l.adviseSequential(mmap)
+	l.adviseHugePages(mmap)
 
 	l.size = info.Size()
-	l.fd = fd
 	l.mmap = mmap
 
 	// read the initial size. We can't use the file size as we
@@ -111,10 +260,29 @@ func Open(path string, syncOnWrite bool) (*Log, error) {
 	// know much of it was used. If we would use info.Size() here
 	// we would waste some space since new pushes are written beyond
 	// the truncated area. Just shrink to the last written data.
-	l.size = l.shrink()
+	// (this works for fallocate() too, as it also pads with zeroes)
+	if l.validHint(opts.SizeHint) {
+		l.size = opts.SizeHint
+	} else {
+		l.size = l.shrink()
+	}
+
 	return l, nil
 }
 
+// validHint checks if `hint` can be the logical size of the log: the last
+// byte before it has to be the end of an item and there must be no item
+// after it. Every item has non-zero bytes in its first HeaderSize+TrailerSize
+// bytes: the blob size in the header or the trailer mark for empty blobs.
+func (l *Log) validHint(hint int64) bool {
+	if hint <= 0 || hint > l.size || l.mmap[hint-1] == 0 {
+		return false
+	}
+
+	next := l.mmap[hint:min(hint+item.HeaderSize+item.TrailerSize, l.size)]
+	return !slices.ContainsFunc(next, func(b byte) bool { return b != 0 })
+}
+
 func (l *Log) shrink() int64 {
 	// we take advantage of the end marker appended to each
 	// log entry. Since ftruncate() will always pad with zeroes
@@ -127,20 +295,14 @@ func (l *Log) shrink() int64 {
 }
 
 func (l *Log) writeItem(it item.Item) {
-	off := l.size
-	binary.BigEndian.PutUint32(l.mmap[off:], uint32(len(it.Blob)))
-	off += 4
-	binary.BigEndian.PutUint64(l.mmap[off:], uint64(it.Key))
-	off += 8
-	off += int64(copy(l.mmap[off:], it.Blob))
-
-	// add trailer mark:
-	l.mmap[off] = 0xFF
-	l.mmap[off+1] = 0xFF
-	l.size = off + item.TrailerSize
+	l.size += encodeItem(l.mmap[l.size:], it)
 }
 
 func (l *Log) Push(items item.Items) (loc item.Location, err error) {
+	if l.opts.ReadOnly {
+		return loc, ErrReadOnly
+	}
+
 	addSize := items.StorageSize()
 
 	loc = item.Location{
@@ -149,30 +311,38 @@ func (l *Log) Push(items item.Items) (loc item.Location, err error) {
 		Len: item.Off(len(items)),
 	}
 
-	nextMmapSize := nextSize(l.size + int64(addSize))
+	nextMmapSize := l.allocSize(l.size + int64(addSize))
 	if nextMmapSize > int64(len(l.mmap)) {
 		// currently mmapped region does not suffice,
 		// allocate more space for it.
-		if err = l.fd.Truncate(nextMmapSize); err != nil {
-			err = fmt.Errorf("truncate: %w", err)
+		if err = l.allocate(nextMmapSize); err != nil {
 			return
 		}
 
-		// If we're unlucky we gonna have to move it:
-		l.mmap, err = unix.Mremap(
-			l.mmap,
-			int(nextMmapSize),
-			unix.MREMAP_MAYMOVE,
-		)
-		if err != nil {
-			err = fmt.Errorf("remap: %w", err)
+		mmap, remapErr := l.remap(int(nextMmapSize))
+		if remapErr != nil {
+			err = remapErr
 			return
 		}
+
+		l.mmap = mmap
+		l.adviseSequential(l.mmap)
+		l.adviseHugePages(l.mmap)
 	}
 
-	// copy the items to the file map:
-	for i := 0; i < len(items); i++ {
-		l.writeItem(items[i])
+	if l.directFd != nil {
+		if err = l.pushDirect(items); err != nil {
+			return
+		}
+	} else if len(items) >= vectorMinItems {
+		if err = l.pushVectored(items); err != nil {
+			return
+		}
+	} else {
+		// copy the items to the file map:
+		for i := 0; i < len(items); i++ {
+			l.writeItem(items[i])
+		}
 	}
 
 	if err = l.Sync(false); err != nil {
@@ -224,7 +394,7 @@ func (l *Log) readItemAt(off item.Off, it *item.Item) (err error) {
 	siz := binary.BigEndian.Uint32(l.mmap[off+0:])
 	key := binary.BigEndian.Uint64(l.mmap[off+4:])
 
-	if siz > 64*1024*1024 {
+	if siz > item.MaxBlobSize {
 		// fail-safe if the size field is corrupt:
 		return fmt.Errorf("log: allocation too big for one value: %d", siz)
 	}
@@ -247,7 +417,7 @@ func (l *Log) readItemAt(off item.Off, it *item.Item) (err error) {
 
 	// check that the trailer was correctly written.
 	// (not a checksum, but could be made to one in future versions)
-	if l.mmap[trailerOff] != 0xFF && l.mmap[trailerOff+1] != 0xFF {
+	if l.mmap[trailerOff] != 0xFF || l.mmap[trailerOff+1] != 0xFF {
 		return fmt.Errorf("log: %s: missing trailer: %d", l.path, off)
 	}
 
@@ -259,21 +429,174 @@ func (l *Log) readItemAt(off item.Off, it *item.Item) (err error) {
 	return nil
 }
 
+func (l *Log) adviseSequential(mmap []byte) {
+	if l.opts.Sequential {
+		// only a hint; nothing bad happens if it fails.
+		_ = unix.Madvise(mmap, unix.MADV_SEQUENTIAL)
+	}
+}
+
+func (l *Log) adviseHugePages(mmap []byte) {
+	if l.opts.HugePages && len(mmap) >= HugePageSize {
+		// only a hint; fails on kernels without THP support.
+		_ = unix.Madvise(mmap, unix.MADV_HUGEPAGE)
+	}
+}
+
+// WillNeed advises the kernel to read in the mapped data soon.
+func (l *Log) WillNeed() error {
+	return unix.Madvise(l.mmap, unix.MADV_WILLNEED)
+}
+
+// FreeBefore advises the kernel to drop the pages before `off` from the
+// memory of our process. The data is still on disk and can be read again,
+// but this keeps the memory usage flat for data that was consumed already.
+// Only full pages are released. Nothing is released while the log is
+// locked (see Lock()), as the kernel refuses to drop locked pages.
+func (l *Log) FreeBefore(off item.Off) error {
+	end := (min(int64(off), l.size) / PageSize) * PageSize
+	if end <= l.freedOff || l.locked {
+		return nil
+	}
+
+	if err := unix.Madvise(l.mmap[l.freedOff:end], unix.MADV_DONTNEED); err != nil {
+		return fmt.Errorf("madvise: %w", err)
+	}
+
+	l.freedOff = end
+	return nil
+}
+
+// Lock locks the mapped memory of the log into RAM, so reading from it can not
+// cause page faults that need to hit the disk. This also covers memory that is
+// mapped later when the log grows. The lock is released on Unlock() or Close().
+func (l *Log) Lock() error {
+	if l.locked {
+		return nil
+	}
+
+	if l.mmap == nil {
+		// empty read-only log, nothing mapped.
+		return nil
+	}
+
+	if err := unix.Mlock(l.mmap); err != nil {
+		return fmt.Errorf("mlock: %w", err)
+	}
+
+	l.locked = true
+	return nil
+}
+
+// Unlock reverts Lock().
+func (l *Log) Unlock() error {
+	if !l.locked {
+		return nil
+	}
+
+	if err := unix.Munlock(l.mmap); err != nil {
+		return fmt.Errorf("munlock: %w", err)
+	}
+
+	l.locked = false
+	return nil
+}
+
+// Locked returns true if Lock() was called without Unlock().
+func (l *Log) Locked() bool {
+	return l.locked
+}
+
+// SetSyncOnWrite changes Options.SyncOnWrite of an open log.
+func (l *Log) SetSyncOnWrite(sync bool) {
+	l.opts.SyncOnWrite = sync
+}
+
 func (l *Log) Sync(force bool) error {
-	if !l.syncOnWrite && !force {
+	if l.opts.ReadOnly || (!l.opts.SyncOnWrite && !force) {
 		return nil
 	}
 
+	if l.directFd != nil {
+		// data is not in the memory map, but might still
+		// sit in the volatile cache of the device.
+		return unix.Fdatasync(int(l.directFd.Fd()))
+	}
+
 	return unix.Msync(l.mmap, unix.MS_SYNC)
 }
 
+func (l *Log) closeFds() error {
+	var err error
+	if l.directFd != nil {
+		err = l.directFd.Close()
+	}
+
+	return errors.Join(err, l.fd.Close())
+}
+
 func (l *Log) Close() error {
-	syncErr := unix.Msync(l.mmap, unix.MS_SYNC)
-	unmapErr := unix.Munmap(l.mmap)
-	closeErr := l.fd.Close()
+	syncErr := l.Sync(true)
+
+	var unmapErr error
+	if l.pins.Load() > 0 {
+		// the mapping stays valid without the fd,
+		// the last Unpin() unmaps it.
+		l.retired = append(l.retired, l.mmap)
+	} else if l.mmap != nil {
+		unmapErr = unix.Munmap(l.mmap)
+	}
+
+	closeErr := l.closeFds()
 	return errors.Join(syncErr, unmapErr, closeErr)
 }
 
+// RepairTail checks the items from `off` to the end of the log. `off` must be
+// the start of an item that is known to be complete, e.g. the last batch that
+// was indexed. If the log ends with a partially written item (e.g. after a
+// power loss), the incomplete data is zeroed and cut off, as it would make
+// reads fail otherwise. The number of discarded bytes is returned.
+func (l *Log) RepairTail(off item.Off) (int64, error) {
+	end := int64(off)
+	if end >= l.size {
+		return 0, nil
+	}
+
+	for end < l.size {
+		if end+item.HeaderSize+item.TrailerSize > l.size {
+			// not even enough space for an empty item.
+			break
+		}
+
+		var it item.Item
+		if err := l.readItemAt(item.Off(end), &it); err != nil {
+			break
+		}
+
+		end += int64(it.StorageSize())
+	}
+
+	if end >= l.size {
+		return 0, nil
+	}
+
+	// zero the rest, so shrink() finds the right end on the next open:
+	discarded := l.size - end
+	clear(l.mmap[end:l.size])
+	if err := unix.Msync(l.mmap, unix.MS_SYNC); err != nil {
+		return 0, err
+	}
+
+	l.size = end
+	return discarded, nil
+}
+
+// Size returns the number of bytes written to the log.
+// This does not include preallocated space.
+func (l *Log) Size() int64 {
+	return l.size
+}
+
 func (l *Log) IsEmpty() bool {
 	return l.isEmpty
 }
@@ -1,6 +1,7 @@
 package vlog
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
@@ -111,6 +112,51 @@ func TestLogShrink(t *testing.T) {
 	require.NoError(t, log.Close())
 }
 
+func TestLogOpenReadOnly(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// missing logs are not created:
+	path := filepath.Join(tmpDir, "log")
+	_, err = OpenWithOptions(path, Options{ReadOnly: true})
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// empty logs are not grown:
+	require.NoError(t, os.WriteFile(path, nil, 0400))
+	log, err := OpenWithOptions(path, Options{ReadOnly: true})
+	require.NoError(t, err)
+	require.True(t, log.IsEmpty())
+	require.NoError(t, log.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+	require.NoError(t, os.Remove(path))
+
+	log, err = Open(path, true)
+	require.NoError(t, err)
+	loc, err := log.Push(testutils.GenItems(1, 3, 1))
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Chmod(path, 0400))
+
+	log, err = OpenWithOptions(path, Options{ReadOnly: true, DirectIO: true})
+	require.NoError(t, err)
+	_, err = log.Push(testutils.GenItems(3, 4, 1))
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	iter := log.At(loc, true)
+	require.True(t, iter.Next())
+	require.Equal(t, item.Key(1), iter.Item().Key)
+	require.True(t, iter.Next())
+	require.Equal(t, item.Key(2), iter.Item().Key)
+	require.False(t, iter.Next())
+	require.NoError(t, log.Close())
+}
+
 func TestLogOpenNonExisting(t *testing.T) {
 	_, err := Open("/nope", true)
 	require.Error(t, err)
@@ -156,6 +202,318 @@ func TestLogRemap(t *testing.T) {
 	require.NoError(t, log.Close())
 }
 
+func TestLogPrealloc(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	const ext = 64 * 1024
+	logPath := filepath.Join(tmpDir, "log")
+	log, err := OpenWithOptions(logPath, Options{PreallocSize: ext})
+	require.NoError(t, err)
+
+	info, err := os.Stat(logPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(ext), info.Size())
+
+	// should fit in the first extent:
+	exp := testutils.GenItems(0, 100, 1)
+	loc, err := log.Push(exp)
+	require.NoError(t, err)
+
+	info, err = os.Stat(logPath)
+	require.NoError(t, err)
+	require.Equal(t, int64(ext), info.Size())
+	require.NoError(t, log.Close())
+
+	// the logical size has to be restored on re-open:
+	log, err = OpenWithOptions(logPath, Options{PreallocSize: ext})
+	require.NoError(t, err)
+	require.False(t, log.IsEmpty())
+	require.Equal(t, int64(exp.StorageSize()), log.size)
+
+	var got item.Items
+	for iter := log.At(loc, true); iter.Next(); {
+		got = append(got, iter.Item())
+	}
+	require.Equal(t, exp, got)
+
+	// grow beyond the first extent:
+	for idx := 0; idx < 100; idx++ {
+		_, err := log.Push(testutils.GenItems(0, 200, 1))
+		require.NoError(t, err)
+	}
+
+	info, err = os.Stat(logPath)
+	require.NoError(t, err)
+	require.True(t, info.Size() > ext)
+	require.Equal(t, int64(0), info.Size()%ext)
+	require.NoError(t, log.Close())
+}
+
+func TestLogSizeHint(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	const ext = 64 * 1024
+	logPath := filepath.Join(tmpDir, "log")
+	log, err := OpenWithOptions(logPath, Options{PreallocSize: ext})
+	require.NoError(t, err)
+
+	first := testutils.GenItems(0, 10, 1)
+	_, err = log.Push(first)
+	require.NoError(t, err)
+	_, err = log.Push(testutils.GenItems(10, 20, 1))
+	require.NoError(t, err)
+	size := log.Size()
+	require.NoError(t, log.Close())
+
+	for _, hint := range []int64{
+		0,                              // unknown
+		int64(first.StorageSize()),     // data was written after it
+		int64(first.StorageSize()) - 1, // not the end of an item
+		size + 100,                     // beyond the data
+		2 * ext,                        // beyond the file
+	} {
+		log, err = OpenWithOptions(logPath, Options{PreallocSize: ext, SizeHint: hint})
+		require.NoError(t, err)
+		require.Equal(t, size, log.Size(), "hint %d", hint)
+		require.NoError(t, log.Close())
+	}
+
+	// a valid hint is used without scanning to the end, where
+	// we put some garbage that a scan would take for data:
+	fd, err := os.OpenFile(logPath, os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = fd.WriteAt([]byte{1}, ext-1)
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	log, err = OpenWithOptions(logPath, Options{PreallocSize: ext, SizeHint: size})
+	require.NoError(t, err)
+	require.Equal(t, size, log.Size())
+	require.NoError(t, log.Close())
+}
+
+func TestLogFreeBefore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	log, err := OpenWithOptions(filepath.Join(tmpDir, "log"), Options{Sequential: true})
+	require.NoError(t, err)
+
+	exp := testutils.GenItems(0, 2000, 1)
+	loc, err := log.Push(exp)
+	require.NoError(t, err)
+	require.NoError(t, log.WillNeed())
+
+	// less than one page should not release anything:
+	require.NoError(t, log.FreeBefore(item.Off(PageSize-1)))
+	require.Equal(t, int64(0), log.freedOff)
+
+	require.NoError(t, log.FreeBefore(item.Off(2*PageSize+1)))
+	require.Equal(t, 2*PageSize, log.freedOff)
+
+	// going back is a no-op:
+	require.NoError(t, log.FreeBefore(item.Off(PageSize)))
+	require.Equal(t, 2*PageSize, log.freedOff)
+
+	// freed data still needs to be readable:
+	var got item.Items
+	for iter := log.At(loc, true); iter.Next(); {
+		got = append(got, iter.Item())
+	}
+	require.Equal(t, exp, got)
+	require.NoError(t, log.Close())
+}
+
+func TestLogLock(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	log, err := Open(filepath.Join(tmpDir, "log"), true)
+	require.NoError(t, err)
+
+	if err := log.Lock(); err != nil {
+		t.Skipf("mlock not permitted here: %v", err)
+	}
+
+	// growing a locked log should still work:
+	for idx := 0; idx < 100; idx++ {
+		_, err := log.Push(testutils.GenItems(0, 200, 1))
+		require.NoError(t, err)
+	}
+
+	// locked pages can not be dropped, this should be skipped:
+	require.NoError(t, log.FreeBefore(item.Off(log.Size())))
+
+	require.NoError(t, log.Unlock())
+	require.NoError(t, log.Unlock())
+	require.NoError(t, log.Lock())
+
+	// Close() should work with a locked log:
+	require.NoError(t, log.Close())
+}
+
+func TestLogPin(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	log, err := Open(filepath.Join(tmpDir, "log"), true)
+	require.NoError(t, err)
+	require.Error(t, log.Unpin())
+
+	exp := testutils.GenItems(0, 10, 1)
+	loc, err := log.Push(exp)
+	require.NoError(t, err)
+
+	log.Pin()
+	var got item.Items
+	for iter := log.At(loc, false); iter.Next(); {
+		got = append(got, iter.Item())
+	}
+
+	// grow the log (so it gets a new mapping) and close it:
+	for idx := 0; idx < 100; idx++ {
+		_, err := log.Push(testutils.GenItems(0, 200, 1))
+		require.NoError(t, err)
+	}
+
+	require.NotEmpty(t, log.retired)
+	require.NoError(t, log.Close())
+	require.Equal(t, exp, got)
+
+	require.NoError(t, log.Unpin())
+	require.Empty(t, log.retired)
+}
+
+func TestLogHugePages(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "log")
+	log, err := OpenWithOptions(logPath, Options{
+		HugePages:    true,
+		PreallocSize: HugePageSize,
+	})
+	require.NoError(t, err)
+
+	// the advice is only a hint, but it should never break anything:
+	exp := testutils.GenItems(0, 2000, 1)
+	loc, err := log.Push(exp)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = OpenWithOptions(logPath, Options{HugePages: true})
+	require.NoError(t, err)
+
+	var got item.Items
+	for iter := log.At(loc, true); iter.Next(); {
+		got = append(got, iter.Item())
+	}
+	require.Equal(t, exp, got)
+	require.NoError(t, log.Close())
+}
+
+func TestLogDirectIO(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "log")
+	log, err := OpenWithOptions(logPath, Options{DirectIO: true, SyncOnWrite: true})
+	require.NoError(t, err)
+	if log.directFd == nil {
+		t.Skipf("no O_DIRECT support for %s", tmpDir)
+	}
+
+	// several small pushes, so we rewrite the last page quite often
+	// and also trigger a few resizes of the log:
+	var exp item.Items
+	var locs []item.Location
+	for idx := 0; idx < 100; idx++ {
+		items := testutils.GenItems(idx*100, (idx+1)*100, 1)
+		loc, err := log.Push(items)
+		require.NoError(t, err)
+		exp = append(exp, items...)
+		locs = append(locs, loc)
+	}
+
+	readAll := func() item.Items {
+		var got item.Items
+		for _, loc := range locs {
+			for iter := log.At(loc, false); iter.Next(); {
+				it := iter.Item()
+				got = append(got, it.Copy())
+			}
+		}
+		return got
+	}
+
+	// data written directly must be visible in the memory map:
+	require.Equal(t, exp, readAll())
+	require.NoError(t, log.Close())
+
+	log, err = OpenWithOptions(logPath, Options{DirectIO: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(exp.StorageSize()), log.size)
+	require.Equal(t, exp, readAll())
+	require.NoError(t, log.Close())
+}
+
+func TestLogPushVectored(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "log")
+	log, err := Open(logPath, true)
+	require.NoError(t, err)
+
+	// small items with some big ones mixed in, so that the
+	// staging buffer is split into several iovecs. Enough items
+	// to need more than one pwritev() call.
+	var exp item.Items
+	var locs []item.Location
+	for batch := 0; batch < 3; batch++ {
+		items := testutils.GenItems(batch*2000, (batch+1)*2000, 1)
+		for idx := 0; idx < len(items); idx += 3 {
+			items[idx].Blob = bytes.Repeat([]byte{byte(idx)}, vectorCopyLimit+idx)
+		}
+
+		loc, err := log.Push(items)
+		require.NoError(t, err)
+		exp = append(exp, items...)
+		locs = append(locs, loc)
+	}
+
+	readAll := func() item.Items {
+		var got item.Items
+		for _, loc := range locs {
+			for iter := log.At(loc, false); iter.Next(); {
+				it := iter.Item()
+				got = append(got, it.Copy())
+			}
+		}
+		return got
+	}
+
+	require.Equal(t, int64(exp.StorageSize()), log.size)
+	require.Equal(t, exp, readAll())
+	require.NoError(t, log.Close())
+
+	log, err = Open(logPath, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(exp.StorageSize()), log.size)
+	require.Equal(t, exp, readAll())
+	require.NoError(t, log.Close())
+}
+
 func TestLogFindNextItem(t *testing.T) {
 	l := &Log{
 		mmap: make([]byte, 200),
@@ -204,3 +562,64 @@ func TestLogEmpty(t *testing.T) {
 	require.False(t, log.IsEmpty())
 	require.NoError(t, log.Close())
 }
+
+func TestLogRepairTail(t *testing.T) {
+	t.Parallel()
+
+	tmpDir, err := os.MkdirTemp("", "timeq-vlogtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "log")
+	log, err := Open(logPath, true)
+	require.NoError(t, err)
+
+	items := testutils.GenItems(0, 10, 1)
+	loc, err := log.Push(items)
+	require.NoError(t, err)
+	goodSize := log.Size()
+
+	// nothing to repair:
+	discarded, err := log.RepairTail(loc.Off)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), discarded)
+
+	// simulate a torn write: the header and part of the blob, but no trailer.
+	torn := testutils.GenItems(10, 11, 1)
+	torn[0].Blob = bytes.Repeat([]byte{1}, 100)
+	_, err = log.Push(torn)
+	require.NoError(t, err)
+	clear(log.mmap[goodSize+item.HeaderSize+50 : log.Size()])
+	require.NoError(t, log.Close())
+
+	log, err = Open(logPath, true)
+	require.NoError(t, err)
+	require.Greater(t, log.Size(), goodSize)
+
+	discarded, err = log.RepairTail(loc.Off)
+	require.NoError(t, err)
+	require.Equal(t, int64(item.HeaderSize+50), discarded)
+	require.Equal(t, goodSize, log.Size())
+
+	// new pushes go after the good data and the old items are still there:
+	loc2, err := log.Push(testutils.GenItems(20, 30, 1))
+	require.NoError(t, err)
+	require.Equal(t, item.Off(goodSize), loc2.Off)
+	require.NoError(t, log.Close())
+
+	log, err = Open(logPath, true)
+	require.NoError(t, err)
+
+	var got item.Items
+	for _, l := range []item.Location{loc, loc2} {
+		iter := log.At(l, false)
+		for iter.Next() {
+			it := iter.Item()
+			got = append(got, it.Copy())
+		}
+		require.NoError(t, iter.Err())
+	}
+
+	require.Equal(t, append(items, testutils.GenItems(20, 30, 1)...), got)
+	require.NoError(t, log.Close())
+}
@@ -0,0 +1,173 @@
+package timeq
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	watchRootMask   = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM
+	watchBucketMask = unix.IN_MODIFY | unix.IN_CREATE | unix.IN_DELETE
+)
+
+// Watcher notices when another process changes a queue directory, e.g. by
+// pushing or popping items, so that inspecting tools do not have to poll.
+// It uses inotify(7) to watch the queue directory and all bucket directories.
+//
+// Note that items are written to the value log via a memory map, which does
+// not produce any events. Every push and pop also appends to an index log
+// though, so those are noticed. Changes made through a Queue in the same
+// process are noticed as well, but SubscribeChan() is the better fit there.
+type Watcher struct {
+	// file wraps ifd. NOTE: Do not call file.Fd(), it makes the fd blocking.
+	ifd     int
+	file    *os.File
+	changed chan struct{}
+	done    chan struct{}
+
+	mu   sync.Mutex
+	dirs map[int32]string
+}
+
+// WatchDir starts watching the queue directory `dir`, which must exist.
+func WatchDir(dir string) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &Watcher{
+		// the fd is non-blocking, so Close() interrupts a pending Read():
+		ifd:     fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		dirs:    make(map[int32]string),
+	}
+
+	if err := w.add(dir, watchRootMask); err != nil {
+		return nil, errors.Join(err, w.file.Close())
+	}
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Join(err, w.file.Close())
+	}
+
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+
+		// the bucket might be gone already; not an issue.
+		_ = w.add(filepath.Join(dir, ent.Name()), watchBucketMask)
+	}
+
+	go w.run(dir)
+	return w, nil
+}
+
+func (w *Watcher) add(path string, mask uint32) error {
+	wd, err := unix.InotifyAddWatch(w.ifd, path, mask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+
+	w.mu.Lock()
+	w.dirs[int32(wd)] = path
+	w.mu.Unlock()
+	return nil
+}
+
+// C returns a channel that receives a value after the directory changed.
+// Several changes in a row are merged into one value. The channel is
+// closed after Close() was called.
+func (w *Watcher) C() <-chan struct{} {
+	return w.changed
+}
+
+func (w *Watcher) run(root string) {
+	defer close(w.done)
+	defer close(w.changed)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			// only happens after Close().
+			return
+		}
+
+		var changed bool
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			w.mu.Lock()
+			path, ok := w.dirs[ev.Wd]
+			if ev.Mask&unix.IN_IGNORED > 0 {
+				delete(w.dirs, ev.Wd)
+			}
+			w.mu.Unlock()
+
+			if !ok || ev.Mask&unix.IN_IGNORED > 0 {
+				continue
+			}
+
+			if path != root {
+				changed = true
+				continue
+			}
+
+			// files in the root directory (like len.manifest) are
+			// rewritten by just opening and closing a queue.
+			if ev.Mask&unix.IN_ISDIR == 0 {
+				continue
+			}
+
+			changed = true
+			if ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) > 0 {
+				name := string(nameBytes[:clen(nameBytes)])
+				_ = w.add(filepath.Join(root, name), watchBucketMask)
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		select {
+		case w.changed <- struct{}{}:
+		default:
+			// a notification is pending already.
+		}
+	}
+}
+
+// clen returns the index of the first NUL byte in `b` or len(b).
+func clen(b []byte) int {
+	for idx, c := range b {
+		if c == 0 {
+			return idx
+		}
+	}
+
+	return len(b)
+}
+
+// Close stops watching. It is safe to call Close() more than once.
+func (w *Watcher) Close() error {
+	err := w.file.Close()
+	<-w.done
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,72 @@
+package timeq
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sahib/timeq/item/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func requireChanged(t *testing.T, w *Watcher) {
+	t.Helper()
+
+	select {
+	case _, ok := <-w.C():
+		require.True(t, ok)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no change noticed")
+	}
+
+	// drain events that belong to the same change:
+	for {
+		select {
+		case <-w.C():
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := os.MkdirTemp("", "timeq-watchtest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.BucketSplitConf = FixedSizeBucketSplitConf(10)
+	queue, err := Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, queue.Push(testutils.GenItems(0, 5, 1)))
+
+	w, err := WatchDir(dir)
+	require.NoError(t, err)
+
+	// push to an existing bucket:
+	require.NoError(t, queue.Push(testutils.GenItems(5, 10, 1)))
+	requireChanged(t, w)
+
+	// push to a new bucket and then to it again:
+	require.NoError(t, queue.Push(testutils.GenItems(10, 12, 1)))
+	requireChanged(t, w)
+	require.NoError(t, queue.Push(testutils.GenItems(12, 14, 1)))
+	requireChanged(t, w)
+
+	// pop from the new bucket only:
+	_, err = queue.Delete(0, 9)
+	require.NoError(t, err)
+	requireChanged(t, w)
+	require.NoError(t, queue.Read(1, func(_ Transaction, _ Items) (ReadOp, error) {
+		return ReadOpPop, nil
+	}))
+	requireChanged(t, w)
+
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close())
+	_, ok := <-w.C()
+	require.False(t, ok)
+	require.NoError(t, queue.Close())
+}